@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	apiutil "ffmpeg_video_capture/api_util"
+	cliputil "ffmpeg_video_capture/clip_util"
+	configutil "ffmpeg_video_capture/config_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	rtsputil "ffmpeg_video_capture/rtsp_util"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	configPath := flag.String("config", os.Getenv("FFCAP_CONFIG"), "配置文件路径(yaml或json)，默认为环境变量FFCAP_CONFIG")
+	addr := flag.String("addr", "", "HTTP监听地址，为空时使用配置文件中的http.addr，默认:8080")
+	worker := flag.Bool("worker", true, "同时运行抓取worker，执行提交的抓取任务")
+	flag.Parse()
+
+	if *configPath == "" {
+		log.Fatal("未指定配置文件")
+	}
+	loader, err := configutil.NewLoader(*configPath)
+	if err != nil {
+		log.Fatal("加载配置失败: ", err)
+	}
+	config := loader.Config()
+	// 摄像头配置的输入参数(options和transport)，重新加载配置时更新
+	ffmpegutil.SetInputOptions(config.InputOptions())
+	loader.OnReload(func(config *configutil.Config) {
+		ffmpegutil.SetInputOptions(config.InputOptions())
+	})
+
+	var redisClient *redis.RedisClient
+	if config.Redis != nil {
+		redisClient, err = redis.NewClient(config.Redis)
+	} else {
+		redisClient, err = redis.DefaultClient()
+	}
+	if err != nil {
+		log.Fatal("初始化redis连接池失败: ", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 启用内置RTSP转发服务时，rtsp.proxy为true的情况下本服务也通过转发服务拉流
+	if config.Rtsp != nil {
+		rtspServer := rtsputil.NewServer(config.CameraUrls(), &rtsputil.Options{
+			Idle:    time.Duration(config.Rtsp.Idle) * time.Second,
+			UdpPort: config.Rtsp.UdpPort,
+		})
+		loader.OnReload(func(config *configutil.Config) {
+			rtspServer.SetCameras(config.CameraUrls())
+		})
+		go func() {
+			if err := rtspServer.ListenAndServe(config.Rtsp.Addr); err != nil {
+				log.Println(err)
+			}
+		}()
+		defer rtspServer.Close()
+	}
+
+	server := apiutil.NewServer(redisClient, config.ProxyUrls())
+	server.SetLiveOptions(liveOptions(config.Live))
+	server.SetRestreams(restreamTargets(config))
+	loader.OnReload(func(config *configutil.Config) {
+		server.SetCameras(config.ProxyUrls())
+		server.SetLiveOptions(liveOptions(config.Live))
+		server.SetRestreams(restreamTargets(config))
+	})
+	defer server.Close()
+
+	if *worker {
+		consumer, _ := os.Hostname()
+		captureWorker := cliputil.NewCaptureWorker(redisClient, config.ProxyUrls(), consumer+":api")
+		captureWorker.SetMp4Layouts(config.Mp4Layouts(configutil.SinkList))
+		captureWorker.SetPolicies(capturePolicies(config))
+		loader.OnReload(func(config *configutil.Config) {
+			captureWorker.SetCameras(config.ProxyUrls())
+			captureWorker.SetMp4Layouts(config.Mp4Layouts(configutil.SinkList))
+			captureWorker.SetPolicies(capturePolicies(config))
+		})
+		go func() {
+			if err := captureWorker.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// 配置了保留策略时启动后台清理
+	if config.Retention != nil {
+		janitor, err := redis.NewJanitor(redisClient, config.Retention, time.Minute, nil)
+		if err != nil {
+			log.Fatal("启动保留策略失败: ", err)
+		}
+		loader.OnReload(func(config *configutil.Config) {
+			if config.Retention != nil {
+				if err := janitor.SetConfig(config.Retention); err != nil {
+					log.Println(err)
+				}
+			}
+		})
+		if err = janitor.Start(); err != nil {
+			log.Fatal("启动保留策略失败: ", err)
+		}
+		defer janitor.Stop()
+	}
+
+	// 收到SIGHUP时重新加载配置
+	loader.WatchSignal(ctx)
+
+	if *addr == "" && config.Http != nil {
+		*addr = config.Http.Addr
+	}
+	if *addr == "" {
+		*addr = ":8080"
+	}
+	httpServer := &http.Server{Addr: *addr, Handler: server}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+	log.Printf("HTTP接口已启动，监听地址：%s", *addr)
+	if err = httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println(err)
+	}
+}
+
+// liveOptions 配置文件中的直播输出参数，未配置时使用默认参数
+func liveOptions(config *configutil.LiveConfig) *apiutil.LiveOptions {
+	options := &apiutil.LiveOptions{}
+	if config != nil {
+		options.Hls = ffmpegutil.HlsOptions{
+			SegmentDuration: time.Duration(config.Segment) * time.Second,
+			ListSize:        config.ListSize,
+			SegmentType:     config.SegmentType,
+		}
+		options.Idle = time.Duration(config.Idle) * time.Second
+		options.Vod = ffmpegutil.VodOptions{SegmentDuration: time.Duration(config.VodSegment) * time.Second}
+		options.Fragment = time.Duration(config.Fragment) * time.Millisecond
+		if config.Mjpeg != nil {
+			options.Mjpeg = ffmpegutil.MjpegOptions{Fps: config.Mjpeg.Fps, Width: config.Mjpeg.Width, Quality: config.Mjpeg.Quality}
+		}
+	}
+	return options
+}
+
+// restreamTargets 摄像头配置的restream类型输出
+func restreamTargets(config *configutil.Config) []apiutil.RestreamTarget {
+	var targets []apiutil.RestreamTarget
+	for _, restream := range config.Restreams() {
+		targets = append(targets, apiutil.RestreamTarget{
+			Camera: restream.Camera,
+			Name:   restream.Sink,
+			Url:    restream.Url,
+			Options: ffmpegutil.RestreamOptions{
+				Transcode:  restream.Config.Transcode,
+				Bitrate:    restream.Config.Bitrate,
+				RetryDelay: time.Duration(restream.Config.Retry) * time.Second,
+			},
+		})
+	}
+	return targets
+}
+
+// capturePolicies 每个摄像头的抓取策略，任务没有指定时使用产物策略的产物和片段时长
+func capturePolicies(config *configutil.Config) map[string]*cliputil.CapturePolicy {
+	policies := make(map[string]*cliputil.CapturePolicy)
+	for camera := range config.Cameras {
+		policies[camera] = &cliputil.CapturePolicy{
+			Artifacts: config.Policy(camera).Artifacts,
+			Seconds:   config.Segment(camera),
+		}
+	}
+	return policies
+}
@@ -0,0 +1,217 @@
+package apiutil
+
+import (
+	"context"
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// LiveOptions 直播输出参数
+type LiveOptions struct {
+	Hls  ffmpegutil.HlsOptions
+	Idle time.Duration // 没有请求多久后停止拉流，为0时为30秒
+	Vod  ffmpegutil.VodOptions
+	// Fragment WebSocket直播GOP内的分片时长，为0时每个GOP一个分片
+	Fragment time.Duration
+	Mjpeg    ffmpegutil.MjpegOptions
+}
+
+// 切片文件扩展名对应的Content-Type
+var segmentContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+}
+
+// liveSession 一个摄像头的直播切片会话，有请求时启动，空闲后停止
+type liveSession struct {
+	store      *ffmpegutil.MemoryStore
+	dash       bool // 是否输出DASH清单，只有fmp4切片时输出
+	cancel     context.CancelFunc
+	done       chan struct{}
+	mutex      sync.Mutex
+	lastAccess time.Time
+}
+
+// touch 记录访问时间
+func (session *liveSession) touch() {
+	session.mutex.Lock()
+	session.lastAccess = time.Now()
+	session.mutex.Unlock()
+}
+
+// idleFor 距上次访问的时间
+func (session *liveSession) idleFor() time.Duration {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return time.Since(session.lastAccess)
+}
+
+// SetLiveOptions 更新直播输出参数，只对之后启动的会话生效
+func (server *Server) SetLiveOptions(options *LiveOptions) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.liveOptions = *options
+}
+
+// liveSession 获取摄像头的直播切片会话，没有时启动
+func (server *Server) liveSession(camera string) (*liveSession, error) {
+	rtspUrl, ok := server.cameraUrl(camera)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("未配置摄像头：%s", camera))
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if session, ok := server.live[camera]; ok {
+		session.touch()
+		return session, nil
+	}
+
+	idle := server.liveOptions.Idle
+	if idle <= 0 {
+		idle = 30 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &liveSession{
+		store:      ffmpegutil.NewMemoryStore(),
+		dash:       server.liveOptions.Hls.SegmentType == ffmpegutil.SegmentFmp4,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		lastAccess: time.Now(),
+	}
+	server.live[camera] = session
+	hls := ffmpegutil.NewLiveHls(session.store, &server.liveOptions.Hls)
+	go func() {
+		defer close(session.done)
+		defer cancel()
+		log.Printf("开始直播切片，摄像头：%s", camera)
+		if err := hls.Run(ctx, rtspUrl); err != nil {
+			log.Printf("直播切片出错，摄像头：%s，%s", camera, err)
+		}
+		log.Printf("直播切片结束，摄像头：%s", camera)
+		server.mutex.Lock()
+		if server.live[camera] == session {
+			delete(server.live, camera)
+		}
+		server.mutex.Unlock()
+	}()
+	// 空闲后停止拉流
+	go func() {
+		ticker := time.NewTicker(idle / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-session.done:
+				return
+			case <-ticker.C:
+				if session.idleFor() > idle {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return session, nil
+}
+
+// handleLive 直播HLS的播放列表、DASH清单和切片，第一次请求时开始拉流，播放列表或清单生成前等待
+func (server *Server) handleLive(w http.ResponseWriter, r *http.Request) {
+	session, err := server.liveSession(r.PathValue("camera"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	file := r.PathValue("file")
+	if file == ffmpegutil.DashManifestName && !session.dash {
+		writeError(w, http.StatusNotFound, errors.New("DASH需要fmp4切片，live.segmentType需配置为fmp4"))
+		return
+	}
+	if file == ffmpegutil.HlsPlaylistName || file == ffmpegutil.DashManifestName {
+		if err = waitSegment(r.Context(), session, file, 20*time.Second); err != nil {
+			writeError(w, http.StatusGatewayTimeout, err)
+			return
+		}
+	}
+	NewSegmentHandler(session.store).ServeHTTP(w, r)
+}
+
+// waitSegment 等待切片或播放列表生成
+func waitSegment(ctx context.Context, session *liveSession, name string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := session.store.Get(name); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.done:
+			return errors.New("直播切片已结束")
+		case <-timer.C:
+			return errors.New(fmt.Sprintf("等待%s超时", name))
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewSegmentHandler 提供切片存储中的播放列表和切片，请求路径的最后一段为文件名
+func NewSegmentHandler(store ffmpegutil.SegmentStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		data, err := store.Get(name)
+		if err != nil {
+			if errors.Is(err, ffmpegutil.ErrSegmentNotFound) {
+				writeError(w, http.StatusNotFound, err)
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		extension := path.Ext(name)
+		if contentType, ok := segmentContentTypes[extension]; ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if extension == ".m3u8" || extension == ".mpd" {
+			// 播放列表不断更新，不能缓存
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		w.Write(data)
+	})
+}
+
+// Close 停止全部直播切片、WebSocket直播、MJPEG会话和转推并等待结束
+func (server *Server) Close() {
+	server.mutex.Lock()
+	var done []chan struct{}
+	for _, session := range server.live {
+		session.cancel()
+		done = append(done, session.done)
+	}
+	for _, session := range server.streams {
+		session.cancel()
+		done = append(done, session.done)
+	}
+	for _, session := range server.mjpegs {
+		session.cancel()
+		done = append(done, session.done)
+	}
+	for _, session := range server.restreams {
+		session.cancel()
+		done = append(done, session.done)
+	}
+	server.mutex.Unlock()
+	for _, ch := range done {
+		<-ch
+	}
+}
@@ -0,0 +1,133 @@
+package apiutil
+
+import (
+	"context"
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// MJPEG分隔符
+const mjpegBoundary = "mjpegframe"
+
+// mjpegSession 一个摄像头的MJPEG会话，多个观看者共用一次拉流和解码，没有观看者时停止
+type mjpegSession struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mutex   sync.Mutex
+	viewers map[chan []byte]struct{} // 每个观看者只缓存最新的一帧
+}
+
+// onFrame 将jpg发送给观看者，观看者还没取走上一帧时替换为最新帧
+func (session *mjpegSession) onFrame(jpg []byte) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	for viewer := range session.viewers {
+		select {
+		case <-viewer:
+		default:
+		}
+		viewer <- jpg
+	}
+	return nil
+}
+
+// joinMjpeg 加入摄像头的MJPEG会话，没有会话时开始拉流解码
+func (server *Server) joinMjpeg(camera string) (*mjpegSession, chan []byte, error) {
+	rtspUrl, ok := server.cameraUrl(camera)
+	if !ok {
+		return nil, nil, errors.New(fmt.Sprintf("未配置摄像头：%s", camera))
+	}
+	viewer := make(chan []byte, 1)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if session, ok := server.mjpegs[camera]; ok {
+		session.mutex.Lock()
+		session.viewers[viewer] = struct{}{}
+		session.mutex.Unlock()
+		return session, viewer, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &mjpegSession{
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		viewers: map[chan []byte]struct{}{viewer: {}},
+	}
+	server.mjpegs[camera] = session
+	options := server.liveOptions.Mjpeg
+	go func() {
+		defer close(session.done)
+		defer cancel()
+		log.Printf("开始MJPEG解码，摄像头：%s", camera)
+		if err := ffmpegutil.MjpegFrames(ctx, rtspUrl, &options, session.onFrame); err != nil {
+			log.Printf("MJPEG解码出错，摄像头：%s，%s", camera, err)
+		}
+		log.Printf("MJPEG解码结束，摄像头：%s", camera)
+		server.mutex.Lock()
+		if server.mjpegs[camera] == session {
+			delete(server.mjpegs, camera)
+		}
+		server.mutex.Unlock()
+	}()
+	return session, viewer, nil
+}
+
+// leaveMjpeg 离开MJPEG会话，最后一个观看者离开时停止解码
+func (server *Server) leaveMjpeg(camera string, session *mjpegSession, viewer chan []byte) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	session.mutex.Lock()
+	delete(session.viewers, viewer)
+	empty := len(session.viewers) == 0
+	session.mutex.Unlock()
+	if empty {
+		if server.mjpegs[camera] == session {
+			delete(server.mjpegs, camera)
+		}
+		session.cancel()
+	}
+}
+
+// handleMjpeg MJPEG预览流(multipart/x-mixed-replace)，帧率和宽度在配置文件的live.mjpeg中设置
+func (server *Server) handleMjpeg(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("连接不支持流式输出"))
+		return
+	}
+	camera := r.PathValue("camera")
+	session, viewer, err := server.joinMjpeg(camera)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	defer server.leaveMjpeg(camera, session, viewer)
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case jpg := <-viewer:
+			if _, err = fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(jpg)); err != nil {
+				return
+			}
+			if _, err = w.Write(jpg); err != nil {
+				return
+			}
+			if _, err = w.Write([]byte("\r\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-session.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package apiutil
+
+import (
+	"context"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"log"
+)
+
+// RestreamTarget 摄像头的转推目标
+type RestreamTarget struct {
+	Camera  string
+	Name    string // 输出名称，用于日志
+	Url     string // rtmp或rtsp推流地址
+	Options ffmpegutil.RestreamOptions
+}
+
+// restreamSession 一个转推目标的后台推流，与直播会话不同，不依赖观看者，一直运行到配置删除或服务关闭
+type restreamSession struct {
+	target   RestreamTarget
+	inputUrl string
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// SetRestreams 设置转推目标，新增的开始推流，删除的停止，推流地址、参数或摄像头地址修改的重新推流
+// 需要在SetCameras之后调用
+func (server *Server) SetRestreams(targets []RestreamTarget) {
+	server.mutex.Lock()
+	wanted := make(map[string]RestreamTarget, len(targets))
+	for _, target := range targets {
+		wanted[target.Camera+"/"+target.Name] = target
+	}
+	var stopped []*restreamSession
+	for key, session := range server.restreams {
+		target, ok := wanted[key]
+		if ok && target == session.target && server.cameras[target.Camera] == session.inputUrl {
+			delete(wanted, key)
+			continue
+		}
+		session.cancel()
+		stopped = append(stopped, session)
+		delete(server.restreams, key)
+	}
+	for key, target := range wanted {
+		inputUrl, ok := server.cameras[target.Camera]
+		if !ok {
+			log.Printf("转推未配置的摄像头：%s", target.Camera)
+			continue
+		}
+		server.restreams[key] = server.startRestream(target, inputUrl)
+	}
+	server.mutex.Unlock()
+	for _, session := range stopped {
+		<-session.done
+	}
+}
+
+// startRestream 启动后台推流，调用时需持有server.mutex
+func (server *Server) startRestream(target RestreamTarget, inputUrl string) *restreamSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &restreamSession{target: target, inputUrl: inputUrl, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(session.done)
+		defer cancel()
+		log.Printf("开始转推，摄像头：%s，输出：%s", target.Camera, target.Name)
+		options := target.Options
+		if err := ffmpegutil.Restream(ctx, inputUrl, target.Url, &options); err != nil {
+			log.Printf("转推出错，摄像头：%s，输出：%s，%s", target.Camera, target.Name, err)
+		}
+		log.Printf("转推结束，摄像头：%s，输出：%s", target.Camera, target.Name)
+	}()
+	return session
+}
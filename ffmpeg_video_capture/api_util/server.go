@@ -0,0 +1,601 @@
+package apiutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	cliputil "ffmpeg_video_capture/clip_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// ExportResultTTL 导出完成后结果在内存中的保存时间，到期后删除
+const ExportResultTTL = 30 * time.Minute
+
+// 产物类型对应的Content-Type
+var artifactContentTypes = map[string]string{
+	redis.ArtifactVideo: "video/mp4",
+	redis.ArtifactAudio: "audio/wav",
+	redis.ArtifactImage: "image/jpeg",
+
+	redis.ArtifactSprite:     "image/jpeg",
+	redis.ArtifactThumbnails: "text/vtt; charset=utf-8",
+	redis.ArtifactGif:        "image/gif",
+	redis.ArtifactWebp:       "image/webp",
+}
+
+// Server HTTP控制接口
+//
+//	POST /captures                      提交抓取任务，由抓取worker异步执行
+//	GET  /captures/{id}                 查询抓取任务状态
+//	GET  /cameras/{camera}/snapshot     抓取一张图片，可选参数width、height
+//	GET  /cameras/{camera}/probe        探测摄像头的流信息，可选参数duration(秒)
+//	GET  /cameras/{camera}/preview      生成直播的预览动图，可选参数format(gif或webp)、width、fps、duration(秒)、maxBytes
+//	GET  /cameras/{camera}/hls/{file}   直播HLS，播放地址为index.m3u8，第一次请求时开始拉流，空闲后停止
+//	GET  /cameras/{camera}/dash/{file}  直播DASH，清单地址为manifest.mpd，与直播HLS共用fmp4切片
+//	GET  /cameras/{camera}/ws           WebSocket直播，发送fMP4初始化切片和分片，浏览器用MSE播放，同一摄像头的观看者共用拉流
+//	GET  /cameras/{camera}/mjpeg        MJPEG预览流，降低帧率和分辨率，有观看者时才解码
+//	GET  /cameras/{camera}/vod.m3u8     时间段内片段的HLS点播播放列表，参数from和to同查询片段
+//	GET  /cameras/{camera}/vod.mpd      时间段内片段的DASH点播清单，与HLS点播共用切片
+//	GET  /cameras                       有片段的摄像头
+//	GET  /clips?camera=&from=&to=       查询片段，from和to为毫秒时间戳或RFC3339时间，不传时返回全部片段
+//	GET  /clips/{id}                    片段元数据
+//	GET  /clips/{id}/{kind}             下载片段产物，支持Range请求
+//	GET  /clips/{id}/hls/{file}         片段的HLS和DASH点播，播放地址为index.m3u8或manifest.mpd，fMP4切片按需重新封装
+//	POST /clips/{id}/sprite             生成片段的雪碧图和WebVTT，可选参数width、columns、interval(秒)
+//	POST /clips/{id}/preview            生成片段的预览动图，参数同直播预览，另有start(秒)
+//	POST /exports                       提交按时间段导出任务，异步执行
+//	GET  /exports/{id}                  查询导出任务状态
+//	GET  /exports/{id}/download         下载导出结果
+//	GET  /cameras/{camera}/export       按时间段导出并直接返回分片mp4，边拼接边发送，参数from、to和exact
+type Server struct {
+	redisClient *redis.RedisClient
+	cameras     map[string]string // 摄像头 -> 拉流地址
+	mux         *http.ServeMux
+	mutex       sync.Mutex
+	exports     map[string]*exportJob
+	live        map[string]*liveSession     // 摄像头 -> 直播切片会话
+	streams     map[string]*streamSession   // 摄像头 -> WebSocket直播会话
+	mjpegs      map[string]*mjpegSession    // 摄像头 -> MJPEG会话
+	restreams   map[string]*restreamSession // 摄像头/输出名称 -> 转推
+	liveOptions LiveOptions
+}
+
+// exportJob 导出任务
+type exportJob struct {
+	ID        string    `json:"id"`
+	Camera    string    `json:"camera"`
+	From      int64     `json:"from"`
+	To        int64     `json:"to"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Size      int       `json:"size,omitempty"`
+	UpdatedAt int64     `json:"updatedAt"`
+	data      []byte    // 导出结果
+	finished  time.Time // 完成时间
+}
+
+// captureRequest 抓取请求
+type captureRequest struct {
+	Camera     string            `json:"camera"`
+	Seconds    int64             `json:"seconds"`
+	Artifacts  []string          `json:"artifacts"`
+	Keys       map[string]string `json:"keys"`
+	Timeout    int64             `json:"timeout"`
+	MaxRetries int               `json:"maxRetries"`
+}
+
+// exportRequest 导出请求，from和to为毫秒时间戳或RFC3339时间
+type exportRequest struct {
+	Camera   string          `json:"camera"`
+	From     json.RawMessage `json:"from"`
+	To       json.RawMessage `json:"to"`
+	ExactCut bool            `json:"exactCut"`
+}
+
+// NewServer 新建HTTP控制接口，cameras为摄像头到拉流地址的映射，用于抓图
+func NewServer(redisClient *redis.RedisClient, cameras map[string]string) *Server {
+	server := &Server{
+		redisClient: redisClient,
+		cameras:     cameras,
+		mux:         http.NewServeMux(),
+		exports:     make(map[string]*exportJob),
+		live:        make(map[string]*liveSession),
+		streams:     make(map[string]*streamSession),
+		mjpegs:      make(map[string]*mjpegSession),
+		restreams:   make(map[string]*restreamSession),
+	}
+	server.mux.HandleFunc("POST /captures", server.handleCapture)
+	server.mux.HandleFunc("GET /captures/{id}", server.handleCaptureStatus)
+	server.mux.HandleFunc("GET /cameras/{camera}/snapshot", server.handleSnapshot)
+	server.mux.HandleFunc("GET /cameras/{camera}/probe", server.handleProbe)
+	server.mux.HandleFunc("POST /snapshot", server.handleUploadSnapshot)
+	server.mux.HandleFunc("POST /probe", server.handleUploadProbe)
+	server.mux.HandleFunc("GET /cameras/{camera}/preview", server.handleLivePreview)
+	server.mux.HandleFunc("GET /cameras/{camera}/hls/{file}", server.handleLive)
+	server.mux.HandleFunc("GET /cameras/{camera}/dash/{file}", server.handleLive)
+	server.mux.HandleFunc("GET /cameras/{camera}/ws", server.handleStream)
+	server.mux.HandleFunc("GET /cameras/{camera}/mjpeg", server.handleMjpeg)
+	server.mux.HandleFunc("GET /cameras/{camera}/vod.m3u8", server.handleVodPlaylist)
+	server.mux.HandleFunc("GET /cameras/{camera}/vod.mpd", server.handleVodManifest)
+	server.mux.HandleFunc("GET /cameras", server.handleCameras)
+	server.mux.HandleFunc("GET /clips", server.handleClips)
+	server.mux.HandleFunc("GET /clips/{id}", server.handleClip)
+	server.mux.HandleFunc("GET /clips/{id}/{kind}", server.handleClipArtifact)
+	server.mux.HandleFunc("GET /clips/{id}/hls/{file}", server.handleClipHls)
+	server.mux.HandleFunc("POST /clips/{id}/sprite", server.handleSprite)
+	server.mux.HandleFunc("POST /clips/{id}/preview", server.handleClipPreview)
+	server.mux.HandleFunc("POST /exports", server.handleExport)
+	server.mux.HandleFunc("GET /exports/{id}", server.handleExportStatus)
+	server.mux.HandleFunc("GET /exports/{id}/download", server.handleExportDownload)
+	server.mux.HandleFunc("GET /cameras/{camera}/export", server.handleExportStream)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// SetCameras 更新摄像头地址，配置重新加载时调用
+func (server *Server) SetCameras(cameras map[string]string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.cameras = cameras
+}
+
+// cameraUrl 摄像头的拉流地址
+func (server *Server) cameraUrl(camera string) (string, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	url, ok := server.cameras[camera]
+	return url, ok
+}
+
+// handleCapture 提交抓取任务
+func (server *Server) handleCapture(w http.ResponseWriter, r *http.Request) {
+	request := &captureRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("解析请求失败: %s", err)))
+		return
+	}
+	url, _ := server.cameraUrl(request.Camera)
+	job := &cliputil.CaptureJob{
+		Camera:     request.Camera,
+		Url:        url,
+		Seconds:    request.Seconds,
+		Artifacts:  request.Artifacts,
+		Keys:       request.Keys,
+		Timeout:    request.Timeout,
+		MaxRetries: request.MaxRetries,
+	}
+	id, err := cliputil.EnqueueCaptureJob(server.redisClient, job)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJson(w, http.StatusAccepted, map[string]string{"id": id})
+}
+
+// handleCaptureStatus 查询抓取任务状态
+func (server *Server) handleCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := cliputil.GetCaptureJobStatus(server.redisClient, r.PathValue("id"))
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, status)
+}
+
+// handleSnapshot 抓取一张图片
+func (server *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	rtspUrl, ok := server.cameraUrl(r.PathValue("camera"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("未配置摄像头：%s", r.PathValue("camera"))))
+		return
+	}
+	options := &ffmpegutil.SnapshotOptions{ReuseInput: true}
+	query := r.URL.Query()
+	options.Width, _ = strconv.Atoi(query.Get("width"))
+	options.Height, _ = strconv.Atoi(query.Get("height"))
+	image, err := ffmpegutil.Snapshot(r.Context(), rtspUrl, options)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errors.New(fmt.Sprintf("抓图失败: %s", err)))
+		return
+	}
+	w.Header().Set("Content-Type", artifactContentTypes[redis.ArtifactImage])
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+// handleProbe 探测摄像头的流信息
+func (server *Server) handleProbe(w http.ResponseWriter, r *http.Request) {
+	rtspUrl, ok := server.cameraUrl(r.PathValue("camera"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("未配置摄像头：%s", r.PathValue("camera"))))
+		return
+	}
+	options := &ffmpegutil.ProbeOptions{}
+	if seconds, err := strconv.Atoi(r.URL.Query().Get("duration")); err == nil && seconds > 0 && seconds <= 60 {
+		options.Duration = time.Duration(seconds) * time.Second
+	}
+	report, err := ffmpegutil.ProbeContext(r.Context(), rtspUrl, options)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errors.New(fmt.Sprintf("探测失败: %s", err)))
+		return
+	}
+	// 不返回带用户名密码的地址
+	report.Url = ""
+	writeJson(w, http.StatusOK, report)
+}
+
+// handleUploadSnapshot 从上传的视频数据中抓图，请求体为视频数据，format参数为格式提示
+// 请求体只能顺序读取，mp4需要moov在文件开头
+func (server *Server) handleUploadSnapshot(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := &ffmpegutil.SnapshotOptions{}
+	options.Width, _ = strconv.Atoi(query.Get("width"))
+	options.Height, _ = strconv.Atoi(query.Get("height"))
+	image, err := ffmpegutil.SnapshotInput(r.Context(), ffmpegutil.ReaderInput(r.Body, query.Get("format")), options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("抓图失败: %s", err)))
+		return
+	}
+	w.Header().Set("Content-Type", artifactContentTypes[redis.ArtifactImage])
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+// handleUploadProbe 探测上传的视频数据，请求体为视频数据，format参数为格式提示
+func (server *Server) handleUploadProbe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := &ffmpegutil.ProbeOptions{}
+	if seconds, err := strconv.Atoi(query.Get("duration")); err == nil && seconds > 0 && seconds <= 60 {
+		options.Duration = time.Duration(seconds) * time.Second
+	}
+	report, err := ffmpegutil.ProbeInput(r.Context(), ffmpegutil.ReaderInput(r.Body, query.Get("format")), options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("探测失败: %s", err)))
+		return
+	}
+	writeJson(w, http.StatusOK, report)
+}
+
+// handleCameras 有片段的摄像头
+func (server *Server) handleCameras(w http.ResponseWriter, r *http.Request) {
+	cameras, err := server.redisClient.ListCameras()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, cameras)
+}
+
+// handleClips 查询片段
+func (server *Server) handleClips(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	camera := query.Get("camera")
+	if camera == "" {
+		writeError(w, http.StatusBadRequest, errors.New("摄像头不能为空"))
+		return
+	}
+	var clips []*redis.ClipMeta
+	var err error
+	if query.Get("from") == "" && query.Get("to") == "" {
+		clips, err = server.redisClient.ListClips(camera)
+	} else {
+		var from, to time.Time
+		if from, err = cliputil.ParseTime(query.Get("from")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if to, err = cliputil.ParseTime(query.Get("to")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		clips, err = cliputil.FindClips(server.redisClient, camera, from, to)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, clips)
+}
+
+// handleClip 片段元数据
+func (server *Server) handleClip(w http.ResponseWriter, r *http.Request) {
+	meta, err := server.redisClient.GetClip(r.PathValue("id"))
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, meta)
+}
+
+// handleClipArtifact 下载片段产物，按需读取分块，支持Range请求
+func (server *Server) handleClipArtifact(w http.ResponseWriter, r *http.Request) {
+	id, kind := r.PathValue("id"), r.PathValue("kind")
+	contentType, ok := artifactContentTypes[kind]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("不支持的产物类型：%s", kind)))
+		return
+	}
+	meta, err := server.redisClient.GetClip(id)
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	reader, err := server.redisClient.OpenClipArtifact(id, kind)
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", meta.EndTime(), reader)
+}
+
+// handleSprite 生成片段的雪碧图和WebVTT，返回更新后的片段元数据
+func (server *Server) handleSprite(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := server.redisClient.GetClip(id); err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	options := &ffmpegutil.SpriteOptions{}
+	query := r.URL.Query()
+	options.Width, _ = strconv.Atoi(query.Get("width"))
+	options.Columns, _ = strconv.Atoi(query.Get("columns"))
+	if seconds, err := strconv.Atoi(query.Get("interval")); err == nil && seconds > 0 {
+		options.Interval = time.Duration(seconds) * time.Second
+	}
+	meta, err := cliputil.GenerateSprite(server.redisClient, id, options)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, meta)
+}
+
+// handleLivePreview 生成直播的预览动图
+func (server *Server) handleLivePreview(w http.ResponseWriter, r *http.Request) {
+	rtspUrl, ok := server.cameraUrl(r.PathValue("camera"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("未配置摄像头：%s", r.PathValue("camera"))))
+		return
+	}
+	options := previewOptions(r)
+	preview, err := ffmpegutil.Preview(r.Context(), rtspUrl, options)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errors.New(fmt.Sprintf("生成预览动图失败: %s", err)))
+		return
+	}
+	w.Header().Set("Content-Type", artifactContentTypes[options.Format])
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(preview)
+}
+
+// handleClipPreview 生成片段的预览动图，返回更新后的片段元数据
+func (server *Server) handleClipPreview(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := server.redisClient.GetClip(id); err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	options := previewOptions(r)
+	if seconds, err := strconv.Atoi(r.URL.Query().Get("start")); err == nil && seconds > 0 {
+		options.Start = time.Duration(seconds) * time.Second
+	}
+	meta, err := cliputil.GeneratePreview(server.redisClient, id, options)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, meta)
+}
+
+// previewOptions 解析预览动图参数，超出限制的参数在生成时按上限处理
+func previewOptions(r *http.Request) *ffmpegutil.PreviewOptions {
+	query := r.URL.Query()
+	options := &ffmpegutil.PreviewOptions{Format: ffmpegutil.PreviewGif}
+	if query.Get("format") == ffmpegutil.PreviewWebp {
+		options.Format = ffmpegutil.PreviewWebp
+	}
+	options.Width, _ = strconv.Atoi(query.Get("width"))
+	options.Fps, _ = strconv.Atoi(query.Get("fps"))
+	options.MaxBytes, _ = strconv.Atoi(query.Get("maxBytes"))
+	if seconds, err := strconv.Atoi(query.Get("duration")); err == nil && seconds > 0 {
+		options.Duration = time.Duration(seconds) * time.Second
+	}
+	return options
+}
+
+// handleExport 提交导出任务
+func (server *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	request := &exportRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("解析请求失败: %s", err)))
+		return
+	}
+	if request.Camera == "" {
+		writeError(w, http.StatusBadRequest, errors.New("摄像头不能为空"))
+		return
+	}
+	from, err := parseJsonTime(request.From)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseJsonTime(request.To)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, errors.New("开始时间必须早于结束时间"))
+		return
+	}
+
+	job := &exportJob{
+		ID:     request.Camera + ":" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		Camera: request.Camera,
+		From:   from.UnixMilli(),
+		To:     to.UnixMilli(),
+		Status: cliputil.JobRunning,
+	}
+	server.mutex.Lock()
+	job.UpdatedAt = time.Now().UnixMilli()
+	server.exports[job.ID] = job
+	server.mutex.Unlock()
+
+	go func() {
+		// 下载后在浏览器中直接播放，moov放在开头
+		data, err := cliputil.ExportRange(server.redisClient, request.Camera, from, to, &cliputil.ExportOptions{ExactCut: request.ExactCut, Layout: ffmpegutil.Mp4LayoutFaststart})
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		if err != nil {
+			log.Printf("导出失败，任务ID：%s，%s", job.ID, err)
+			job.Status = cliputil.JobFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = cliputil.JobSucceeded
+			job.Size = len(data)
+			job.data = data
+		}
+		job.finished = time.Now()
+		job.UpdatedAt = job.finished.UnixMilli()
+		// 到期后删除结果，没有查询和下载时也不会一直占用内存
+		time.AfterFunc(ExportResultTTL, func() {
+			server.mutex.Lock()
+			defer server.mutex.Unlock()
+			delete(server.exports, job.ID)
+		})
+	}()
+	writeJson(w, http.StatusAccepted, map[string]string{"id": job.ID})
+}
+
+// handleExportStatus 查询导出任务状态
+// 在锁内复制状态，返回时不持有锁，客户端接收较慢时不影响其他导出任务
+func (server *Server) handleExportStatus(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	job, ok := server.exports[r.PathValue("id")]
+	var status exportJob
+	if ok {
+		status = *job
+	}
+	server.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("导出任务不存在"))
+		return
+	}
+	writeJson(w, http.StatusOK, &status)
+}
+
+// handleExportDownload 下载导出结果
+func (server *Server) handleExportDownload(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	job, ok := server.exports[r.PathValue("id")]
+	var status string
+	var data []byte
+	var finished time.Time
+	if ok {
+		status, data, finished = job.Status, job.data, job.finished
+	}
+	server.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("导出任务不存在"))
+		return
+	}
+	if status != cliputil.JobSucceeded {
+		writeError(w, http.StatusConflict, errors.New(fmt.Sprintf("导出任务未完成，状态：%s", status)))
+		return
+	}
+	w.Header().Set("Content-Type", artifactContentTypes[redis.ArtifactVideo])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%d_%d.mp4\"", job.Camera, job.From, job.To))
+	http.ServeContent(w, r, "", finished, bytes.NewReader(data))
+}
+
+// handleExportStream 按时间段导出，拼接结果以分片mp4直接写入响应，导出时长较长时也不占用大量内存
+// 开始发送后出错时只能断开连接
+func (server *Server) handleExportStream(w http.ResponseWriter, r *http.Request) {
+	camera := r.PathValue("camera")
+	query := r.URL.Query()
+	from, err := cliputil.ParseTime(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := cliputil.ParseTime(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, errors.New("开始时间必须早于结束时间"))
+		return
+	}
+	exactCut, _ := strconv.ParseBool(query.Get("exact"))
+
+	writer := &exportWriter{ResponseWriter: w}
+	writer.Header().Set("Content-Type", artifactContentTypes[redis.ArtifactVideo])
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%d_%d.mp4\"", camera, from.UnixMilli(), to.UnixMilli()))
+	err = cliputil.ExportRangeTo(writer, server.redisClient, camera, from, to, &cliputil.ExportOptions{ExactCut: exactCut})
+	if err == nil {
+		return
+	}
+	if writer.written {
+		log.Printf("导出失败，摄像头：%s，%s", camera, err)
+		panic(http.ErrAbortHandler)
+	}
+	writer.Header().Del("Content-Disposition")
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+// exportWriter 记录是否已经开始发送导出结果，只实现io.Writer，拼接时按不能seek的输出写入分片mp4
+type exportWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+// parseJsonTime 解析json中的毫秒时间戳或RFC3339时间
+func parseJsonTime(value json.RawMessage) (time.Time, error) {
+	var text string
+	if err := json.Unmarshal(value, &text); err != nil {
+		text = string(value)
+	}
+	return cliputil.ParseTime(text)
+}
+
+// writeJson 返回json
+func writeJson(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("返回json失败:", err)
+	}
+}
+
+// writeError 返回错误信息
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJson(w, code, map[string]string{"error": err.Error()})
+}
+
+// writeRedisError 返回redis错误，数据不存在时返回404
+func writeRedisError(w http.ResponseWriter, err error) {
+	if errors.Is(err, redigo.ErrNil) {
+		writeError(w, http.StatusNotFound, errors.New("数据不存在"))
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,50 @@
+package apiutil
+
+import (
+	"encoding/json"
+	cliputil "ffmpeg_video_capture/clip_util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleExportStatus(t *testing.T) {
+	server := NewServer(nil, nil)
+	server.exports["cam:1"] = &exportJob{ID: "cam:1", Camera: "cam", Status: cliputil.JobSucceeded, Size: 3, data: []byte("mp4")}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/exports/cam:1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("状态码为%d", recorder.Code)
+	}
+	status := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status["id"] != "cam:1" || status["status"] != cliputil.JobSucceeded || status["size"] != float64(3) {
+		t.Errorf("导出任务状态错误: %v", status)
+	}
+	if _, ok := status["data"]; ok {
+		t.Error("导出结果不应出现在状态中")
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/exports/none", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("不存在的导出任务状态码为%d", recorder.Code)
+	}
+}
+
+func TestParseJsonTime(t *testing.T) {
+	want := time.UnixMilli(1700000000000)
+	for _, value := range []string{`1700000000000`, `"1700000000000"`, `"` + want.Format(time.RFC3339) + `"`} {
+		got, err := parseJsonTime(json.RawMessage(value))
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseJsonTime(%s) = %s, %v", value, got, err)
+		}
+	}
+	if _, err := parseJsonTime(json.RawMessage(`"yesterday"`)); err == nil {
+		t.Error("无法解析的时间应返回错误")
+	}
+}
@@ -0,0 +1,187 @@
+package apiutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// 观看者待发送消息的缓冲个数，浏览器读取过慢、缓冲满时断开
+const streamViewerBuffer = 64
+
+// streamMessage 发送给观看者的WebSocket消息
+type streamMessage struct {
+	opcode byte
+	data   []byte
+}
+
+// streamViewer WebSocket直播的一个观看者
+type streamViewer struct {
+	messages chan streamMessage
+	dropped  chan struct{} // 缓冲满被断开时关闭
+	started  bool          // 是否已开始发送分片，从关键帧开始的分片开始发送
+}
+
+// streamSession 一个摄像头的WebSocket fMP4直播会话，多个观看者共用一次拉流，没有观看者时停止
+type streamSession struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mutex   sync.Mutex
+	init    *ffmpegutil.SegmentInit
+	viewers map[*streamViewer]struct{}
+}
+
+// send 发送消息，缓冲满时断开观看者，调用时需持有session.mutex
+func (session *streamSession) send(viewer *streamViewer, message streamMessage) {
+	select {
+	case viewer.messages <- message:
+	default:
+		delete(session.viewers, viewer)
+		close(viewer.dropped)
+	}
+}
+
+// sendInit 发送MIME类型和初始化切片，调用时需持有session.mutex
+func (session *streamSession) sendInit(viewer *streamViewer) {
+	header, _ := json.Marshal(map[string]string{"mimeType": session.init.Media.MimeType()})
+	session.send(viewer, streamMessage{opcode: websocketText, data: header})
+	session.send(viewer, streamMessage{opcode: websocketBinary, data: session.init.Data})
+}
+
+// onInit 收到初始化切片，发送给已连接的观看者
+func (session *streamSession) onInit(init *ffmpegutil.SegmentInit) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.init = init
+	for viewer := range session.viewers {
+		session.sendInit(viewer)
+	}
+	return nil
+}
+
+// onSegment 收到分片，发送给观看者，新加入的观看者从关键帧开始的分片开始接收
+func (session *streamSession) onSegment(segment *ffmpegutil.LiveSegment) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	for viewer := range session.viewers {
+		if !viewer.started && !segment.Keyframe {
+			continue
+		}
+		viewer.started = true
+		session.send(viewer, streamMessage{opcode: websocketBinary, data: segment.Data})
+	}
+	return nil
+}
+
+// joinStream 加入摄像头的WebSocket直播会话，没有会话时启动拉流
+func (server *Server) joinStream(camera string) (*streamSession, *streamViewer, error) {
+	rtspUrl, ok := server.cameraUrl(camera)
+	if !ok {
+		return nil, nil, errors.New(fmt.Sprintf("未配置摄像头：%s", camera))
+	}
+	viewer := &streamViewer{messages: make(chan streamMessage, streamViewerBuffer), dropped: make(chan struct{})}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if session, ok := server.streams[camera]; ok {
+		session.mutex.Lock()
+		session.viewers[viewer] = struct{}{}
+		if session.init != nil {
+			session.sendInit(viewer)
+		}
+		session.mutex.Unlock()
+		return session, viewer, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &streamSession{
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		viewers: map[*streamViewer]struct{}{viewer: {}},
+	}
+	server.streams[camera] = session
+	// 每个GOP一个分片，配置了分片时长时GOP内再分片，降低延迟
+	options := &ffmpegutil.SegmentOptions{Format: ffmpegutil.SegmentFmp4, Fragment: server.liveOptions.Fragment}
+	go func() {
+		defer close(session.done)
+		defer cancel()
+		log.Printf("开始WebSocket直播，摄像头：%s", camera)
+		if err := ffmpegutil.SegmentLive(ctx, rtspUrl, options, session.onInit, session.onSegment); err != nil {
+			log.Printf("WebSocket直播出错，摄像头：%s，%s", camera, err)
+		}
+		log.Printf("WebSocket直播结束，摄像头：%s", camera)
+		server.mutex.Lock()
+		if server.streams[camera] == session {
+			delete(server.streams, camera)
+		}
+		server.mutex.Unlock()
+	}()
+	return session, viewer, nil
+}
+
+// leaveStream 离开WebSocket直播会话，最后一个观看者离开时停止拉流
+func (server *Server) leaveStream(camera string, session *streamSession, viewer *streamViewer) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	session.mutex.Lock()
+	delete(session.viewers, viewer)
+	empty := len(session.viewers) == 0
+	session.mutex.Unlock()
+	if empty {
+		if server.streams[camera] == session {
+			delete(server.streams, camera)
+		}
+		session.cancel()
+	}
+}
+
+// handleStream WebSocket直播，先发送一条文本消息{"mimeType": "video/mp4; codecs=\"...\""}，
+// 之后依次发送fMP4初始化切片和分片(moof+mdat)的二进制消息，浏览器用Media Source Extensions播放
+func (server *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	camera := r.PathValue("camera")
+	if _, ok := server.cameraUrl(camera); !ok {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("未配置摄像头：%s", camera)))
+		return
+	}
+	conn, err := upgradeWebsocket(w, r)
+	if errors.Is(err, errWebsocketHijacked) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer conn.Close()
+	session, viewer, err := server.joinStream(camera)
+	if err != nil {
+		return
+	}
+	defer server.leaveStream(camera, session, viewer)
+
+	// 浏览器关闭连接时结束
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		_ = conn.ReadLoop()
+	}()
+	for {
+		select {
+		case message := <-viewer.messages:
+			if err = conn.WriteMessage(message.opcode, message.data); err != nil {
+				return
+			}
+		case <-viewer.dropped:
+			log.Printf("WebSocket观看者接收过慢，已断开，摄像头：%s", camera)
+			return
+		case <-closed:
+			return
+		case <-session.done:
+			_ = conn.WriteMessage(websocketClose, nil)
+			return
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package apiutil
+
+import (
+	"errors"
+	cliputil "ffmpeg_video_capture/clip_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vodGenerator 生成时间段内片段的HLS播放列表或DASH清单
+type vodGenerator func(redisClient *redis.RedisClient, camera string, from, to time.Time, opts *ffmpegutil.VodOptions, clipUri func(id string) string) ([]byte, error)
+
+// handleVodPlaylist 时间段内片段的HLS点播播放列表，切片地址指向/clips/{id}/hls/
+func (server *Server) handleVodPlaylist(w http.ResponseWriter, r *http.Request) {
+	server.serveVod(w, r, ffmpegutil.HlsPlaylistName, cliputil.VodPlaylist)
+}
+
+// handleVodManifest 时间段内片段的DASH点播清单，与HLS点播共用切片
+func (server *Server) handleVodManifest(w http.ResponseWriter, r *http.Request) {
+	server.serveVod(w, r, ffmpegutil.DashManifestName, cliputil.VodManifest)
+}
+
+// serveVod 按参数from和to生成时间段内片段的播放列表或清单
+func (server *Server) serveVod(w http.ResponseWriter, r *http.Request, name string, generate vodGenerator) {
+	query := r.URL.Query()
+	from, err := cliputil.ParseTime(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := cliputil.ParseTime(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	options := server.vodOptions()
+	data, err := generate(server.redisClient, r.PathValue("camera"), from, to, &options, func(id string) string {
+		// 相对/cameras/{camera}/vod.m3u8或vod.mpd的地址，经过反向代理时不依赖路径前缀
+		return "../../clips/" + url.PathEscape(id) + "/hls/"
+	})
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writePlaylist(w, name, data)
+}
+
+// handleClipHls 片段的HLS点播播放列表、DASH点播清单、初始化切片和切片
+func (server *Server) handleClipHls(w http.ResponseWriter, r *http.Request) {
+	id, file := r.PathValue("id"), r.PathValue("file")
+	var data []byte
+	var err error
+	switch file {
+	case ffmpegutil.HlsPlaylistName:
+		options := server.vodOptions()
+		if data, err = cliputil.ClipVodPlaylist(server.redisClient, id, &options); err != nil {
+			writeRedisError(w, err)
+			return
+		}
+		writePlaylist(w, file, data)
+		return
+	case ffmpegutil.DashManifestName:
+		options := server.vodOptions()
+		if data, err = cliputil.ClipVodManifest(server.redisClient, id, &options); err != nil {
+			writeRedisError(w, err)
+			return
+		}
+		writePlaylist(w, file, data)
+		return
+	case ffmpegutil.VodInitName:
+		data, err = cliputil.VodInit(server.redisClient, id)
+	default:
+		data, err = cliputil.VodSegment(server.redisClient, id, file)
+	}
+	if err != nil {
+		writeRedisError(w, err)
+		return
+	}
+	writeSegment(w, file, data)
+}
+
+// vodOptions 点播播放列表参数
+func (server *Server) vodOptions() ffmpegutil.VodOptions {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.liveOptions.Vod
+}
+
+// writePlaylist 返回m3u8播放列表或mpd清单
+func writePlaylist(w http.ResponseWriter, name string, data []byte) {
+	w.Header().Set("Content-Type", segmentContentTypes[path.Ext(name)])
+	w.Write(data)
+}
+
+// writeSegment 返回切片，点播切片内容不变，可以缓存
+func writeSegment(w http.ResponseWriter, name string, data []byte) {
+	if contentType, ok := segmentContentTypes[path.Ext(name)]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Write(data)
+}
+
+// vodDirHandler 本地目录中mp4视频的HLS和DASH点播
+type vodDirHandler struct {
+	dir    string
+	opts   ffmpegutil.VodOptions
+	mutex  sync.Mutex
+	probes map[string]*vodProbe // 文件名 -> 扫描结果
+}
+
+// vodProbe 本地mp4视频的扫描结果，文件修改后重新扫描
+type vodProbe struct {
+	modTime   time.Time
+	size      int64
+	keyframes *ffmpegutil.KeyframeIndex
+	duration  time.Duration
+	media     *ffmpegutil.MediaInfo
+}
+
+// clip 点播片段
+func (probe *vodProbe) clip(uri string) *ffmpegutil.VodClip {
+	clip := &ffmpegutil.VodClip{Uri: uri, Duration: probe.duration, Keyframes: probe.keyframes, Media: probe.media}
+	if probe.duration > 0 {
+		clip.Bandwidth = int64(float64(probe.size*8) / probe.duration.Seconds())
+	}
+	return clip
+}
+
+// NewVodDirHandler 提供本地目录中mp4视频的HLS和DASH点播，请求路径需去掉前缀(http.StripPrefix)
+//
+//	index.m3u8                目录中全部mp4视频按文件名排序的播放列表
+//	manifest.mpd              目录中全部mp4视频的DASH清单
+//	{file}/index.m3u8         单个视频的播放列表
+//	{file}/manifest.mpd       单个视频的DASH清单
+//	{file}/init.mp4           初始化切片
+//	{file}/{first}-{last}.m4s 切片
+//
+// 视频第一次请求时扫描关键帧，扫描结果缓存在内存中
+func NewVodDirHandler(dir string, opts *ffmpegutil.VodOptions) http.Handler {
+	handler := &vodDirHandler{dir: dir, probes: make(map[string]*vodProbe)}
+	if opts != nil {
+		handler.opts = *opts
+	}
+	return handler
+}
+
+func (handler *vodDirHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == ffmpegutil.HlsPlaylistName || name == ffmpegutil.DashManifestName {
+		handler.serveDirPlaylist(w, name)
+		return
+	}
+	file, segment, ok := strings.Cut(name, "/")
+	if !ok || !validVodFile(file) {
+		writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("文件不存在：%s", name)))
+		return
+	}
+	probe, err := handler.probe(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if segment == ffmpegutil.HlsPlaylistName || segment == ffmpegutil.DashManifestName {
+		writePlaylist(w, segment, handler.playlist(segment, []*ffmpegutil.VodClip{probe.clip("")}))
+		return
+	}
+
+	reader, err := os.Open(filepath.Join(handler.dir, file))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer reader.Close()
+	var data []byte
+	if segment == ffmpegutil.VodInitName {
+		data, err = ffmpegutil.VodInit(reader)
+	} else {
+		var first, last int
+		if first, last, err = ffmpegutil.ParseVodSegmentName(segment); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		data, err = ffmpegutil.VodSegment(reader, probe.keyframes, first, last)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeSegment(w, segment, data)
+}
+
+// playlist 按文件名生成HLS播放列表或DASH清单
+func (handler *vodDirHandler) playlist(name string, clips []*ffmpegutil.VodClip) []byte {
+	if name == ffmpegutil.DashManifestName {
+		return ffmpegutil.VodManifest(clips, &handler.opts).Bytes()
+	}
+	return ffmpegutil.VodPlaylist(clips, &handler.opts).Bytes()
+}
+
+// serveDirPlaylist 目录中全部mp4视频的播放列表或清单
+func (handler *vodDirHandler) serveDirPlaylist(w http.ResponseWriter, name string) {
+	entries, err := os.ReadDir(handler.dir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && validVodFile(entry.Name()) {
+			files = append(files, entry.Name())
+		}
+	}
+	slices.Sort(files)
+
+	var clips []*ffmpegutil.VodClip
+	for _, file := range files {
+		probe, err := handler.probe(file)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errors.New(fmt.Sprintf("扫描视频失败，文件：%s，%s", file, err)))
+			return
+		}
+		clips = append(clips, probe.clip(url.PathEscape(file)+"/"))
+	}
+	if len(clips) == 0 {
+		writeError(w, http.StatusNotFound, errors.New("目录中没有mp4视频"))
+		return
+	}
+	writePlaylist(w, name, handler.playlist(name, clips))
+}
+
+// probe 扫描视频的关键帧，文件未修改时使用缓存
+func (handler *vodDirHandler) probe(file string) (*vodProbe, error) {
+	path := filepath.Join(handler.dir, file)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	handler.mutex.Lock()
+	probe, ok := handler.probes[file]
+	handler.mutex.Unlock()
+	if ok && probe.modTime.Equal(info.ModTime()) && probe.size == info.Size() {
+		return probe, nil
+	}
+
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	keyframes, duration, err := ffmpegutil.ProbeVodClip(reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	media, err := ffmpegutil.VodMedia(reader)
+	if err != nil {
+		return nil, err
+	}
+	probe = &vodProbe{modTime: info.ModTime(), size: info.Size(), keyframes: keyframes, duration: duration, media: media}
+	handler.mutex.Lock()
+	handler.probes[file] = probe
+	handler.mutex.Unlock()
+	return probe, nil
+}
+
+// validVodFile 是否为目录中可以点播的mp4文件名，不允许访问目录外的文件
+func validVodFile(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && filepath.Base(name) == name && strings.EqualFold(filepath.Ext(name), ".mp4")
+}
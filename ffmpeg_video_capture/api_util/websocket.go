@@ -0,0 +1,158 @@
+package apiutil
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket帧类型
+const (
+	websocketText   = 0x1
+	websocketBinary = 0x2
+	websocketClose  = 0x8
+	websocketPing   = 0x9
+	websocketPong   = 0xa
+)
+
+// 计算Sec-WebSocket-Accept使用的GUID
+const websocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// errWebsocketHijacked 连接已被接管但握手失败，连接已关闭，不能再写入HTTP响应
+var errWebsocketHijacked = errors.New("WebSocket握手失败，连接已关闭")
+
+// websocketConn 服务端WebSocket连接，只用于向浏览器推送数据，收到的数据帧丢弃
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex // 写入互斥
+}
+
+// upgradeWebsocket 将HTTP请求升级为WebSocket连接
+// 接管连接后握手失败时返回errWebsocketHijacked，调用方不能再用w返回错误
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, errors.New("不是WebSocket请求")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("只支持WebSocket版本13")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("缺少Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("连接不支持升级")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("升级WebSocket连接失败: %s", err))
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		log.Printf("发送WebSocket握手响应失败: %s", err)
+		return nil, errWebsocketHijacked
+	}
+	return &websocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// websocketAccept 握手响应中的Sec-WebSocket-Accept
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// WriteMessage 发送一个不分帧的消息，服务端发送的帧不加掩码
+func (c *websocketConn) WriteMessage(opcode byte, data []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+	case len(data) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(data)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(data)))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// 浏览器长时间不读取时断开，不阻塞其他观看者
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadLoop 读取浏览器发送的帧，回复ping和close，连接关闭或出错时返回
+func (c *websocketConn) ReadLoop() error {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0f
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, buf); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(buf))
+		case 127:
+			buf := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, buf); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(buf)
+		}
+		if length > 1<<20 {
+			return errors.New("WebSocket消息过大")
+		}
+		// 浏览器发送的帧都有掩码
+		var mask [4]byte
+		if header[1]&0x80 != 0 {
+			if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+				return err
+			}
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case websocketClose:
+			_ = c.WriteMessage(websocketClose, nil)
+			return io.EOF
+		case websocketPing:
+			if err := c.WriteMessage(websocketPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close 关闭连接
+func (c *websocketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,142 @@
+package apiutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// RFC 6455 1.3节的示例
+	if got, want := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("websocketAccept() = %s, want %s", got, want)
+	}
+}
+
+// newWebsocketPipe 通过内存管道连接的WebSocket连接，返回服务端连接和浏览器端
+func newWebsocketPipe() (*websocketConn, net.Conn) {
+	server, client := net.Pipe()
+	return &websocketConn{conn: server, reader: bufio.NewReader(server)}, client
+}
+
+func TestWebsocketWriteMessage(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{0x82, 0}},
+		{125, []byte{0x82, 125}},
+		{126, []byte{0x82, 126, 0, 126}},
+		{0xffff, []byte{0x82, 126, 0xff, 0xff}},
+		{0x10000, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, test := range tests {
+		conn, client := newWebsocketPipe()
+		data := bytes.Repeat([]byte{7}, test.length)
+		go func() {
+			_ = conn.WriteMessage(websocketBinary, data)
+			conn.Close()
+		}()
+		frame, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame[:min(len(frame), len(test.header))], test.header) || !bytes.Equal(frame[len(test.header):], data) {
+			t.Errorf("长度为%d的消息帧头为%v，want %v", test.length, frame[:min(len(frame), 10)], test.header)
+		}
+	}
+}
+
+// maskedFrame 浏览器发送的带掩码的帧
+func maskedFrame(opcode byte, payload []byte, mask [4]byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebsocketReadLoop(t *testing.T) {
+	conn, client := newWebsocketPipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.ReadLoop()
+	}()
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	reader := bufio.NewReader(client)
+
+	// 数据帧丢弃，ping回复去掉掩码后的pong
+	long := bytes.Repeat([]byte("abc"), 100)
+	ping := []byte("hello")
+	go func() {
+		_, _ = client.Write(maskedFrame(websocketText, long, mask))
+		_, _ = client.Write(maskedFrame(websocketPing, ping, mask))
+	}()
+	pong := make([]byte, 2+len(ping))
+	if _, err := io.ReadFull(reader, pong); err != nil {
+		t.Fatal(err)
+	}
+	if pong[0] != 0x80|websocketPong || int(pong[1]) != len(ping) || !bytes.Equal(pong[2:], ping) {
+		t.Errorf("pong帧错误: %v", pong)
+	}
+
+	// close回复close后结束
+	go func() {
+		_, _ = client.Write(maskedFrame(websocketClose, nil, mask))
+	}()
+	closeFrame := make([]byte, 2)
+	if _, err := io.ReadFull(reader, closeFrame); err != nil {
+		t.Fatal(err)
+	}
+	if closeFrame[0] != 0x80|websocketClose || closeFrame[1] != 0 {
+		t.Errorf("close帧错误: %v", closeFrame)
+	}
+	if err := <-done; err != io.EOF {
+		t.Errorf("ReadLoop() = %v", err)
+	}
+}
+
+// failedHijacker 接管后写入握手响应失败的连接
+type failedHijacker struct {
+	*httptest.ResponseRecorder
+}
+
+func (h failedHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	server, client := net.Pipe()
+	client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestUpgradeWebsocketError(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/cameras/cam/stream", nil)
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "keep-alive, Upgrade")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	// 不支持接管时可以返回HTTP错误
+	if _, err := upgradeWebsocket(httptest.NewRecorder(), request); err == nil || errors.Is(err, errWebsocketHijacked) {
+		t.Errorf("upgradeWebsocket() = %v", err)
+	}
+	if _, err := upgradeWebsocket(failedHijacker{httptest.NewRecorder()}, request); !errors.Is(err, errWebsocketHijacked) {
+		t.Errorf("握手失败时upgradeWebsocket() = %v", err)
+	}
+	request.Header.Del("Sec-WebSocket-Key")
+	if _, err := upgradeWebsocket(httptest.NewRecorder(), request); err == nil {
+		t.Error("缺少Sec-WebSocket-Key时应返回错误")
+	}
+}
@@ -0,0 +1,64 @@
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadAt(t *testing.T) {
+	b := NewBuffer([]byte("0123456789"))
+	tests := []struct {
+		off    int64
+		length int
+		want   string
+		eof    bool
+	}{
+		{0, 4, "0123", false},
+		{6, 4, "6789", false},
+		{8, 4, "89", true},
+		{10, 1, "", true},
+		{20, 1, "", true},
+	}
+	for _, test := range tests {
+		p := make([]byte, test.length)
+		n, err := b.ReadAt(p, test.off)
+		if string(p[:n]) != test.want || errors.Is(err, io.EOF) != test.eof {
+			t.Errorf("ReadAt(%d, %d) = %q, %v", test.length, test.off, p[:n], err)
+		}
+	}
+	if _, err := b.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Error("ReadAt负数偏移应返回错误")
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	b := NewBuffer([]byte("0123456789"))
+	if _, err := b.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		off  int64
+		data string
+		want []byte
+	}{
+		{2, "ab", []byte("01ab456789")},
+		{8, "xyz", []byte("01ab4567xyz")},
+		// 超过末尾时中间补0
+		{13, "!", []byte("01ab4567xyz\x00\x00!")},
+	}
+	for _, test := range tests {
+		n, err := b.WriteAt([]byte(test.data), test.off)
+		if err != nil || n != len(test.data) || !bytes.Equal(b.Bytes(), test.want) {
+			t.Errorf("WriteAt(%q, %d) = %d, %v, data %q", test.data, test.off, n, err, b.Bytes())
+		}
+	}
+	// WriteAt不改变顺序读写的位置
+	if offset, _ := b.Seek(0, io.SeekCurrent); offset != 3 {
+		t.Errorf("WriteAt后位置为%d", offset)
+	}
+	if _, err := b.WriteAt([]byte("a"), -1); err == nil {
+		t.Error("WriteAt负数偏移应返回错误")
+	}
+}
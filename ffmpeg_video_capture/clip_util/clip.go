@@ -0,0 +1,236 @@
+package cliputil
+
+import (
+	"context"
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// CaptureAndIndex 抓取视频、音频和图片，保存到redis并加入摄像头的片段索引
+func CaptureAndIndex(redisClient *redis.RedisClient, camera string, rtspUrl string, seconds time.Duration) (*redis.ClipMeta, error) {
+	return CaptureAndIndexContext(context.Background(), redisClient, camera, rtspUrl, seconds)
+}
+
+// CaptureAndIndexContext 同CaptureAndIndex，ctx取消时中断抓取
+func CaptureAndIndexContext(ctx context.Context, redisClient *redis.RedisClient, camera string, rtspUrl string, seconds time.Duration) (*redis.ClipMeta, error) {
+	return CaptureInputAndIndex(ctx, redisClient, camera, ffmpegutil.UrlInput(rtspUrl), seconds, nil)
+}
+
+// CaptureInputAndIndex 从地址或读取器抓取并保存为片段，kinds为保存的产物类型，为空时保存视频、音频和图片
+// 视频以分片mp4边抓取边分块写入redis，音频同样边抓取边写入，内存占用与抓取时长无关
+func CaptureInputAndIndex(ctx context.Context, redisClient *redis.RedisClient, camera string, input *ffmpegutil.Input, seconds time.Duration, kinds []string) (*redis.ClipMeta, error) {
+	writers := newClipWriters(redisClient, camera, kinds)
+	result, err := ffmpegutil.CaptureTo(ctx, input, seconds, writers.output())
+	if err != nil {
+		writers.abort()
+		return nil, err
+	}
+	return saveClip(redisClient, camera, result, writers, kinds)
+}
+
+// RecordAndIndex 持续录制input，每段边录制边分块写入redis并保存为片段，保存成功后交给onClip
+// 保存失败只丢弃这一段，不中断录制；onClip返回错误时结束录制并返回该错误，其他结束条件同ffmpegutil.RecordSegments
+func RecordAndIndex(ctx context.Context, redisClient *redis.RedisClient, camera string, input *ffmpegutil.Input, segment time.Duration, kinds []string, onClip func(meta *redis.ClipMeta) error) error {
+	// 当前片段的写入
+	var writers *clipWriters
+	err := ffmpegutil.RecordSegmentsTo(ctx, input, segment, func() (*ffmpegutil.CaptureOutput, error) {
+		writers = newClipWriters(redisClient, camera, kinds)
+		return writers.output(), nil
+	}, func(result *ffmpegutil.CaptureResult) error {
+		finished := writers
+		writers = nil
+		meta, err := saveClip(redisClient, camera, result, finished, kinds)
+		if err != nil {
+			log.Printf("保存片段失败: %s", err)
+			return nil
+		}
+		return onClip(meta)
+	})
+	// 未完成的片段
+	if writers != nil {
+		writers.abort()
+	}
+	return err
+}
+
+// clipWriters 抓取时视频和音频的分块写入
+// 片段ID在抓取完成后才确定，分块先写入摄像头的暂存key，保存片段时清单写入片段的key，清单中记录分块所在的key
+type clipWriters struct {
+	video *redis.ChunkWriter
+	audio *redis.ChunkWriter // 不保存音频时为nil
+}
+
+// newClipWriters 新建抓取的分块写入，视频用于生成雪碧图和预览动图，总是写入，音频只在需要保存时写入
+func newClipWriters(redisClient *redis.RedisClient, camera string, kinds []string) *clipWriters {
+	writers := &clipWriters{video: redisClient.NewChunkWriter(redis.ClipStagingKey(camera, redis.ArtifactVideo), 0)}
+	if hasArtifact(kinds, redis.ArtifactAudio) {
+		writers.audio = redisClient.NewChunkWriter(redis.ClipStagingKey(camera, redis.ArtifactAudio), 0)
+	}
+	return writers
+}
+
+// output 抓取的写入目标，ChunkWriter不能seek，视频为分片mp4
+func (writers *clipWriters) output() *ffmpegutil.CaptureOutput {
+	output := &ffmpegutil.CaptureOutput{Video: writers.video, Layout: ffmpegutil.Mp4LayoutFragmented}
+	if writers.audio != nil {
+		output.Audio = writers.audio
+	}
+	return output
+}
+
+// close 写入剩余数据
+func (writers *clipWriters) close() error {
+	if err := writers.video.Close(); err != nil {
+		return err
+	}
+	if writers.audio != nil {
+		return writers.audio.Close()
+	}
+	return nil
+}
+
+// abort 删除已写入的分块
+func (writers *clipWriters) abort() {
+	abortWriter(writers.video)
+	if writers.audio != nil {
+		abortWriter(writers.audio)
+	}
+}
+
+// abortWriter 删除已写入的分块，失败时只记录日志，残留的分块不影响片段
+func abortWriter(writer *redis.ChunkWriter) {
+	if err := writer.Abort(); err != nil {
+		log.Printf("删除片段产物的分块失败: %s", err)
+	}
+}
+
+// saveClip 抓取结果中kinds类型的产物保存为片段并加入片段索引，kinds为空时保存视频、音频和图片
+// 视频和音频已在抓取时分块写入，图片和按需生成的产物在确定片段ID后写入，保存视频时同时保存关键帧索引
+// 保存失败时删除全部分块，不需要保存的视频在保存后删除
+func saveClip(redisClient *redis.RedisClient, camera string, result *ffmpegutil.CaptureResult, writers *clipWriters, kinds []string) (meta *redis.ClipMeta, err error) {
+	// 按需生成的产物的分块写入
+	var generated []*redis.ChunkWriter
+	defer func() {
+		if err != nil {
+			writers.abort()
+			for _, writer := range generated {
+				abortWriter(writer)
+			}
+		}
+	}()
+	if err = writers.close(); err != nil {
+		return nil, err
+	}
+	meta = &redis.ClipMeta{
+		ID:     redis.NewClipID(camera, result.StartTime),
+		Camera: camera,
+		Start:  result.StartTime.UnixMilli(),
+		End:    result.EndTime.UnixMilli(),
+	}
+
+	manifests := make(map[string]*redis.ChunkManifest)
+	if hasArtifact(kinds, redis.ArtifactVideo) {
+		manifests[redis.ArtifactVideo] = writers.video.Manifest()
+		meta.Keyframes = keyframeMeta(result.Keyframes)
+	}
+	if writers.audio != nil {
+		manifests[redis.ArtifactAudio] = writers.audio.Manifest()
+	}
+	artifacts, err := generateArtifacts(writers.video.Reader(), result.Keyframes, kinds)
+	if err != nil {
+		return nil, err
+	}
+	if hasArtifact(kinds, redis.ArtifactImage) {
+		artifacts[redis.ArtifactImage] = result.Image
+	}
+	for kind, data := range artifacts {
+		writer := redisClient.NewChunkWriter(redis.ClipDataKey(meta.ID, kind), 0)
+		generated = append(generated, writer)
+		if _, err = writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err = writer.Close(); err != nil {
+			return nil, err
+		}
+		manifests[kind] = writer.Manifest()
+	}
+
+	if err = redisClient.SaveClip(meta, manifests); err != nil {
+		return nil, errors.New(fmt.Sprintf("片段数据保存redis失败: %s", err))
+	}
+	// 不需要保存的视频在生成雪碧图和预览动图后才删除
+	if _, ok := manifests[redis.ArtifactVideo]; !ok {
+		abortWriter(writers.video)
+	}
+	log.Printf("片段保存成功，片段ID：%s", meta.ID)
+	return meta, nil
+}
+
+// hasArtifact kinds中是否包含kind，kinds为空时包含视频、音频和图片
+func hasArtifact(kinds []string, kind string) bool {
+	if len(kinds) == 0 {
+		return kind == redis.ArtifactVideo || kind == redis.ArtifactAudio || kind == redis.ArtifactImage
+	}
+	return slices.Contains(kinds, kind)
+}
+
+// FindClips 查找摄像头在[from, to]时间段内的片段
+func FindClips(redisClient *redis.RedisClient, camera string, from, to time.Time) ([]*redis.ClipMeta, error) {
+	if !from.Before(to) {
+		return nil, errors.New("开始时间必须早于结束时间")
+	}
+	return redisClient.FindClips(camera, from, to)
+}
+
+// ParseTime 解析毫秒时间戳或RFC3339时间
+func ParseTime(value string) (time.Time, error) {
+	if milli, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(milli), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("时间格式错误：%s", value))
+	}
+	return t, nil
+}
+
+// ClipKeyframes 片段元数据中的关键帧索引，没有索引时返回nil
+func ClipKeyframes(meta *redis.ClipMeta) *ffmpegutil.KeyframeIndex {
+	if meta.Keyframes == nil || meta.Keyframes.TimeBase[1] == 0 {
+		return nil
+	}
+	index := &ffmpegutil.KeyframeIndex{
+		TimeBase:  astiav.NewRational(meta.Keyframes.TimeBase[0], meta.Keyframes.TimeBase[1]),
+		Keyframes: make([]ffmpegutil.Keyframe, 0, len(meta.Keyframes.Keyframes)),
+		End:       meta.Keyframes.End,
+		Layout:    ffmpegutil.Mp4Layout(meta.Keyframes.Layout),
+	}
+	for _, keyframe := range meta.Keyframes.Keyframes {
+		index.Keyframes = append(index.Keyframes, ffmpegutil.Keyframe{Pts: keyframe.Pts, Offset: keyframe.Offset})
+	}
+	return index
+}
+
+// keyframeMeta 抓取结果的关键帧索引转换为片段元数据中的格式
+func keyframeMeta(index *ffmpegutil.KeyframeIndex) *redis.KeyframeIndex {
+	if index == nil || len(index.Keyframes) == 0 {
+		return nil
+	}
+	meta := &redis.KeyframeIndex{
+		TimeBase:  [2]int{index.TimeBase.Num(), index.TimeBase.Den()},
+		Keyframes: make([]redis.Keyframe, 0, len(index.Keyframes)),
+		End:       index.End,
+		Layout:    string(index.Layout),
+	}
+	for _, keyframe := range index.Keyframes {
+		meta.Keyframes = append(meta.Keyframes, redis.Keyframe{Pts: keyframe.Pts, Offset: keyframe.Offset})
+	}
+	return meta
+}
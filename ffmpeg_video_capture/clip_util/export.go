@@ -0,0 +1,78 @@
+package cliputil
+
+import (
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ExportOptions 导出参数
+type ExportOptions struct {
+	ExactCut bool                 // 是否精确剪切，默认在关键帧处剪切
+	Layout   ffmpegutil.Mp4Layout // mp4的封装方式，ExportRange为空时moov在末尾，ExportRangeTo为空时按写入目标选择
+}
+
+// ExportRange 导出摄像头在[from, to]时间段内的视频
+// 查找与时间段重叠的片段，按时间顺序拼接，并将第一个和最后一个片段剪切到时间段边界
+func ExportRange(redisClient *redis.RedisClient, camera string, from, to time.Time, options *ExportOptions) ([]byte, error) {
+	if options == nil {
+		options = &ExportOptions{}
+	}
+	segments, err := exportSegments(redisClient, camera, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return ffmpegutil.ConcatSegments(segments, &ffmpegutil.ConcatOptions{ExactCut: options.ExactCut, Layout: options.Layout})
+}
+
+// ExportRangeTo 同ExportRange，导出的视频边拼接边写入writer，不在内存中保留
+// writer不能seek(如HTTP响应)时输出分片mp4，可以随机读写(如*os.File)时输出faststart的mp4
+func ExportRangeTo(writer io.Writer, redisClient *redis.RedisClient, camera string, from, to time.Time, options *ExportOptions) error {
+	if options == nil {
+		options = &ExportOptions{}
+	}
+	segments, err := exportSegments(redisClient, camera, from, to)
+	if err != nil {
+		return err
+	}
+	return ffmpegutil.ConcatSegmentsTo(writer, segments, &ffmpegutil.ConcatOptions{ExactCut: options.ExactCut, Layout: options.Layout})
+}
+
+// exportSegments 与时间段重叠的片段，第一个和最后一个片段剪切到时间段边界
+func exportSegments(redisClient *redis.RedisClient, camera string, from, to time.Time) ([]*ffmpegutil.ConcatSegment, error) {
+	clips, err := FindClips(redisClient, camera, from, to)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("查找片段失败: %s", err))
+	}
+
+	var segments []*ffmpegutil.ConcatSegment
+	for _, clip := range clips {
+		if _, ok := clip.Artifacts[redis.ArtifactVideo]; !ok {
+			continue
+		}
+		// 按需读取片段数据，不整体加载到内存
+		videoReader, err := redisClient.OpenClipArtifact(clip.ID, redis.ArtifactVideo)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("获取片段视频数据失败，片段ID：%s，%s", clip.ID, err))
+		}
+		segment := &ffmpegutil.ConcatSegment{Reader: videoReader, Keyframes: ClipKeyframes(clip)}
+		// 片段开始时间早于from，剪掉开头
+		if clip.StartTime().Before(from) {
+			segment.Start = from.Sub(clip.StartTime())
+		}
+		// 片段结束时间晚于to，剪掉结尾
+		if clip.EndTime().After(to) {
+			segment.End = to.Sub(clip.StartTime())
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return nil, errors.New(fmt.Sprintf("时间段内无视频数据，摄像头：%s", camera))
+	}
+	log.Printf("时间段内共%d个片段", len(segments))
+	return segments, nil
+}
@@ -0,0 +1,520 @@
+package cliputil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"ffmpeg_video_capture/buffer"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CaptureJobStream 抓取任务队列
+const CaptureJobStream = "capture:jobs"
+
+// CaptureJobGroup 抓取任务的消费者组，所有worker属于同一个组，每个任务只会被一个worker执行
+const CaptureJobGroup = "capture-workers"
+
+// CaptureJobStreamMaxLen 抓取任务队列的最大长度(近似值)，未确认和尚未读取的任务不受限制
+const CaptureJobStreamMaxLen = 10000
+
+// CaptureJobDelayedKey 等待重试的抓取任务，有序集合，分数为重试时间的毫秒时间戳，到期后移入任务队列
+const CaptureJobDelayedKey = "capture:jobs:delayed"
+
+// 失败重试的等待时间，从captureRetryDelay开始每次翻倍，最长为captureMaxRetryDelay
+const (
+	captureRetryDelay    = 10 * time.Second
+	captureMaxRetryDelay = 10 * time.Minute
+)
+
+// captureJobStatusKeyPrefix 抓取任务状态的key前缀
+const captureJobStatusKeyPrefix = "capture:job:"
+
+// CaptureJobStatusTTL 抓取任务状态的保存时间，单位秒
+const CaptureJobStatusTTL = 7 * 24 * 3600
+
+// 抓取任务状态
+const (
+	JobPending   = "pending"   // 等待执行
+	JobRunning   = "running"   // 执行中
+	JobRetrying  = "retrying"  // 执行失败，等待重试
+	JobSucceeded = "succeeded" // 执行成功
+	JobFailed    = "failed"    // 执行失败，不再重试
+)
+
+// CaptureJob 抓取任务
+type CaptureJob struct {
+	ID         string            `json:"id"`
+	Camera     string            `json:"camera"`
+	Url        string            `json:"url"`        // 拉流地址，为空时使用worker配置的摄像头地址
+	Seconds    int64             `json:"seconds"`    // 抓取时长，单位秒，为0时使用摄像头产物策略的时长
+	Artifacts  []string          `json:"artifacts"`  // 需要的产物类型，为空时使用摄像头产物策略的产物，都没有时保存视频、音频和图片
+	Keys       map[string]string `json:"keys"`       // 产物类型 -> 目标列表key，为空时保存为片段并加入片段索引
+	Timeout    int64             `json:"timeout"`    // 单次执行超时时间，单位秒，为0时为抓取时长加30秒
+	MaxRetries int               `json:"maxRetries"` // 最多重试次数
+	Attempts   int               `json:"attempts"`   // 已执行次数
+}
+
+// CaptureJobStatus 抓取任务状态
+type CaptureJobStatus struct {
+	ID         string            `json:"id"`
+	Camera     string            `json:"camera"`
+	Status     string            `json:"status"`
+	Attempts   int               `json:"attempts"`
+	Error      string            `json:"error,omitempty"`
+	ClipID     string            `json:"clipId,omitempty"`     // 保存为片段时的片段ID
+	ResultKeys map[string]string `json:"resultKeys,omitempty"` // 产物类型 -> 结果所在的key
+	RetryAt    int64             `json:"retryAt,omitempty"`    // 等待重试时的重试时间，毫秒时间戳
+	UpdatedAt  int64             `json:"updatedAt"`            // 更新时间，毫秒时间戳
+}
+
+// CaptureJobStatusKey 抓取任务状态的key
+func CaptureJobStatusKey(id string) string {
+	return captureJobStatusKeyPrefix + id
+}
+
+// EnqueueCaptureJob 提交抓取任务，ID为空时自动生成，返回任务ID
+func EnqueueCaptureJob(redisClient *redis.RedisClient, job *CaptureJob) (string, error) {
+	if job.Camera == "" {
+		return "", errors.New("摄像头不能为空")
+	}
+	if job.Seconds < 0 {
+		return "", errors.New("抓取时长不能小于0")
+	}
+	for _, kind := range job.Artifacts {
+		if kind != redis.ArtifactVideo && kind != redis.ArtifactAudio && kind != redis.ArtifactImage &&
+			kind != redis.ArtifactSprite && kind != redis.ArtifactGif && kind != redis.ArtifactWebp {
+			return "", errors.New(fmt.Sprintf("不支持的产物类型：%s", kind))
+		}
+	}
+	if job.ID == "" {
+		job.ID = job.Camera + ":" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	if err := setCaptureJobStatus(redisClient, &CaptureJobStatus{ID: job.ID, Camera: job.Camera, Status: JobPending, Attempts: job.Attempts}); err != nil {
+		return "", err
+	}
+	if err := pushCaptureJob(redisClient, job); err != nil {
+		return "", err
+	}
+	return job.ID, nil
+}
+
+// GetCaptureJobStatus 获取抓取任务状态
+func GetCaptureJobStatus(redisClient *redis.RedisClient, id string) (*CaptureJobStatus, error) {
+	statusBytes, err := redisClient.GetBytes(CaptureJobStatusKey(id))
+	if err != nil {
+		return nil, err
+	}
+	status := &CaptureJobStatus{}
+	if err = json.Unmarshal(statusBytes, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// pushCaptureJob 将任务写入队列
+func pushCaptureJob(redisClient *redis.RedisClient, job *CaptureJob) error {
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if _, err = redisClient.XAdd(CaptureJobStream, CaptureJobStreamMaxLen, map[string]interface{}{"job": jobBytes}); err != nil {
+		return errors.New(fmt.Sprintf("提交抓取任务失败: %s", err))
+	}
+	return nil
+}
+
+// delayCaptureJob 将任务加入等待重试的有序集合，retryAt之后由worker移入队列
+func delayCaptureJob(redisClient *redis.RedisClient, job *CaptureJob, retryAt time.Time) error {
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err = redisClient.ZAdd(CaptureJobDelayedKey, retryAt.UnixMilli(), jobBytes); err != nil {
+		return errors.New(fmt.Sprintf("提交重试任务失败: %s", err))
+	}
+	return nil
+}
+
+// retryDelay 第attempts次失败后的等待时间，从base开始每次翻倍，最长为max
+func retryDelay(base time.Duration, max time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
+
+// setCaptureJobStatus 写入任务状态
+func setCaptureJobStatus(redisClient *redis.RedisClient, status *CaptureJobStatus) error {
+	status.UpdatedAt = time.Now().UnixMilli()
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return redisClient.SetEx(CaptureJobStatusKey(status.ID), CaptureJobStatusTTL, statusBytes)
+}
+
+// CapturePolicy 摄像头的抓取策略，任务没有指定产物类型和抓取时长时使用
+type CapturePolicy struct {
+	Artifacts []string // 产物类型，为空时保存视频、音频和图片
+	Seconds   int64    // 抓取时长，单位秒
+}
+
+// CaptureWorker 抓取任务执行者，从队列中读取任务并执行，多个worker可以同时运行
+// 执行任务期间每隔ClaimIdle/3重新认领一次任务，执行时间超过ClaimIdle的任务不会被其他worker认领
+type CaptureWorker struct {
+	redisClient   *redis.RedisClient
+	mutex         sync.Mutex
+	cameras       map[string]string               // 摄像头 -> 拉流地址
+	listLayouts   map[string]ffmpegutil.Mp4Layout // 摄像头 -> 推送到列表时视频的mp4封装方式
+	policies      map[string]*CapturePolicy       // 摄像头 -> 抓取策略
+	Consumer      string                          // 消费者名称，组内唯一
+	Block         time.Duration                   // 读取阻塞等待时间
+	ClaimIdle     time.Duration                   // 异常退出的worker未确认的任务空闲多久后重新认领，为0时不认领
+	MaxDeliveries int64                           // 任务最多投递次数，超过后转入死信流，为0时不限制
+}
+
+// NewCaptureWorker 新建抓取任务执行者
+func NewCaptureWorker(redisClient *redis.RedisClient, cameras map[string]string, consumer string) *CaptureWorker {
+	return &CaptureWorker{
+		redisClient:   redisClient,
+		cameras:       cameras,
+		Consumer:      consumer,
+		Block:         5 * time.Second,
+		ClaimIdle:     time.Minute,
+		MaxDeliveries: redis.DefaultMaxDeliveries,
+	}
+}
+
+// SetCameras 更新摄像头地址，配置重新加载时调用
+func (worker *CaptureWorker) SetCameras(cameras map[string]string) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	worker.cameras = cameras
+}
+
+// SetMp4Layouts 更新推送到列表时视频的mp4封装方式，未设置的摄像头moov在末尾，保存为片段时视频总是分片mp4
+func (worker *CaptureWorker) SetMp4Layouts(list map[string]ffmpegutil.Mp4Layout) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	worker.listLayouts = list
+}
+
+// SetPolicies 更新摄像头的抓取策略，未设置的摄像头任务需要指定抓取时长
+func (worker *CaptureWorker) SetPolicies(policies map[string]*CapturePolicy) {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	worker.policies = policies
+}
+
+// Run 持续执行抓取任务，直到ctx被取消，任务逐个执行
+// 读取队列或写回状态出错时等待一段时间后继续，未确认的任务空闲超过ClaimIdle后重新认领执行
+func (worker *CaptureWorker) Run(ctx context.Context) error {
+	if err := worker.redisClient.XGroupCreate(CaptureJobStream, CaptureJobGroup, "0"); err != nil {
+		return errors.New(fmt.Sprintf("创建消费者组失败: %s", err))
+	}
+	poller := &capturePoller{worker: worker, claimStart: "0-0", lastClaim: time.Now()}
+	// 连续出错的次数
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		err := poller.poll(ctx)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		failures++
+		delay := retryDelay(time.Second, time.Minute, failures)
+		log.Printf("抓取任务处理出错，%s后继续: %s", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// capturePoller 读取和认领任务的位置
+type capturePoller struct {
+	worker     *CaptureWorker
+	claimStart string
+	lastClaim  time.Time
+}
+
+// poll 读取一次任务并执行，出错时任务不确认
+func (poller *capturePoller) poll(ctx context.Context) error {
+	worker := poller.worker
+	// 到期的重试任务移入队列
+	if _, err := worker.redisClient.PromoteDelayed(CaptureJobDelayedKey, CaptureJobStream, "job", time.Now().UnixMilli(), 100); err != nil {
+		return errors.New(fmt.Sprintf("移动重试任务失败: %s", err))
+	}
+
+	messages, err := worker.redisClient.XReadGroup(CaptureJobStream, CaptureJobGroup, worker.Consumer, 1, worker.Block)
+	if err != nil {
+		return errors.New(fmt.Sprintf("读取抓取任务失败: %s", err))
+	}
+
+	// 认领异常退出的worker未确认的任务，反复认领仍未完成的任务转入死信流
+	if len(messages) == 0 && worker.ClaimIdle > 0 && time.Since(poller.lastClaim) >= worker.ClaimIdle {
+		if worker.MaxDeliveries > 0 {
+			if _, err = worker.redisClient.DeadLetterPending(CaptureJobStream, CaptureJobGroup, worker.ClaimIdle, worker.MaxDeliveries, 10); err != nil {
+				return errors.New(fmt.Sprintf("抓取任务转入死信流失败: %s", err))
+			}
+		}
+		poller.claimStart, messages, err = worker.redisClient.XAutoClaim(CaptureJobStream, CaptureJobGroup, worker.Consumer, worker.ClaimIdle, poller.claimStart, 1)
+		if err != nil {
+			return errors.New(fmt.Sprintf("认领未确认的抓取任务失败: %s", err))
+		}
+		poller.lastClaim = time.Now()
+	}
+
+	for _, message := range messages {
+		job := &CaptureJob{}
+		if err = json.Unmarshal([]byte(message.Fields["job"]), job); err != nil {
+			log.Printf("解析抓取任务失败，消息ID：%s，%s", message.ID, err)
+		} else {
+			stopKeepClaim := worker.keepClaim(message.ID)
+			err = worker.handle(ctx, job)
+			stopKeepClaim()
+			if err != nil {
+				// 任务不确认，空闲超过ClaimIdle后重新认领执行
+				return err
+			}
+		}
+		if err = worker.redisClient.XAck(CaptureJobStream, CaptureJobGroup, message.ID); err != nil {
+			return errors.New(fmt.Sprintf("确认抓取任务失败: %s", err))
+		}
+	}
+	return nil
+}
+
+// keepClaim 任务执行期间定期重新认领任务，重置任务的空闲时间，返回停止认领的函数
+func (worker *CaptureWorker) keepClaim(messageID string) (stop func()) {
+	if worker.ClaimIdle <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(worker.ClaimIdle / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := worker.redisClient.XClaimJustID(CaptureJobStream, CaptureJobGroup, worker.Consumer, messageID); err != nil {
+					log.Printf("重新认领抓取任务失败，消息ID：%s，%s", messageID, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// handle 执行一次任务并写回状态，执行失败且未超过重试次数时按退避时间重新入队
+// 开始执行前写入状态失败或重新入队失败时返回错误，任务由worker重新认领执行
+// 执行结束后写入状态失败只记录日志，任务已执行完成，不再重复执行
+func (worker *CaptureWorker) handle(ctx context.Context, job *CaptureJob) error {
+	job.Attempts++
+	status := &CaptureJobStatus{ID: job.ID, Camera: job.Camera, Status: JobRunning, Attempts: job.Attempts}
+	if err := setCaptureJobStatus(worker.redisClient, status); err != nil {
+		return errors.New(fmt.Sprintf("写入抓取任务状态失败: %s", err))
+	}
+	log.Printf("开始执行抓取任务，任务ID：%s，第%d次", job.ID, job.Attempts)
+
+	err := worker.execute(ctx, job, status)
+	if err == nil {
+		status.Status = JobSucceeded
+		log.Printf("抓取任务执行成功，任务ID：%s", job.ID)
+		worker.finishStatus(status)
+		return nil
+	}
+	if ctx.Err() != nil {
+		// worker退出，任务保持未确认状态
+		return ctx.Err()
+	}
+
+	status.Error = err.Error()
+	log.Printf("抓取任务执行失败，任务ID：%s，%s", job.ID, err)
+	if job.Attempts > job.MaxRetries {
+		status.Status = JobFailed
+		worker.finishStatus(status)
+		return nil
+	}
+	retryAt := time.Now().Add(retryDelay(captureRetryDelay, captureMaxRetryDelay, job.Attempts))
+	if err = delayCaptureJob(worker.redisClient, job, retryAt); err != nil {
+		return err
+	}
+	status.Status = JobRetrying
+	status.RetryAt = retryAt.UnixMilli()
+	worker.finishStatus(status)
+	return nil
+}
+
+// finishStatus 写入任务执行结束后的状态，失败时只记录日志
+func (worker *CaptureWorker) finishStatus(status *CaptureJobStatus) {
+	if err := setCaptureJobStatus(worker.redisClient, status); err != nil {
+		log.Printf("写入抓取任务状态失败，任务ID：%s，状态：%s，%s", status.ID, status.Status, err)
+	}
+}
+
+// execute 抓取并保存产物，结果写入status
+func (worker *CaptureWorker) execute(ctx context.Context, job *CaptureJob, status *CaptureJobStatus) error {
+	rtspUrl := job.Url
+	worker.mutex.Lock()
+	if rtspUrl == "" {
+		rtspUrl = worker.cameras[job.Camera]
+	}
+	layout := worker.listLayouts[job.Camera]
+	kinds, seconds := job.Artifacts, job.Seconds
+	if policy := worker.policies[job.Camera]; policy != nil {
+		if len(kinds) == 0 {
+			kinds = policy.Artifacts
+		}
+		if seconds == 0 {
+			seconds = policy.Seconds
+		}
+	}
+	worker.mutex.Unlock()
+	if rtspUrl == "" {
+		return errors.New(fmt.Sprintf("未配置摄像头的拉流地址：%s", job.Camera))
+	}
+	if seconds <= 0 {
+		return errors.New(fmt.Sprintf("未指定抓取时长，摄像头也没有抓取策略：%s", job.Camera))
+	}
+	timeout := time.Duration(job.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(seconds)*time.Second + 30*time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// 超时返回超时时间，便于排查
+	captureError := func(err error) error {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errors.New(fmt.Sprintf("抓取超时，超时时间：%s", timeout))
+		}
+		return err
+	}
+
+	// 写入目标列表
+	if len(job.Keys) > 0 {
+		result, err := ffmpegutil.CaptureLayout(ctx, ffmpegutil.UrlInput(rtspUrl), time.Duration(seconds), layout)
+		if err != nil {
+			return captureError(err)
+		}
+		artifacts, err := CaptureArtifacts(result, kinds)
+		if err != nil {
+			return err
+		}
+		status.ResultKeys = make(map[string]string)
+		for kind, data := range artifacts {
+			key, ok := job.Keys[kind]
+			if !ok {
+				continue
+			}
+			if err = worker.redisClient.Push(key, data); err != nil {
+				return errors.New(fmt.Sprintf("产物推送redis失败: %s", err))
+			}
+			status.ResultKeys[kind] = key
+		}
+		return nil
+	}
+
+	// 保存为片段，边抓取边分块写入redis
+	meta, err := CaptureInputAndIndex(ctx, worker.redisClient, job.Camera, ffmpegutil.UrlInput(rtspUrl), time.Duration(seconds), kinds)
+	if err != nil {
+		return captureError(err)
+	}
+	status.ClipID = meta.ID
+	status.ResultKeys = make(map[string]string)
+	for kind := range meta.Artifacts {
+		status.ResultKeys[kind] = redis.ClipDataKey(meta.ID, kind)
+	}
+	return nil
+}
+
+// CaptureArtifacts 抓取结果中kinds类型的产物，kinds为空时返回视频、音频和图片
+// 雪碧图和预览动图按需从视频生成
+func CaptureArtifacts(result *ffmpegutil.CaptureResult, kinds []string) (map[string][]byte, error) {
+	artifacts := selectArtifacts(result, kinds)
+	generated, err := generateArtifacts(buffer.NewBuffer(result.Video), result.Keyframes, kinds)
+	if err != nil {
+		return nil, err
+	}
+	for kind, data := range generated {
+		artifacts[kind] = data
+	}
+	return artifacts, nil
+}
+
+// generateArtifacts 按需由视频生成雪碧图、WebVTT和预览动图，每次生成前回到视频开头
+func generateArtifacts(video io.ReadSeeker, keyframes *ffmpegutil.KeyframeIndex, kinds []string) (map[string][]byte, error) {
+	artifacts := make(map[string][]byte)
+	// 雪碧图按需生成，同时生成对应的WebVTT
+	if slices.Contains(kinds, redis.ArtifactSprite) {
+		if _, err := video.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		sprite, err := ffmpegutil.SpriteSheet(video, keyframes, nil)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("生成雪碧图失败: %s", err))
+		}
+		artifacts[redis.ArtifactSprite] = sprite.Image
+		artifacts[redis.ArtifactThumbnails] = sprite.Vtt
+	}
+	// 预览动图按需生成
+	for _, kind := range []string{redis.ArtifactGif, redis.ArtifactWebp} {
+		if slices.Contains(kinds, kind) {
+			if _, err := video.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			preview, err := ffmpegutil.PreviewVideo(video, &ffmpegutil.PreviewOptions{Format: kind})
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("生成预览动图失败: %s", err))
+			}
+			artifacts[kind] = preview
+		}
+	}
+	return artifacts, nil
+}
+
+// selectArtifacts 按产物类型筛选抓取结果，kinds为空时返回全部产物
+func selectArtifacts(result *ffmpegutil.CaptureResult, kinds []string) map[string][]byte {
+	all := map[string][]byte{
+		redis.ArtifactVideo: result.Video,
+		redis.ArtifactAudio: result.Audio,
+		redis.ArtifactImage: result.Image,
+	}
+	if len(kinds) == 0 {
+		return all
+	}
+	artifacts := make(map[string][]byte, len(kinds))
+	for _, kind := range kinds {
+		if data, ok := all[kind]; ok {
+			artifacts[kind] = data
+		}
+	}
+	return artifacts
+}
@@ -0,0 +1,53 @@
+package cliputil
+
+import (
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{7, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := retryDelay(captureRetryDelay, captureMaxRetryDelay, test.attempts); got != test.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestSelectArtifacts(t *testing.T) {
+	result := &ffmpegutil.CaptureResult{Video: []byte("v"), Audio: []byte("a"), Image: []byte("i")}
+	tests := []struct {
+		kinds []string
+		want  []string
+	}{
+		{nil, []string{redis.ArtifactAudio, redis.ArtifactImage, redis.ArtifactVideo}},
+		{[]string{redis.ArtifactVideo}, []string{redis.ArtifactVideo}},
+		// 雪碧图等需要另外生成的产物不在抓取结果中
+		{[]string{redis.ArtifactImage, redis.ArtifactSprite}, []string{redis.ArtifactImage}},
+	}
+	for _, test := range tests {
+		artifacts := selectArtifacts(result, test.kinds)
+		var kinds []string
+		for _, kind := range []string{redis.ArtifactAudio, redis.ArtifactImage, redis.ArtifactVideo} {
+			if _, ok := artifacts[kind]; ok {
+				kinds = append(kinds, kind)
+			}
+		}
+		if !reflect.DeepEqual(kinds, test.want) || len(artifacts) != len(test.want) {
+			t.Errorf("selectArtifacts(%v) = %v, want %v", test.kinds, kinds, test.want)
+		}
+	}
+}
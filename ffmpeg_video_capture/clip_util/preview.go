@@ -0,0 +1,41 @@
+package cliputil
+
+import (
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"log"
+)
+
+// GeneratePreview 为已保存的片段生成预览动图，按格式作为gif或webp产物保存
+func GeneratePreview(redisClient *redis.RedisClient, id string, opts *ffmpegutil.PreviewOptions) (*redis.ClipMeta, error) {
+	if opts == nil {
+		opts = &ffmpegutil.PreviewOptions{}
+	}
+	kind := opts.Format
+	if kind == "" {
+		kind = ffmpegutil.PreviewGif
+	}
+	meta, err := redisClient.GetClip(id)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("获取片段元数据失败: %s", err))
+	}
+	if _, ok := meta.Artifacts[redis.ArtifactVideo]; !ok {
+		return nil, errors.New(fmt.Sprintf("片段没有视频数据，片段ID：%s", id))
+	}
+	videoReader, err := redisClient.OpenClipArtifact(id, redis.ArtifactVideo)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("获取片段视频数据失败，片段ID：%s，%s", id, err))
+	}
+	preview, err := ffmpegutil.PreviewVideo(videoReader, opts)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("生成预览动图失败: %s", err))
+	}
+	meta, err = redisClient.AddClipArtifacts(id, map[string][]byte{kind: preview})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("预览动图保存redis失败: %s", err))
+	}
+	log.Printf("预览动图生成成功，片段ID：%s，大小：%d字节", id, len(preview))
+	return meta, nil
+}
@@ -0,0 +1,38 @@
+package cliputil
+
+import (
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"log"
+)
+
+// GenerateSprite 为已保存的片段生成雪碧图和WebVTT，作为片段产物保存
+// 有关键帧索引时直接定位关键帧，视频数据按需从redis读取
+func GenerateSprite(redisClient *redis.RedisClient, id string, opts *ffmpegutil.SpriteOptions) (*redis.ClipMeta, error) {
+	meta, err := redisClient.GetClip(id)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("获取片段元数据失败: %s", err))
+	}
+	if _, ok := meta.Artifacts[redis.ArtifactVideo]; !ok {
+		return nil, errors.New(fmt.Sprintf("片段没有视频数据，片段ID：%s", id))
+	}
+	videoReader, err := redisClient.OpenClipArtifact(id, redis.ArtifactVideo)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("获取片段视频数据失败，片段ID：%s，%s", id, err))
+	}
+	sprite, err := ffmpegutil.SpriteSheet(videoReader, ClipKeyframes(meta), opts)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("生成雪碧图失败: %s", err))
+	}
+	meta, err = redisClient.AddClipArtifacts(id, map[string][]byte{
+		redis.ArtifactSprite:     sprite.Image,
+		redis.ArtifactThumbnails: sprite.Vtt,
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("雪碧图保存redis失败: %s", err))
+	}
+	log.Printf("雪碧图生成成功，片段ID：%s", id)
+	return meta, nil
+}
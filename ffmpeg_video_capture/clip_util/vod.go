@@ -0,0 +1,225 @@
+package cliputil
+
+import (
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	vodSourceTTL = time.Minute // 点播片段数据缓存时间，覆盖写入后最多这么久仍使用旧的索引和清单
+	vodSourceMax = 64          // 最多缓存的片段个数
+)
+
+// vodSource 缓存的点播片段关键帧索引和视频数据，同一片段的初始化切片和各个切片请求共用
+// 不必每次请求都读取片段元数据和分块清单，分块读取器缓存最近读取的分块
+type vodSource struct {
+	index   *ffmpegutil.KeyframeIndex
+	reader  *redis.ChunkReader
+	expires time.Time
+}
+
+var (
+	vodSourcesMutex sync.Mutex
+	vodSources      = make(map[string]*vodSource)
+)
+
+// VodPlaylist 生成摄像头[from, to]时间段内片段的HLS点播播放列表，不需要先拼接成一个mp4
+// clipUri返回片段的切片地址前缀，切片由VodInit和VodSegment按需重新封装
+func VodPlaylist(redisClient *redis.RedisClient, camera string, from, to time.Time, opts *ffmpegutil.VodOptions, clipUri func(id string) string) ([]byte, error) {
+	_, vodClips, err := findVodClips(redisClient, camera, from, to, clipUri)
+	if err != nil {
+		return nil, err
+	}
+	return ffmpegutil.VodPlaylist(vodClips, opts).Bytes(), nil
+}
+
+// VodManifest 生成摄像头[from, to]时间段内片段的DASH点播清单，与VodPlaylist共用切片
+// 每个片段需要读取mp4文件头获取编码信息
+func VodManifest(redisClient *redis.RedisClient, camera string, from, to time.Time, opts *ffmpegutil.VodOptions, clipUri func(id string) string) ([]byte, error) {
+	clips, vodClips, err := findVodClips(redisClient, camera, from, to, clipUri)
+	if err != nil {
+		return nil, err
+	}
+	for i, vodClip := range vodClips {
+		if err = vodClipMedia(redisClient, clips[i].ID, vodClip); err != nil {
+			return nil, err
+		}
+	}
+	return ffmpegutil.VodManifest(vodClips, opts).Bytes(), nil
+}
+
+// findVodClips 查找时间段内有视频数据的片段，返回片段元数据和对应的点播片段
+func findVodClips(redisClient *redis.RedisClient, camera string, from, to time.Time, clipUri func(id string) string) ([]*redis.ClipMeta, []*ffmpegutil.VodClip, error) {
+	clips, err := FindClips(redisClient, camera, from, to)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("查找片段失败: %s", err))
+	}
+	var videoClips []*redis.ClipMeta
+	var vodClips []*ffmpegutil.VodClip
+	for _, clip := range clips {
+		if _, ok := clip.Artifacts[redis.ArtifactVideo]; !ok {
+			continue
+		}
+		vodClip := vodClip(clip, clipUri(clip.ID))
+		// 片段开始时间早于from，跳过开头的切片
+		if clip.StartTime().Before(from) {
+			vodClip.Start = from.Sub(clip.StartTime())
+		}
+		// 片段结束时间晚于to，跳过结尾的切片
+		if clip.EndTime().After(to) {
+			vodClip.End = to.Sub(clip.StartTime())
+		}
+		videoClips = append(videoClips, clip)
+		vodClips = append(vodClips, vodClip)
+	}
+	if len(vodClips) == 0 {
+		return nil, nil, errors.New(fmt.Sprintf("时间段内无视频数据，摄像头：%s", camera))
+	}
+	return videoClips, vodClips, nil
+}
+
+// ClipVodPlaylist 生成单个片段的HLS点播播放列表，切片地址相对播放列表
+func ClipVodPlaylist(redisClient *redis.RedisClient, id string, opts *ffmpegutil.VodOptions) ([]byte, error) {
+	meta, err := getVideoClip(redisClient, id)
+	if err != nil {
+		return nil, err
+	}
+	return ffmpegutil.VodPlaylist([]*ffmpegutil.VodClip{vodClip(meta, "")}, opts).Bytes(), nil
+}
+
+// ClipVodManifest 生成单个片段的DASH点播清单，切片地址相对清单
+func ClipVodManifest(redisClient *redis.RedisClient, id string, opts *ffmpegutil.VodOptions) ([]byte, error) {
+	meta, err := getVideoClip(redisClient, id)
+	if err != nil {
+		return nil, err
+	}
+	clip := vodClip(meta, "")
+	if err = vodClipMedia(redisClient, id, clip); err != nil {
+		return nil, err
+	}
+	return ffmpegutil.VodManifest([]*ffmpegutil.VodClip{clip}, opts).Bytes(), nil
+}
+
+// VodInit 生成片段的fMP4初始化切片
+func VodInit(redisClient *redis.RedisClient, id string) ([]byte, error) {
+	_, videoReader, err := openVodSource(redisClient, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ffmpegutil.VodInit(videoReader)
+	if err != nil {
+		// 片段可能已被覆盖或删除，下次请求重新读取
+		dropVodSource(id)
+	}
+	return data, err
+}
+
+// VodSegment 按切片文件名重新封装片段中的fMP4切片，按需读取片段数据
+func VodSegment(redisClient *redis.RedisClient, id string, name string) ([]byte, error) {
+	first, last, err := ffmpegutil.ParseVodSegmentName(name)
+	if err != nil {
+		return nil, err
+	}
+	index, videoReader, err := openVodSource(redisClient, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ffmpegutil.VodSegment(videoReader, index, first, last)
+	if err != nil {
+		dropVodSource(id)
+	}
+	return data, err
+}
+
+// openVodSource 获取片段的关键帧索引和视频数据，优先使用缓存
+// 每次返回新的SectionReader，通过可并发调用的ReadAt读取，同一片段的请求可以并发处理
+func openVodSource(redisClient *redis.RedisClient, id string) (*ffmpegutil.KeyframeIndex, io.ReadSeeker, error) {
+	now := time.Now()
+	vodSourcesMutex.Lock()
+	source, ok := vodSources[id]
+	vodSourcesMutex.Unlock()
+	if !ok || now.After(source.expires) {
+		meta, err := getVideoClip(redisClient, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader, err := redisClient.OpenClipArtifact(id, redis.ArtifactVideo)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("获取片段视频数据失败，片段ID：%s，%s", id, err))
+		}
+		source = &vodSource{index: ClipKeyframes(meta), reader: reader, expires: now.Add(vodSourceTTL)}
+
+		vodSourcesMutex.Lock()
+		if len(vodSources) >= vodSourceMax {
+			for key, cached := range vodSources {
+				if now.After(cached.expires) {
+					delete(vodSources, key)
+				}
+			}
+			// 没有过期的片段时任意删除一个
+			for key := range vodSources {
+				if len(vodSources) < vodSourceMax {
+					break
+				}
+				delete(vodSources, key)
+			}
+		}
+		vodSources[id] = source
+		vodSourcesMutex.Unlock()
+	}
+	return source.index, io.NewSectionReader(source.reader, 0, source.reader.Size()), nil
+}
+
+// dropVodSource 删除片段的缓存
+func dropVodSource(id string) {
+	vodSourcesMutex.Lock()
+	defer vodSourcesMutex.Unlock()
+	delete(vodSources, id)
+}
+
+// getVideoClip 获取有视频数据的片段元数据
+func getVideoClip(redisClient *redis.RedisClient, id string) (*redis.ClipMeta, error) {
+	meta, err := redisClient.GetClip(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := meta.Artifacts[redis.ArtifactVideo]; !ok {
+		return nil, errors.New(fmt.Sprintf("片段没有视频数据，片段ID：%s", id))
+	}
+	return meta, nil
+}
+
+// vodClip 片段元数据转换为点播播放列表中的片段，码率按视频大小估算
+// 时长使用关键帧索引中记录的视频时长，抓取的墙钟时间包含打开输入等耗时，比视频长
+// 没有记录视频时长的旧片段使用元数据中的开始和结束时间
+func vodClip(meta *redis.ClipMeta, uri string) *ffmpegutil.VodClip {
+	clip := &ffmpegutil.VodClip{
+		Uri:       uri,
+		Duration:  meta.EndTime().Sub(meta.StartTime()),
+		Keyframes: ClipKeyframes(meta),
+	}
+	if clip.Keyframes != nil && clip.Keyframes.End > 0 {
+		clip.Duration = clip.Keyframes.Time(clip.Keyframes.End)
+	}
+	if clip.Duration > 0 {
+		clip.Bandwidth = int64(float64(meta.Artifacts[redis.ArtifactVideo]*8) / clip.Duration.Seconds())
+	}
+	return clip
+}
+
+// vodClipMedia 读取片段视频的编码信息，用于DASH清单
+func vodClipMedia(redisClient *redis.RedisClient, id string, clip *ffmpegutil.VodClip) error {
+	videoReader, err := redisClient.OpenClipArtifact(id, redis.ArtifactVideo)
+	if err != nil {
+		return errors.New(fmt.Sprintf("获取片段视频数据失败，片段ID：%s，%s", id, err))
+	}
+	if clip.Media, err = ffmpegutil.VodMedia(videoReader); err != nil {
+		return errors.New(fmt.Sprintf("读取片段编码信息失败，片段ID：%s，%s", id, err))
+	}
+	return nil
+}
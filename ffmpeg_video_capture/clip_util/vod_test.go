@@ -0,0 +1,24 @@
+package cliputil
+
+import (
+	redis "ffmpeg_video_capture/redis_util"
+	"testing"
+	"time"
+)
+
+func TestVodClipDuration(t *testing.T) {
+	meta := &redis.ClipMeta{
+		ID:        "cam:1",
+		Start:     1700000000000,
+		End:       1700000011000,
+		Artifacts: map[string]int64{redis.ArtifactVideo: 1000000},
+	}
+	// 没有记录视频时长时使用墙钟时间
+	if clip := vodClip(meta, ""); clip.Duration != 11*time.Second || clip.Bandwidth != 727272 {
+		t.Errorf("vodClip() Duration = %s, Bandwidth = %d", clip.Duration, clip.Bandwidth)
+	}
+	meta.Keyframes = &redis.KeyframeIndex{TimeBase: [2]int{1, 90000}, Keyframes: []redis.Keyframe{{Pts: 0}}, End: 900000}
+	if clip := vodClip(meta, "cam:1/"); clip.Duration != 10*time.Second || clip.Bandwidth != 800000 || clip.Uri != "cam:1/" {
+		t.Errorf("vodClip() Duration = %s, Bandwidth = %d", clip.Duration, clip.Bandwidth)
+	}
+}
@@ -0,0 +1,512 @@
+package configutil
+
+import (
+	"encoding/json"
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 输出类型
+const (
+	SinkClip     = "clip"     // 保存为片段并加入片段索引
+	SinkList     = "list"     // 推送到redis列表
+	SinkFile     = "file"     // 保存到本地目录
+	SinkRestream = "restream" // 转推到rtmp或rtsp地址
+)
+
+// Config 统一配置，支持yaml和json格式，字段名相同
+type Config struct {
+	Redis     *redis.RedisConf           `json:"redis"`
+	Cameras   map[string]*CameraConfig   `json:"cameras"`   // 摄像头名称 -> 摄像头配置
+	Policies  map[string]*ArtifactPolicy `json:"policies"`  // 产物策略名称 -> 产物策略
+	Retention *redis.RetentionConfig     `json:"retention"` // 保留策略
+	Sinks     map[string]*SinkConfig     `json:"sinks"`     // 输出名称 -> 输出配置
+	Http      *HttpConfig                `json:"http"`
+	Live      *LiveConfig                `json:"live"` // 直播输出
+	Rtsp      *RtspConfig                `json:"rtsp"` // 内置RTSP转发服务
+}
+
+// CameraConfig 摄像头配置
+type CameraConfig struct {
+	Url       string            `json:"url"`
+	Username  string            `json:"username"`  // 用户名，不为空时写入地址
+	Password  string            `json:"password"`  // 密码
+	Transport string            `json:"transport"` // rtsp传输方式，tcp或udp，默认tcp
+	Options   map[string]string `json:"options"`   // 其他ffmpeg输入参数
+	Policy    string            `json:"policy"`    // 产物策略名称，为空时使用default
+	Sinks     []string          `json:"sinks"`     // 输出名称，为空时保存为片段
+}
+
+// ArtifactPolicy 产物策略，决定抓取哪些产物以及片段时长
+type ArtifactPolicy struct {
+	Artifacts []string `json:"artifacts"` // 产物类型，为空时为全部产物
+	Segment   int64    `json:"segment"`   // 片段时长，单位秒
+}
+
+// SinkConfig 输出配置
+type SinkConfig struct {
+	Type      string            `json:"type"`      // clip、list、file或restream
+	Keys      map[string]string `json:"keys"`      // list类型：产物类型 -> 列表key
+	Dir       string            `json:"dir"`       // file类型：本地目录
+	Url       string            `json:"url"`       // restream类型：推流地址，{camera}替换为摄像头名称
+	Transcode bool              `json:"transcode"` // restream类型：视频转码为H.264，默认直接复制
+	Bitrate   int64             `json:"bitrate"`   // restream类型：转码码率，单位bit/s
+	Retry     int64             `json:"retry"`     // restream类型：断开后的重连间隔，单位秒，默认5
+	// Mp4 list和file类型：视频的mp4封装方式，默认moov在末尾
+	// faststart为moov在开头，浏览器下载到开头即可播放；fragmented为分片mp4，边抓取边写入
+	// clip类型总是分片mp4，只能为空或fragmented
+	Mp4 string `json:"mp4"`
+}
+
+// Restream 摄像头的一个转推输出
+type Restream struct {
+	Camera string
+	Sink   string
+	Url    string // 推流地址
+	Config *SinkConfig
+}
+
+// HttpConfig HTTP接口配置
+type HttpConfig struct {
+	Addr string `json:"addr"`
+}
+
+// LiveConfig 直播输出配置，HTTP接口按需拉流切片，没有请求一段时间后停止
+type LiveConfig struct {
+	Segment     int64        `json:"segment"`     // 切片时长，单位秒，默认2
+	ListSize    int          `json:"listSize"`    // 播放列表中的切片个数，默认6
+	SegmentType string       `json:"segmentType"` // 切片格式，mpegts或fmp4，默认mpegts
+	Idle        int64        `json:"idle"`        // 没有请求多久后停止拉流，单位秒，默认30
+	VodSegment  int64        `json:"vodSegment"`  // 片段点播播放列表的切片时长，单位秒，默认6
+	Fragment    int64        `json:"fragment"`    // WebSocket直播GOP内的分片时长，单位毫秒，默认0即每个GOP一个分片
+	Mjpeg       *MjpegConfig `json:"mjpeg"`       // MJPEG预览流
+}
+
+// MjpegConfig MJPEG预览流配置
+type MjpegConfig struct {
+	Fps     int `json:"fps"`     // 帧率，默认5，最大25
+	Width   int `json:"width"`   // 宽度，默认640
+	Quality int `json:"quality"` // jpg质量，1-100，默认75
+}
+
+// RtspConfig 内置RTSP转发服务配置，每个摄像头只拉一次流，转发给任意个RTSP客户端
+type RtspConfig struct {
+	Addr    string `json:"addr"`    // 监听地址，如:8554
+	UdpPort int    `json:"udpPort"` // UDP传输的RTP端口，RTCP为udpPort+1，默认8000，-1为只支持TCP
+	Idle    int64  `json:"idle"`    // 最后一个客户端断开后保持拉流的时间，单位秒，默认30
+	Proxy   bool   `json:"proxy"`   // api_server的抓取、直播等也通过转发服务拉流，与其他客户端共用摄像头连接
+}
+
+// DefaultPolicy 没有配置产物策略时使用的策略
+var DefaultPolicy = &ArtifactPolicy{Segment: 10}
+
+// Load 读取配置文件，按扩展名解析yaml或json，然后应用环境变量覆盖并校验
+func Load(path string) (*Config, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("配置文件读取失败: %s", err))
+	}
+	config, err := Parse(bytes, filepath.Ext(path))
+	if err != nil {
+		return nil, err
+	}
+	if err = config.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Parse 解析配置内容，ext为.yaml或.yml时按yaml解析，否则按json解析
+// yaml先转换为json再解析，两种格式共用json标签
+func Parse(bytes []byte, ext string) (*Config, error) {
+	if ext == ".yaml" || ext == ".yml" {
+		var value interface{}
+		if err := yaml.Unmarshal(bytes, &value); err != nil {
+			return nil, errors.New(fmt.Sprintf("yaml配置解析失败: %s", err))
+		}
+		var err error
+		if bytes, err = json.Marshal(value); err != nil {
+			return nil, errors.New(fmt.Sprintf("yaml配置转换失败: %s", err))
+		}
+	}
+	config := &Config{}
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, errors.New(fmt.Sprintf("配置解析失败: %s", err))
+	}
+	return config, nil
+}
+
+// ApplyEnv 使用环境变量覆盖配置，environ为KEY=VALUE格式
+//
+//	FFCAP_REDIS_HOST、FFCAP_REDIS_PASSWORD、FFCAP_REDIS_DB
+//	FFCAP_CAMERA_<摄像头>_URL、FFCAP_CAMERA_<摄像头>_USERNAME、FFCAP_CAMERA_<摄像头>_PASSWORD
+//	FFCAP_HTTP_ADDR
+//
+// 摄像头名称转为大写，'-'和'.'替换为'_'
+func (config *Config) ApplyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, item := range environ {
+		if key, value, ok := strings.Cut(item, "="); ok && strings.HasPrefix(key, "FFCAP_") {
+			env[key] = value
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+
+	_, hasHost := env["FFCAP_REDIS_HOST"]
+	_, hasPassword := env["FFCAP_REDIS_PASSWORD"]
+	_, hasDb := env["FFCAP_REDIS_DB"]
+	if config.Redis == nil && (hasHost || hasPassword || hasDb) {
+		config.Redis = &redis.RedisConf{MaxIdle: 30, MaxActive: 60, IdleTimeout: 30}
+	}
+	if value, ok := env["FFCAP_REDIS_HOST"]; ok {
+		config.Redis.Host = value
+	}
+	if value, ok := env["FFCAP_REDIS_PASSWORD"]; ok {
+		config.Redis.Password = value
+	}
+	if value, ok := env["FFCAP_REDIS_DB"]; ok {
+		db, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("环境变量FFCAP_REDIS_DB格式错误：%s", value))
+		}
+		config.Redis.Db = db
+	}
+	if value, ok := env["FFCAP_HTTP_ADDR"]; ok {
+		if config.Http == nil {
+			config.Http = &HttpConfig{}
+		}
+		config.Http.Addr = value
+	}
+	for name, camera := range config.Cameras {
+		if camera == nil {
+			continue
+		}
+		prefix := "FFCAP_CAMERA_" + envName(name) + "_"
+		if value, ok := env[prefix+"URL"]; ok {
+			camera.Url = value
+		}
+		if value, ok := env[prefix+"USERNAME"]; ok {
+			camera.Username = value
+		}
+		if value, ok := env[prefix+"PASSWORD"]; ok {
+			camera.Password = value
+		}
+	}
+	return nil
+}
+
+// envName 摄像头名称对应的环境变量名称
+func envName(name string) string {
+	return strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(name))
+}
+
+// Validate 校验配置，返回全部错误
+func (config *Config) Validate() error {
+	var errs []error
+	if config.Redis != nil && config.Redis.Host == "" {
+		errs = append(errs, errors.New("redis.host不能为空"))
+	}
+	for _, name := range sortedKeys(config.Cameras) {
+		camera := config.Cameras[name]
+		if camera == nil || camera.Url == "" {
+			errs = append(errs, errors.New(fmt.Sprintf("cameras.%s.url不能为空", name)))
+			continue
+		}
+		if _, err := neturl.Parse(camera.Url); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("cameras.%s.url格式错误: %s", name, err)))
+		}
+		if camera.Transport != "" && camera.Transport != "tcp" && camera.Transport != "udp" {
+			errs = append(errs, errors.New(fmt.Sprintf("cameras.%s.transport只能为tcp或udp", name)))
+		}
+		if camera.Policy != "" {
+			if _, ok := config.Policies[camera.Policy]; !ok {
+				errs = append(errs, errors.New(fmt.Sprintf("cameras.%s.policy未定义：%s", name, camera.Policy)))
+			}
+		}
+		for _, sink := range camera.Sinks {
+			if _, ok := config.Sinks[sink]; !ok {
+				errs = append(errs, errors.New(fmt.Sprintf("cameras.%s.sinks未定义：%s", name, sink)))
+			}
+		}
+	}
+	for _, name := range sortedKeys(config.Policies) {
+		policy := config.Policies[name]
+		if policy == nil {
+			continue
+		}
+		if policy.Segment < 0 {
+			errs = append(errs, errors.New(fmt.Sprintf("policies.%s.segment不能小于0", name)))
+		}
+		for _, kind := range policy.Artifacts {
+			if !validArtifact(kind) {
+				errs = append(errs, errors.New(fmt.Sprintf("policies.%s.artifacts不支持的产物类型：%s", name, kind)))
+			}
+		}
+	}
+	for _, name := range sortedKeys(config.Sinks) {
+		sink := config.Sinks[name]
+		if sink == nil {
+			errs = append(errs, errors.New(fmt.Sprintf("sinks.%s不能为空", name)))
+			continue
+		}
+		if _, err := ffmpegutil.ParseMp4Layout(sink.Mp4); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.mp4只能为end、faststart或fragmented：%s", name, sink.Mp4)))
+		}
+		switch sink.Type {
+		case SinkClip:
+			// 片段边抓取边分块写入redis，只能为分片mp4
+			if sink.Mp4 != "" && ffmpegutil.Mp4Layout(sink.Mp4) != ffmpegutil.Mp4LayoutFragmented {
+				errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.mp4只能为fragmented，片段总是保存为分片mp4：%s", name, sink.Mp4)))
+			}
+		case SinkList:
+			if len(sink.Keys) == 0 {
+				errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.keys不能为空", name)))
+			}
+			for kind := range sink.Keys {
+				if !validArtifact(kind) {
+					errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.keys不支持的产物类型：%s", name, kind)))
+				}
+			}
+		case SinkFile:
+			if sink.Dir == "" {
+				errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.dir不能为空", name)))
+			}
+		case SinkRestream:
+			if u, err := neturl.Parse(sink.Url); err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps" && u.Scheme != "rtsp" && u.Scheme != "rtsps") {
+				errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.url需为rtmp或rtsp地址", name)))
+			}
+			if sink.Bitrate < 0 || sink.Retry < 0 {
+				errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.bitrate和retry不能小于0", name)))
+			}
+		default:
+			errs = append(errs, errors.New(fmt.Sprintf("sinks.%s.type不支持：%s", name, sink.Type)))
+		}
+	}
+	if config.Retention != nil {
+		for kind, policy := range config.Retention.Default {
+			if policy != nil && (policy.MaxAge < 0 || policy.MaxCount < 0 || policy.MaxBytes < 0) {
+				errs = append(errs, errors.New(fmt.Sprintf("retention.default.%s不能小于0", kind)))
+			}
+		}
+		for camera := range config.Retention.Cameras {
+			if _, ok := config.Cameras[camera]; !ok {
+				errs = append(errs, errors.New(fmt.Sprintf("retention.cameras未定义的摄像头：%s", camera)))
+			}
+		}
+	}
+	if config.Live != nil {
+		if config.Live.Segment < 0 || config.Live.ListSize < 0 || config.Live.Idle < 0 || config.Live.VodSegment < 0 || config.Live.Fragment < 0 {
+			errs = append(errs, errors.New("live.segment、live.listSize、live.idle、live.vodSegment和live.fragment不能小于0"))
+		}
+		if config.Live.SegmentType != "" && config.Live.SegmentType != "mpegts" && config.Live.SegmentType != "fmp4" {
+			errs = append(errs, errors.New(fmt.Sprintf("live.segmentType只能为mpegts或fmp4：%s", config.Live.SegmentType)))
+		}
+		if mjpeg := config.Live.Mjpeg; mjpeg != nil && (mjpeg.Fps < 0 || mjpeg.Width < 0 || mjpeg.Quality < 0 || mjpeg.Quality > 100) {
+			errs = append(errs, errors.New("live.mjpeg.fps和width不能小于0，quality需在0-100之间"))
+		}
+	}
+	if config.Rtsp != nil {
+		if _, _, err := net.SplitHostPort(config.Rtsp.Addr); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("rtsp.addr格式错误: %s", err)))
+		}
+		if config.Rtsp.UdpPort < -1 || config.Rtsp.UdpPort > 65534 || config.Rtsp.Idle < 0 {
+			errs = append(errs, errors.New("rtsp.udpPort需在-1到65534之间，rtsp.idle不能小于0"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validArtifact 是否为支持的产物类型
+func validArtifact(kind string) bool {
+	switch kind {
+	case redis.ArtifactVideo, redis.ArtifactAudio, redis.ArtifactImage, redis.ArtifactSprite, redis.ArtifactThumbnails, redis.ArtifactGif, redis.ArtifactWebp:
+		return true
+	}
+	return false
+}
+
+// sortedKeys map的key排序，保证错误信息顺序稳定
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CameraUrls 摄像头名称 -> 带用户名密码的拉流地址
+func (config *Config) CameraUrls() map[string]string {
+	urls := make(map[string]string, len(config.Cameras))
+	for name, camera := range config.Cameras {
+		if camera != nil {
+			urls[name] = camera.InputUrl()
+		}
+	}
+	return urls
+}
+
+// InputOptions 拉流地址 -> 摄像头配置的ffmpeg输入参数，覆盖按协议的默认参数
+func (config *Config) InputOptions() map[string]map[string]string {
+	options := make(map[string]map[string]string, len(config.Cameras))
+	for _, camera := range config.Cameras {
+		if camera != nil {
+			options[camera.InputUrl()] = camera.InputOptions()
+		}
+	}
+	return options
+}
+
+// ProxyUrls 摄像头名称 -> 内置RTSP转发服务的拉流地址，未启用rtsp.proxy时与CameraUrls相同
+func (config *Config) ProxyUrls() map[string]string {
+	if config.Rtsp == nil || !config.Rtsp.Proxy {
+		return config.CameraUrls()
+	}
+	host, port, _ := net.SplitHostPort(config.Rtsp.Addr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	urls := make(map[string]string, len(config.Cameras))
+	for name, camera := range config.Cameras {
+		if camera != nil {
+			urls[name] = "rtsp://" + net.JoinHostPort(host, port) + "/" + neturl.PathEscape(name)
+		}
+	}
+	return urls
+}
+
+// Policy 摄像头的产物策略
+func (config *Config) Policy(camera string) *ArtifactPolicy {
+	name := "default"
+	if cameraConfig, ok := config.Cameras[camera]; ok && cameraConfig.Policy != "" {
+		name = cameraConfig.Policy
+	}
+	if policy, ok := config.Policies[name]; ok && policy != nil {
+		return policy
+	}
+	return DefaultPolicy
+}
+
+// Segment 摄像头产物策略的片段时长，单位秒，策略中没有配置时使用DefaultPolicy的时长
+func (config *Config) Segment(camera string) int64 {
+	if segment := config.Policy(camera).Segment; segment > 0 {
+		return segment
+	}
+	return DefaultPolicy.Segment
+}
+
+// CaptureSink 摄像头抓取结果的输出，即摄像头配置的第一个clip、list或file类型的输出，没有时返回nil，保存为片段
+func (config *Config) CaptureSink(camera string) *SinkConfig {
+	cameraConfig, ok := config.Cameras[camera]
+	if !ok || cameraConfig == nil {
+		return nil
+	}
+	for _, name := range cameraConfig.Sinks {
+		if sink := config.Sinks[name]; sink != nil && (sink.Type == SinkClip || sink.Type == SinkList || sink.Type == SinkFile) {
+			return sink
+		}
+	}
+	return nil
+}
+
+// ListKeys 第一个list类型输出的列表key，没有时返回旧的默认key
+func (config *Config) ListKeys() map[string]string {
+	for _, name := range sortedKeys(config.Sinks) {
+		if sink := config.Sinks[name]; sink != nil && sink.Type == SinkList {
+			return sink.Keys
+		}
+	}
+	return map[string]string{
+		redis.ArtifactVideo: "VideoData",
+		redis.ArtifactAudio: "AudioData",
+		redis.ArtifactImage: "ImageData",
+	}
+}
+
+// Mp4Layout 摄像头sinkType类型(list或file)输出的mp4封装方式，clip类型总是分片mp4，使用摄像头配置的第一个该类型的输出
+// 摄像头没有配置该类型的输出时为ffmpegutil.Mp4LayoutAuto，不使用其他摄像头的输出配置
+func (config *Config) Mp4Layout(camera, sinkType string) ffmpegutil.Mp4Layout {
+	if cameraConfig, ok := config.Cameras[camera]; ok && cameraConfig != nil {
+		for _, name := range cameraConfig.Sinks {
+			if sink := config.Sinks[name]; sink != nil && sink.Type == sinkType {
+				return ffmpegutil.Mp4Layout(sink.Mp4)
+			}
+		}
+	}
+	return ffmpegutil.Mp4LayoutAuto
+}
+
+// Mp4Layouts 每个摄像头sinkType类型输出的mp4封装方式，摄像头 -> 封装方式
+func (config *Config) Mp4Layouts(sinkType string) map[string]ffmpegutil.Mp4Layout {
+	layouts := make(map[string]ffmpegutil.Mp4Layout, len(config.Cameras))
+	for camera := range config.Cameras {
+		layouts[camera] = config.Mp4Layout(camera, sinkType)
+	}
+	return layouts
+}
+
+// Restreams 摄像头配置的全部restream类型输出，按摄像头和输出名称排序
+func (config *Config) Restreams() []*Restream {
+	var restreams []*Restream
+	for _, camera := range sortedKeys(config.Cameras) {
+		cameraConfig := config.Cameras[camera]
+		if cameraConfig == nil {
+			continue
+		}
+		for _, name := range cameraConfig.Sinks {
+			if sink := config.Sinks[name]; sink != nil && sink.Type == SinkRestream {
+				restreams = append(restreams, &Restream{
+					Camera: camera,
+					Sink:   name,
+					Url:    strings.ReplaceAll(sink.Url, "{camera}", camera),
+					Config: sink,
+				})
+			}
+		}
+	}
+	return restreams
+}
+
+// InputUrl 拉流地址，配置了用户名时写入地址
+func (camera *CameraConfig) InputUrl() string {
+	if camera.Username == "" {
+		return camera.Url
+	}
+	u, err := neturl.Parse(camera.Url)
+	if err != nil {
+		return camera.Url
+	}
+	u.User = neturl.UserPassword(camera.Username, camera.Password)
+	return u.String()
+}
+
+// InputOptions ffmpeg输入参数，包括传输方式
+func (camera *CameraConfig) InputOptions() map[string]string {
+	options := make(map[string]string, len(camera.Options)+1)
+	for key, value := range camera.Options {
+		options[key] = value
+	}
+	if strings.HasPrefix(camera.Url, "rtsp://") || strings.HasPrefix(camera.Url, "rtsps://") {
+		transport := camera.Transport
+		if transport == "" {
+			transport = "tcp"
+		}
+		options["rtsp_transport"] = transport
+	}
+	return options
+}
@@ -0,0 +1,199 @@
+package configutil
+
+import (
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExample(t *testing.T) {
+	config, err := Load(filepath.Join(".", "config.example.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Redis == nil || config.Redis.Host != "localhost:6379" {
+		t.Errorf("redis配置错误: %+v", config.Redis)
+	}
+	if camera := config.Cameras["camera1"]; camera == nil || camera.Transport != "tcp" || camera.Options["max_delay"] != "5000" {
+		t.Errorf("摄像头配置错误: %+v", camera)
+	}
+	if sink := config.Sinks["files"]; sink == nil || sink.Type != SinkFile || sink.Dir == "" {
+		t.Errorf("输出配置错误: %+v", sink)
+	}
+	// 转推到本机的流媒体服务不能与内置RTSP转发服务使用同一个端口
+	if sink := config.Sinks["mediamtx"]; sink == nil || config.Rtsp == nil || strings.Contains(sink.Url, "localhost"+config.Rtsp.Addr+"/") {
+		t.Errorf("转推地址与RTSP转发服务冲突: %+v, %+v", sink, config.Rtsp)
+	}
+}
+
+func TestParseJson(t *testing.T) {
+	config, err := Parse([]byte(`{"cameras": {"cam": {"url": "rtsp://host/1", "sinks": ["clips"]}}, "sinks": {"clips": {"type": "clip"}}}`), ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = config.Validate(); err != nil {
+		t.Errorf("Validate() = %s", err)
+	}
+	if _, err = Parse([]byte("cameras: [\n"), ".yaml"); err == nil {
+		t.Error("yaml格式错误时应返回错误")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	config := &Config{Cameras: map[string]*CameraConfig{"front-door.1": {Url: "rtsp://old"}}}
+	environ := []string{
+		"PATH=/usr/bin",
+		"FFCAP_REDIS_HOST=redis:6379",
+		"FFCAP_REDIS_DB=2",
+		"FFCAP_HTTP_ADDR=:9090",
+		"FFCAP_CAMERA_FRONT_DOOR_1_URL=rtsp://new",
+		"FFCAP_CAMERA_FRONT_DOOR_1_PASSWORD=a=b",
+	}
+	if err := config.ApplyEnv(environ); err != nil {
+		t.Fatal(err)
+	}
+	if config.Redis == nil || config.Redis.Host != "redis:6379" || config.Redis.Db != 2 || config.Redis.MaxActive == 0 {
+		t.Errorf("redis配置错误: %+v", config.Redis)
+	}
+	if config.Http == nil || config.Http.Addr != ":9090" {
+		t.Errorf("http配置错误: %+v", config.Http)
+	}
+	if camera := config.Cameras["front-door.1"]; camera.Url != "rtsp://new" || camera.Password != "a=b" {
+		t.Errorf("摄像头配置错误: %+v", camera)
+	}
+
+	if err := (&Config{}).ApplyEnv([]string{"FFCAP_REDIS_DB=x"}); err == nil {
+		t.Error("FFCAP_REDIS_DB格式错误时应返回错误")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		errs   []string
+	}{
+		{"空配置", &Config{}, nil},
+		{"摄像头", &Config{Cameras: map[string]*CameraConfig{
+			"a": {},
+			"b": {Url: "rtsp://host", Transport: "http", Policy: "none", Sinks: []string{"none"}},
+		}}, []string{"cameras.a.url不能为空", "cameras.b.transport只能为tcp或udp", "cameras.b.policy未定义：none", "cameras.b.sinks未定义：none"}},
+		{"产物策略", &Config{Policies: map[string]*ArtifactPolicy{
+			"p": {Segment: -1, Artifacts: []string{"video", "mp3"}},
+		}}, []string{"policies.p.segment不能小于0", "policies.p.artifacts不支持的产物类型：mp3"}},
+		{"输出", &Config{Sinks: map[string]*SinkConfig{
+			"a": {Type: SinkList},
+			"b": {Type: SinkFile, Mp4: "moov"},
+			"c": {Type: SinkRestream, Url: "http://host"},
+			"d": {Type: "s3"},
+			"e": nil,
+			"f": {Type: SinkClip, Mp4: "faststart"},
+		}}, []string{"sinks.a.keys不能为空", "sinks.b.mp4只能为end、faststart或fragmented：moov", "sinks.b.dir不能为空", "sinks.c.url需为rtmp或rtsp地址", "sinks.d.type不支持：s3", "sinks.e不能为空", "sinks.f.mp4只能为fragmented，片段总是保存为分片mp4：faststart"}},
+		{"直播和转发", &Config{
+			Live: &LiveConfig{Segment: -1, SegmentType: "webm"},
+			Rtsp: &RtspConfig{Addr: "8554", UdpPort: 65535},
+		}, []string{"live.segment", "live.segmentType只能为mpegts或fmp4：webm", "rtsp.addr格式错误", "rtsp.udpPort"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Errorf("Validate() = %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want %v", test.errs)
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(test.errs) {
+				t.Fatalf("Validate()返回%d个错误，应为%d个: %s", len(lines), len(test.errs), err)
+			}
+			for i, line := range lines {
+				if !strings.HasPrefix(line, test.errs[i]) {
+					t.Errorf("第%d个错误为%s，应为%s", i, line, test.errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &ArtifactPolicy{Artifacts: []string{"image"}, Segment: 30}
+	config := &Config{
+		Cameras: map[string]*CameraConfig{
+			"a": {Url: "rtsp://a", Policy: "images"},
+			"b": {Url: "rtsp://b"},
+			"c": {Url: "rtsp://c", Policy: "short"},
+		},
+		Policies: map[string]*ArtifactPolicy{"images": policy, "short": {}},
+	}
+	if got := config.Policy("a"); got != policy {
+		t.Errorf("Policy(a) = %+v", got)
+	}
+	if got := config.Policy("b"); got != DefaultPolicy {
+		t.Errorf("Policy(b) = %+v", got)
+	}
+	tests := map[string]int64{"a": 30, "b": DefaultPolicy.Segment, "c": DefaultPolicy.Segment}
+	for camera, want := range tests {
+		if got := config.Segment(camera); got != want {
+			t.Errorf("Segment(%s) = %d, want %d", camera, got, want)
+		}
+	}
+}
+
+func TestCaptureSink(t *testing.T) {
+	files := &SinkConfig{Type: SinkFile, Dir: "./captures"}
+	config := &Config{
+		Cameras: map[string]*CameraConfig{
+			"a": {Url: "rtsp://a", Sinks: []string{"push", "files"}},
+			"b": {Url: "rtsp://b", Sinks: []string{"push"}},
+		},
+		Sinks: map[string]*SinkConfig{
+			"push":  {Type: SinkRestream, Url: "rtmp://host/live/{camera}"},
+			"files": files,
+		},
+	}
+	if got := config.CaptureSink("a"); got != files {
+		t.Errorf("CaptureSink(a) = %+v", got)
+	}
+	for _, camera := range []string{"b", "none"} {
+		if got := config.CaptureSink(camera); got != nil {
+			t.Errorf("CaptureSink(%s) = %+v, want nil", camera, got)
+		}
+	}
+	restreams := config.Restreams()
+	want := []*Restream{{Camera: "a", Sink: "push", Url: "rtmp://host/live/a", Config: config.Sinks["push"]}, {Camera: "b", Sink: "push", Url: "rtmp://host/live/b", Config: config.Sinks["push"]}}
+	if !reflect.DeepEqual(restreams, want) {
+		t.Errorf("Restreams() = %+v", restreams)
+	}
+}
+
+func TestMp4Layout(t *testing.T) {
+	config := &Config{
+		Cameras: map[string]*CameraConfig{
+			"a": {Url: "rtsp://a", Sinks: []string{"clips", "fast"}},
+			"b": {Url: "rtsp://b", Sinks: []string{"fast"}},
+			"c": {Url: "rtsp://c", Sinks: []string{"push"}},
+		},
+		Sinks: map[string]*SinkConfig{
+			"clips": {Type: SinkClip, Mp4: "fragmented"},
+			"fast":  {Type: SinkFile, Dir: "./captures", Mp4: "faststart"},
+			"push":  {Type: SinkRestream, Url: "rtmp://host/live/{camera}"},
+		},
+	}
+	// 没有配置该类型输出的摄像头不使用其他摄像头的配置
+	want := map[string]ffmpegutil.Mp4Layout{"a": ffmpegutil.Mp4LayoutFragmented, "b": ffmpegutil.Mp4LayoutAuto, "c": ffmpegutil.Mp4LayoutAuto}
+	if got := config.Mp4Layouts(SinkClip); !reflect.DeepEqual(got, want) {
+		t.Errorf("Mp4Layouts(clip) = %v, want %v", got, want)
+	}
+	if got := config.Mp4Layout("b", SinkFile); got != ffmpegutil.Mp4LayoutFaststart {
+		t.Errorf("Mp4Layout(b, file) = %s", got)
+	}
+	if got := config.Mp4Layout("none", SinkFile); got != ffmpegutil.Mp4LayoutAuto {
+		t.Errorf("Mp4Layout(none, file) = %s", got)
+	}
+}
@@ -0,0 +1,80 @@
+package configutil
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Loader 加载配置文件，收到SIGHUP时重新加载
+// 重新加载失败(读取、解析或校验失败)时保留当前配置
+type Loader struct {
+	path     string
+	mutex    sync.RWMutex
+	config   *Config
+	onReload []func(config *Config)
+}
+
+// NewLoader 新建配置加载器并加载一次配置
+func NewLoader(path string) (*Loader, error) {
+	config, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Loader{path: path, config: config}, nil
+}
+
+// Config 当前配置，调用方不应修改返回的配置
+func (loader *Loader) Config() *Config {
+	loader.mutex.RLock()
+	defer loader.mutex.RUnlock()
+	return loader.config
+}
+
+// OnReload 注册重新加载成功后的回调，回调按注册顺序执行
+func (loader *Loader) OnReload(callback func(config *Config)) {
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+	loader.onReload = append(loader.onReload, callback)
+}
+
+// Reload 重新加载配置，成功后执行回调
+func (loader *Loader) Reload() error {
+	config, err := Load(loader.path)
+	if err != nil {
+		return err
+	}
+	loader.mutex.Lock()
+	loader.config = config
+	callbacks := append([]func(config *Config){}, loader.onReload...)
+	loader.mutex.Unlock()
+
+	for _, callback := range callbacks {
+		callback(config)
+	}
+	return nil
+}
+
+// WatchSignal 收到SIGHUP时重新加载配置，直到ctx被取消
+func (loader *Loader) WatchSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				if err := loader.Reload(); err != nil {
+					log.Printf("重新加载配置失败，继续使用当前配置: %s", err)
+					continue
+				}
+				log.Printf("配置已重新加载：%s", loader.path)
+			}
+		}
+	}()
+}
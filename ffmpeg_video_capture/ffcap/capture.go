@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	cliputil "ffmpeg_video_capture/clip_util"
+	configutil "ffmpeg_video_capture/config_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runCapture 抓取一段视频、音频和图片
+// 指定-o时保存到本地目录，指定-lists时推送到redis列表，否则按摄像头配置的输出保存，没有配置输出时保存为片段并加入片段索引
+func runCapture(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("capture")
+	seconds := fs.Int("seconds", 5, "抓取时长，单位秒")
+	output := fs.String("o", "", "保存到本地目录，文件名为video.mp4、audio.wav和image.jpg")
+	lists := fs.Bool("lists", false, "推送到配置文件中第一个list类型输出的redis列表，而不是按摄像头配置的输出保存")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *seconds <= 0 {
+		return newUsageError("-seconds必须大于0")
+	}
+	input, err := e.input()
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		return captureToDir(ctx, input, time.Duration(*seconds), *output, e.mp4Layout(configutil.SinkFile))
+	}
+
+	sink := e.captureSink(*lists)
+	var redisClient *redis.RedisClient
+	if sink.Type != configutil.SinkFile {
+		if redisClient, err = e.redisClient(); err != nil {
+			return err
+		}
+	}
+	if sink.Type == configutil.SinkClip {
+		// 保存为片段时边抓取边分块写入redis
+		meta, err := cliputil.CaptureInputAndIndex(ctx, redisClient, e.camera, input, time.Duration(*seconds), e.config.Policy(e.camera).Artifacts)
+		if err != nil {
+			return err
+		}
+		fmt.Println(meta.ID)
+		return nil
+	}
+	result, err := ffmpegutil.CaptureLayout(ctx, input, time.Duration(*seconds), ffmpegutil.Mp4Layout(sink.Mp4))
+	if err != nil {
+		return err
+	}
+	return e.saveResult(redisClient, sink, result)
+}
+
+// captureSink 抓取结果的输出，lists为true时为第一个list类型的输出，否则为摄像头配置的输出，没有配置时保存为片段
+func (e *env) captureSink(lists bool) *configutil.SinkConfig {
+	if lists {
+		return &configutil.SinkConfig{Type: configutil.SinkList, Keys: e.config.ListKeys(), Mp4: string(e.mp4Layout(configutil.SinkList))}
+	}
+	if sink := e.config.CaptureSink(e.camera); sink != nil {
+		return sink
+	}
+	return &configutil.SinkConfig{Type: configutil.SinkClip}
+}
+
+// saveResult 抓取结果中摄像头产物策略的产物保存到list或file类型的sink，clip类型边抓取边保存，不经过抓取结果
+// list类型推送到对应的列表，file类型保存到目录，文件名为<摄像头>_<开始时间>_<产物类型>
+func (e *env) saveResult(redisClient *redis.RedisClient, sink *configutil.SinkConfig, result *ffmpegutil.CaptureResult) error {
+	artifacts, err := cliputil.CaptureArtifacts(result, e.config.Policy(e.camera).Artifacts)
+	if err != nil {
+		return err
+	}
+	if sink.Type == configutil.SinkFile {
+		if err = os.MkdirAll(sink.Dir, 0755); err != nil {
+			return errors.New(fmt.Sprintf("创建目录失败，目录：%s，%s", sink.Dir, err))
+		}
+		for kind, data := range artifacts {
+			if err = saveFile(data, filepath.Join(sink.Dir, artifactFileName(e.camera, result.StartTime.UnixMilli(), kind))); err != nil {
+				return err
+			}
+		}
+		log.Printf("抓取结果已保存到%s", sink.Dir)
+		return nil
+	}
+	for kind, key := range sink.Keys {
+		data, ok := artifacts[kind]
+		if !ok {
+			continue
+		}
+		if err = redisClient.Push(key, data); err != nil {
+			return errors.New(fmt.Sprintf("数据推送redis失败，key：%s，%s", key, err))
+		}
+	}
+	log.Println("抓取结果推送redis成功")
+	return nil
+}
+
+// captureToDir 抓取结果保存到本地目录，视频和音频边抓取边写入文件，layout为空时视频为faststart
+func captureToDir(ctx context.Context, input *ffmpegutil.Input, seconds time.Duration, dir string, layout ffmpegutil.Mp4Layout) error {
+	videoFile, err := createFile(filepath.Join(dir, "video.mp4"))
+	if err != nil {
+		return err
+	}
+	audioFile, err := createFile(filepath.Join(dir, "audio.wav"))
+	if err != nil {
+		return closeFile(videoFile, err)
+	}
+	result, err := ffmpegutil.CaptureTo(ctx, input, seconds, &ffmpegutil.CaptureOutput{Video: videoFile, Audio: audioFile, Layout: layout})
+	err = closeFile(videoFile, err)
+	if err = closeFile(audioFile, err); err != nil {
+		return err
+	}
+	if err = saveFile(result.Image, filepath.Join(dir, "image.jpg")); err != nil {
+		return err
+	}
+	log.Printf("抓取结果已保存到%s", dir)
+	return nil
+}
+
+// runSnapshot 抓取一张图片
+func runSnapshot(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("snapshot")
+	output := fs.String("o", "snapshot.jpg", "输出文件")
+	width := fs.Int("width", 0, "输出宽度，为0时使用原始宽度")
+	height := fs.Int("height", 0, "输出高度，为0时使用原始高度")
+	quality := fs.Int("quality", 0, "jpg质量(1-100)，为0时使用默认质量")
+	timeout := fs.Duration("timeout", 10*time.Second, "超时时间")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *quality < 0 || *quality > 100 {
+		return newUsageError("-quality必须在1到100之间")
+	}
+	input, err := e.input()
+	if err != nil {
+		return err
+	}
+	image, err := ffmpegutil.SnapshotInput(ctx, input, &ffmpegutil.SnapshotOptions{
+		Width:   *width,
+		Height:  *height,
+		Quality: *quality,
+		Timeout: *timeout,
+	})
+	if err != nil {
+		return err
+	}
+	return saveFile(image, *output)
+}
+
+// runRecord 持续录制，每段按摄像头配置的输出保存，没有配置输出时保存为片段并加入片段索引，直到收到退出信号或达到片段个数
+// 输入只打开一次，在关键帧处切分片段，输入中断时等待retry-delay后重新打开
+func runRecord(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("record")
+	segment := fs.Int("segment", 0, "每个片段的时长，单位秒，为0时使用摄像头产物策略的片段时长，默认10秒")
+	count := fs.Int("count", 0, "录制的片段个数，为0时一直录制")
+	retryDelay := fs.Duration("retry-delay", 5*time.Second, "录制中断后的重试间隔")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *segment < 0 {
+		return newUsageError("-segment不能小于0")
+	}
+	if *segment == 0 {
+		*segment = int(e.config.Segment(e.camera))
+	}
+	url, err := e.inputUrl()
+	if err != nil {
+		return err
+	}
+	sink := e.captureSink(false)
+	var redisClient *redis.RedisClient
+	if sink.Type != configutil.SinkFile {
+		if redisClient, err = e.redisClient(); err != nil {
+			return err
+		}
+	}
+
+	errRecordDone := errors.New("已录制指定个数的片段")
+	recorded := 0
+	// 保存一段后计数，达到片段个数时结束录制
+	onRecorded := func() error {
+		recorded++
+		if *count > 0 && recorded >= *count {
+			return errRecordDone
+		}
+		return nil
+	}
+	for {
+		if sink.Type == configutil.SinkClip {
+			// 保存为片段时每段边录制边分块写入redis，保存失败只丢弃这一段
+			err = cliputil.RecordAndIndex(ctx, redisClient, e.camera, ffmpegutil.UrlInput(url), time.Duration(*segment)*time.Second, e.config.Policy(e.camera).Artifacts, func(meta *redis.ClipMeta) error {
+				fmt.Println(meta.ID)
+				return onRecorded()
+			})
+		} else {
+			err = ffmpegutil.RecordSegments(ctx, ffmpegutil.UrlInput(url), time.Duration(*segment)*time.Second, ffmpegutil.Mp4Layout(sink.Mp4), func(result *ffmpegutil.CaptureResult) error {
+				if err := e.saveResult(redisClient, sink, result); err != nil {
+					// 保存失败只丢弃这一段，不中断录制
+					log.Printf("保存片段失败: %s", err)
+					return nil
+				}
+				return onRecorded()
+			})
+		}
+		if ctx.Err() != nil || errors.Is(err, errRecordDone) {
+			// 收到退出信号或达到片段个数，正常结束
+			return nil
+		}
+		if err == nil {
+			err = errors.New("输入已结束")
+		}
+		log.Printf("录制中断，%s后重试: %s", *retryDelay, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*retryDelay):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	configutil "ffmpeg_video_capture/config_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// env 子命令的公共参数和配置
+type env struct {
+	configPath string
+	camera     string
+	url        string
+	format     string
+	config     *configutil.Config
+}
+
+// newFlagSet 新建子命令的参数集合，包含公共参数
+func newFlagSet(name string) (*flag.FlagSet, *env) {
+	fs := flag.NewFlagSet("ffcap "+name, flag.ContinueOnError)
+	e := &env{}
+	fs.StringVar(&e.configPath, "config", os.Getenv("FFCAP_CONFIG"), "配置文件路径(yaml或json)，默认为环境变量FFCAP_CONFIG")
+	fs.StringVar(&e.camera, "camera", "camera1", "摄像头名称")
+	fs.StringVar(&e.url, "url", "", "拉流地址，为空时使用配置文件中摄像头的地址，capture、snapshot和probe为-时从标准输入读取")
+	fs.StringVar(&e.format, "format", "", "输入格式提示(如mp4、flv、mpegts)，为空时自动探测")
+	return fs, e
+}
+
+// parse 解析参数并加载配置文件，没有配置文件时只应用环境变量
+func (e *env) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{message: err.Error()}
+	}
+	if e.configPath == "" {
+		e.config = &configutil.Config{}
+		return e.config.ApplyEnv(os.Environ())
+	}
+	config, err := configutil.Load(e.configPath)
+	if err != nil {
+		return err
+	}
+	e.config = config
+	// 摄像头配置的输入参数(options和transport)
+	ffmpegutil.SetInputOptions(config.InputOptions())
+	return nil
+}
+
+// inputUrl 输入地址，优先使用-url参数
+func (e *env) inputUrl() (string, error) {
+	if e.url == "-" {
+		return "", newUsageError("该命令不支持从标准输入读取")
+	}
+	if e.url != "" {
+		return e.url, nil
+	}
+	if camera, ok := e.config.Cameras[e.camera]; ok && camera != nil {
+		return camera.InputUrl(), nil
+	}
+	return "", newUsageError("未指定-url，配置文件中也没有摄像头%s的地址", e.camera)
+}
+
+// input 输入源，-url为-时从标准输入读取，数据只能顺序读取
+func (e *env) input() (*ffmpegutil.Input, error) {
+	if e.url == "-" {
+		return ffmpegutil.ReaderInput(os.Stdin, e.format), nil
+	}
+	url, err := e.inputUrl()
+	if err != nil {
+		return nil, err
+	}
+	return &ffmpegutil.Input{Url: url, Format: e.format}, nil
+}
+
+// mp4Layout 摄像头sinkType类型输出配置的mp4封装方式
+func (e *env) mp4Layout(sinkType string) ffmpegutil.Mp4Layout {
+	return e.config.Mp4Layout(e.camera, sinkType)
+}
+
+// redisClient 新建redis客户端，配置文件中没有redis配置时使用默认配置
+func (e *env) redisClient() (*redis.RedisClient, error) {
+	if e.config.Redis != nil && e.config.Redis.Host != "" {
+		return redis.NewClient(e.config.Redis)
+	}
+	client, err := redis.DefaultClient()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("初始化redis连接池失败: %s", err))
+	}
+	return client, nil
+}
+
+// createFile 新建输出文件，path为-时输出到标准输出
+func createFile(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("创建文件失败，文件名：%s，%s", path, err))
+	}
+	return file, nil
+}
+
+// closeFile 关闭输出文件，写入失败时删除不完整的文件
+func closeFile(file *os.File, err error) error {
+	if file == os.Stdout {
+		return err
+	}
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = errors.New(fmt.Sprintf("写入文件失败，文件名：%s，%s", file.Name(), closeErr))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// saveFile 保存数据到本地文件
+func saveFile(data []byte, path string) error {
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return errors.New(fmt.Sprintf("写入文件失败，文件名：%s，%s", path, err))
+	}
+	return nil
+}
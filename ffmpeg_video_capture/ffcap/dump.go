@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// 产物类型对应的文件扩展名
+var artifactExtensions = map[string]string{
+	redis.ArtifactVideo: ".mp4",
+	redis.ArtifactAudio: ".wav",
+	redis.ArtifactImage: ".jpg",
+
+	redis.ArtifactSprite:     ".jpg",
+	redis.ArtifactThumbnails: ".vtt",
+	redis.ArtifactGif:        ".gif",
+	redis.ArtifactWebp:       ".webp",
+}
+
+// artifactFileName 产物保存到本地时的文件名，start为开始时间的毫秒时间戳
+func artifactFileName(camera string, start int64, kind string) string {
+	return fmt.Sprintf("%s_%d_%s%s", camera, start, kind, artifactExtensions[kind])
+}
+
+// runDump 将redis中的数据保存到本地
+// 指定-clip时保存片段的全部产物，否则保存list类型输出中各列表的全部元素
+func runDump(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("dump")
+	clipID := fs.String("clip", "", "片段ID")
+	output := fs.String("o", ".", "输出目录")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	redisClient, err := e.redisClient()
+	if err != nil {
+		return err
+	}
+
+	if *clipID != "" {
+		meta, err := redisClient.GetClip(*clipID)
+		if err != nil {
+			return errors.New(fmt.Sprintf("获取片段元数据失败: %s", err))
+		}
+		for kind := range meta.Artifacts {
+			data, err := redisClient.GetClipArtifact(meta.ID, kind)
+			if err != nil {
+				return errors.New(fmt.Sprintf("获取片段产物失败，类型：%s，%s", kind, err))
+			}
+			if err = saveFile(data, filepath.Join(*output, artifactFileName(meta.Camera, meta.Start, kind))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for kind, key := range e.config.ListKeys() {
+		dataList, err := redisClient.GetAllElements(key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("获取数据出错，key：%s，%s", key, err))
+		}
+		log.Printf("%s获取到%d条数据", key, len(dataList))
+		for i, data := range dataList {
+			if err = saveFile(data.([]byte), filepath.Join(*output, fmt.Sprintf("output%d%s", i, artifactExtensions[kind]))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
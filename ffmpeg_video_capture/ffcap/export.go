@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	cliputil "ffmpeg_video_capture/clip_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	redis "ffmpeg_video_capture/redis_util"
+	"fmt"
+	"log"
+	"os"
+)
+
+// runConcat 拼接视频，指定文件时拼接本地文件，否则拼接redis列表中的全部视频
+func runConcat(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("concat")
+	key := fs.String("key", "", "redis视频列表的key，为空时使用配置文件中list类型输出的视频列表")
+	output := fs.String("o", "output.mp4", "输出文件，为-时以分片mp4输出到标准输出")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: ffcap concat [参数] [本地mp4文件...]")
+		fs.PrintDefaults()
+	}
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	var videoList [][]byte
+	if fs.NArg() > 0 {
+		for _, path := range fs.Args() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return errors.New(fmt.Sprintf("读取文件失败: %s", err))
+			}
+			videoList = append(videoList, data)
+		}
+	} else {
+		if *key == "" {
+			*key = e.config.ListKeys()[redis.ArtifactVideo]
+		}
+		redisClient, err := e.redisClient()
+		if err != nil {
+			return err
+		}
+		dataList, err := redisClient.GetAllElements(*key)
+		if err != nil {
+			return errors.New(fmt.Sprintf("获取视频数据出错: %s", err))
+		}
+		for _, videoData := range dataList {
+			videoList = append(videoList, videoData.([]byte))
+		}
+	}
+	if len(videoList) == 0 {
+		return errors.New("无视频数据")
+	}
+	log.Printf("获取到%d条视频数据", len(videoList))
+
+	segments := make([]*ffmpegutil.ConcatSegment, 0, len(videoList))
+	for _, videoBytes := range videoList {
+		segments = append(segments, &ffmpegutil.ConcatSegment{Data: videoBytes})
+	}
+	file, err := createFile(*output)
+	if err != nil {
+		return err
+	}
+	return closeFile(file, ffmpegutil.ConcatSegmentsTo(file, segments, nil))
+}
+
+// runExport 按时间段导出摄像头的视频
+func runExport(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("export")
+	from := fs.String("from", "", "开始时间，毫秒时间戳或RFC3339时间")
+	to := fs.String("to", "", "结束时间，毫秒时间戳或RFC3339时间")
+	exactCut := fs.Bool("exact", false, "精确剪切，首尾被剪开的GOP重新编码")
+	output := fs.String("o", "export.mp4", "输出文件，为-时以分片mp4输出到标准输出")
+	mp4 := fs.String("mp4", "", "mp4封装方式，end、faststart或fragmented，为空时输出到文件为faststart")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	layout, err := ffmpegutil.ParseMp4Layout(*mp4)
+	if err != nil {
+		return newUsageError("-mp4 %s", err)
+	}
+	fromTime, err := cliputil.ParseTime(*from)
+	if err != nil {
+		return newUsageError("-from %s", err)
+	}
+	toTime, err := cliputil.ParseTime(*to)
+	if err != nil {
+		return newUsageError("-to %s", err)
+	}
+	if !fromTime.Before(toTime) {
+		return newUsageError("开始时间必须早于结束时间")
+	}
+	redisClient, err := e.redisClient()
+	if err != nil {
+		return err
+	}
+	// 边拼接边写入文件，导出时长较长时也不占用大量内存
+	file, err := createFile(*output)
+	if err != nil {
+		return err
+	}
+	err = cliputil.ExportRangeTo(file, redisClient, e.camera, fromTime, toTime, &cliputil.ExportOptions{ExactCut: *exactCut, Layout: layout})
+	return closeFile(file, err)
+}
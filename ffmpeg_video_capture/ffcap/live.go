@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"log"
+)
+
+// runHls 拉流并输出直播HLS到本地目录，直到收到退出信号
+func runHls(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("hls")
+	output := fs.String("o", "hls", "输出目录，播放列表为index.m3u8，fmp4切片时DASH清单为manifest.mpd")
+	segment := fs.Duration("segment", 0, "目标切片时长，为0时为2秒")
+	listSize := fs.Int("list-size", 0, "播放列表中的切片个数，为0时为6")
+	segmentType := fs.String("type", ffmpegutil.SegmentTs, "切片格式，mpegts或fmp4")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *segmentType != ffmpegutil.SegmentTs && *segmentType != ffmpegutil.SegmentFmp4 {
+		return newUsageError("-type只能为mpegts或fmp4")
+	}
+	url, err := e.inputUrl()
+	if err != nil {
+		return err
+	}
+	store, err := ffmpegutil.NewDirStore(*output)
+	if err != nil {
+		return err
+	}
+
+	hls := ffmpegutil.NewLiveHls(store, &ffmpegutil.HlsOptions{
+		SegmentDuration: *segment,
+		ListSize:        *listSize,
+		SegmentType:     *segmentType,
+	})
+	log.Printf("开始输出直播HLS，目录：%s", *output)
+	return hls.Run(ctx, url)
+}
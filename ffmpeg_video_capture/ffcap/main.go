@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// 退出码
+const (
+	exitOK    = 0 // 成功
+	exitError = 1 // 执行失败
+	exitUsage = 2 // 参数错误
+)
+
+// command 子命令
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []*command{
+	{"capture", "抓取一段视频、音频和图片", runCapture},
+	{"snapshot", "抓取一张图片", runSnapshot},
+	{"record", "持续录制，按时长切分片段并加入片段索引", runRecord},
+	{"concat", "拼接redis列表或本地文件中的视频", runConcat},
+	{"export", "按时间段导出摄像头的视频", runExport},
+	{"probe", "查看输入的流信息", runProbe},
+	{"sprite", "生成片段或本地视频的雪碧图和WebVTT", runSprite},
+	{"preview", "生成片段、本地视频或直播的预览动图(gif/webp)", runPreview},
+	{"hls", "拉流并输出直播HLS(fmp4时同时输出DASH)到本地目录", runHls},
+	{"vod", "提供本地目录中mp4视频的HLS和DASH点播", runVod},
+	{"restream", "拉流并转推到rtmp或rtsp地址，断开后自动重连", runRestream},
+	{"rtsp", "RTSP转发服务，每个摄像头只拉一次流，转发给任意个客户端", runRtsp},
+	{"dump", "将redis中的列表或片段产物保存到本地", runDump},
+}
+
+// usageError 参数错误，退出码为exitUsage
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func newUsageError(format string, args ...interface{}) error {
+	return &usageError{message: fmt.Sprintf(format, args...)}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run 执行子命令，返回退出码
+func run(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		printUsage()
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+	var cmd *command
+	for _, c := range commands {
+		if c.name == args[0] {
+			cmd = c
+			break
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "未知的子命令：%s\n\n", args[0])
+		printUsage()
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.run(ctx, args[1:])
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "ffcap %s: %s\n", cmd.name, err)
+	var usageErr *usageError
+	if errors.As(err, &usageErr) {
+		return exitUsage
+	}
+	return exitError
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "用法: ffcap <子命令> [参数]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "子命令:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "使用 ffcap <子命令> -h 查看子命令的参数")
+}
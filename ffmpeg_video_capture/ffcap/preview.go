@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	cliputil "ffmpeg_video_capture/clip_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// runSprite 生成雪碧图和WebVTT
+// 指定-clip时为redis中的片段生成并作为片段产物保存，否则为本地mp4文件生成并保存到-o目录
+func runSprite(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("sprite")
+	clipID := fs.String("clip", "", "片段ID")
+	output := fs.String("o", ".", "本地文件的输出目录，文件名为sprite.jpg和thumbnails.vtt")
+	width := fs.Int("width", 0, "缩略图宽度，为0时为160")
+	columns := fs.Int("columns", 0, "每行缩略图个数，为0时为10")
+	interval := fs.Duration("interval", 0, "缩略图最小间隔，为0时每个关键帧一张")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: ffcap sprite [参数] [本地mp4文件]")
+		fs.PrintDefaults()
+	}
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	options := &ffmpegutil.SpriteOptions{Width: *width, Columns: *columns, Interval: *interval}
+
+	if *clipID != "" {
+		redisClient, err := e.redisClient()
+		if err != nil {
+			return err
+		}
+		_, err = cliputil.GenerateSprite(redisClient, *clipID, options)
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return newUsageError("需要指定-clip或一个本地mp4文件")
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return errors.New(fmt.Sprintf("读取文件失败: %s", err))
+	}
+	defer file.Close()
+	options.ImageUrl = "sprite.jpg"
+	sprite, err := ffmpegutil.SpriteSheet(file, nil, options)
+	if err != nil {
+		return err
+	}
+	if err = saveFile(sprite.Image, filepath.Join(*output, "sprite.jpg")); err != nil {
+		return err
+	}
+	return saveFile(sprite.Vtt, filepath.Join(*output, "thumbnails.vtt"))
+}
+
+// runPreview 生成预览动图
+// 指定-clip时为redis中的片段生成并作为片段产物保存，指定本地mp4文件时为文件生成，否则从直播输入生成
+func runPreview(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("preview")
+	clipID := fs.String("clip", "", "片段ID")
+	output := fs.String("o", "", "输出文件，为空时为preview.gif或preview.webp")
+	format := fs.String("format", ffmpegutil.PreviewGif, "格式，gif或webp")
+	width := fs.Int("width", 0, "宽度，为0时为320")
+	fps := fs.Int("fps", 0, "帧率，为0时为5")
+	start := fs.Duration("start", 0, "视频中的起始时间，只对片段和本地文件有效")
+	duration := fs.Duration("duration", 0, "时长，为0时为5秒")
+	maxBytes := fs.Int("max-bytes", 0, "最大字节数，为0时不限制")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: ffcap preview [参数] [本地mp4文件]")
+		fs.PrintDefaults()
+	}
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *format != ffmpegutil.PreviewGif && *format != ffmpegutil.PreviewWebp {
+		return newUsageError("-format只能为gif或webp")
+	}
+	if *output == "" {
+		*output = "preview." + *format
+	}
+	options := &ffmpegutil.PreviewOptions{
+		Format:   *format,
+		Width:    *width,
+		Fps:      *fps,
+		Start:    *start,
+		Duration: *duration,
+		MaxBytes: *maxBytes,
+	}
+
+	if *clipID != "" {
+		redisClient, err := e.redisClient()
+		if err != nil {
+			return err
+		}
+		_, err = cliputil.GeneratePreview(redisClient, *clipID, options)
+		return err
+	}
+
+	var preview []byte
+	if fs.NArg() > 0 {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return errors.New(fmt.Sprintf("读取文件失败: %s", err))
+		}
+		defer file.Close()
+		if preview, err = ffmpegutil.PreviewVideo(file, options); err != nil {
+			return err
+		}
+	} else {
+		url, err := e.inputUrl()
+		if err != nil {
+			return err
+		}
+		if preview, err = ffmpegutil.Preview(ctx, url, options); err != nil {
+			return err
+		}
+	}
+	return saveFile(preview, *output)
+}
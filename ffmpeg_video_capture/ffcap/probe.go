@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"os"
+	"time"
+)
+
+// runProbe 探测输入，输出json格式的流信息
+func runProbe(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("probe")
+	duration := fs.Duration("duration", 5*time.Second, "统计GOP、帧率和码率读取的时长")
+	timeout := fs.Duration("timeout", 0, "超时时间，为0时为统计时长加10秒")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *duration <= 0 {
+		return newUsageError("-duration必须大于0")
+	}
+	input, err := e.input()
+	if err != nil {
+		return err
+	}
+
+	report, err := ffmpegutil.ProbeInput(ctx, input, &ffmpegutil.ProbeOptions{Duration: *duration, Timeout: *timeout})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
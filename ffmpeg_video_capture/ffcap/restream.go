@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"log"
+)
+
+// runRestream 拉流并转推到rtmp或rtsp地址，断开后自动重连，直到收到退出信号
+func runRestream(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("restream")
+	output := fs.String("o", "", "推流地址，rtmp://使用flv封装，rtsp://使用rtsp封装")
+	transcode := fs.Bool("transcode", false, "视频转码为H.264，默认直接复制")
+	bitrate := fs.Int64("bitrate", 0, "转码码率，单位bit/s，为0时使用编码器默认码率")
+	retry := fs.Duration("retry", 0, "断开后的重连间隔，为0时为5秒")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	if *output == "" {
+		return newUsageError("未指定推流地址-o")
+	}
+	if _, err := ffmpegutil.RestreamFormat(*output); err != nil {
+		return newUsageError("%s", err)
+	}
+	url, err := e.inputUrl()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("开始转推，摄像头：%s", e.camera)
+	return ffmpegutil.Restream(ctx, url, *output, &ffmpegutil.RestreamOptions{
+		Transcode:  *transcode,
+		Bitrate:    *bitrate,
+		RetryDelay: *retry,
+	})
+}
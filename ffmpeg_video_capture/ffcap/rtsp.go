@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	configutil "ffmpeg_video_capture/config_util"
+	rtsputil "ffmpeg_video_capture/rtsp_util"
+	"time"
+)
+
+// runRtsp 启动RTSP转发服务，转发配置文件中的全部摄像头或-url指定的一个摄像头，直到收到退出信号
+func runRtsp(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("rtsp")
+	addr := fs.String("addr", "", "监听地址，为空时使用配置文件中的rtsp.addr，默认:8554")
+	udpPort := fs.Int("udp-port", 0, "UDP传输的RTP端口，RTCP为端口+1，为0时使用配置文件或8000，-1为只支持TCP")
+	idle := fs.Duration("idle", 0, "最后一个客户端断开后保持拉流的时间，为0时使用配置文件或30秒")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+	cameras := e.config.CameraUrls()
+	if e.url != "" {
+		cameras = map[string]string{e.camera: e.url}
+	}
+	if len(cameras) == 0 {
+		return newUsageError("未指定-url，配置文件中也没有摄像头")
+	}
+	rtspConfig := e.config.Rtsp
+	if rtspConfig == nil {
+		rtspConfig = &configutil.RtspConfig{}
+	}
+	if *addr == "" {
+		*addr = rtspConfig.Addr
+	}
+	if *addr == "" {
+		*addr = ":8554"
+	}
+	if *udpPort == 0 {
+		*udpPort = rtspConfig.UdpPort
+	}
+	if *idle == 0 {
+		*idle = time.Duration(rtspConfig.Idle) * time.Second
+	}
+
+	server := rtsputil.NewServer(cameras, &rtsputil.Options{Idle: *idle, UdpPort: *udpPort})
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err := server.ListenAndServe(*addr)
+	server.Close()
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	apiutil "ffmpeg_video_capture/api_util"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"log"
+	"net/http"
+	"time"
+)
+
+// runVod 提供本地目录中mp4视频的HLS和DASH点播，直到收到退出信号
+func runVod(ctx context.Context, args []string) error {
+	fs, e := newFlagSet("vod")
+	dir := fs.String("dir", ".", "mp4视频所在目录")
+	addr := fs.String("addr", ":8081", "HTTP监听地址")
+	segment := fs.Duration("segment", 0, "目标切片时长，为0时为6秒")
+	if err := e.parse(fs, args); err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{
+		Addr:    *addr,
+		Handler: apiutil.NewVodDirHandler(*dir, &ffmpegutil.VodOptions{SegmentDuration: *segment}),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+	log.Printf("点播已启动，播放地址：http://%s/%s，DASH清单：http://%s/%s", *addr, ffmpegutil.HlsPlaylistName, *addr, ffmpegutil.DashManifestName)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,775 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"ffmpeg_video_capture/buffer"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// CaptureResult 抓取结果
+type CaptureResult struct {
+	Video     []byte    // mp4视频数据
+	Audio     []byte    // wav音频数据
+	Image     []byte    // jpg图片数据
+	StartTime time.Time // 开始抓取的时间
+	EndTime   time.Time // 结束抓取的时间
+	// Keyframes 视频的关键帧索引，写入mp4时记录
+	Keyframes *KeyframeIndex
+}
+
+// CaptureVideoAudioImage 抓取视频、音频和图片
+// 视频格式为mp4(h264+aac)，音频格式为wav，图片格式为jpg
+func CaptureVideoAudioImage(rtspUrl string, seconds time.Duration) (*CaptureResult, error) {
+	return CaptureVideoAudioImageContext(context.Background(), rtspUrl, seconds)
+}
+
+// CaptureVideoAudioImageContext 抓取视频、音频和图片，ctx取消或超时时中断抓取并返回ctx的错误
+func CaptureVideoAudioImageContext(ctx context.Context, rtspUrl string, seconds time.Duration) (*CaptureResult, error) {
+	return CaptureInput(ctx, UrlInput(rtspUrl), seconds)
+}
+
+// CaptureInput 从地址或读取器抓取视频、音频和图片
+// 读取器的数据按视频时间戳截取时长，地址输入按抓取的实际时间截取
+func CaptureInput(ctx context.Context, input *Input, seconds time.Duration) (*CaptureResult, error) {
+	return CaptureLayout(ctx, input, seconds, Mp4LayoutEnd)
+}
+
+// CaptureLayout 同CaptureInput，视频按layout封装，faststart时moov在开头，浏览器边下载边播放，为空时moov在末尾
+func CaptureLayout(ctx context.Context, input *Input, seconds time.Duration, layout Mp4Layout) (*CaptureResult, error) {
+	if layout == Mp4LayoutAuto {
+		layout = Mp4LayoutEnd
+	}
+	videoBuf := buffer.NewEmptyBuffer()
+	audioBuf := buffer.NewEmptyBuffer()
+	result, err := CaptureTo(ctx, input, seconds, &CaptureOutput{Video: videoBuf, Audio: audioBuf, Layout: layout})
+	if err != nil {
+		return nil, err
+	}
+	result.Video = videoBuf.Bytes()
+	result.Audio = audioBuf.Bytes()
+	return result, nil
+}
+
+// CaptureOutput 抓取结果的写入目标，抓取时边封装边写入，内存占用与抓取时长无关
+type CaptureOutput struct {
+	Video  io.Writer // mp4视频
+	Audio  io.Writer // wav音频，为nil时丢弃
+	Layout Mp4Layout // mp4封装方式，为空时按Video选择，不能seek时为分片mp4，可以随机读写(如*os.File)时为faststart
+}
+
+// CaptureTo 抓取视频和音频写入output，返回的结果中没有Video和Audio
+func CaptureTo(ctx context.Context, input *Input, seconds time.Duration, output *CaptureOutput) (*CaptureResult, error) {
+	//时长校验
+	if seconds <= 0 {
+		return nil, errors.New("时长不能小于0")
+	}
+	//保存的视频会多出1秒，这里减1
+	seconds = seconds - 1
+	outputDuration := seconds * time.Second
+
+	// 按协议设置输入参数，ctx取消时中断阻塞的读取
+	in, err := openCaptureInput(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	defer in.close()
+
+	//输出时长大于视频时长
+	if outputDuration.Microseconds() > in.duration {
+		outputDuration = time.Duration(in.duration * 1000)
+	}
+
+	segment, err := newCaptureSegment(in, output, false)
+	if err != nil {
+		return nil, err
+	}
+	defer segment.free()
+
+	packet := in.packet
+	firstVideoPts := astiav.NoPtsValue
+	for input.Reader != nil || time.Since(segment.startTime) < outputDuration {
+		if err = in.readPacket(ctx); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if packet.StreamIndex() == in.videoStream.Index() {
+			// 读取器的数据不受实时速度限制，读到指定时长的视频后结束
+			if input.Reader != nil && firstVideoPts != astiav.NoPtsValue && packet.Pts() != astiav.NoPtsValue &&
+				astiav.RescaleQ(packet.Pts()-firstVideoPts, in.videoStream.TimeBase(), astiav.TimeBaseQ) >= outputDuration.Microseconds() {
+				packet.Unref()
+				break
+			}
+			if firstVideoPts == astiav.NoPtsValue {
+				firstVideoPts = packet.Pts()
+			}
+			err = segment.writeVideo(packet)
+		} else if packet.StreamIndex() == in.audioStream.Index() {
+			err = segment.writeAudio(packet)
+		}
+		packet.Unref()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return segment.finish()
+}
+
+// RecordSegments 持续录制input，达到segment时长后在下一个关键帧处切分，每段的抓取结果(包括Video和Audio)交给onSegment
+// 所有片段共用一次打开的输入，切分时不重新连接和探测，片段之间不丢帧，每段的视频时间戳从0开始
+// 片段的开始和结束时间按视频时间戳推算，onSegment返回错误时结束录制并返回该错误
+// 输入结束时输出最后一段并返回nil，ctx取消时丢弃未完成的片段并返回ctx的错误
+func RecordSegments(ctx context.Context, input *Input, segment time.Duration, layout Mp4Layout, onSegment func(result *CaptureResult) error) error {
+	if layout == Mp4LayoutAuto {
+		layout = Mp4LayoutEnd
+	}
+	var videoBuf, audioBuf *buffer.Buffer
+	return RecordSegmentsTo(ctx, input, segment, func() (*CaptureOutput, error) {
+		videoBuf, audioBuf = buffer.NewEmptyBuffer(), buffer.NewEmptyBuffer()
+		return &CaptureOutput{Video: videoBuf, Audio: audioBuf, Layout: layout}, nil
+	}, func(result *CaptureResult) error {
+		result.Video = videoBuf.Bytes()
+		result.Audio = audioBuf.Bytes()
+		return onSegment(result)
+	})
+}
+
+// RecordSegmentsTo 同RecordSegments，每段开始时调用newOutput获取写入目标，边录制边写入，内存占用与片段时长无关
+// 交给onSegment的结果中没有Video和Audio，newOutput返回错误时结束录制，未完成的片段的写入目标由调用方清理
+func RecordSegmentsTo(ctx context.Context, input *Input, segment time.Duration, newOutput func() (*CaptureOutput, error), onSegment func(result *CaptureResult) error) error {
+	if segment <= 0 {
+		return errors.New("片段时长必须大于0")
+	}
+	in, err := openCaptureInput(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer in.close()
+
+	videoTimeBase := in.videoStream.TimeBase()
+	segmentLength := astiav.RescaleQ(segment.Microseconds(), astiav.TimeBaseQ, videoTimeBase)
+	firstPts, segmentPts, lastPts := astiav.NoPtsValue, astiav.NoPtsValue, astiav.NoPtsValue
+	var firstTime time.Time
+	// 视频时间戳对应的时间
+	toTime := func(pts int64) time.Time {
+		return firstTime.Add(time.Duration(astiav.RescaleQ(pts-firstPts, videoTimeBase, astiav.TimeBaseQ)) * time.Microsecond)
+	}
+
+	var current *captureSegment
+	defer func() {
+		if current != nil {
+			current.free()
+		}
+	}()
+	// 结束当前片段，endPts为下一段开始的时间戳
+	finish := func(endPts int64) error {
+		result, err := current.finish()
+		current.free()
+		current = nil
+		if err != nil {
+			return err
+		}
+		result.StartTime = toTime(segmentPts)
+		result.EndTime = toTime(endPts)
+		return onSegment(result)
+	}
+
+	packet := in.packet
+	for {
+		if err = in.readPacket(ctx); err != nil {
+			if errors.Is(err, io.EOF) {
+				if current != nil {
+					return finish(lastPts)
+				}
+				return nil
+			}
+			return err
+		}
+		if packet.StreamIndex() == in.videoStream.Index() {
+			pts := packet.Pts()
+			isKeyframe := packet.Flags().Has(astiav.PacketFlagKey) && pts != astiav.NoPtsValue
+			if current == nil && !isKeyframe {
+				// 每段从关键帧开始
+				packet.Unref()
+				continue
+			}
+			if isKeyframe && (current == nil || pts-segmentPts >= segmentLength) {
+				if current != nil {
+					if err = finish(pts); err != nil {
+						packet.Unref()
+						return err
+					}
+				}
+				if firstPts == astiav.NoPtsValue {
+					firstPts, firstTime = pts, time.Now()
+				}
+				output, err := newOutput()
+				if err == nil {
+					current, err = newCaptureSegment(in, output, true)
+				}
+				if err != nil {
+					packet.Unref()
+					return err
+				}
+				segmentPts = pts
+			}
+			if pts != astiav.NoPtsValue && (lastPts == astiav.NoPtsValue || pts > lastPts) {
+				lastPts = pts
+			}
+			err = current.writeVideo(packet)
+		} else if packet.StreamIndex() == in.audioStream.Index() && current != nil {
+			err = current.writeAudio(packet)
+		}
+		packet.Unref()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// captureInput 抓取的输入，持续录制时所有片段共用
+type captureInput struct {
+	formatCtx       *astiav.FormatContext
+	closeInput      func()
+	videoStream     *astiav.Stream
+	audioStream     *astiav.Stream
+	audioDecoderCtx *astiav.CodecContext // 音频解码器，片段之间连续解码
+	audioFrame      *astiav.Frame
+	packet          *astiav.Packet
+	live            *liveInput
+	url             string
+	duration        int64 // 输入时长，单位微秒，rtsp流为math.MaxInt64
+}
+
+// openCaptureInput 打开输入，查找视频流和音频流并打开音频解码器
+func openCaptureInput(ctx context.Context, input *Input) (*captureInput, error) {
+	inputFormatCtx, closeInput, err := input.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	in := &captureInput{formatCtx: inputFormatCtx, closeInput: closeInput}
+
+	in.videoStream = FindStream(inputFormatCtx, astiav.MediaTypeVideo)
+	in.audioStream = FindStream(inputFormatCtx, astiav.MediaTypeAudio)
+	if in.audioStream == nil || in.videoStream == nil {
+		in.close()
+		return nil, errors.New("未找到视频流或音频流")
+	}
+
+	log.Println("===========流索引信息===========")
+	log.Println("视频流索引:", in.videoStream.Index())
+	log.Println("音频流索引:", in.audioStream.Index())
+
+	// 获得音频解码器上下文，并打开解码器
+	audioDecoderCtx, audioDecoder, err := FindAndOpenDecoderCtx(in.audioStream)
+	if audioDecoderCtx == nil || err != nil {
+		in.close()
+		return nil, err
+	}
+	in.audioDecoderCtx = audioDecoderCtx
+	in.audioFrame = astiav.AllocFrame()
+	in.packet = astiav.AllocPacket()
+
+	// 登记正在录制的地址，抓图时复用缓存的关键帧，读取器输入没有地址不登记
+	if input.Reader == nil {
+		in.url = input.Url
+		in.live = registerLiveInput(input.Url, in.videoStream)
+	}
+
+	//视频信息
+	videoParams := in.videoStream.CodecParameters()
+	in.duration = inputFormatCtx.Duration()
+	fps := in.videoStream.AvgFrameRate().Num() / in.videoStream.AvgFrameRate().Den()
+
+	//rtsp流，duration为负数
+	if in.duration < 0 {
+		in.duration = math.MaxInt64
+	}
+
+	// 打印视频信息
+	log.Println("===========视频流信息===========")
+	log.Printf("视频形式：%s", inputFormatCtx.InputFormat().Name())
+	log.Printf("视频时长：%.2f s", float64(in.duration)/float64(astiav.TimeBase))
+	log.Printf("视频fps：%d", fps)
+	log.Printf("视频宽高：%d,%d", videoParams.Width(), videoParams.Height())
+	log.Printf("视频像素格式：%s", videoParams.PixelFormat().Name())
+	log.Printf("视频编码：%s", videoParams.CodecID().Name())
+
+	// 打印音频信息
+	log.Println("===========音频流信息===========")
+	log.Printf("音频解码器：%s", audioDecoder.Name())
+	log.Printf("音频采样格式：%s", audioDecoderCtx.SampleFormat().Name())
+	log.Printf("码率： %d", audioDecoderCtx.BitRate())
+	log.Printf("采样率： %d", audioDecoderCtx.SampleRate())
+	return in, nil
+}
+
+// readPacket 读取下一个数据帧到in.packet，输入结束时返回io.EOF，ctx取消时返回ctx的错误
+func (in *captureInput) readPacket(ctx context.Context) error {
+	if err := in.formatCtx.ReadFrame(in.packet); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, astiav.ErrEof) {
+			return io.EOF
+		}
+		return errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+	}
+	if in.packet.StreamIndex() == in.videoStream.Index() {
+		in.live.updateKeyframe(in.packet)
+	}
+	return nil
+}
+
+func (in *captureInput) close() {
+	if in.live != nil {
+		unregisterLiveInput(in.url, in.live)
+	}
+	if in.packet != nil {
+		in.packet.Free()
+	}
+	if in.audioFrame != nil {
+		in.audioFrame.Free()
+	}
+	if in.audioDecoderCtx != nil {
+		in.audioDecoderCtx.Free()
+	}
+	in.closeInput()
+}
+
+// captureSegment 一段抓取结果的输出，mp4视频(h264+aac)、wav音频和第一帧图片
+type captureSegment struct {
+	in                 *captureInput
+	mp4OutputFormatCtx *astiav.FormatContext
+	wavOutputFormatCtx *astiav.FormatContext
+	videoOutput        *writerOutput
+	audioOutput        *writerOutput
+	// 每段单独的视频解码器，只用于解码第一帧图片
+	videoDecoderCtx      *astiav.CodecContext
+	decodedFrame         *astiav.Frame
+	mp4AudioEncoderCtx   *astiav.CodecContext
+	mp4VideoOutputStream *astiav.Stream
+	mp4AudioOutputStream *astiav.Stream
+	wavAudioOutputStream *astiav.Stream
+	swrCtx               *astiav.SoftwareResampleContext
+	resampledFrame       *astiav.Frame
+	finalFrame           *astiav.Frame
+	audioFifo            *astiav.AudioFifo
+	// rebase为true时视频时间戳减去第一个视频帧的解码时间戳，从0开始
+	rebase        bool
+	tsOffset      int64
+	firstVideoPts int64
+	keyframes     *KeyframeIndex
+	image         []byte
+	startTime     time.Time
+}
+
+// newCaptureSegment 创建输出并写入mp4和wav文件头
+func newCaptureSegment(in *captureInput, output *CaptureOutput, rebase bool) (*captureSegment, error) {
+	audioWriter := output.Audio
+	if audioWriter == nil {
+		audioWriter = io.Discard
+	}
+	segment := &captureSegment{in: in, rebase: rebase, tsOffset: astiav.NoPtsValue, firstVideoPts: astiav.NoPtsValue}
+	if err := segment.open(output.Video, audioWriter, output.Layout); err != nil {
+		segment.free()
+		return nil, err
+	}
+	segment.startTime = time.Now()
+	return segment, nil
+}
+
+func (segment *captureSegment) open(videoWriter, audioWriter io.Writer, layout Mp4Layout) (err error) {
+	in := segment.in
+	// 获得视频解码器上下文，并打开解码器
+	if segment.videoDecoderCtx, _, err = FindAndOpenDecoderCtx(in.videoStream); segment.videoDecoderCtx == nil || err != nil {
+		return err
+	}
+	segment.decodedFrame = astiav.AllocFrame()
+
+	// 分配mp4视频输出格式上下文
+	mp4OutputFormatCtx, err := astiav.AllocOutputFormatContext(nil, "mp4", "")
+	if err != nil || mp4OutputFormatCtx == nil {
+		return errors.New(fmt.Sprintf("分配mp4输出格式上下文失败: %s", err))
+	}
+	segment.mp4OutputFormatCtx = mp4OutputFormatCtx
+
+	// 分配wav音频输出格式上下文
+	wavOutputFormatCtx, err := astiav.AllocOutputFormatContext(nil, "wav", "")
+	if err != nil || wavOutputFormatCtx == nil {
+		return errors.New(fmt.Sprintf("分配wav输出格式上下文失败: %s", err))
+	}
+	segment.wavOutputFormatCtx = wavOutputFormatCtx
+
+	// mp4视频直接写入output.Video
+	if segment.videoOutput, err = openMp4Output(mp4OutputFormatCtx, videoWriter, layout); err != nil {
+		return err
+	}
+
+	// wav音频直接写入output.Audio，不能seek时文件头中的长度不更新
+	if segment.audioOutput, err = openWriterOutput(wavOutputFormatCtx, audioWriter); err != nil {
+		return err
+	}
+
+	//创建aac编码器上下文
+	audioDecoderCtx := in.audioDecoderCtx
+	mp4AudioEncoder := astiav.FindEncoder(astiav.CodecIDAac)
+	mp4AudioEncoderCtx := astiav.AllocCodecContext(mp4AudioEncoder)
+	segment.mp4AudioEncoderCtx = mp4AudioEncoderCtx
+	mp4AudioEncoderCtx.SetSampleRate(audioDecoderCtx.SampleRate())
+	mp4AudioEncoderCtx.SetChannelLayout(audioDecoderCtx.ChannelLayout())
+	mp4AudioEncoderCtx.SetBitRate(48000)
+	mp4AudioEncoderCtx.SetSampleFormat(astiav.SampleFormatFltp)
+
+	if err = mp4AudioEncoderCtx.Open(mp4AudioEncoder, nil); err != nil {
+		return errors.New(fmt.Sprintf("无法打开aac编码器: %s", err))
+	}
+
+	//创建mp4视频输出流
+	if segment.mp4VideoOutputStream, err = CreateStreamAndCopyParams(mp4OutputFormatCtx, in.videoStream); err != nil {
+		return errors.New(fmt.Sprintf("创建mp4视频输出流失败: %s", err))
+	}
+	segment.mp4VideoOutputStream.CodecParameters().SetCodecTag(0)
+
+	//创建mp4音频输出流
+	segment.mp4AudioOutputStream = mp4OutputFormatCtx.NewStream(nil)
+	if err = mp4AudioEncoderCtx.ToCodecParameters(segment.mp4AudioOutputStream.CodecParameters()); err != nil {
+		return errors.New(fmt.Sprintf("创建mp4音频输出流失败,无法复制编码参数: %s", err))
+	}
+	segment.mp4AudioOutputStream.CodecParameters().SetCodecTag(0)
+
+	// 创建wav音频输出流
+	if segment.wavAudioOutputStream, err = CreateStreamAndCopyParams(wavOutputFormatCtx, in.audioStream); err != nil {
+		return errors.New(fmt.Sprintf("创建wav音频输出流失败: %s", err))
+	}
+
+	// 分配重采样上下文
+	segment.swrCtx = astiav.AllocSoftwareResampleContext()
+
+	// 分配重采样帧
+	resampledFrame := astiav.AllocFrame()
+	segment.resampledFrame = resampledFrame
+	//设置重采样帧参数
+	resampledFrame.SetChannelLayout(mp4AudioEncoderCtx.ChannelLayout())
+	resampledFrame.SetSampleFormat(mp4AudioEncoderCtx.SampleFormat())
+	resampledFrame.SetSampleRate(mp4AudioEncoderCtx.SampleRate())
+	resampledFrame.SetNbSamples(1024)
+
+	//最终音频帧
+	finalFrame := astiav.AllocFrame()
+	segment.finalFrame = finalFrame
+	//设置最终音频帧参数
+	finalFrame.SetChannelLayout(resampledFrame.ChannelLayout())
+	finalFrame.SetNbSamples(resampledFrame.NbSamples())
+	finalFrame.SetSampleFormat(resampledFrame.SampleFormat())
+	finalFrame.SetSampleRate(resampledFrame.SampleRate())
+
+	//写入MP4文件头
+	headerOptions := segment.videoOutput.headerOptions()
+	err = mp4OutputFormatCtx.WriteHeader(headerOptions)
+	headerOptions.Free()
+	if err != nil {
+		return errors.New(fmt.Sprintf("写入MP4文件头失败: %s", segment.videoOutput.writeError(err)))
+	}
+
+	//写入WAV文件头
+	if err = wavOutputFormatCtx.WriteHeader(nil); err != nil {
+		return errors.New(fmt.Sprintf("写入WAV文件头失败: %s", err))
+	}
+
+	if err = finalFrame.AllocBuffer(0); err != nil {
+		return errors.New(fmt.Sprintf("分配缓冲区失败: %s", err))
+	}
+	if err = finalFrame.AllocSamples(0); err != nil {
+		return errors.New(fmt.Sprintf("分配样本失败: %s", err))
+	}
+
+	//分配音频队列
+	segment.audioFifo = astiav.AllocAudioFifo(finalFrame.SampleFormat(), finalFrame.ChannelLayout().Channels(), finalFrame.NbSamples())
+
+	// 关键帧索引，时间戳相对第一个视频帧
+	segment.keyframes = &KeyframeIndex{TimeBase: segment.mp4VideoOutputStream.TimeBase(), Layout: segment.videoOutput.layout}
+	return nil
+}
+
+// writeVideo 写入视频帧，保存第一帧图片并记录关键帧索引
+func (segment *captureSegment) writeVideo(packet *astiav.Packet) error {
+	//保存一帧图片
+	if segment.image == nil {
+		if err := segment.decodeImage(packet); err != nil {
+			return err
+		}
+	}
+	if segment.rebase {
+		if segment.tsOffset == astiav.NoPtsValue {
+			segment.tsOffset = packet.Dts()
+			if segment.tsOffset == astiav.NoPtsValue {
+				segment.tsOffset = packet.Pts()
+			}
+		}
+		if packet.Pts() != astiav.NoPtsValue {
+			packet.SetPts(packet.Pts() - segment.tsOffset)
+		}
+		if packet.Dts() != astiav.NoPtsValue {
+			packet.SetDts(packet.Dts() - segment.tsOffset)
+		}
+	}
+	//写入视频帧
+	// 更新数据帧参数
+	videoOutput := segment.videoOutput
+	packet.SetStreamIndex(segment.mp4VideoOutputStream.Index())
+	packet.RescaleTs(segment.in.videoStream.TimeBase(), segment.mp4VideoOutputStream.TimeBase())
+	packet.SetPos(-1)
+	if segment.firstVideoPts == astiav.NoPtsValue {
+		segment.firstVideoPts = packet.Pts()
+	}
+	// 记录视频时长，按最后一个视频帧的结束时间计算，不依赖抓取的墙钟时间
+	if packet.Pts() != astiav.NoPtsValue {
+		segment.keyframes.End = max(segment.keyframes.End, packet.Pts()+packet.Duration()-segment.firstVideoPts)
+	}
+	// 记录关键帧的时间戳和字节偏移
+	// 直接写入不经过交叉缓冲，mov封装器收到数据帧后立即写入mdat，写入前的位置即为该帧的偏移
+	// 分片mp4收到关键帧时先写出上一个分片，写入后的位置为关键帧所在分片(moof)的位置
+	var err error
+	isKeyframe := packet.Flags().Has(astiav.PacketFlagKey) && packet.Pts() != astiav.NoPtsValue
+	keyframe := Keyframe{Pts: packet.Pts() - segment.firstVideoPts}
+	if isKeyframe && videoOutput.layout != Mp4LayoutFragmented {
+		if keyframe.Offset, err = videoOutput.position(); err != nil {
+			return errors.New(fmt.Sprintf("获取视频写入位置失败: %s", err))
+		}
+	}
+	if err = segment.mp4OutputFormatCtx.WriteFrame(packet); err != nil {
+		return errors.New(fmt.Sprintf("写入视频帧失败: %s", videoOutput.writeError(err)))
+	}
+	if isKeyframe && videoOutput.layout == Mp4LayoutFragmented {
+		if keyframe.Offset, err = videoOutput.position(); err != nil {
+			return errors.New(fmt.Sprintf("获取视频写入位置失败: %s", err))
+		}
+	}
+	if isKeyframe {
+		segment.keyframes.Keyframes = append(segment.keyframes.Keyframes, keyframe)
+	}
+	return nil
+}
+
+// decodeImage 解码视频帧并编码为jpg，解码器缓存数据帧时等待下一个视频帧
+func (segment *captureSegment) decodeImage(packet *astiav.Packet) error {
+	videoDecoderCtx, decodedFrame := segment.videoDecoderCtx, segment.decodedFrame
+	//发送给解码器
+	if err := videoDecoderCtx.SendPacket(packet); err != nil {
+		return errors.New(fmt.Sprintf("视频数据发送给视频解码器失败: %s", err))
+	}
+	//接收解码后的数据
+	if err := videoDecoderCtx.ReceiveFrame(decodedFrame); err != nil {
+		if errors.Is(err, astiav.ErrEagain) {
+			return nil
+		}
+		return errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+	}
+	defer decodedFrame.Unref()
+	//视频帧缓冲区大小
+	size, _ := decodedFrame.ImageBufferSize(1)
+	imageBuf := make([]byte, size)
+
+	//数据拷贝到缓冲区
+	if _, err := decodedFrame.ImageCopyToBuffer(imageBuf, 1); err != nil {
+		return errors.New(fmt.Sprintf("图像数据拷贝到缓冲区中失败: %s", err))
+	}
+	//YUV转RGB
+	img := YUV420PToRGB(imageBuf, videoDecoderCtx.Width(), videoDecoderCtx.Height())
+
+	//数据编码成jpg格式（压缩）
+	var encodedBuffer bytes.Buffer
+	if err := jpeg.Encode(&encodedBuffer, img, &jpeg.Options{Quality: jpeg.DefaultQuality}); err != nil {
+		return errors.New(fmt.Sprintf("图像编码失败: %s", err))
+	}
+	//jpg编码后的字节数据
+	segment.image = encodedBuffer.Bytes()
+	return nil
+}
+
+// writeAudio 写入音频帧，wav的音频流直接写入，mp4音频流转码成aac格式再写入
+func (segment *captureSegment) writeAudio(packet *astiav.Packet) error {
+	in := segment.in
+	//直接写入wav文件
+	audioPacket := packet.Clone()
+	// 更新数据帧参数
+	audioPacket.SetStreamIndex(segment.wavAudioOutputStream.Index())
+	audioPacket.RescaleTs(in.audioStream.TimeBase(), segment.wavAudioOutputStream.TimeBase())
+	audioPacket.SetPos(-1)
+	// 交叉写入输出缓冲区
+	err := segment.wavOutputFormatCtx.WriteFrame(audioPacket)
+	audioPacket.Free()
+	if err != nil {
+		return errors.New(fmt.Sprintf("交叉写入音频帧失败: %s", err))
+	}
+
+	//解码音频帧
+	if err = in.audioDecoderCtx.SendPacket(packet); err != nil {
+		return errors.New(fmt.Sprintf("视频数据发送给音频解码器失败: %s", err))
+	}
+	decodedFrame := in.audioFrame
+	for {
+		if err = in.audioDecoderCtx.ReceiveFrame(decodedFrame); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				break
+			}
+			return errors.New(fmt.Sprintf("从音频解码器中获取解码帧失败: %s", err))
+		}
+
+		//重采样音频帧
+		if err = segment.swrCtx.ConvertFrame(decodedFrame, segment.resampledFrame); err != nil {
+			return errors.New(fmt.Sprintf("重采样音频帧失败: %s", err))
+		}
+		// 将重采样后的音频帧添加到音频队列中
+		if err = addResampledFrameToAudioFIFO(false, segment.mp4AudioEncoderCtx, segment.mp4OutputFormatCtx, segment.audioFifo, segment.resampledFrame, segment.finalFrame, in.audioStream, segment.mp4AudioOutputStream); err != nil {
+			return errors.New(fmt.Sprintf("添加重采样后的音频帧到音频队列中失败: %s", err))
+		}
+
+		// 刷新重采样上下文
+		if err = flushSoftwareResampleContext(false, segment.mp4AudioEncoderCtx, segment.mp4OutputFormatCtx, segment.audioFifo, segment.swrCtx, segment.resampledFrame, segment.finalFrame, in.audioStream, segment.mp4AudioOutputStream); err != nil {
+			return errors.New(fmt.Sprintf("刷新重采样上下文失败: %s", err))
+		}
+		decodedFrame.Unref()
+	}
+	return nil
+}
+
+// finish 写入文件尾，返回的结果中没有Video和Audio
+func (segment *captureSegment) finish() (*CaptureResult, error) {
+	//写入MP4文件尾
+	if err := segment.mp4OutputFormatCtx.WriteTrailer(); err != nil {
+		return nil, errors.New(fmt.Sprintf("写入MP4文件尾失败: %s", segment.videoOutput.writeError(err)))
+	}
+	// faststart时moov移到mdat之前，mdat中关键帧的偏移随之后移
+	shift, err := segment.videoOutput.finish()
+	if err != nil {
+		return nil, err
+	}
+	for i := range segment.keyframes.Keyframes {
+		segment.keyframes.Keyframes[i].Offset += shift
+	}
+
+	//写入WAV文件尾
+	if err = segment.wavOutputFormatCtx.WriteTrailer(); err != nil {
+		return nil, errors.New(fmt.Sprintf("写入WAV文件尾失败: %s", segment.audioOutput.writeError(err)))
+	}
+	if _, err = segment.audioOutput.finish(); err != nil {
+		return nil, err
+	}
+
+	return &CaptureResult{
+		Image:     segment.image,
+		StartTime: segment.startTime,
+		EndTime:   time.Now(),
+		Keyframes: segment.keyframes,
+	}, nil
+}
+
+func (segment *captureSegment) free() {
+	if segment.audioFifo != nil {
+		segment.audioFifo.Free()
+	}
+	if segment.finalFrame != nil {
+		segment.finalFrame.Free()
+	}
+	if segment.resampledFrame != nil {
+		segment.resampledFrame.Free()
+	}
+	if segment.swrCtx != nil {
+		segment.swrCtx.Free()
+	}
+	if segment.mp4AudioEncoderCtx != nil {
+		segment.mp4AudioEncoderCtx.Free()
+	}
+	if segment.audioOutput != nil {
+		segment.audioOutput.Free()
+	}
+	if segment.videoOutput != nil {
+		segment.videoOutput.Free()
+	}
+	if segment.wavOutputFormatCtx != nil {
+		segment.wavOutputFormatCtx.Free()
+	}
+	if segment.mp4OutputFormatCtx != nil {
+		segment.mp4OutputFormatCtx.Free()
+	}
+	if segment.decodedFrame != nil {
+		segment.decodedFrame.Free()
+	}
+	if segment.videoDecoderCtx != nil {
+		segment.videoDecoderCtx.Free()
+	}
+}
+
+func flushSoftwareResampleContext(finalFlush bool, mp4AudioEncoderCtx *astiav.CodecContext, mp4OutputFormatCtx *astiav.FormatContext, audioFifo *astiav.AudioFifo, swrCtx *astiav.SoftwareResampleContext, resampledFrame *astiav.Frame, finalFrame *astiav.Frame, inputStream, outputStream *astiav.Stream) error {
+	for {
+		if finalFlush || swrCtx.Delay(int64(resampledFrame.SampleRate())) >= int64(resampledFrame.NbSamples()) {
+			// 刷新重采样器
+			if err := swrCtx.ConvertFrame(nil, resampledFrame); err != nil {
+				return errors.New(fmt.Sprintf("刷新重采样器失败: %s", err))
+			}
+			// 添加重采样帧到音频队列中
+			if err := addResampledFrameToAudioFIFO(finalFlush, mp4AudioEncoderCtx, mp4OutputFormatCtx, audioFifo, resampledFrame, finalFrame, inputStream, outputStream); err != nil {
+				return errors.New(fmt.Sprintf("添加重采样帧到音频队列中失败: %s", err))
+			}
+
+			if finalFlush && resampledFrame.NbSamples() == 0 {
+				break
+			}
+			continue
+		}
+		break
+	}
+	return nil
+}
+
+func addResampledFrameToAudioFIFO(flush bool, mp4AudioEncoderCtx *astiav.CodecContext, mp4OutputFormatCtx *astiav.FormatContext, audioFifo *astiav.AudioFifo, resampledFrame *astiav.Frame, finalFrame *astiav.Frame, inputStream, outputStream *astiav.Stream) error {
+	// 写入音频队列
+	if resampledFrame.NbSamples() > 0 {
+		if _, err := audioFifo.Write(resampledFrame); err != nil {
+			return fmt.Errorf("写入音频队列失败: %w", err)
+		}
+	}
+	outputPacket := astiav.AllocPacket()
+	defer outputPacket.Free()
+	for {
+		if (flush && audioFifo.Size() > 0) || (!flush && audioFifo.Size() >= finalFrame.NbSamples()) {
+			nbSamples, err := audioFifo.Read(finalFrame)
+			//执行编码，写入操作
+			//设置时间戳
+			finalFrame.SetNbSamples(nbSamples)
+			err = mp4AudioEncoderCtx.SendFrame(finalFrame)
+			if err != nil {
+				return errors.New(fmt.Sprintf("数据发送给输出音频编码器失败: %s", err))
+			}
+			err = mp4AudioEncoderCtx.ReceivePacket(outputPacket)
+			outputPacket.RescaleTs(inputStream.TimeBase(), outputStream.TimeBase())
+			outputPacket.SetStreamIndex(outputStream.Index())
+			outputPacket.SetPos(-1)
+			if err != nil {
+				if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+					break
+				}
+				return errors.New(fmt.Sprintf("从音频编码器中获取数据包失败: %s", err))
+			}
+			// 与视频帧一样直接写入，保证关键帧索引中的字节偏移准确
+			if err = mp4OutputFormatCtx.WriteFrame(outputPacket); err != nil {
+				return errors.New(fmt.Sprintf("写入音频帧到mp4文件中失败: %s", err))
+			}
+			outputPacket.Unref()
+			continue
+		}
+		break
+	}
+	return nil
+}
@@ -0,0 +1,475 @@
+package ffmpegutil
+
+import (
+	"context"
+	"errors"
+	"ffmpeg_video_capture/buffer"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// ConcatSegment 待拼接的视频片段
+type ConcatSegment struct {
+	Data   []byte        // mp4视频数据
+	Reader io.ReadSeeker // mp4视频数据的读取器，不为nil时代替Data，数据按需读取，不整体加载到内存
+	Start  time.Duration // 片段内的起始时间，0表示从头开始
+	End    time.Duration // 片段内的结束时间，0表示到结尾
+	// Keyframes 片段的关键帧索引，不为nil时直接按索引计算剪切范围，不再扫描整个片段
+	Keyframes *KeyframeIndex
+}
+
+// ConcatOptions 拼接参数
+type ConcatOptions struct {
+	// ExactCut 精确剪切
+	// 为false时在关键帧处剪切，起点取Start之前最近的关键帧，终点取End之后最近的关键帧
+	// 为true时只重新编码起点和终点所在的不完整GOP，剪切点精确到帧，中间完整的GOP和音频直接复制
+	// 输出流的参数取自第一个片段，重新编码的部分在关键帧的数据包中带有自己的参数集
+	ExactCut bool
+	// Layout mp4的封装方式，为空时按写入目标选择，ConcatSegments为空时moov在末尾
+	Layout Mp4Layout
+}
+
+// readerInput 通过读取器读取的输入
+type readerInput struct {
+	fmtCtx      *astiav.FormatContext
+	closeInput  func()
+	videoStream *astiav.Stream
+	audioStream *astiav.Stream
+}
+
+// openReaderInput 通过读取器打开视频数据
+func openReaderInput(reader io.ReadSeeker, formatName string) (*readerInput, error) {
+	inputFormatCtx, closeInput, err := ReaderInput(reader, formatName).Open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &readerInput{
+		fmtCtx:      inputFormatCtx,
+		closeInput:  closeInput,
+		videoStream: FindStream(inputFormatCtx, astiav.MediaTypeVideo),
+		audioStream: FindStream(inputFormatCtx, astiav.MediaTypeAudio),
+	}, nil
+}
+
+// Free 释放输入
+func (input *readerInput) Free() {
+	input.closeInput()
+}
+
+// ConcatVideos 将多段mp4视频拼接成一个mp4视频
+func ConcatVideos(videoList [][]byte) ([]byte, error) {
+	segments := make([]*ConcatSegment, 0, len(videoList))
+	for _, videoBytes := range videoList {
+		segments = append(segments, &ConcatSegment{Data: videoBytes})
+	}
+	return ConcatSegments(segments, nil)
+}
+
+// ConcatSegments 按顺序拼接多段mp4视频，并按每段的起止时间进行剪切
+func ConcatSegments(segments []*ConcatSegment, options *ConcatOptions) ([]byte, error) {
+	bufferOptions := ConcatOptions{}
+	if options != nil {
+		bufferOptions = *options
+	}
+	if bufferOptions.Layout == Mp4LayoutAuto {
+		bufferOptions.Layout = Mp4LayoutEnd
+	}
+	//存放拼接后的视频数据
+	videoBuf := buffer.NewEmptyBuffer()
+	if err := ConcatSegmentsTo(videoBuf, segments, &bufferOptions); err != nil {
+		return nil, err
+	}
+	return videoBuf.Bytes(), nil
+}
+
+// ConcatSegmentsTo 同ConcatSegments，拼接结果边封装边写入writer，内存占用与视频总长度无关
+// writer不能seek时输出分片mp4，可以随机读写(如*os.File)时输出faststart的mp4
+func ConcatSegmentsTo(writer io.Writer, segments []*ConcatSegment, options *ConcatOptions) error {
+	if len(segments) == 0 {
+		return errors.New("无视频数据")
+	}
+	if options == nil {
+		options = &ConcatOptions{}
+	}
+
+	var inputList []*readerInput
+	defer func() {
+		for _, input := range inputList {
+			input.Free()
+		}
+	}()
+	// 分片mp4按关键帧索引只读取剪切范围所在的分片
+	windows := make([]*ConcatSegment, 0, len(segments))
+	for _, segment := range segments {
+		segment, err := fragmentWindow(segment)
+		if err != nil {
+			return err
+		}
+		windows = append(windows, segment)
+		reader := segment.Reader
+		if reader == nil {
+			reader = buffer.NewBuffer(segment.Data)
+		}
+		input, err := openReaderInput(reader, "mp4")
+		if err != nil {
+			return err
+		}
+		inputList = append(inputList, input)
+		if input.videoStream == nil {
+			return errors.New("未找到视频流")
+		}
+	}
+
+	// 分配mp4输出格式上下文
+	outputFormatCtx, err := astiav.AllocOutputFormatContext(nil, "mp4", "")
+	if err != nil || outputFormatCtx == nil {
+		return errors.New(fmt.Sprintf("分配mp4视频输出格式上下文失败: %s", err))
+	}
+	defer outputFormatCtx.Free()
+	// 拼接后的视频直接写入writer
+	output, err := openMp4Output(outputFormatCtx, writer, options.Layout)
+	if err != nil {
+		return err
+	}
+	defer output.Free()
+
+	//为输出格式上下文创建视频输出流
+	videoOutputStream, err := CreateStreamAndCopyParams(outputFormatCtx, inputList[0].videoStream)
+	if err != nil {
+		return errors.New(fmt.Sprintf("创建视频输出流失败: %s", err))
+	}
+
+	//为输出格式上下文创建音频输出流
+	var audioOutputStream *astiav.Stream
+	if inputList[0].audioStream != nil {
+		audioOutputStream, err = CreateStreamAndCopyParams(outputFormatCtx, inputList[0].audioStream)
+		if err != nil {
+			return errors.New(fmt.Sprintf("创建音频输出流失败: %s", err))
+		}
+	}
+
+	//写入MP4文件头
+	headerOptions := output.headerOptions()
+	err = outputFormatCtx.WriteHeader(headerOptions)
+	headerOptions.Free()
+	if err != nil {
+		return errors.New(fmt.Sprintf("写入MP4文件头失败: %s", output.writeError(err)))
+	}
+
+	// 已拼接部分的时长，单位为微秒
+	var offset int64
+	for i, input := range inputList {
+		segmentDuration, err := writeSegment(outputFormatCtx, input, windows[i], options, videoOutputStream, audioOutputStream, offset)
+		if err != nil {
+			return errors.New(fmt.Sprintf("拼接第%d个视频失败: %s", i+1, output.writeError(err)))
+		}
+		offset += segmentDuration
+		log.Printf("第%d个视频拼接完成", i+1)
+	}
+	//写入MP4文件尾
+	if err = outputFormatCtx.WriteTrailer(); err != nil {
+		return errors.New(fmt.Sprintf("写入MP4文件尾失败: %s", output.writeError(err)))
+	}
+	_, err = output.finish()
+	return err
+}
+
+// segmentRange 片段的剪切范围，时间基为视频流的时间基
+type segmentRange struct {
+	from           int64 // 剪切起点
+	to             int64 // 剪切终点
+	startKey       int64 // 起点所在GOP的关键帧
+	endKey         int64 // 终点所在GOP的关键帧
+	outStart       int64 // 输出起点
+	outEnd         int64 // 输出终点
+	videoStartTime int64 // 视频流的起始时间
+	// 精确剪切时[copyStart, copyEnd)之间的GOP直接复制，其他范围内的帧重新编码
+	copyStart int64
+	copyEnd   int64
+}
+
+// scanSegmentRange 计算片段的剪切范围，计算后输入定位到起点所在GOP的关键帧
+func scanSegmentRange(input *readerInput, segment *ConcatSegment, options *ConcatOptions) (*segmentRange, error) {
+	videoStream := input.videoStream
+	keyFrames, err := indexKeyFrames(input, segment.Keyframes)
+	if err != nil {
+		return nil, err
+	}
+	if keyFrames == nil {
+		// 没有关键帧索引，扫描整个片段
+		if keyFrames, err = scanKeyFrames(input); err != nil {
+			return nil, err
+		}
+	}
+	if len(keyFrames) == 0 {
+		return nil, errors.New("未找到关键帧")
+	}
+	sort.Slice(keyFrames, func(i, j int) bool { return keyFrames[i] < keyFrames[j] })
+
+	r := &segmentRange{videoStartTime: videoStream.StartTime()}
+	if r.videoStartTime == astiav.NoPtsValue {
+		r.videoStartTime = keyFrames[0]
+	}
+	r.from = r.videoStartTime + astiav.RescaleQ(segment.Start.Microseconds(), astiav.TimeBaseQ, videoStream.TimeBase())
+	r.to = int64(math.MaxInt64)
+	if segment.End > 0 {
+		r.to = r.videoStartTime + astiav.RescaleQ(segment.End.Microseconds(), astiav.TimeBaseQ, videoStream.TimeBase())
+	}
+	if r.from < keyFrames[0] {
+		r.from = keyFrames[0]
+	}
+	if r.to <= r.from {
+		return nil, errors.New("剪切终点必须晚于起点")
+	}
+
+	// 起点之前最近的关键帧，终点之前最近的关键帧，终点之后最近的关键帧
+	r.startKey, r.endKey = keyFrames[0], keyFrames[0]
+	nextKey := int64(math.MaxInt64)
+	for _, key := range keyFrames {
+		if key <= r.from {
+			r.startKey = key
+		}
+		if key < r.to {
+			r.endKey = key
+		} else if key < nextKey {
+			nextKey = key
+		}
+	}
+
+	if options.ExactCut {
+		r.outStart, r.outEnd = r.from, r.to
+		r.copyStart, r.copyEnd = copyRange(keyFrames, r.from, r.to)
+	} else {
+		r.outStart, r.outEnd = r.startKey, nextKey
+	}
+
+	// 定位到起点所在GOP的关键帧，之前的数据不再读取
+	if err = input.fmtCtx.SeekFrame(videoStream.Index(), r.startKey, astiav.NewSeekFlags(astiav.SeekFlagBackward)); err != nil {
+		return nil, errors.New(fmt.Sprintf("定位到剪切起点失败: %s", err))
+	}
+	return r, nil
+}
+
+// scanKeyFrames 读取整个片段，返回视频流全部关键帧的时间戳
+func scanKeyFrames(input *readerInput) ([]int64, error) {
+	videoStream := input.videoStream
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+
+	var keyFrames []int64
+	for {
+		if err := input.fmtCtx.ReadFrame(packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) {
+				break
+			}
+			return nil, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if packet.StreamIndex() == videoStream.Index() && packet.Flags().Has(astiav.PacketFlagKey) {
+			keyFrames = append(keyFrames, packet.Pts())
+		}
+		packet.Unref()
+	}
+	return keyFrames, nil
+}
+
+// indexKeyFrames 根据关键帧索引计算视频流全部关键帧的时间戳
+// 索引的时间戳相对第一个视频帧，只需读取第一个视频帧即可换算，索引不可用时返回nil
+func indexKeyFrames(input *readerInput, index *KeyframeIndex) ([]int64, error) {
+	videoStream := input.videoStream
+	if index == nil || len(index.Keyframes) == 0 || index.TimeBase.Num() != videoStream.TimeBase().Num() || index.TimeBase.Den() != videoStream.TimeBase().Den() {
+		return nil, nil
+	}
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+
+	firstPts := astiav.NoPtsValue
+	for firstPts == astiav.NoPtsValue {
+		if err := input.fmtCtx.ReadFrame(packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) {
+				return nil, errors.New("未找到视频帧")
+			}
+			return nil, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if packet.StreamIndex() == videoStream.Index() {
+			firstPts = packet.Pts()
+		}
+		packet.Unref()
+	}
+
+	keyFrames := make([]int64, 0, len(index.Keyframes))
+	for _, keyframe := range index.Keyframes {
+		keyFrames = append(keyFrames, firstPts+keyframe.Pts)
+	}
+	return keyFrames, nil
+}
+
+// writeSegment 将一个片段剪切后写入输出，offset为该片段在输出中的起始时间，返回写入的时长，单位均为微秒
+// 精确剪切时起点和终点所在的不完整GOP解码后只把[from, to)范围内的帧重新编码，中间完整的GOP直接复制
+func writeSegment(outputFormatCtx *astiav.FormatContext, input *readerInput, segment *ConcatSegment, options *ConcatOptions, videoOutputStream, audioOutputStream *astiav.Stream, offset int64) (int64, error) {
+	r, err := scanSegmentRange(input, segment, options)
+	if err != nil {
+		return 0, err
+	}
+	videoStream, audioStream := input.videoStream, input.audioStream
+
+	var audioOutStart, audioOutEnd int64
+	if audioStream != nil {
+		audioStartTime := audioStream.StartTime()
+		if audioStartTime == astiav.NoPtsValue {
+			audioStartTime = 0
+		}
+		audioOutStart = audioStartTime + astiav.RescaleQ(r.outStart-r.videoStartTime, videoStream.TimeBase(), audioStream.TimeBase())
+		audioOutEnd = int64(math.MaxInt64)
+		if r.outEnd != math.MaxInt64 {
+			audioOutEnd = audioStartTime + astiav.RescaleQ(r.outEnd-r.videoStartTime, videoStream.TimeBase(), audioStream.TimeBase())
+		}
+	}
+
+	// 片段写入的时长
+	var segmentDuration int64
+	// 更新时间戳并写入输出
+	writePacket := func(packet *astiav.Packet, inputStream, outputStream *astiav.Stream, outStart int64) error {
+		outputOffset := astiav.RescaleQ(offset, astiav.TimeBaseQ, outputStream.TimeBase())
+		packet.SetPts(astiav.RescaleQ(packet.Pts()-outStart, inputStream.TimeBase(), outputStream.TimeBase()) + outputOffset)
+		packet.SetDts(astiav.RescaleQ(packet.Dts()-outStart, inputStream.TimeBase(), outputStream.TimeBase()) + outputOffset)
+		packet.SetDuration(astiav.RescaleQ(packet.Duration(), inputStream.TimeBase(), outputStream.TimeBase()))
+		packet.SetStreamIndex(outputStream.Index())
+		packet.SetPos(-1)
+
+		end := astiav.RescaleQ(packet.Pts()+packet.Duration(), outputStream.TimeBase(), astiav.TimeBaseQ) - offset
+		if end > segmentDuration {
+			segmentDuration = end
+		}
+		// 交叉写入视频输出缓冲区
+		if err := outputFormatCtx.WriteInterleavedFrame(packet); err != nil {
+			return errors.New(fmt.Sprintf("交叉写入数据帧失败: %s", err))
+		}
+		return nil
+	}
+
+	// 精确剪切时重新编码的帧，返回换算到输出时间轴的时间戳，时间基为输入流的时间基
+	interval := frameInterval(videoStream)
+	edgePts := func(pts int64) (int64, bool) {
+		if pts == astiav.NoPtsValue || !r.encodeFrame(pts) {
+			return 0, false
+		}
+		end := astiav.RescaleQ(pts-r.outStart, videoStream.TimeBase(), astiav.TimeBaseQ) + interval
+		if end > segmentDuration {
+			segmentDuration = end
+		}
+		return pts - r.outStart + astiav.RescaleQ(offset, astiav.TimeBaseQ, videoStream.TimeBase()), true
+	}
+	// 当前重新编码的不完整GOP，开始复制GOP前和片段结束时写完
+	var edge *edgeEncoder
+	defer func() {
+		if edge != nil {
+			edge.Free()
+		}
+	}()
+	closeEdge := func() error {
+		err := edge.Close(edgePts)
+		edge.Free()
+		edge = nil
+		return err
+	}
+	// 复制的GOP中解码时间戳比显示时间戳提前的时长，取第一个视频数据包
+	videoDelay := int64(-1)
+	// 精确剪切时复制的关键帧需要带有参数集，前一段可能是重新编码的GOP(包括上一个片段的结尾)，参数集已被替换
+	needParameterSets := options.ExactCut
+	codecParameters := videoStream.CodecParameters()
+	lengthSize := nalLengthSize(codecParameters.CodecID(), codecParameters.ExtraData())
+
+	// 视频和音频都超出剪切范围后不再继续读取
+	currentKey := int64(math.MinInt64)
+	videoDone := false
+	audioDone := audioStream == nil || audioOutputStream == nil
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	for !videoDone || !audioDone {
+		if err = input.fmtCtx.ReadFrame(packet); err != nil {
+			//读到文件尾
+			if errors.Is(err, astiav.ErrEof) {
+				break
+			}
+			return 0, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+
+		if packet.StreamIndex() == videoStream.Index() {
+			if packet.Flags().Has(astiav.PacketFlagKey) {
+				// 进入新的GOP
+				currentKey = packet.Pts()
+			}
+			if currentKey > r.endKey {
+				videoDone = true
+			}
+			if currentKey < r.startKey || currentKey > r.endKey {
+				packet.Unref()
+				continue
+			}
+			if videoDelay < 0 {
+				videoDelay = 0
+				if packet.Pts() != astiav.NoPtsValue && packet.Dts() != astiav.NoPtsValue && packet.Pts() > packet.Dts() {
+					videoDelay = packet.Pts() - packet.Dts()
+				}
+			}
+			if options.ExactCut && !r.copyGop(currentKey) {
+				if edge == nil {
+					if edge, err = newEdgeEncoder(outputFormatCtx, videoOutputStream, videoStream, videoDelay); err != nil {
+						return 0, err
+					}
+				}
+				err = edge.Decode(packet, edgePts)
+			} else {
+				if edge != nil {
+					if err = closeEdge(); err != nil {
+						return 0, err
+					}
+					needParameterSets = true
+				}
+				if needParameterSets && lengthSize > 0 && packet.Flags().Has(astiav.PacketFlagKey) {
+					needParameterSets = false
+					if data := packet.Data(); !hasParameterSets(codecParameters.CodecID(), data, lengthSize) {
+						err = replacePacketData(packet, append(parameterSets(codecParameters.CodecID(), codecParameters.ExtraData(), lengthSize), data...))
+					}
+				}
+				if err == nil {
+					err = writePacket(packet, videoStream, videoOutputStream, r.outStart)
+				}
+			}
+			if err != nil {
+				return 0, err
+			}
+		} else if audioStream != nil && audioOutputStream != nil && packet.StreamIndex() == audioStream.Index() {
+			if packet.Pts() >= audioOutEnd {
+				audioDone = true
+			}
+			if packet.Pts() >= audioOutStart && packet.Pts() < audioOutEnd {
+				if err = writePacket(packet, audioStream, audioOutputStream, audioOutStart); err != nil {
+					return 0, err
+				}
+			}
+		}
+		packet.Unref()
+	}
+	if edge != nil {
+		// 写完终点所在的GOP
+		if err = closeEdge(); err != nil {
+			return 0, err
+		}
+	}
+	return segmentDuration, nil
+}
+
+// frameInterval 视频流每帧的时长，单位为微秒，帧率未知时按25帧计算
+func frameInterval(stream *astiav.Stream) int64 {
+	framerate := stream.AvgFrameRate()
+	if framerate.Num() <= 0 || framerate.Den() <= 0 {
+		return 40000
+	}
+	return int64(framerate.Den()) * 1000000 / int64(framerate.Num())
+}
@@ -0,0 +1,154 @@
+package ffmpegutil
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// DashManifestName DASH清单文件名
+const DashManifestName = "manifest.mpd"
+
+// 清单中的时间单位为毫秒
+const dashTimescale = 1000
+
+// DashSegment 清单中的一个切片
+type DashSegment struct {
+	Uri      string        // 切片地址，使用SegmentTemplate时为空
+	Start    time.Duration // 切片第一个数据帧的时间戳，与切片中tfdt一致
+	Duration time.Duration
+}
+
+// DashPeriod 清单中的一个Period，对应HLS播放列表中两个EXT-X-DISCONTINUITY之间的部分
+// 视频和音频封装在同一个fMP4切片中，作为一个Representation
+type DashPeriod struct {
+	Start     time.Duration // Period在整个清单中的开始时间
+	Media     *MediaInfo
+	Bandwidth int64  // 码率，单位bit/s
+	InitUri   string // 初始化切片地址
+	// MediaTemplate 切片地址模板，如segment$Number$.m4s，不为空时使用SegmentTemplate，为空时使用SegmentList
+	MediaTemplate string
+	StartNumber   int64 // 第一个切片的$Number$
+	Segments      []DashSegment
+}
+
+// DashManifest DASH清单(MPD)
+type DashManifest struct {
+	Dynamic bool // 直播为true，点播为false
+	// AvailabilityStart 直播第一个切片开始的时间，切片时间戳从此刻开始计算
+	AvailabilityStart time.Time
+	MinimumUpdate     time.Duration // 直播清单的更新间隔
+	TimeShiftBuffer   time.Duration // 直播清单中切片的总时长
+	Duration          time.Duration // 点播总时长
+	Periods           []DashPeriod
+}
+
+// Bytes 生成mpd内容
+func (manifest *DashManifest) Bytes() []byte {
+	var maxDuration time.Duration
+	for _, period := range manifest.Periods {
+		for _, segment := range period.Segments {
+			maxDuration = max(maxDuration, segment.Duration)
+		}
+	}
+
+	var builder strings.Builder
+	builder.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	builder.WriteString("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\"")
+	if manifest.Dynamic {
+		builder.WriteString(" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\"")
+		builder.WriteString(fmt.Sprintf(" availabilityStartTime=\"%s\"", manifest.AvailabilityStart.UTC().Format(time.RFC3339Nano)))
+		builder.WriteString(fmt.Sprintf(" publishTime=\"%s\"", time.Now().UTC().Format(time.RFC3339Nano)))
+		builder.WriteString(fmt.Sprintf(" minimumUpdatePeriod=\"%s\"", dashDuration(manifest.MinimumUpdate)))
+		builder.WriteString(fmt.Sprintf(" timeShiftBufferDepth=\"%s\"", dashDuration(manifest.TimeShiftBuffer)))
+		// 落后直播点3个切片播放，与HLS播放器的默认行为一致
+		builder.WriteString(fmt.Sprintf(" suggestedPresentationDelay=\"%s\"", dashDuration(3*maxDuration)))
+	} else {
+		builder.WriteString(" profiles=\"urn:mpeg:dash:profile:full:2011\" type=\"static\"")
+		builder.WriteString(fmt.Sprintf(" mediaPresentationDuration=\"%s\"", dashDuration(manifest.Duration)))
+	}
+	builder.WriteString(fmt.Sprintf(" minBufferTime=\"%s\" maxSegmentDuration=\"%s\">\n", dashDuration(maxDuration), dashDuration(maxDuration)))
+
+	for i, period := range manifest.Periods {
+		if len(period.Segments) == 0 {
+			continue
+		}
+		builder.WriteString(fmt.Sprintf("  <Period id=\"%d\" start=\"%s\">\n", i, dashDuration(period.Start)))
+		media := period.Media
+		if media == nil {
+			media = &MediaInfo{}
+		}
+		builder.WriteString(fmt.Sprintf("    <AdaptationSet id=\"0\" mimeType=\"video/mp4\" codecs=\"%s\" segmentAlignment=\"true\" startWithSAP=\"1\">\n", html.EscapeString(strings.Join(media.Codecs, ","))))
+		builder.WriteString(fmt.Sprintf("      <Representation id=\"0\" bandwidth=\"%d\"", max(period.Bandwidth, 1)))
+		if media.Width > 0 && media.Height > 0 {
+			builder.WriteString(fmt.Sprintf(" width=\"%d\" height=\"%d\"", media.Width, media.Height))
+		}
+		builder.WriteString(">\n")
+
+		// 直播切片时间戳从AvailabilityStart开始计算；点播切片时间戳从片段开头计算，Period从第一个切片开始
+		var offset int64
+		if !manifest.Dynamic {
+			offset = period.Segments[0].Start.Milliseconds()
+		}
+		if period.MediaTemplate != "" {
+			builder.WriteString(fmt.Sprintf("        <SegmentTemplate timescale=\"%d\" presentationTimeOffset=\"%d\" initialization=\"%s\" media=\"%s\" startNumber=\"%d\">\n",
+				dashTimescale, offset, html.EscapeString(period.InitUri), html.EscapeString(period.MediaTemplate), period.StartNumber))
+		} else {
+			builder.WriteString(fmt.Sprintf("        <SegmentList timescale=\"%d\" presentationTimeOffset=\"%d\">\n", dashTimescale, offset))
+			builder.WriteString(fmt.Sprintf("          <Initialization sourceURL=\"%s\"/>\n", html.EscapeString(period.InitUri)))
+		}
+		builder.WriteString("          <SegmentTimeline>\n")
+		for _, segment := range period.Segments {
+			builder.WriteString(fmt.Sprintf("            <S t=\"%d\" d=\"%d\"/>\n", segment.Start.Milliseconds(), segment.Duration.Milliseconds()))
+		}
+		builder.WriteString("          </SegmentTimeline>\n")
+		if period.MediaTemplate != "" {
+			builder.WriteString("        </SegmentTemplate>\n")
+		} else {
+			for _, segment := range period.Segments {
+				builder.WriteString(fmt.Sprintf("          <SegmentURL media=\"%s\"/>\n", html.EscapeString(segment.Uri)))
+			}
+			builder.WriteString("        </SegmentList>\n")
+		}
+		builder.WriteString("      </Representation>\n")
+		builder.WriteString("    </AdaptationSet>\n")
+		builder.WriteString("  </Period>\n")
+	}
+	builder.WriteString("</MPD>\n")
+	return []byte(builder.String())
+}
+
+// dashDuration xs:duration格式的时长，如PT2.000S
+func dashDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// VodManifest 生成多个片段的DASH点播清单，每个片段为一个Period
+// 切片与VodPlaylist完全相同，HLS和DASH共用同一组初始化切片和切片，clip.Media为nil时codecs为空
+func VodManifest(clips []*VodClip, opts *VodOptions) *DashManifest {
+	target := vodTarget(opts)
+	manifest := &DashManifest{}
+	for _, clip := range clips {
+		segments := vodSegments(clip, target)
+		if len(segments) == 0 {
+			continue
+		}
+		period := DashPeriod{
+			Start:     manifest.Duration,
+			Media:     clip.Media,
+			Bandwidth: clip.Bandwidth,
+			InitUri:   clip.Uri + VodInitName,
+		}
+		for _, segment := range segments {
+			period.Segments = append(period.Segments, DashSegment{
+				Uri:      clip.Uri + VodSegmentName(segment.first, segment.last),
+				Start:    segment.start,
+				Duration: segment.end - segment.start,
+			})
+			manifest.Duration += segment.end - segment.start
+		}
+		manifest.Periods = append(manifest.Periods, period)
+	}
+	return manifest
+}
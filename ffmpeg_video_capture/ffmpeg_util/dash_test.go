@@ -0,0 +1,100 @@
+package ffmpegutil
+
+import (
+	"github.com/asticode/go-astiav"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVodManifestBytes(t *testing.T) {
+	index := &KeyframeIndex{TimeBase: astiav.NewRational(1, 1000), Keyframes: []Keyframe{{Pts: 0}, {Pts: 3000}}}
+	trimmed := &KeyframeIndex{TimeBase: astiav.NewRational(1, 1000), Keyframes: []Keyframe{{Pts: 0}, {Pts: 2000}, {Pts: 4000}}}
+	clips := []*VodClip{
+		{
+			Uri:       "a/",
+			Duration:  5 * time.Second,
+			Keyframes: index,
+			Media:     &MediaInfo{Codecs: []string{"avc1.64001f", "mp4a.40.2"}, Width: 1280, Height: 720},
+			Bandwidth: 800000,
+		},
+		// 跳过开头的切片，Period从第一个切片开始
+		{Uri: "b&c/", Duration: 6 * time.Second, Keyframes: trimmed, Start: 2500 * time.Millisecond},
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:full:2011" type="static" mediaPresentationDuration="PT9.000S" minBufferTime="PT3.000S" maxSegmentDuration="PT3.000S">
+  <Period id="0" start="PT0.000S">
+    <AdaptationSet id="0" mimeType="video/mp4" codecs="avc1.64001f,mp4a.40.2" segmentAlignment="true" startWithSAP="1">
+      <Representation id="0" bandwidth="800000" width="1280" height="720">
+        <SegmentList timescale="1000" presentationTimeOffset="0">
+          <Initialization sourceURL="a/init.mp4"/>
+          <SegmentTimeline>
+            <S t="0" d="3000"/>
+            <S t="3000" d="2000"/>
+          </SegmentTimeline>
+          <SegmentURL media="a/0-1.m4s"/>
+          <SegmentURL media="a/1-2.m4s"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+  <Period id="1" start="PT5.000S">
+    <AdaptationSet id="0" mimeType="video/mp4" codecs="" segmentAlignment="true" startWithSAP="1">
+      <Representation id="0" bandwidth="1">
+        <SegmentList timescale="1000" presentationTimeOffset="2000">
+          <Initialization sourceURL="b&amp;c/init.mp4"/>
+          <SegmentTimeline>
+            <S t="2000" d="2000"/>
+            <S t="4000" d="2000"/>
+          </SegmentTimeline>
+          <SegmentURL media="b&amp;c/1-2.m4s"/>
+          <SegmentURL media="b&amp;c/2-3.m4s"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+	if got := string(VodManifest(clips, &VodOptions{SegmentDuration: 2 * time.Second}).Bytes()); got != want {
+		t.Errorf("Bytes() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLiveManifestBytes(t *testing.T) {
+	manifest := &DashManifest{
+		Dynamic:           true,
+		AvailabilityStart: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		MinimumUpdate:     2 * time.Second,
+		TimeShiftBuffer:   6 * time.Second,
+		Periods: []DashPeriod{
+			{
+				Media:         &MediaInfo{Codecs: []string{"avc1.42c01e"}},
+				Bandwidth:     100000,
+				InitUri:       "init.mp4",
+				MediaTemplate: "segment$Number$.m4s",
+				StartNumber:   7,
+				Segments:      []DashSegment{{Start: 14 * time.Second, Duration: 2 * time.Second}, {Start: 16 * time.Second, Duration: 2 * time.Second}},
+			},
+			// 没有切片的Period不输出
+			{InitUri: "empty.mp4"},
+		},
+	}
+	got := string(manifest.Bytes())
+	for _, want := range []string{
+		`type="dynamic"`,
+		`availabilityStartTime="2024-01-02T03:04:05Z"`,
+		`minimumUpdatePeriod="PT2.000S"`,
+		`timeShiftBufferDepth="PT6.000S"`,
+		`suggestedPresentationDelay="PT6.000S"`,
+		`<SegmentTemplate timescale="1000" presentationTimeOffset="0" initialization="init.mp4" media="segment$Number$.m4s" startNumber="7">`,
+		`<S t="14000" d="2000"/>`,
+		`<S t="16000" d="2000"/>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("清单缺少%s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "empty.mp4") || strings.Contains(got, "SegmentURL") || strings.Contains(got, "mediaPresentationDuration") {
+		t.Errorf("清单内容错误:\n%s", got)
+	}
+}
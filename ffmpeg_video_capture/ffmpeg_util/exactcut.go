@@ -0,0 +1,352 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"math"
+)
+
+// copyRange 精确剪切时直接复制的GOP范围，keyFrames为升序排列的关键帧时间戳
+// 起点之后第一个关键帧开始的GOP到最后一个完整落在[from, to)内的GOP直接复制，返回复制的第一个关键帧和之后的第一个关键帧
+// 最后一个GOP的结束时间未知，to为math.MaxInt64(到结尾)时才复制；没有可以复制的GOP时两者相等
+func copyRange(keyFrames []int64, from, to int64) (copyStart, copyEnd int64) {
+	copyStart, copyEnd = math.MaxInt64, math.MaxInt64
+	for i, key := range keyFrames {
+		if key < from {
+			continue
+		}
+		if copyStart == math.MaxInt64 {
+			copyStart = key
+		}
+		next := int64(math.MaxInt64)
+		if i+1 < len(keyFrames) {
+			next = keyFrames[i+1]
+		}
+		if next > to {
+			// 该GOP超出终点，从这里开始重新编码
+			copyEnd = key
+			break
+		}
+	}
+	return copyStart, copyEnd
+}
+
+// copyGop 精确剪切时关键帧为key的GOP是否直接复制
+func (r *segmentRange) copyGop(key int64) bool {
+	return key >= r.copyStart && key < r.copyEnd
+}
+
+// encodeFrame 精确剪切时时间戳为pts的帧是否重新编码，即在剪切范围内且不在直接复制的GOP中
+func (r *segmentRange) encodeFrame(pts int64) bool {
+	return pts >= r.from && pts < r.to && !r.copyGop(pts)
+}
+
+// nalLengthSize extradata为avcC或hvcC时数据包中NAL长度字段的字节数，Annex B格式或其他编码返回0
+func nalLengthSize(codecID astiav.CodecID, extradata []byte) int {
+	switch codecID {
+	case astiav.CodecIDH264:
+		if len(extradata) >= 5 && extradata[0] == 1 {
+			return int(extradata[4]&0x03) + 1
+		}
+	case astiav.CodecIDHevc:
+		if len(extradata) >= 23 && extradata[0] == 1 {
+			return int(extradata[21]&0x03) + 1
+		}
+	}
+	return 0
+}
+
+// annexBToLengthPrefixed Annex B码流转换为NAL长度前缀的格式，lengthSize为长度字段的字节数
+func annexBToLengthPrefixed(data []byte, lengthSize int) []byte {
+	var out []byte
+	for _, nalu := range splitAnnexB(data) {
+		out = appendNalu(out, nalu, lengthSize)
+	}
+	return out
+}
+
+// splitAnnexB 按起始码(00 00 01或00 00 00 01)切分Annex B码流，返回不含起始码的NAL单元
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = append(nalus, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// appendNalu 以lengthSize字节的长度前缀追加NAL单元
+func appendNalu(out, nalu []byte, lengthSize int) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(nalu)))
+	out = append(out, length[4-lengthSize:]...)
+	return append(out, nalu...)
+}
+
+// parameterSets avcC或hvcC中的参数集(h264为SPS/PPS，hevc为VPS/SPS/PPS)，转换为lengthSize字节长度前缀的格式
+func parameterSets(codecID astiav.CodecID, extradata []byte, lengthSize int) []byte {
+	var out []byte
+	// 读取2字节长度的NAL单元，数据不完整时返回false
+	readNalus := func(data []byte, count int) ([]byte, bool) {
+		for ; count > 0; count-- {
+			if len(data) < 2 {
+				return nil, false
+			}
+			size := int(binary.BigEndian.Uint16(data))
+			if len(data) < 2+size {
+				return nil, false
+			}
+			out = appendNalu(out, data[2:2+size], lengthSize)
+			data = data[2+size:]
+		}
+		return data, true
+	}
+	switch codecID {
+	case astiav.CodecIDH264:
+		if len(extradata) < 6 || extradata[0] != 1 {
+			return nil
+		}
+		data, ok := readNalus(extradata[6:], int(extradata[5]&0x1f))
+		if !ok || len(data) < 1 {
+			return nil
+		}
+		if _, ok = readNalus(data[1:], int(data[0])); !ok {
+			return nil
+		}
+	case astiav.CodecIDHevc:
+		if len(extradata) < 23 || extradata[0] != 1 {
+			return nil
+		}
+		data := extradata[23:]
+		for arrays := int(extradata[22]); arrays > 0; arrays-- {
+			if len(data) < 3 {
+				return nil
+			}
+			var ok bool
+			if data, ok = readNalus(data[3:], int(binary.BigEndian.Uint16(data[1:]))); !ok {
+				return nil
+			}
+		}
+	default:
+		return nil
+	}
+	return out
+}
+
+// hasParameterSets lengthSize字节长度前缀格式的数据包中是否带有SPS
+func hasParameterSets(codecID astiav.CodecID, data []byte, lengthSize int) bool {
+	for len(data) > lengthSize {
+		size := 0
+		for _, b := range data[:lengthSize] {
+			size = size<<8 | int(b)
+		}
+		data = data[lengthSize:]
+		if size <= 0 || size > len(data) {
+			return false
+		}
+		switch codecID {
+		case astiav.CodecIDH264:
+			if data[0]&0x1f == 7 {
+				return true
+			}
+		case astiav.CodecIDHevc:
+			if data[0]>>1&0x3f == 33 {
+				return true
+			}
+		}
+		data = data[size:]
+	}
+	return false
+}
+
+// replacePacketData 替换数据包的数据，保留时间戳和标志
+func replacePacketData(packet *astiav.Packet, data []byte) error {
+	pts, dts, duration, flags, streamIndex := packet.Pts(), packet.Dts(), packet.Duration(), packet.Flags(), packet.StreamIndex()
+	packet.Unref()
+	if err := packet.FromData(data); err != nil {
+		return errors.New(fmt.Sprintf("替换数据包数据失败: %s", err))
+	}
+	packet.SetPts(pts)
+	packet.SetDts(dts)
+	packet.SetDuration(duration)
+	packet.SetFlags(flags)
+	packet.SetStreamIndex(streamIndex)
+	return nil
+}
+
+// edgeEncoder 精确剪切时重新编码起点或终点所在的不完整GOP
+// 每段新建解码器和编码器，编码后的第一帧为关键帧，参数集随关键帧在数据包中输出，不修改与复制的GOP共用的输出流参数
+type edgeEncoder struct {
+	formatCtx  *astiav.FormatContext
+	stream     *astiav.Stream // 视频输出流，与直接复制的GOP共用
+	decoderCtx *astiav.CodecContext
+	encoderCtx *astiav.CodecContext
+	swsCtx     *astiav.SoftwareScaleContext
+	frame      *astiav.Frame
+	scaled     *astiav.Frame
+	packet     *astiav.Packet
+	lengthSize int   // 输出流的NAL长度字段字节数，不为0时编码器输出的Annex B转换为长度前缀的格式
+	delay      int64 // 复制的GOP中解码时间戳比显示时间戳提前的时长，单位为输入流的时间基，编码的数据包保持相同的提前量
+	lastPts    int64 // 上一个编码帧的时间戳，保证送入编码器的时间戳递增
+}
+
+// newEdgeEncoder 按输入视频流创建解码器和同编码格式的编码器，编码器不输出B帧
+func newEdgeEncoder(outputFormatCtx *astiav.FormatContext, outputStream, inputStream *astiav.Stream, delay int64) (*edgeEncoder, error) {
+	codecParameters := inputStream.CodecParameters()
+	encoder := astiav.FindEncoder(codecParameters.CodecID())
+	if encoder == nil {
+		return nil, errors.New(fmt.Sprintf("未找到编码器: %s", codecParameters.CodecID()))
+	}
+	decoderCtx, _, err := FindAndOpenDecoderCtx(inputStream)
+	if err != nil {
+		return nil, err
+	}
+	encoderCtx := astiav.AllocCodecContext(encoder)
+	encoderCtx.SetWidth(codecParameters.Width())
+	encoderCtx.SetHeight(codecParameters.Height())
+	encoderCtx.SetPixelFormat(codecParameters.PixelFormat())
+	encoderCtx.SetSampleAspectRatio(codecParameters.SampleAspectRatio())
+	encoderCtx.SetProfile(codecParameters.Profile())
+	encoderCtx.SetLevel(codecParameters.Level())
+	encoderCtx.SetTimeBase(inputStream.TimeBase())
+	encoderCtx.SetFramerate(inputStream.AvgFrameRate())
+	encoderCtx.SetBitRate(codecParameters.BitRate())
+	// 没有B帧时解码时间戳等于显示时间戳，加上复制部分的提前量后与前后复制的数据包保持递增
+	encoderCtx.SetMaxBFrames(0)
+	if err = encoderCtx.Open(encoder, nil); err != nil {
+		encoderCtx.Free()
+		decoderCtx.Free()
+		return nil, errors.New(fmt.Sprintf("无法打开编码器: %s", err))
+	}
+	outputParameters := outputStream.CodecParameters()
+	return &edgeEncoder{
+		formatCtx:  outputFormatCtx,
+		stream:     outputStream,
+		decoderCtx: decoderCtx,
+		encoderCtx: encoderCtx,
+		frame:      astiav.AllocFrame(),
+		scaled:     astiav.AllocFrame(),
+		packet:     astiav.AllocPacket(),
+		lengthSize: nalLengthSize(outputParameters.CodecID(), outputParameters.ExtraData()),
+		delay:      delay,
+		lastPts:    math.MinInt64,
+	}, nil
+}
+
+// Decode 解码数据包，outPts返回需要编码的帧在输出中的时间戳(时间基为输入流的时间基)，不需要编码时返回false
+// packet为nil时取出解码器中缓存的帧
+func (e *edgeEncoder) Decode(packet *astiav.Packet, outPts func(pts int64) (int64, bool)) error {
+	if err := e.decoderCtx.SendPacket(packet); err != nil && !errors.Is(err, astiav.ErrEof) {
+		return errors.New(fmt.Sprintf("数据发送给视频解码器失败: %s", err))
+	}
+	for {
+		if err := e.decoderCtx.ReceiveFrame(e.frame); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+		}
+		if pts, ok := outPts(e.frame.Pts()); ok {
+			if err := e.encode(e.frame, pts); err != nil {
+				e.frame.Unref()
+				return err
+			}
+		}
+		e.frame.Unref()
+	}
+}
+
+// encode 以pts为时间戳编码视频帧，尺寸或像素格式与编码器不同时先转换
+func (e *edgeEncoder) encode(frame *astiav.Frame, pts int64) error {
+	if frame.PixelFormat() != e.encoderCtx.PixelFormat() || frame.Width() != e.encoderCtx.Width() || frame.Height() != e.encoderCtx.Height() {
+		if e.swsCtx == nil {
+			swsCtx, err := astiav.CreateSoftwareScaleContext(frame.Width(), frame.Height(), frame.PixelFormat(),
+				e.encoderCtx.Width(), e.encoderCtx.Height(), e.encoderCtx.PixelFormat(), astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear))
+			if err != nil {
+				return errors.New(fmt.Sprintf("创建图像缩放上下文失败: %s", err))
+			}
+			e.swsCtx = swsCtx
+		}
+		e.scaled.Unref()
+		e.scaled.SetWidth(e.encoderCtx.Width())
+		e.scaled.SetHeight(e.encoderCtx.Height())
+		e.scaled.SetPixelFormat(e.encoderCtx.PixelFormat())
+		if err := e.swsCtx.ScaleFrame(frame, e.scaled); err != nil {
+			return errors.New(fmt.Sprintf("图像像素格式转换失败: %s", err))
+		}
+		frame = e.scaled
+	}
+	if pts <= e.lastPts {
+		pts = e.lastPts + 1
+	}
+	e.lastPts = pts
+	frame.SetPts(pts)
+	frame.SetPictureType(astiav.PictureTypeNone)
+	if err := e.encoderCtx.SendFrame(frame); err != nil {
+		return errors.New(fmt.Sprintf("视频帧发送给编码器失败: %s", err))
+	}
+	return e.receivePackets()
+}
+
+// Close 取出解码器中缓存的帧并刷新编码器，写入剩余的数据包，之后继续复制GOP
+func (e *edgeEncoder) Close(outPts func(pts int64) (int64, bool)) error {
+	if err := e.Decode(nil, outPts); err != nil {
+		return err
+	}
+	if err := e.encoderCtx.SendFrame(nil); err != nil && !errors.Is(err, astiav.ErrEof) {
+		return errors.New(fmt.Sprintf("刷新视频编码器失败: %s", err))
+	}
+	return e.receivePackets()
+}
+
+// receivePackets 取出编码后的数据包，转换为输出流的NAL格式，换算到输出流的时间基后写入输出
+func (e *edgeEncoder) receivePackets() error {
+	for {
+		if err := e.encoderCtx.ReceivePacket(e.packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("从视频编码器获取数据包失败: %s", err))
+		}
+		if e.lengthSize > 0 {
+			if err := replacePacketData(e.packet, annexBToLengthPrefixed(e.packet.Data(), e.lengthSize)); err != nil {
+				e.packet.Unref()
+				return err
+			}
+		}
+		e.packet.SetDts(e.packet.Pts() - e.delay)
+		e.packet.RescaleTs(e.encoderCtx.TimeBase(), e.stream.TimeBase())
+		e.packet.SetStreamIndex(e.stream.Index())
+		e.packet.SetPos(-1)
+		err := e.formatCtx.WriteInterleavedFrame(e.packet)
+		e.packet.Unref()
+		if err != nil {
+			return errors.New(fmt.Sprintf("交叉写入数据帧失败: %s", err))
+		}
+	}
+}
+
+// Free 释放解码器和编码器
+func (e *edgeEncoder) Free() {
+	if e.swsCtx != nil {
+		e.swsCtx.Free()
+	}
+	e.packet.Free()
+	e.scaled.Free()
+	e.frame.Free()
+	e.encoderCtx.Free()
+	e.decoderCtx.Free()
+}
@@ -0,0 +1,131 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"github.com/asticode/go-astiav"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCopyRange(t *testing.T) {
+	keyFrames := []int64{0, 1000, 2000, 3000, 4000}
+	tests := []struct {
+		name          string
+		from, to      int64
+		wantStart     int64
+		wantEnd       int64
+		wantCopyCount int // 直接复制的GOP个数
+	}{
+		{"起止都在GOP中间", 1500, 3500, 2000, 3000, 1},
+		{"起点在关键帧上", 1000, 3500, 1000, 3000, 2},
+		{"终点在关键帧上", 1500, 4000, 2000, 4000, 2},
+		{"到结尾", 1500, math.MaxInt64, 2000, math.MaxInt64, 3},
+		{"在同一个GOP中", 1200, 1800, 2000, 2000, 0},
+		{"相邻的两个GOP", 1500, 2500, 2000, 2000, 0},
+		{"起点在最后一个关键帧之后", 4500, math.MaxInt64, math.MaxInt64, math.MaxInt64, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end := copyRange(keyFrames, test.from, test.to)
+			if start != test.wantStart || end != test.wantEnd {
+				t.Errorf("copyRange() = %d, %d, want %d, %d", start, end, test.wantStart, test.wantEnd)
+			}
+			r := &segmentRange{from: test.from, to: test.to, copyStart: start, copyEnd: end}
+			count := 0
+			for _, key := range keyFrames {
+				if r.copyGop(key) {
+					count++
+				}
+			}
+			if count != test.wantCopyCount {
+				t.Errorf("复制的GOP个数 = %d, want %d", count, test.wantCopyCount)
+			}
+		})
+	}
+}
+
+func TestExactCutCopiesMiddle(t *testing.T) {
+	// 每秒一个GOP，每帧100ms，数据为帧的时间戳
+	type packet struct {
+		pts  int64
+		key  bool
+		data []byte
+	}
+	var packets []packet
+	for pts := int64(0); pts < 5000; pts += 100 {
+		packets = append(packets, packet{pts: pts, key: pts%1000 == 0, data: []byte{byte(pts / 100), 0xaa, byte(pts / 1000)}})
+	}
+	keyFrames := []int64{0, 1000, 2000, 3000, 4000}
+	r := &segmentRange{from: 1500, to: 3500, startKey: 1000, endKey: 3000}
+	r.copyStart, r.copyEnd = copyRange(keyFrames, r.from, r.to)
+
+	// 按writeSegment的方式分流：范围外的GOP跳过，复制的GOP原样输出，其他GOP解码后只编码范围内的帧
+	var copied []packet
+	var encoded []int64
+	currentKey := int64(math.MinInt64)
+	for _, p := range packets {
+		if p.key {
+			currentKey = p.pts
+		}
+		if currentKey < r.startKey || currentKey > r.endKey {
+			continue
+		}
+		if r.copyGop(currentKey) {
+			copied = append(copied, p)
+		} else if r.encodeFrame(p.pts) {
+			encoded = append(encoded, p.pts)
+		}
+	}
+
+	if len(copied) != 10 || copied[0].pts != 2000 || copied[len(copied)-1].pts != 2900 {
+		t.Fatalf("复制的数据包应为2000到2900的完整GOP，实际%d个", len(copied))
+	}
+	for _, p := range copied {
+		want := []byte{byte(p.pts / 100), 0xaa, byte(p.pts / 1000)}
+		if !bytes.Equal(p.data, want) {
+			t.Errorf("复制的数据包%d被修改", p.pts)
+		}
+	}
+	wantEncoded := []int64{1500, 1600, 1700, 1800, 1900, 3000, 3100, 3200, 3300, 3400}
+	if !reflect.DeepEqual(encoded, wantEncoded) {
+		t.Errorf("重新编码的帧 = %v, want %v", encoded, wantEncoded)
+	}
+}
+
+func TestAnnexBToLengthPrefixed(t *testing.T) {
+	data := []byte{0, 0, 0, 1, 0x67, 1, 2, 0, 0, 1, 0x68, 3, 0, 0, 0, 1, 0x65, 4, 5, 6}
+	want := []byte{0, 0, 0, 3, 0x67, 1, 2, 0, 0, 0, 2, 0x68, 3, 0, 0, 0, 4, 0x65, 4, 5, 6}
+	if got := annexBToLengthPrefixed(data, 4); !bytes.Equal(got, want) {
+		t.Errorf("annexBToLengthPrefixed() = %v, want %v", got, want)
+	}
+	if got := annexBToLengthPrefixed(data, 2); !bytes.Equal(got, []byte{0, 3, 0x67, 1, 2, 0, 2, 0x68, 3, 0, 4, 0x65, 4, 5, 6}) {
+		t.Errorf("2字节长度前缀 = %v", got)
+	}
+}
+
+func TestParameterSets(t *testing.T) {
+	// avcC：版本、profile、兼容标志、level、长度字段4字节，1个SPS和1个PPS
+	avcC := []byte{1, 0x64, 0, 0x1f, 0xff, 0xe1, 0, 3, 0x67, 1, 2, 1, 0, 2, 0x68, 3}
+	if size := nalLengthSize(astiav.CodecIDH264, avcC); size != 4 {
+		t.Fatalf("nalLengthSize() = %d", size)
+	}
+	if size := nalLengthSize(astiav.CodecIDH264, []byte{0, 0, 0, 1, 0x67}); size != 0 {
+		t.Errorf("Annex B的extradata nalLengthSize() = %d, want 0", size)
+	}
+	params := parameterSets(astiav.CodecIDH264, avcC, 4)
+	if want := []byte{0, 0, 0, 3, 0x67, 1, 2, 0, 0, 0, 2, 0x68, 3}; !bytes.Equal(params, want) {
+		t.Errorf("parameterSets() = %v, want %v", params, want)
+	}
+	if parameterSets(astiav.CodecIDH264, avcC[:10], 4) != nil {
+		t.Error("avcC不完整时应返回nil")
+	}
+
+	idr := []byte{0, 0, 0, 2, 0x65, 4}
+	if hasParameterSets(astiav.CodecIDH264, idr, 4) {
+		t.Error("只有IDR的数据包不应带有参数集")
+	}
+	if !hasParameterSets(astiav.CodecIDH264, append(params, idr...), 4) {
+		t.Error("带有SPS的数据包应返回true")
+	}
+}
@@ -0,0 +1,177 @@
+package ffmpegutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+)
+
+// 移动数据时每次读写的长度
+const relocateChunkSize = 1024 * 1024
+
+// 包含块偏移表(stco/co64)的容器盒子
+var mp4Containers = map[string]bool{
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+}
+
+// mp4Box mp4的一个顶层盒子
+type mp4Box struct {
+	kind   string
+	offset int64 // 盒子在文件中的位置
+	size   int64 // 盒子长度，包括盒子头
+	header int64 // 盒子头长度，8或16
+}
+
+// relocateMoov 把[start, end)范围内的mp4末尾的moov移到mdat之前，浏览器下载到moov后即可开始播放
+// 从后往前分块移动mdat，内存中只保留moov和一个块，返回mdat后移的长度，moov已经在mdat之前时为0
+// 移动后块偏移超出32位时保留原来的布局
+func relocateMoov(file interface {
+	io.ReaderAt
+	io.WriterAt
+}, start, end int64) (shift int64, err error) {
+	boxes, err := readMp4Boxes(file, start, end)
+	if err != nil {
+		return 0, err
+	}
+	moovIndex, mdatIndex := -1, -1
+	for i, box := range boxes {
+		if box.kind == "moov" && moovIndex < 0 {
+			moovIndex = i
+		} else if box.kind == "mdat" && mdatIndex < 0 {
+			mdatIndex = i
+		}
+	}
+	if moovIndex < 0 || mdatIndex < 0 {
+		return 0, errors.New("mp4中未找到moov或mdat")
+	}
+	if moovIndex < mdatIndex {
+		return 0, nil
+	}
+
+	moovBox, mdatBox := boxes[moovIndex], boxes[mdatIndex]
+	moov := make([]byte, moovBox.size)
+	if _, err = file.ReadAt(moov, moovBox.offset); err != nil {
+		return 0, errors.New(fmt.Sprintf("读取moov失败: %s", err))
+	}
+	// 先修改块偏移，失败时文件还没有修改
+	if err = shiftChunkOffsets(moov[moovBox.header:], moovBox.size); err != nil {
+		log.Printf("moov不能移到文件开头，保留在末尾: %s", err)
+		return 0, nil
+	}
+	// 从后往前移动，不会覆盖还没有移动的数据
+	chunk := make([]byte, relocateChunkSize)
+	for position := moovBox.offset; position > mdatBox.offset; {
+		n := min(int64(len(chunk)), position-mdatBox.offset)
+		position -= n
+		if _, err = file.ReadAt(chunk[:n], position); err != nil {
+			return 0, errors.New(fmt.Sprintf("读取mdat失败: %s", err))
+		}
+		if _, err = file.WriteAt(chunk[:n], position+moovBox.size); err != nil {
+			return 0, errors.New(fmt.Sprintf("移动mdat失败: %s", err))
+		}
+	}
+	if _, err = file.WriteAt(moov, mdatBox.offset); err != nil {
+		return 0, errors.New(fmt.Sprintf("写入moov失败: %s", err))
+	}
+	return moovBox.size, nil
+}
+
+// readMp4Boxes 读取[start, end)范围内的顶层盒子
+func readMp4Boxes(file io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	header := make([]byte, 16)
+	for offset := start; offset < end; {
+		if end-offset < 8 {
+			return nil, errors.New("mp4盒子头不完整")
+		}
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return nil, errors.New(fmt.Sprintf("读取mp4盒子头失败: %s", err))
+		}
+		box := mp4Box{kind: string(header[4:8]), offset: offset, size: int64(binary.BigEndian.Uint32(header)), header: 8}
+		switch box.size {
+		case 0:
+			// 长度为0时延伸到文件末尾
+			box.size = end - offset
+		case 1:
+			// 长度为1时使用64位长度
+			if end-offset < 16 {
+				return nil, errors.New("mp4盒子头不完整")
+			}
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, errors.New(fmt.Sprintf("读取mp4盒子头失败: %s", err))
+			}
+			box.size = int64(binary.BigEndian.Uint64(header[8:16]))
+			box.header = 16
+		}
+		if box.size < box.header || box.size > end-offset {
+			return nil, errors.New(fmt.Sprintf("mp4盒子%s长度错误", box.kind))
+		}
+		boxes = append(boxes, box)
+		offset += box.size
+	}
+	return boxes, nil
+}
+
+// shiftChunkOffsets 把data中全部块偏移表(stco/co64)的偏移加上shift，data为容器盒子的内容
+func shiftChunkOffsets(data []byte, shift int64) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errors.New("moov数据不完整")
+		}
+		kind := string(data[4:8])
+		size, header := int64(binary.BigEndian.Uint32(data)), int64(8)
+		switch size {
+		case 0:
+			size = int64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return errors.New("moov数据不完整")
+			}
+			size, header = int64(binary.BigEndian.Uint64(data[8:16])), 16
+		}
+		if size < header || size > int64(len(data)) {
+			return errors.New(fmt.Sprintf("moov中盒子%s长度错误", kind))
+		}
+		payload := data[header:size]
+		switch {
+		case mp4Containers[kind]:
+			if err := shiftChunkOffsets(payload, shift); err != nil {
+				return err
+			}
+		case kind == "stco" || kind == "co64":
+			// 1字节版本、3字节标志、4字节条目数，之后是每个块的偏移
+			if len(payload) < 8 {
+				return errors.New(fmt.Sprintf("%s数据不完整", kind))
+			}
+			count := int(binary.BigEndian.Uint32(payload[4:8]))
+			entries := payload[8:]
+			if kind == "stco" {
+				if len(entries) < count*4 {
+					return errors.New("stco数据不完整")
+				}
+				for i := 0; i < count; i++ {
+					offset := int64(binary.BigEndian.Uint32(entries[i*4:])) + shift
+					if offset > math.MaxUint32 {
+						return errors.New("块偏移超出32位")
+					}
+					binary.BigEndian.PutUint32(entries[i*4:], uint32(offset))
+				}
+			} else {
+				if len(entries) < count*8 {
+					return errors.New("co64数据不完整")
+				}
+				for i := 0; i < count; i++ {
+					binary.BigEndian.PutUint64(entries[i*8:], binary.BigEndian.Uint64(entries[i*8:])+uint64(shift))
+				}
+			}
+		}
+		data = data[size:]
+	}
+	return nil
+}
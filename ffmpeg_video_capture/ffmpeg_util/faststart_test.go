@@ -0,0 +1,167 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"ffmpeg_video_capture/buffer"
+	"math"
+	"testing"
+)
+
+// mp4TestBox 长度为32位的盒子
+func mp4TestBox(kind string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	return append(append(box, kind...), data...)
+}
+
+// mp4TestBox64 长度为64位的盒子
+func mp4TestBox64(kind string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	box := binary.BigEndian.AppendUint32(nil, 1)
+	box = append(box, kind...)
+	box = binary.BigEndian.AppendUint64(box, uint64(16+len(data)))
+	return append(box, data...)
+}
+
+// stcoBox 32位块偏移表
+func stcoBox(offsets ...uint32) []byte {
+	payload := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(offsets)))
+	for _, offset := range offsets {
+		payload = binary.BigEndian.AppendUint32(payload, offset)
+	}
+	return mp4TestBox("stco", payload)
+}
+
+// co64Box 64位块偏移表
+func co64Box(offsets ...uint64) []byte {
+	payload := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(offsets)))
+	for _, offset := range offsets {
+		payload = binary.BigEndian.AppendUint64(payload, offset)
+	}
+	return mp4TestBox("co64", payload)
+}
+
+// testMoov 包含两个轨道的moov，分别使用stco和co64
+func testMoov(stco []uint32, co64 []uint64) []byte {
+	return mp4TestBox("moov",
+		mp4TestBox("mvhd", make([]byte, 100)),
+		mp4TestBox("trak", mp4TestBox("mdia", mp4TestBox("minf", mp4TestBox("stbl", mp4TestBox("stsd", make([]byte, 16)), stcoBox(stco...))))),
+		mp4TestBox("trak", mp4TestBox("mdia", mp4TestBox("minf", mp4TestBox64("stbl", co64Box(co64...))))),
+	)
+}
+
+func TestShiftChunkOffsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		moov    []byte
+		shift   int64
+		want    []byte
+		wantErr bool
+	}{
+		{"32位和64位偏移", testMoov([]uint32{48, 1000}, []uint64{2000}), 500,
+			testMoov([]uint32{548, 1500}, []uint64{2500}), false},
+		{"stco不超出32位", testMoov([]uint32{math.MaxUint32 - 100}, nil), 100,
+			testMoov([]uint32{math.MaxUint32}, nil), false},
+		// 移动后超过4GiB的偏移不能用stco表示
+		{"stco超出32位", testMoov([]uint32{math.MaxUint32 - 100}, nil), 101, nil, true},
+		{"co64超过4GiB", testMoov(nil, []uint64{math.MaxUint32 - 100}), 200,
+			testMoov(nil, []uint64{math.MaxUint32 + 100}), false},
+		{"块偏移表不完整", mp4TestBox("moov", mp4TestBox("stco", binary.BigEndian.AppendUint32(make([]byte, 4), 2), make([]byte, 4))), 1, nil, true},
+		{"盒子长度错误", append(mp4TestBox("moov"), 0, 0, 0, 99, 't', 'r', 'a', 'k'), 1, nil, true},
+		{"盒子头不完整", append(mp4TestBox("moov"), 0, 0, 0), 1, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 与relocateMoov相同，传入moov盒子的内容
+			moov := bytes.Clone(test.moov)
+			err := shiftChunkOffsets(moov[8:], test.shift)
+			if test.wantErr {
+				if err == nil {
+					t.Error("shiftChunkOffsets() 应返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(moov, test.want) {
+				t.Errorf("shiftChunkOffsets() = %x, want %x", moov, test.want)
+			}
+		})
+	}
+}
+
+func TestRelocateMoov(t *testing.T) {
+	prefix := []byte("prefix")
+	ftyp := mp4TestBox("ftyp", []byte("isom\x00\x00\x02\x00"))
+	// mdat超过一个移动块，测试分块从后往前移动
+	payload := make([]byte, relocateChunkSize*2+12345)
+	for i := range payload {
+		payload[i] = byte(i * 31)
+	}
+	mdat := mp4TestBox("mdat", payload)
+	mdatOffset := int64(len(prefix) + len(ftyp))
+	dataOffset := uint32(mdatOffset + 8)
+	moov := testMoov([]uint32{dataOffset, dataOffset + 100}, []uint64{uint64(dataOffset) + 200})
+
+	tests := []struct {
+		name      string
+		file      [][]byte
+		wantShift int64
+		want      [][]byte
+		wantErr   bool
+	}{
+		{"moov在末尾", [][]byte{prefix, ftyp, mdat, moov}, int64(len(moov)),
+			[][]byte{prefix, ftyp, testMoov(
+				[]uint32{dataOffset + uint32(len(moov)), dataOffset + uint32(len(moov)) + 100},
+				[]uint64{uint64(dataOffset) + uint64(len(moov)) + 200}), mdat}, false},
+		{"已经是faststart", [][]byte{prefix, ftyp, moov, mdat}, 0, [][]byte{prefix, ftyp, moov, mdat}, false},
+		// 移动后超出32位时保留原来的布局
+		{"偏移超出32位", [][]byte{prefix, ftyp, mdat, testMoov([]uint32{math.MaxUint32 - 10}, nil)}, 0,
+			[][]byte{prefix, ftyp, mdat, testMoov([]uint32{math.MaxUint32 - 10}, nil)}, false},
+		{"没有moov", [][]byte{prefix, ftyp, mdat}, 0, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := buffer.NewBuffer(bytes.Join(test.file, nil))
+			end := int64(len(file.Bytes()))
+			shift, err := relocateMoov(file, int64(len(prefix)), end)
+			if test.wantErr {
+				if err == nil {
+					t.Error("relocateMoov() 应返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shift != test.wantShift {
+				t.Errorf("relocateMoov() = %d, want %d", shift, test.wantShift)
+			}
+			if want := bytes.Join(test.want, nil); !bytes.Equal(file.Bytes(), want) {
+				t.Errorf("移动后的文件内容错误，长度%d，want %d", len(file.Bytes()), len(want))
+			}
+		})
+	}
+}
+
+func TestReadMp4Boxes(t *testing.T) {
+	data := bytes.Join([][]byte{mp4TestBox("ftyp", make([]byte, 8)), mp4TestBox64("mdat", make([]byte, 10)), mp4TestBox("free")}, nil)
+	boxes, err := readMp4Boxes(buffer.NewBuffer(data), 0, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mp4Box{{"ftyp", 0, 16, 8}, {"mdat", 16, 26, 16}, {"free", 42, 8, 8}}
+	if len(boxes) != len(want) {
+		t.Fatalf("readMp4Boxes() = %+v", boxes)
+	}
+	for i := range want {
+		if boxes[i] != want[i] {
+			t.Errorf("readMp4Boxes()[%d] = %+v, want %+v", i, boxes[i], want[i])
+		}
+	}
+	if _, err = readMp4Boxes(buffer.NewBuffer(data), 0, int64(len(data))-1); err == nil {
+		t.Error("盒子超出范围时应返回错误")
+	}
+}
@@ -22,13 +22,24 @@ func CreateStreamAndCopyParams(fmtCtx *astiav.FormatContext, srcStream *astiav.S
 
 // 打开流并查找流信息
 func GetInputFormatContext(input string, options *astiav.Dictionary) (*astiav.FormatContext, error) {
+	return GetInputFormatContextWithInterrupter(input, options, nil)
+}
+
+// 打开流并查找流信息，interrupter不为nil时可以中断阻塞的打开和读取
+func GetInputFormatContextWithInterrupter(input string, options *astiav.Dictionary, interrupter *astiav.IOInterrupter) (*astiav.FormatContext, error) {
 	// 打开流
 	inputFormatContext := astiav.AllocFormatContext()
+	if interrupter != nil {
+		inputFormatContext.SetIOInterrupter(interrupter)
+	}
 	if err := inputFormatContext.OpenInput(input, nil, options); err != nil {
+		inputFormatContext.Free()
 		return nil, err
 	}
 	// 查找流信息
 	if err := inputFormatContext.FindStreamInfo(nil); err != nil {
+		inputFormatContext.CloseInput()
+		inputFormatContext.Free()
 		return nil, err
 	}
 	return inputFormatContext, nil
@@ -0,0 +1,90 @@
+package ffmpegutil
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+)
+
+// videoFilter 单输入单输出的视频滤镜图
+type videoFilter struct {
+	graph *astiav.FilterGraph
+	src   *astiav.BuffersrcFilterContext
+	sink  *astiav.BuffersinkFilterContext
+}
+
+// newVideoFilter 按滤镜描述创建滤镜图，输入参数取自frame，timeBase为输入帧时间戳的时间基
+func newVideoFilter(description string, frame *astiav.Frame, timeBase astiav.Rational) (*videoFilter, error) {
+	filter := &videoFilter{graph: astiav.AllocFilterGraph()}
+	var err error
+	if filter.src, err = filter.graph.NewBuffersrcFilterContext(astiav.FindFilterByName("buffer"), "in"); err != nil {
+		filter.Free()
+		return nil, errors.New(fmt.Sprintf("创建滤镜输入失败: %s", err))
+	}
+	params := astiav.AllocBuffersrcFilterContextParameters()
+	defer params.Free()
+	params.SetWidth(frame.Width())
+	params.SetHeight(frame.Height())
+	params.SetPixelFormat(frame.PixelFormat())
+	params.SetSampleAspectRatio(frame.SampleAspectRatio())
+	params.SetTimeBase(timeBase)
+	if err = filter.src.SetParameters(params); err != nil {
+		filter.Free()
+		return nil, errors.New(fmt.Sprintf("设置滤镜输入参数失败: %s", err))
+	}
+	if err = filter.src.Initialize(); err != nil {
+		filter.Free()
+		return nil, errors.New(fmt.Sprintf("初始化滤镜输入失败: %s", err))
+	}
+	if filter.sink, err = filter.graph.NewBuffersinkFilterContext(astiav.FindFilterByName("buffersink"), "out"); err != nil {
+		filter.Free()
+		return nil, errors.New(fmt.Sprintf("创建滤镜输出失败: %s", err))
+	}
+
+	outputs := astiav.AllocFilterInOut()
+	defer outputs.Free()
+	outputs.SetName("in")
+	outputs.SetFilterContext(filter.src.FilterContext())
+	outputs.SetPadIdx(0)
+	inputs := astiav.AllocFilterInOut()
+	defer inputs.Free()
+	inputs.SetName("out")
+	inputs.SetFilterContext(filter.sink.FilterContext())
+	inputs.SetPadIdx(0)
+	if err = filter.graph.Parse(description, inputs, outputs); err != nil {
+		filter.Free()
+		return nil, errors.New(fmt.Sprintf("解析滤镜失败，%s: %s", description, err))
+	}
+	if err = filter.graph.Configure(); err != nil {
+		filter.Free()
+		return nil, errors.New(fmt.Sprintf("配置滤镜失败: %s", err))
+	}
+	return filter, nil
+}
+
+// Filter 输入一帧，frame为nil时表示输入结束，每个输出帧调用一次handle，handle返回后输出帧会被释放
+func (filter *videoFilter) Filter(frame *astiav.Frame, handle func(*astiav.Frame) error) error {
+	if err := filter.src.AddFrame(frame, astiav.NewBuffersrcFlags(astiav.BuffersrcFlagKeepRef)); err != nil {
+		return errors.New(fmt.Sprintf("视频帧发送给滤镜失败: %s", err))
+	}
+	output := astiav.AllocFrame()
+	defer output.Free()
+	for {
+		if err := filter.sink.GetFrame(output, astiav.NewBuffersinkFlags()); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("从滤镜获取视频帧失败: %s", err))
+		}
+		err := handle(output)
+		output.Unref()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Free 释放滤镜图
+func (filter *videoFilter) Free() {
+	filter.graph.Free()
+}
@@ -0,0 +1,247 @@
+package ffmpegutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 直播HLS输出的文件名
+const (
+	HlsPlaylistName = "index.m3u8" // 播放列表
+	HlsInitName     = "init.mp4"   // fMP4初始化切片
+)
+
+// HlsOptions 直播HLS参数
+type HlsOptions struct {
+	SegmentDuration time.Duration // 目标切片时长，在关键帧处切分，为0时为2秒
+	ListSize        int           // 播放列表中的切片个数，为0时为6
+	SegmentType     string        // 切片格式，mpegts或fmp4，为空时为mpegts
+}
+
+// LiveHls 直播HLS输出，将直播输入切片后写入存储，并维护滚动的播放列表
+// fmp4切片时同时维护DASH清单，HLS和DASH共用同一组切片
+type LiveHls struct {
+	store    SegmentStore
+	opts     HlsOptions
+	mutex    sync.Mutex
+	segments []*hlsSegment // 播放列表窗口内和等待删除的切片
+	media    *MediaInfo
+	// targetDuration 播放列表的EXT-X-TARGETDURATION，从SegmentDuration开始只增不减
+	// 关键帧间隔大于切片时长时切片会超过SegmentDuration，播放过程中目标时长不能变小
+	targetDuration time.Duration
+	// availabilityStart 第一个切片开始的时间，DASH清单中切片的时间从此刻开始计算
+	availabilityStart time.Time
+}
+
+// hlsSegment 已写入存储的切片
+type hlsSegment struct {
+	name     string
+	sequence int64
+	start    time.Duration
+	duration time.Duration
+	size     int
+}
+
+// NewLiveHls 新建直播HLS输出，store为切片和播放列表的存储
+func NewLiveHls(store SegmentStore, opts *HlsOptions) *LiveHls {
+	hls := &LiveHls{store: store}
+	if opts != nil {
+		hls.opts = *opts
+	}
+	if hls.opts.SegmentDuration <= 0 {
+		hls.opts.SegmentDuration = 2 * time.Second
+	}
+	if hls.opts.ListSize <= 0 {
+		hls.opts.ListSize = 6
+	}
+	if hls.opts.SegmentType == "" {
+		hls.opts.SegmentType = SegmentTs
+	}
+	hls.targetDuration = hls.opts.SegmentDuration
+	return hls
+}
+
+// Run 拉流并持续切片，直到ctx取消或输入出错，结束时在播放列表末尾写入EXT-X-ENDLIST
+func (hls *LiveHls) Run(ctx context.Context, url string) error {
+	return hls.RunInput(ctx, UrlInput(url))
+}
+
+// RunInput 从地址或读取器切片，读取器读完后写入EXT-X-ENDLIST并返回nil
+func (hls *LiveHls) RunInput(ctx context.Context, input *Input) error {
+	segmentOptions := &SegmentOptions{Format: hls.opts.SegmentType, Duration: hls.opts.SegmentDuration}
+	err := SegmentInput(ctx, input, segmentOptions, func(init *SegmentInit) error {
+		hls.mutex.Lock()
+		hls.media = init.Media
+		hls.mutex.Unlock()
+		if init.Data == nil {
+			return nil
+		}
+		return hls.store.Put(HlsInitName, init.Data)
+	}, hls.addSegment)
+	hls.mutex.Lock()
+	defer hls.mutex.Unlock()
+	if playlistErr := hls.writePlaylist(true); playlistErr != nil {
+		log.Printf("写入HLS播放列表失败: %s", playlistErr)
+	}
+	return err
+}
+
+// addSegment 保存切片，更新播放列表，删除移出窗口的切片
+func (hls *LiveHls) addSegment(segment *LiveSegment) error {
+	extension := ".ts"
+	if hls.opts.SegmentType == SegmentFmp4 {
+		extension = ".m4s"
+	}
+	name := fmt.Sprintf("segment%d%s", segment.Sequence, extension)
+	if err := hls.store.Put(name, segment.Data); err != nil {
+		return err
+	}
+
+	hls.mutex.Lock()
+	defer hls.mutex.Unlock()
+	if hls.availabilityStart.IsZero() {
+		hls.availabilityStart = time.Now().Add(-segment.Start - segment.Duration)
+	}
+	hls.segments = append(hls.segments, &hlsSegment{
+		name:     name,
+		sequence: segment.Sequence,
+		start:    segment.Start,
+		duration: segment.Duration,
+		size:     len(segment.Data),
+	})
+	hls.targetDuration = max(hls.targetDuration, segment.Duration)
+	if err := hls.writePlaylist(false); err != nil {
+		return err
+	}
+	// 移出窗口的切片保留2个再删除，播放器可能正在下载刚移出窗口的切片
+	for len(hls.segments) > hls.opts.ListSize+2 {
+		if err := hls.store.Delete(hls.segments[0].name); err != nil {
+			log.Printf("删除HLS切片失败: %s", err)
+		}
+		hls.segments = hls.segments[1:]
+	}
+	return nil
+}
+
+// window 播放列表窗口内的切片
+func (hls *LiveHls) window() []*hlsSegment {
+	return hls.segments[max(len(hls.segments)-hls.opts.ListSize, 0):]
+}
+
+// writePlaylist 写入窗口内切片的播放列表，fmp4切片时同时写入DASH清单
+func (hls *LiveHls) writePlaylist(ended bool) error {
+	window := hls.window()
+	if len(window) == 0 {
+		return nil
+	}
+	entries := make([]HlsEntry, 0, len(window))
+	for _, segment := range window {
+		entries = append(entries, HlsEntry{Uri: segment.name, Duration: segment.duration})
+	}
+	playlist := &HlsPlaylist{MediaSequence: window[0].sequence, TargetDuration: hls.targetDuration, Entries: entries, Ended: ended}
+	if hls.opts.SegmentType == SegmentFmp4 {
+		playlist.InitUri = HlsInitName
+	}
+	if err := hls.store.Put(HlsPlaylistName, playlist.Bytes()); err != nil {
+		return err
+	}
+	if hls.opts.SegmentType != SegmentFmp4 {
+		return nil
+	}
+	return hls.store.Put(DashManifestName, hls.manifest(ended).Bytes())
+}
+
+// manifest 窗口内切片的DASH清单，结束后改为点播清单，只能播放窗口内的切片
+func (hls *LiveHls) manifest(ended bool) *DashManifest {
+	window := hls.window()
+	period := DashPeriod{
+		Media:         hls.media,
+		InitUri:       HlsInitName,
+		MediaTemplate: "segment$Number$.m4s",
+		StartNumber:   window[0].sequence,
+	}
+	var total time.Duration
+	for _, segment := range window {
+		period.Segments = append(period.Segments, DashSegment{Start: segment.start, Duration: segment.duration})
+		total += segment.duration
+		// 按窗口内码率最高的切片估算
+		if segment.duration > 0 {
+			period.Bandwidth = max(period.Bandwidth, int64(float64(segment.size*8)/segment.duration.Seconds()))
+		}
+	}
+	manifest := &DashManifest{
+		Dynamic:           !ended,
+		AvailabilityStart: hls.availabilityStart,
+		MinimumUpdate:     hls.opts.SegmentDuration,
+		TimeShiftBuffer:   total,
+		Duration:          total,
+		Periods:           []DashPeriod{period},
+	}
+	return manifest
+}
+
+// HlsEntry 播放列表中的一个切片
+type HlsEntry struct {
+	Uri           string
+	Duration      time.Duration
+	Discontinuity bool   // 与上一个切片的时间戳不连续，如来自不同的片段
+	Map           string // 不为空时在该切片前写入EXT-X-MAP，之后的切片使用该初始化切片
+}
+
+// HlsPlaylist HLS媒体播放列表
+type HlsPlaylist struct {
+	MediaSequence int64
+	// TargetDuration EXT-X-TARGETDURATION，直播时应在播放过程中保持不变，小于最长的切片时使用最长切片的时长
+	TargetDuration time.Duration
+	InitUri        string // fMP4初始化切片地址，为空时为ts切片
+	Entries        []HlsEntry
+	Ended          bool   // 是否写入EXT-X-ENDLIST
+	Type           string // EXT-X-PLAYLIST-TYPE，直播时为空，点播时为VOD
+}
+
+// Bytes 生成m3u8内容
+func (playlist *HlsPlaylist) Bytes() []byte {
+	targetDuration := playlist.TargetDuration
+	for _, entry := range playlist.Entries {
+		targetDuration = max(targetDuration, entry.Duration)
+	}
+	version := 3
+	if playlist.InitUri != "" {
+		version = 7
+	}
+	for _, entry := range playlist.Entries {
+		if entry.Map != "" {
+			version = 7
+		}
+	}
+
+	var builder strings.Builder
+	builder.WriteString("#EXTM3U\n")
+	builder.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", version))
+	builder.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration.Seconds()))))
+	builder.WriteString(fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", playlist.MediaSequence))
+	if playlist.Type != "" {
+		builder.WriteString(fmt.Sprintf("#EXT-X-PLAYLIST-TYPE:%s\n", playlist.Type))
+	}
+	if playlist.InitUri != "" {
+		builder.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", playlist.InitUri))
+	}
+	for _, entry := range playlist.Entries {
+		if entry.Discontinuity {
+			builder.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if entry.Map != "" {
+			builder.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", entry.Map))
+		}
+		builder.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n%s\n", entry.Duration.Seconds(), entry.Uri))
+	}
+	if playlist.Ended {
+		builder.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return []byte(builder.String())
+}
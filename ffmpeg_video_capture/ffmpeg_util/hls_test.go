@@ -0,0 +1,83 @@
+package ffmpegutil
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHlsPlaylistBytes(t *testing.T) {
+	playlist := &HlsPlaylist{
+		MediaSequence: 5,
+		InitUri:       "init.mp4",
+		Entries: []HlsEntry{
+			{Uri: "a.m4s", Duration: 2 * time.Second},
+			{Uri: "b.m4s", Duration: 2100 * time.Millisecond, Discontinuity: true},
+		},
+		Ended: true,
+		Type:  "VOD",
+	}
+	want := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-TARGETDURATION:3\n" +
+		"#EXT-X-MEDIA-SEQUENCE:5\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+		"#EXTINF:2.000,\na.m4s\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXTINF:2.100,\nb.m4s\n" +
+		"#EXT-X-ENDLIST\n"
+	if got := string(playlist.Bytes()); got != want {
+		t.Errorf("Bytes() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHlsPlaylistTargetDuration(t *testing.T) {
+	tests := []struct {
+		target  time.Duration
+		entries []time.Duration
+		want    string
+	}{
+		{0, []time.Duration{time.Second, 1500 * time.Millisecond}, "#EXT-X-TARGETDURATION:2\n"},
+		{6 * time.Second, []time.Duration{time.Second}, "#EXT-X-TARGETDURATION:6\n"},
+		// 切片超过目标时长时使用最长切片的时长
+		{2 * time.Second, []time.Duration{4 * time.Second}, "#EXT-X-TARGETDURATION:4\n"},
+	}
+	for _, test := range tests {
+		playlist := &HlsPlaylist{TargetDuration: test.target}
+		for _, duration := range test.entries {
+			playlist.Entries = append(playlist.Entries, HlsEntry{Uri: "s.ts", Duration: duration})
+		}
+		if got := string(playlist.Bytes()); !strings.Contains(got, test.want) || !strings.Contains(got, "#EXT-X-VERSION:3\n") {
+			t.Errorf("TargetDuration %s: Bytes() =\n%s", test.target, got)
+		}
+	}
+}
+
+func TestLiveHlsTargetDuration(t *testing.T) {
+	store := NewMemoryStore()
+	hls := NewLiveHls(store, &HlsOptions{SegmentDuration: 2 * time.Second, ListSize: 2})
+	// 第二个切片因关键帧间隔变长，移出窗口后目标时长不变小
+	durations := []time.Duration{2 * time.Second, 5 * time.Second, 2 * time.Second, 2 * time.Second}
+	var start time.Duration
+	for i, duration := range durations {
+		if err := hls.addSegment(&LiveSegment{Sequence: int64(i), Start: start, Duration: duration, Keyframe: true, Data: []byte("ts")}); err != nil {
+			t.Fatal(err)
+		}
+		start += duration
+		playlist, err := store.Get(HlsPlaylistName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "#EXT-X-TARGETDURATION:2\n"
+		if i > 0 {
+			want = "#EXT-X-TARGETDURATION:5\n"
+		}
+		if !strings.Contains(string(playlist), want) {
+			t.Errorf("第%d个切片后的播放列表:\n%s", i, playlist)
+		}
+	}
+	if _, err := store.Get("segment0.ts"); err != nil {
+		t.Errorf("窗口外的切片应保留2个: %s", err)
+	}
+}
@@ -0,0 +1,275 @@
+package ffmpegutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"io"
+	neturl "net/url"
+	"strings"
+	"sync"
+)
+
+// 输入协议
+const (
+	ProtocolFile = "file" // 本地文件
+	ProtocolRtsp = "rtsp"
+	ProtocolRtmp = "rtmp"
+	ProtocolHttp = "http" // HTTP-FLV、HLS等
+	ProtocolSrt  = "srt"
+	ProtocolUdp  = "udp" // udp或rtp承载的MPEG-TS
+)
+
+// 网络读写超时，单位微秒，摄像头或编码器断开时不会一直阻塞
+const inputTimeout = "10000000"
+
+// 各协议的默认输入参数
+var protocolOptions = map[string]map[string]string{
+	ProtocolFile: {},
+	ProtocolRtsp: {
+		"rtsp_transport": "tcp",  //tcp传输
+		"buffer_size":    "8192", //缓冲区大小
+		"max_delay":      "5000", //最大处理延迟
+		"timeout":        inputTimeout,
+	},
+	ProtocolRtmp: {
+		"rtmp_live":  "live", // 只拉直播流
+		"rw_timeout": inputTimeout,
+	},
+	ProtocolHttp: {
+		// 服务端断开时自动重连，HLS的每个切片单独请求
+		"reconnect":           "1",
+		"reconnect_streamed":  "1",
+		"reconnect_delay_max": "5",
+		"rw_timeout":          inputTimeout,
+	},
+	ProtocolSrt: {
+		"timeout": inputTimeout,
+	},
+	ProtocolUdp: {
+		// 码率较高时系统缓冲区太小会丢包
+		"buffer_size":      "4194304",
+		"overrun_nonfatal": "1",
+		"timeout":          inputTimeout,
+	},
+}
+
+// inputOptions 拉流地址 -> 配置的输入参数
+var inputOptions = struct {
+	sync.Mutex
+	options map[string]map[string]string
+}{options: make(map[string]map[string]string)}
+
+// InputProtocol 输入地址的协议，没有协议的路径(包括Windows盘符路径)为本地文件，其他协议返回协议名，没有默认参数
+func InputProtocol(url string) string {
+	u, err := neturl.Parse(url)
+	if err != nil || len(u.Scheme) <= 1 {
+		return ProtocolFile
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		return ProtocolFile
+	case "rtsp", "rtsps":
+		return ProtocolRtsp
+	case "rtmp", "rtmps", "rtmpt", "rtmpe":
+		return ProtocolRtmp
+	case "http", "https":
+		return ProtocolHttp
+	case "srt":
+		return ProtocolSrt
+	case "udp", "rtp":
+		return ProtocolUdp
+	}
+	return strings.ToLower(u.Scheme)
+}
+
+// SetInputOptions 设置拉流地址的输入参数(如摄像头配置的options和transport)，覆盖按协议的默认参数
+// 每次调用替换全部地址的参数，重新加载配置时再次调用
+func SetInputOptions(options map[string]map[string]string) {
+	inputOptions.Lock()
+	defer inputOptions.Unlock()
+	inputOptions.options = options
+}
+
+// InputOptions 输入地址的参数，按协议的默认参数加上SetInputOptions设置的参数
+func InputOptions(url string) map[string]string {
+	options := make(map[string]string)
+	for key, value := range protocolOptions[InputProtocol(url)] {
+		options[key] = value
+	}
+	inputOptions.Lock()
+	defer inputOptions.Unlock()
+	for key, value := range inputOptions.options[url] {
+		options[key] = value
+	}
+	return options
+}
+
+// Input 输入源，Url和Reader二选一
+// Reader用于上传的文件、从对象存储读取的数据等，不需要先写入临时文件
+type Input struct {
+	Url string // 输入地址，按协议设置输入参数
+	// Reader 输入数据的读取器，不为nil时代替Url
+	// 实现io.Seeker时可以随机读取(如moov在文件末尾的mp4)，否则只能顺序读取，适合flv、mpegts等流式格式
+	Reader io.Reader
+	Format string // 格式提示(如mp4、flv、mpegts、h264)，为空时自动探测，无法探测的裸流需要指定
+}
+
+// UrlInput 从地址读取的输入
+func UrlInput(url string) *Input {
+	return &Input{Url: url}
+}
+
+// ReaderInput 从读取器读取的输入，format为格式提示，为空时自动探测
+func ReaderInput(reader io.Reader, format string) *Input {
+	return &Input{Reader: reader, Format: format}
+}
+
+// String 输入的描述，用于日志和探测报告
+func (input *Input) String() string {
+	if input.Reader != nil {
+		if input.Format != "" {
+			return "reader:" + input.Format
+		}
+		return "reader"
+	}
+	return input.Url
+}
+
+// OpenInput 按协议设置输入参数后打开输入，rtsp、rtmp、http(s)的FLV和HLS、srt、udp/rtp的MPEG-TS和本地文件都有默认参数
+// ctx取消时中断阻塞的打开和读取，使用完后调用返回的closeInput
+func OpenInput(ctx context.Context, url string) (inputFormatCtx *astiav.FormatContext, closeInput func(), err error) {
+	return UrlInput(url).Open(ctx)
+}
+
+// Open 打开输入并查找流信息，地址输入按协议设置输入参数
+// ctx取消时中断阻塞的打开和读取，使用完后调用返回的closeInput
+func (input *Input) Open(ctx context.Context) (inputFormatCtx *astiav.FormatContext, closeInput func(), err error) {
+	var inputFormat *astiav.InputFormat
+	if input.Format != "" {
+		if inputFormat = astiav.FindInputFormat(input.Format); inputFormat == nil {
+			return nil, nil, errors.New(fmt.Sprintf("不支持的输入格式: %s", input.Format))
+		}
+	}
+	options := &astiav.Dictionary{}
+	defer options.Free()
+	if input.Reader == nil {
+		for key, value := range InputOptions(input.Url) {
+			_ = options.Set(key, value, astiav.DictionaryFlags(0))
+		}
+	}
+
+	interrupter := astiav.NewIOInterrupter()
+	stopInterrupt := context.AfterFunc(ctx, interrupter.Interrupt)
+	var ioContext *astiav.IOContext
+	free := func() {
+		if ioContext != nil {
+			ioContext.Free()
+		}
+		stopInterrupt()
+		interrupter.Free()
+	}
+	inputFormatCtx = astiav.AllocFormatContext()
+	inputFormatCtx.SetIOInterrupter(interrupter)
+	if input.Reader != nil {
+		if ioContext, err = allocReaderIOContext(ctx, input.Reader); err != nil {
+			inputFormatCtx.Free()
+			free()
+			return nil, nil, err
+		}
+		inputFormatCtx.SetPb(ioContext)
+	}
+	if err = inputFormatCtx.OpenInput(input.Url, inputFormat, options); err != nil {
+		inputFormatCtx.Free()
+		free()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, errors.New(fmt.Sprintf("打开输入失败: %s", err))
+	}
+	if err = inputFormatCtx.FindStreamInfo(nil); err != nil {
+		inputFormatCtx.CloseInput()
+		inputFormatCtx.Free()
+		free()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, errors.New(fmt.Sprintf("查找流信息失败: %s", err))
+	}
+	closeInput = func() {
+		inputFormatCtx.CloseInput()
+		inputFormatCtx.Free()
+		free()
+	}
+	return inputFormatCtx, closeInput, nil
+}
+
+// 查询数据总长度的seek标志(AVSEEK_SIZE)和强制seek标志(AVSEEK_FORCE)
+const (
+	seekSize  = 0x10000
+	seekForce = 0x20000
+)
+
+// allocReaderIOContext 分配从读取器读取的IO上下文，读取器实现io.Seeker时支持seek
+// 自定义IO不经过中断回调，每次读取前检查ctx
+func allocReaderIOContext(ctx context.Context, reader io.Reader) (*astiav.IOContext, error) {
+	var seek astiav.IOContextSeekFunc
+	if seeker, ok := reader.(io.Seeker); ok {
+		seek = seekFunc(seeker, 0)
+	}
+	ioContext, err := astiav.AllocIOContext(
+		8192,
+		false,
+		func(b []byte) (n int, err error) {
+			if ctx.Err() != nil {
+				return 0, astiav.ErrExit
+			}
+			n, err = reader.Read(b)
+			// 读到数据时先返回数据，io.EOF在下一次读取时返回
+			if n > 0 {
+				return n, nil
+			}
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		},
+		seek,
+		nil,
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("分配io上下文失败: %s", err))
+	}
+	return ioContext, nil
+}
+
+// seekFunc IO上下文的seek回调，IO上下文中的位置0对应seeker的位置start，支持查询总长度
+func seekFunc(seeker io.Seeker, start int64) astiav.IOContextSeekFunc {
+	return func(offset int64, whence int) (int64, error) {
+		if whence&seekSize != 0 {
+			// 查询总长度后回到当前位置
+			current, err := seeker.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return 0, err
+			}
+			size, err := seeker.Seek(0, io.SeekEnd)
+			if err != nil {
+				return 0, err
+			}
+			if _, err = seeker.Seek(current, io.SeekStart); err != nil {
+				return 0, err
+			}
+			return size - start, nil
+		}
+		whence &^= seekForce
+		if whence == io.SeekStart {
+			offset += start
+		}
+		position, err := seeker.Seek(offset, whence)
+		if err != nil {
+			return 0, err
+		}
+		return position - start, nil
+	}
+}
@@ -0,0 +1,171 @@
+package ffmpegutil
+
+import (
+	"errors"
+	"ffmpeg_video_capture/buffer"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"io"
+	"sort"
+	"time"
+)
+
+// Keyframe 关键帧在mp4中的位置
+type Keyframe struct {
+	Pts int64 // 显示时间戳，相对第一个视频帧，单位为索引的时间基
+	// Offset 在mp4数据中的字节偏移，end和faststart为数据帧在mdat中的位置，fragmented为关键帧所在分片(moof)的位置
+	Offset int64
+}
+
+// KeyframeIndex 关键帧索引，抓取时写入mp4的同时记录，按时间戳升序排列
+type KeyframeIndex struct {
+	TimeBase  astiav.Rational // mp4视频流的时间基
+	Keyframes []Keyframe
+	End       int64     // 最后一个视频帧的结束时间戳，相对第一个视频帧，即视频时长，为0时未记录
+	Layout    Mp4Layout // mp4的封装方式，决定Offset的含义，为空时未记录
+}
+
+// Time 时间戳对应的时间
+func (index *KeyframeIndex) Time(pts int64) time.Duration {
+	return time.Duration(astiav.RescaleQ(pts, index.TimeBase, astiav.TimeBaseQ)) * time.Microsecond
+}
+
+// Pts 时间对应的时间戳
+func (index *KeyframeIndex) Pts(t time.Duration) int64 {
+	return astiav.RescaleQ(t.Microseconds(), astiav.TimeBaseQ, index.TimeBase)
+}
+
+// Before t之前（含t）最近的关键帧，t早于第一个关键帧时返回第一个关键帧
+func (index *KeyframeIndex) Before(t time.Duration) (Keyframe, bool) {
+	if index == nil || len(index.Keyframes) == 0 {
+		return Keyframe{}, false
+	}
+	pts := index.Pts(t)
+	i := sort.Search(len(index.Keyframes), func(i int) bool { return index.Keyframes[i].Pts > pts })
+	if i == 0 {
+		return index.Keyframes[0], true
+	}
+	return index.Keyframes[i-1], true
+}
+
+// fragmentRange 分片mp4中[start, end)范围所在的分片，返回第一个和最后一个分片的关键帧下标，last不包含
+// 终点之后多取一个分片，交叉写入较晚的音频可能在终点所在分片之后的分片中，end为0时到最后一个分片
+func (index *KeyframeIndex) fragmentRange(start, end time.Duration) (first, last int) {
+	startPts := index.Pts(start)
+	first = sort.Search(len(index.Keyframes), func(i int) bool { return index.Keyframes[i].Pts > startPts }) - 1
+	first = max(first, 0)
+	last = len(index.Keyframes)
+	if end > 0 {
+		endPts := index.Pts(end)
+		last = sort.Search(len(index.Keyframes), func(i int) bool { return index.Keyframes[i].Pts >= endPts })
+		last = min(last+1, len(index.Keyframes))
+	}
+	return first, last
+}
+
+// fragmentWindow 按关键帧索引中的分片位置，只读取分片mp4中剪切范围所在的分片
+// 返回的片段由文件头(ftyp和不含数据帧的moov)和这些分片拼接而成，起止时间和关键帧索引都相对第一个分片
+// 分片使用default_base_moof，数据位置相对所在分片，拼接后不需要修改；索引不可用或不需要剪切时返回原片段
+func fragmentWindow(segment *ConcatSegment) (*ConcatSegment, error) {
+	index := segment.Keyframes
+	if index == nil || index.Layout != Mp4LayoutFragmented || len(index.Keyframes) == 0 || index.Keyframes[0].Offset <= 0 {
+		return segment, nil
+	}
+	first, last := index.fragmentRange(segment.Start, segment.End)
+	base := index.Keyframes[first]
+	baseTime := index.Time(base.Pts)
+	if first == 0 && last == len(index.Keyframes) || segment.End > 0 && segment.End <= baseTime {
+		return segment, nil
+	}
+
+	reader := segment.Reader
+	if reader == nil {
+		reader = buffer.NewBuffer(segment.Data)
+	}
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("获取视频数据长度失败: %s", err))
+	}
+	header := index.Keyframes[0].Offset
+	to := size
+	if last < len(index.Keyframes) {
+		to = index.Keyframes[last].Offset
+	}
+	if header > base.Offset || base.Offset >= to || to > size {
+		return nil, errors.New("关键帧索引中的分片位置错误")
+	}
+
+	window := &KeyframeIndex{TimeBase: index.TimeBase, Layout: index.Layout, Keyframes: make([]Keyframe, 0, last-first)}
+	for _, keyframe := range index.Keyframes[first:last] {
+		window.Keyframes = append(window.Keyframes, Keyframe{Pts: keyframe.Pts - base.Pts, Offset: header + keyframe.Offset - base.Offset})
+	}
+	if last < len(index.Keyframes) {
+		window.End = index.Keyframes[last].Pts - base.Pts
+	} else if index.End > 0 {
+		window.End = index.End - base.Pts
+	}
+	result := &ConcatSegment{
+		Reader:    newSectionsReader(reader, [][2]int64{{0, header}, {base.Offset, to}}),
+		Start:     max(segment.Start-baseTime, 0),
+		Keyframes: window,
+	}
+	if segment.End > 0 {
+		result.End = segment.End - baseTime
+	}
+	return result, nil
+}
+
+// sectionsReader 把读取器中的多个[from, to)范围按顺序拼接成一个读取器，只读取这些范围内的数据
+type sectionsReader struct {
+	reader   io.ReadSeeker
+	sections [][2]int64
+	size     int64
+	offset   int64
+}
+
+func newSectionsReader(reader io.ReadSeeker, sections [][2]int64) *sectionsReader {
+	r := &sectionsReader{reader: reader, sections: sections}
+	for _, section := range sections {
+		r.size += section[1] - section[0]
+	}
+	return r
+}
+
+func (r *sectionsReader) Read(p []byte) (n int, err error) {
+	// 找到当前位置所在的范围
+	position := r.offset
+	for _, section := range r.sections {
+		length := section[1] - section[0]
+		if position >= length {
+			position -= length
+			continue
+		}
+		if _, err = r.reader.Seek(section[0]+position, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err = r.reader.Read(p[:min(int64(len(p)), length-position)])
+		r.offset += int64(n)
+		if n > 0 && errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+func (r *sectionsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence value")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = offset
+	return r.offset, nil
+}
@@ -0,0 +1,122 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"github.com/asticode/go-astiav"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFragmentWindow(t *testing.T) {
+	data := make([]byte, 500)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	// 文件头100字节，每秒一个分片
+	index := &KeyframeIndex{
+		TimeBase: astiav.NewRational(1, 1000),
+		Keyframes: []Keyframe{
+			{Pts: 0, Offset: 100},
+			{Pts: 1000, Offset: 200},
+			{Pts: 2000, Offset: 300},
+			{Pts: 3000, Offset: 400},
+		},
+		End:    4000,
+		Layout: Mp4LayoutFragmented,
+	}
+	tests := []struct {
+		name       string
+		start, end time.Duration
+		want       []byte // nil时返回原片段
+		wantStart  time.Duration
+		wantEnd    time.Duration
+		wantIndex  []Keyframe
+		wantLength int64
+	}{
+		{"不剪切", 0, 0, nil, 0, 0, nil, 0},
+		{"从中间到结尾", 1500 * time.Millisecond, 0, append(bytes.Clone(data[:100]), data[200:]...), 500 * time.Millisecond, 0,
+			[]Keyframe{{0, 100}, {1000, 200}, {2000, 300}}, 3000},
+		// 终点之后多取一个分片
+		{"从开头到中间", 0, 1200 * time.Millisecond, data[:400], 0, 1200 * time.Millisecond,
+			[]Keyframe{{0, 100}, {1000, 200}, {2000, 300}}, 3000},
+		{"中间的一段", 1000 * time.Millisecond, 1500 * time.Millisecond, append(bytes.Clone(data[:100]), data[200:400]...), 0, 500 * time.Millisecond,
+			[]Keyframe{{0, 100}, {1000, 200}}, 2000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segment := &ConcatSegment{Data: data, Start: test.start, End: test.end, Keyframes: index}
+			window, err := fragmentWindow(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == nil {
+				if window != segment {
+					t.Error("不需要剪切时应返回原片段")
+				}
+				return
+			}
+			got, err := io.ReadAll(window.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("读取的数据长度%d，want %d", len(got), len(test.want))
+			}
+			if window.Start != test.wantStart || window.End != test.wantEnd {
+				t.Errorf("起止时间 = %s, %s, want %s, %s", window.Start, window.End, test.wantStart, test.wantEnd)
+			}
+			if !reflect.DeepEqual(window.Keyframes.Keyframes, test.wantIndex) || window.Keyframes.End != test.wantLength {
+				t.Errorf("关键帧索引 = %+v, want %+v, %d", window.Keyframes, test.wantIndex, test.wantLength)
+			}
+		})
+	}
+}
+
+func TestFragmentWindowLayout(t *testing.T) {
+	index := &KeyframeIndex{TimeBase: astiav.NewRational(1, 1000), Keyframes: []Keyframe{{0, 100}, {1000, 200}}, Layout: Mp4LayoutFaststart}
+	segment := &ConcatSegment{Data: make([]byte, 300), Start: 1500 * time.Millisecond, Keyframes: index}
+	window, err := fragmentWindow(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if window != segment {
+		t.Error("非分片mp4应返回原片段，由解封装器按moov定位")
+	}
+}
+
+func TestSectionsReader(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	reader := newSectionsReader(bytes.NewReader(data), [][2]int64{{0, 3}, {10, 14}, {18, 20}})
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "012abcdij" {
+		t.Errorf("ReadAll() = %q", got)
+	}
+
+	tests := []struct {
+		offset int64
+		whence int
+		length int
+		want   string
+	}{
+		{2, io.SeekStart, 3, "2ab"},
+		{-2, io.SeekEnd, 5, "ij"},
+		{4, io.SeekStart, 4, "bcdi"},
+	}
+	for _, test := range tests {
+		if _, err := reader.Seek(test.offset, test.whence); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(io.LimitReader(reader, int64(test.length)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("Seek(%d, %d)后读取%d字节 = %q, want %q", test.offset, test.whence, test.length, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"math/bits"
+	"strings"
+)
+
+// MediaInfo fMP4切片的编码信息，用于DASH清单和MSE的MIME类型
+type MediaInfo struct {
+	Codecs []string // RFC 6381格式的编码字符串，视频在前
+	Width  int
+	Height int
+}
+
+// MimeType MSE创建SourceBuffer使用的MIME类型，如video/mp4; codecs="avc1.64001f,mp4a.40.2"
+func (media *MediaInfo) MimeType() string {
+	return fmt.Sprintf("video/mp4; codecs=\"%s\"", strings.Join(media.Codecs, ","))
+}
+
+// newMediaInfo 视频流和音频流的编码信息，audioStream可以为nil
+func newMediaInfo(videoStream, audioStream *astiav.Stream) *MediaInfo {
+	params := videoStream.CodecParameters()
+	media := &MediaInfo{Width: params.Width(), Height: params.Height()}
+	for _, stream := range []*astiav.Stream{videoStream, audioStream} {
+		if stream == nil {
+			continue
+		}
+		if codec := CodecString(stream.CodecParameters()); codec != "" {
+			media.Codecs = append(media.Codecs, codec)
+		}
+	}
+	return media
+}
+
+// CodecString RFC 6381格式的编码字符串，支持h264、hevc和aac，其他编码返回空字符串
+func CodecString(params *astiav.CodecParameters) string {
+	return codecString(params.CodecID(), params.Profile(), params.Level(), params.ExtraData())
+}
+
+// codecString 按编码参数生成编码字符串
+// mp4中的extradata为avcC或hvcC，直播输入的extradata为Annex B格式，分别解析，都没有时使用profile和level
+func codecString(codecID astiav.CodecID, profile astiav.Profile, level astiav.Level, extradata []byte) string {
+	switch codecID {
+	case astiav.CodecIDH264:
+		if len(extradata) >= 4 && extradata[0] == 1 {
+			// avcC: 版本、profile、兼容标志、level
+			return fmt.Sprintf("avc1.%02x%02x%02x", extradata[1], extradata[2], extradata[3])
+		}
+		if sps := annexBNalu(extradata, func(header byte) bool { return header&0x1f == 7 }); len(sps) >= 4 {
+			return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+		}
+		return fmt.Sprintf("avc1.%02x00%02x", int(profile), int(level))
+	case astiav.CodecIDHevc:
+		// mp4封装时hevc的codec tag为hev1
+		if len(extradata) >= 13 && extradata[0] == 1 {
+			// hvcC: profile_space、tier、profile，32位兼容标志，48位约束标志，level
+			profileSpace := []string{"", "A", "B", "C"}[extradata[1]>>6]
+			tier := "L"
+			if extradata[1]&0x20 != 0 {
+				tier = "H"
+			}
+			compatibility := bits.Reverse32(uint32(extradata[2])<<24 | uint32(extradata[3])<<16 | uint32(extradata[4])<<8 | uint32(extradata[5]))
+			codec := fmt.Sprintf("hev1.%s%d.%X.%s%d", profileSpace, extradata[1]&0x1f, compatibility, tier, extradata[12])
+			// 约束标志省略末尾的0字节
+			constraints := bytes.TrimRight(extradata[6:12], "\x00")
+			for _, b := range constraints {
+				codec += fmt.Sprintf(".%X", b)
+			}
+			return codec
+		}
+		hevcProfile := int(profile)
+		if hevcProfile <= 0 {
+			hevcProfile = 1
+		}
+		// 兼容标志只包含自身profile，Main同时兼容Main 10
+		compatibility := uint32(1) << hevcProfile
+		if hevcProfile == 1 {
+			compatibility |= 1 << 2
+		}
+		return fmt.Sprintf("hev1.%d.%X.L%d.B0", hevcProfile, compatibility, int(level))
+	case astiav.CodecIDAac:
+		// AudioSpecificConfig的前5位为audio object type
+		objectType := 2
+		if len(extradata) > 0 && extradata[0]>>3 > 0 {
+			objectType = int(extradata[0] >> 3)
+		}
+		return fmt.Sprintf("mp4a.40.%d", objectType)
+	}
+	return ""
+}
+
+// annexBNalu Annex B码流中第一个NAL头满足match的NAL单元，包含NAL头
+func annexBNalu(data []byte, match func(header byte) bool) []byte {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		nalu := data[i+3:]
+		if !match(nalu[0]) {
+			continue
+		}
+		if end := bytes.Index(nalu, []byte{0, 0, 1}); end >= 0 {
+			nalu = nalu[:end]
+		}
+		return nalu
+	}
+	return nil
+}
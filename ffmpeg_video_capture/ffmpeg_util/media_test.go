@@ -0,0 +1,43 @@
+package ffmpegutil
+
+import (
+	"github.com/asticode/go-astiav"
+	"testing"
+)
+
+func TestCodecString(t *testing.T) {
+	tests := []struct {
+		name      string
+		codecID   astiav.CodecID
+		profile   astiav.Profile
+		level     astiav.Level
+		extradata []byte
+		want      string
+	}{
+		{"h264 avcC", astiav.CodecIDH264, 0, 0, []byte{1, 0x64, 0x00, 0x1f, 0xff}, "avc1.64001f"},
+		{"h264 Annex B", astiav.CodecIDH264, 0, 0, []byte{0, 0, 0, 1, 0x68, 0xce, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1e, 0x8c, 0, 0, 1, 0x68}, "avc1.42c01e"},
+		{"h264 没有extradata", astiav.CodecIDH264, 100, 31, nil, "avc1.64001f"},
+		// Main profile，兼容Main和Main 10，约束标志只有第一个字节
+		{"hevc hvcC", astiav.CodecIDHevc, 0, 0, []byte{1, 0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 93, 0xf0}, "hev1.1.6.L93.90"},
+		{"hevc High tier", astiav.CodecIDHevc, 0, 0, []byte{1, 0x22, 0x20, 0, 0, 0, 0x90, 0x80, 0, 0, 0, 0, 153}, "hev1.2.4.H153.90.80"},
+		{"hevc Main", astiav.CodecIDHevc, 1, 120, nil, "hev1.1.6.L120.B0"},
+		{"hevc Main 10", astiav.CodecIDHevc, 2, 120, nil, "hev1.2.4.L120.B0"},
+		{"hevc 未知profile", astiav.CodecIDHevc, -99, 93, nil, "hev1.1.6.L93.B0"},
+		{"aac LC", astiav.CodecIDAac, 0, 0, []byte{0x12, 0x10}, "mp4a.40.2"},
+		{"aac HE", astiav.CodecIDAac, 0, 0, []byte{0x2b, 0x92, 0x08, 0x00}, "mp4a.40.5"},
+		{"aac 没有extradata", astiav.CodecIDAac, 0, 0, nil, "mp4a.40.2"},
+		{"不支持的编码", astiav.CodecID(0), 0, 0, nil, ""},
+	}
+	for _, test := range tests {
+		if got := codecString(test.codecID, test.profile, test.level, test.extradata); got != test.want {
+			t.Errorf("%s: codecString() = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMimeType(t *testing.T) {
+	media := &MediaInfo{Codecs: []string{"avc1.64001f", "mp4a.40.2"}}
+	if got, want := media.MimeType(), `video/mp4; codecs="avc1.64001f,mp4a.40.2"`; got != want {
+		t.Errorf("MimeType() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package ffmpegutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"time"
+)
+
+// MJPEG的默认参数
+const (
+	DefaultMjpegFps   = 5
+	DefaultMjpegWidth = 640
+	MaxMjpegFps       = 25
+)
+
+// MjpegOptions MJPEG参数
+type MjpegOptions struct {
+	Fps     int // 帧率，为0时为5，最大25
+	Width   int // 宽度，为0时为640，不超过原始宽度，高度按比例缩放
+	Quality int // jpg质量，为0时使用默认质量
+}
+
+// MjpegFrames 打开直播输入，解码后按帧率抽帧，缩小后编码为jpg，每帧调用一次onFrame
+// 编码与抓图的FrameToJPEG相同，缩放上下文在整个直播中复用，ctx取消时返回nil，输入出错或onFrame返回错误时返回错误
+// 只支持地址输入：读取器没有实时速度，按帧率抽出的帧会一次性推给浏览器，不能作为预览流
+func MjpegFrames(ctx context.Context, url string, opts *MjpegOptions, onFrame func(jpg []byte) error) error {
+	options := MjpegOptions{}
+	if opts != nil {
+		options = *opts
+	}
+	if options.Fps <= 0 {
+		options.Fps = DefaultMjpegFps
+	}
+	options.Fps = min(options.Fps, MaxMjpegFps)
+	if options.Width <= 0 {
+		options.Width = DefaultMjpegWidth
+	}
+
+	inputFormatCtx, closeInput, err := OpenInput(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+	videoInputStream := FindStream(inputFormatCtx, astiav.MediaTypeVideo)
+	if videoInputStream == nil {
+		return errors.New("未找到视频流")
+	}
+	videoDecoderCtx, _, err := FindAndOpenDecoderCtx(videoInputStream)
+	if err != nil {
+		return err
+	}
+	defer videoDecoderCtx.Free()
+	width := min(options.Width, videoInputStream.CodecParameters().Width())
+
+	encoder := newJpegEncoder(width, 0, options.Quality)
+	defer encoder.Free()
+	limiter := newFrameLimiter(options.Fps)
+	start := time.Now()
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	frame := astiav.AllocFrame()
+	defer frame.Free()
+	gotKeyframe := false
+	for {
+		if err = inputFormatCtx.ReadFrame(packet); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, astiav.ErrEof) {
+				return errors.New("直播输入已结束")
+			}
+			return errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if packet.StreamIndex() != videoInputStream.Index() || (!gotKeyframe && !packet.Flags().Has(astiav.PacketFlagKey)) {
+			packet.Unref()
+			continue
+		}
+		gotKeyframe = true
+		err = videoDecoderCtx.SendPacket(packet)
+		packet.Unref()
+		if err != nil {
+			return errors.New(fmt.Sprintf("视频数据发送给视频解码器失败: %s", err))
+		}
+		for {
+			if err = videoDecoderCtx.ReceiveFrame(frame); err != nil {
+				if errors.Is(err, astiav.ErrEagain) {
+					break
+				}
+				return errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+			}
+			// 没有时间戳的帧按收到的时间抽帧
+			t := time.Since(start)
+			if frame.Pts() != astiav.NoPtsValue {
+				t = time.Duration(astiav.RescaleQ(frame.Pts(), videoInputStream.TimeBase(), astiav.TimeBaseQ)) * time.Microsecond
+			}
+			if !limiter.allow(t) {
+				frame.Unref()
+				continue
+			}
+			jpg, err := encoder.Encode(frame)
+			frame.Unref()
+			if err != nil {
+				return err
+			}
+			if err = onFrame(jpg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// frameLimiter 按帧率抽帧，帧间隔小于1/fps的帧丢弃
+type frameLimiter struct {
+	interval time.Duration
+	next     time.Duration // 下一帧输出的时间，之前的帧丢弃，为负数时输出第一帧
+}
+
+func newFrameLimiter(fps int) *frameLimiter {
+	return &frameLimiter{interval: time.Second / time.Duration(fps), next: -1}
+}
+
+// allow 时间为t的帧是否输出
+func (l *frameLimiter) allow(t time.Duration) bool {
+	if l.next >= 0 && t < l.next && t >= l.next-l.interval-time.Second {
+		return false
+	}
+	// 时间戳跳变(如摄像头重置)时重新计时
+	l.next += l.interval
+	if l.next <= t || l.next > t+time.Second {
+		l.next = t + l.interval
+	}
+	return true
+}
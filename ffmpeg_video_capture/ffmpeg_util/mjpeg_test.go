@@ -0,0 +1,33 @@
+package ffmpegutil
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrameLimiter(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		fps    int
+		frames []time.Duration
+		want   []bool
+	}{
+		{"25帧抽为5帧", 5, []time.Duration{0, 40 * ms, 80 * ms, 120 * ms, 160 * ms, 200 * ms, 240 * ms, 400 * ms},
+			[]bool{true, false, false, false, false, true, false, true}},
+		{"输入帧率低于输出帧率", 5, []time.Duration{0, 500 * ms, 1000 * ms}, []bool{true, true, true}},
+		// 时间戳回退或跳到很远之后重新计时
+		{"时间戳跳变", 5, []time.Duration{10 * time.Second, 10*time.Second + 40*ms, 0, 40 * ms, 200 * ms, time.Hour}, []bool{true, false, true, false, true, true}},
+	}
+	for _, test := range tests {
+		limiter := newFrameLimiter(test.fps)
+		var got []bool
+		for _, frame := range test.frames {
+			got = append(got, limiter.allow(frame))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: allow() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
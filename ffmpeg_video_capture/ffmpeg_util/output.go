@@ -0,0 +1,186 @@
+package ffmpegutil
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"io"
+)
+
+// Mp4Layout mp4的封装方式
+type Mp4Layout string
+
+const (
+	// Mp4LayoutAuto 按写入目标选择，不能seek时为分片mp4，可以随机读写时为faststart，只能seek时moov在末尾
+	Mp4LayoutAuto       Mp4Layout = ""
+	Mp4LayoutEnd        Mp4Layout = "end"        // moov在文件末尾，需要下载完整个文件才能播放
+	Mp4LayoutFaststart  Mp4Layout = "faststart"  // 写完后把moov移到mdat之前，边下载边播放
+	Mp4LayoutFragmented Mp4Layout = "fragmented" // 分片mp4，每个关键帧开始一个分片，写入时不需要seek
+)
+
+// ParseMp4Layout 解析配置中的mp4封装方式，end、faststart或fragmented，为空时为Mp4LayoutAuto
+func ParseMp4Layout(value string) (Mp4Layout, error) {
+	switch layout := Mp4Layout(value); layout {
+	case Mp4LayoutAuto, Mp4LayoutEnd, Mp4LayoutFaststart, Mp4LayoutFragmented:
+		return layout, nil
+	}
+	return "", errors.New(fmt.Sprintf("不支持的mp4封装方式: %s", value))
+}
+
+// 分片mp4的封装参数，每个关键帧开始一个分片，文件头中的moov不包含数据帧
+const fragmentedMovflags = "+frag_keyframe+empty_moov+default_base_moof"
+
+// outputBufferSize 写入writer的IO上下文缓冲区大小
+const outputBufferSize = 64 * 1024
+
+// randomAccessWriter 可以随机读写的写入目标，如*os.File、*buffer.Buffer，faststart写完后需要回读移动moov
+type randomAccessWriter interface {
+	io.WriteSeeker
+	io.ReaderAt
+	io.WriterAt
+}
+
+// resolveMp4Layout 确定写入writer使用的mp4封装方式，writer不支持指定的方式时返回错误
+func resolveMp4Layout(writer io.Writer, layout Mp4Layout) (Mp4Layout, error) {
+	seekable := seekableWriter(writer)
+	_, randomAccess := writer.(randomAccessWriter)
+	randomAccess = randomAccess && seekable
+	switch layout {
+	case Mp4LayoutAuto:
+		if randomAccess {
+			return Mp4LayoutFaststart, nil
+		}
+		if seekable {
+			return Mp4LayoutEnd, nil
+		}
+		return Mp4LayoutFragmented, nil
+	case Mp4LayoutEnd:
+		if !seekable {
+			return "", errors.New("写入目标不能seek，只能输出分片mp4")
+		}
+	case Mp4LayoutFaststart:
+		if !randomAccess {
+			return "", errors.New("写入目标不能随机读写，不能输出faststart的mp4")
+		}
+	case Mp4LayoutFragmented:
+	default:
+		return "", errors.New(fmt.Sprintf("不支持的mp4封装方式: %s", layout))
+	}
+	return layout, nil
+}
+
+// seekableWriter writer是否可以seek，标准输出等管道实现了io.Seeker但不能seek
+func seekableWriter(writer io.Writer) bool {
+	seeker, ok := writer.(io.Seeker)
+	if !ok {
+		return false
+	}
+	_, err := seeker.Seek(0, io.SeekCurrent)
+	return err == nil
+}
+
+// writerOutput 写入io.Writer的输出，数据经过IO上下文的缓冲区直接写入writer，不在内存中保留
+type writerOutput struct {
+	ioContext *astiav.IOContext
+	writer    io.Writer
+	start     int64     // 开始写入时writer的位置，IO上下文中的位置相对该位置
+	layout    Mp4Layout // mp4的封装方式，其他格式为空
+	err       error     // writer返回的错误
+}
+
+// openWriterOutput 分配写入writer的IO上下文并保存到输出格式上下文中，writer实现io.Seeker时支持seek
+func openWriterOutput(outputFormatCtx *astiav.FormatContext, writer io.Writer) (*writerOutput, error) {
+	output := &writerOutput{writer: writer}
+	var seek astiav.IOContextSeekFunc
+	if seeker, ok := writer.(io.Seeker); ok {
+		// 不能seek时按顺序写入处理
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			output.start = start
+			seek = seekFunc(seeker, start)
+		}
+	}
+	ioContext, err := astiav.AllocIOContext(
+		outputBufferSize,
+		true,
+		nil,
+		seek,
+		func(b []byte) (n int, err error) {
+			if n, err = writer.Write(b); err != nil && output.err == nil {
+				output.err = err
+			}
+			return n, err
+		},
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("分配输出IO上下文失败: %s", err))
+	}
+	output.ioContext = ioContext
+	outputFormatCtx.SetPb(ioContext)
+	return output, nil
+}
+
+// openMp4Output 同openWriterOutput，按layout和writer确定mp4的封装方式
+func openMp4Output(outputFormatCtx *astiav.FormatContext, writer io.Writer, layout Mp4Layout) (*writerOutput, error) {
+	layout, err := resolveMp4Layout(writer, layout)
+	if err != nil {
+		return nil, err
+	}
+	output, err := openWriterOutput(outputFormatCtx, writer)
+	if err != nil {
+		return nil, err
+	}
+	output.layout = layout
+	return output, nil
+}
+
+// headerOptions 写入文件头的封装参数，使用完后释放
+func (output *writerOutput) headerOptions() *astiav.Dictionary {
+	options := &astiav.Dictionary{}
+	if output.layout == Mp4LayoutFragmented {
+		_ = options.Set("movflags", fragmentedMovflags, astiav.DictionaryFlags(0))
+	}
+	return options
+}
+
+// position 当前写入位置，相对开始写入的位置
+func (output *writerOutput) position() (int64, error) {
+	return output.ioContext.Seek(0, io.SeekCurrent)
+}
+
+// writeError 写入失败时返回writer的错误，writer没有返回错误时返回err
+func (output *writerOutput) writeError(err error) error {
+	if output.err != nil {
+		return output.err
+	}
+	return err
+}
+
+// finish 写入文件尾后调用，刷新缓冲区，faststart时把moov移到mdat之前
+// 返回mdat后移的长度，写入时记录的mdat中的位置需要加上该长度
+func (output *writerOutput) finish() (shift int64, err error) {
+	output.ioContext.Flush()
+	if output.err != nil {
+		return 0, errors.New(fmt.Sprintf("写入输出失败: %s", output.err))
+	}
+	if output.layout != Mp4LayoutFaststart {
+		return 0, nil
+	}
+	end, err := output.position()
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("获取写入位置失败: %s", err))
+	}
+	file := output.writer.(randomAccessWriter)
+	if shift, err = relocateMoov(file, output.start, output.start+end); err != nil || shift == 0 {
+		return 0, err
+	}
+	// writer的位置回到文件末尾，调用方可以继续写入
+	if _, err = file.Seek(output.start+end, io.SeekStart); err != nil {
+		return 0, errors.New(fmt.Sprintf("移动写入位置失败: %s", err))
+	}
+	return shift, nil
+}
+
+// Free 释放IO上下文
+func (output *writerOutput) Free() {
+	output.ioContext.Free()
+}
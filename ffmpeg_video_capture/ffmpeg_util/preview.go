@@ -0,0 +1,431 @@
+package ffmpegutil
+
+import (
+	"context"
+	"errors"
+	"ffmpeg_video_capture/buffer"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"io"
+	"time"
+)
+
+// 预览动图格式
+const (
+	PreviewGif  = "gif"
+	PreviewWebp = "webp"
+)
+
+// 预览动图的限制，超过时按上限处理
+const (
+	MaxPreviewDuration = 30 * time.Second
+	MaxPreviewWidth    = 640
+	MaxPreviewFps      = 15
+	minPreviewWidth    = 64 // 超过大小限制时缩小宽度重新编码，宽度不小于该值
+)
+
+// PreviewOptions 预览动图参数
+type PreviewOptions struct {
+	Format   string        // gif或webp，为空时为gif
+	Width    int           // 宽度，为0时为320，高度按比例缩放，不放大
+	Fps      int           // 帧率，为0时为5
+	Start    time.Duration // 视频数据中的起始时间，直播输入从第一个关键帧开始
+	Duration time.Duration // 时长，为0时为5秒
+	MaxBytes int           // 最大字节数，为0时不限制，超过时缩小宽度重新编码
+	Timeout  time.Duration // 直播输入的超时时间，为0时为时长加10秒
+}
+
+// normalize 填充默认值并限制范围
+func (opts PreviewOptions) normalize() (*PreviewOptions, error) {
+	if opts.Format == "" {
+		opts.Format = PreviewGif
+	}
+	if opts.Format != PreviewGif && opts.Format != PreviewWebp {
+		return nil, errors.New(fmt.Sprintf("不支持的预览格式：%s", opts.Format))
+	}
+	if opts.Width <= 0 {
+		opts.Width = 320
+	}
+	opts.Width = min(opts.Width, MaxPreviewWidth)
+	if opts.Fps <= 0 {
+		opts.Fps = 5
+	}
+	opts.Fps = min(opts.Fps, MaxPreviewFps)
+	if opts.Duration <= 0 {
+		opts.Duration = 5 * time.Second
+	}
+	opts.Duration = min(opts.Duration, MaxPreviewDuration)
+	if opts.Timeout <= 0 {
+		opts.Timeout = opts.Duration + 10*time.Second
+	}
+	return &opts, nil
+}
+
+// Preview 从直播输入生成预览动图，从第一个关键帧开始解码指定时长
+func Preview(ctx context.Context, url string, opts *PreviewOptions) ([]byte, error) {
+	return PreviewInput(ctx, UrlInput(url), opts)
+}
+
+// PreviewInput 从地址或读取器生成预览动图，读取器的数据不足指定时长时使用全部数据
+func PreviewInput(ctx context.Context, input *Input, opts *PreviewOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &PreviewOptions{}
+	}
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	inputFormatCtx, closeInput, err := input.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+
+	frames, err := decodePreviewFrames(ctx, inputFormatCtx, astiav.NoPtsValue, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer frames.Free()
+	return frames.Encode()
+}
+
+// PreviewVideo 从mp4视频数据生成预览动图，从opts.Start开始解码指定时长
+func PreviewVideo(reader io.ReadSeeker, opts *PreviewOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &PreviewOptions{}
+	}
+	opts, err := opts.normalize()
+	if err != nil {
+		return nil, err
+	}
+	input, err := openReaderInput(reader, "mp4")
+	if err != nil {
+		return nil, err
+	}
+	defer input.Free()
+	if input.videoStream == nil {
+		return nil, errors.New("未找到视频流")
+	}
+
+	// 定位到起始时间之前最近的关键帧
+	videoStream := input.videoStream
+	startPts := videoStream.StartTime()
+	if startPts == astiav.NoPtsValue {
+		startPts = 0
+	}
+	startPts += astiav.RescaleQ(opts.Start.Microseconds(), astiav.TimeBaseQ, videoStream.TimeBase())
+	if err = input.fmtCtx.SeekFrame(videoStream.Index(), startPts, astiav.NewSeekFlags(astiav.SeekFlagBackward)); err != nil {
+		return nil, errors.New(fmt.Sprintf("定位到起始时间失败: %s", err))
+	}
+
+	frames, err := decodePreviewFrames(context.Background(), input.fmtCtx, startPts, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer frames.Free()
+	return frames.Encode()
+}
+
+// previewFrames 降低帧率并缩放后的预览帧，编码超过大小限制时可以缩小后重新编码
+type previewFrames struct {
+	opts     *PreviewOptions
+	filter   *videoFilter
+	frames   []*astiav.Frame
+	timeBase astiav.Rational // 预览帧时间戳的时间基
+}
+
+// decodePreviewFrames 解码视频流，从startPts开始取指定时长，startPts为NoPtsValue时从第一个关键帧开始
+func decodePreviewFrames(ctx context.Context, inputFormatCtx *astiav.FormatContext, startPts int64, opts *PreviewOptions) (*previewFrames, error) {
+	videoStream := FindStream(inputFormatCtx, astiav.MediaTypeVideo)
+	if videoStream == nil {
+		return nil, errors.New("未找到视频流")
+	}
+	decoderCtx, _, err := FindAndOpenDecoderCtx(videoStream)
+	if err != nil {
+		return nil, err
+	}
+	defer decoderCtx.Free()
+
+	frames := &previewFrames{opts: opts}
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	frame := astiav.AllocFrame()
+	defer frame.Free()
+
+	endPts := int64(0)
+	if startPts != astiav.NoPtsValue {
+		endPts = startPts + astiav.RescaleQ(opts.Duration.Microseconds(), astiav.TimeBaseQ, videoStream.TimeBase())
+	}
+	done := false
+	// 取出解码器中已解码的帧，超出时长后结束
+	receiveFrames := func() error {
+		for !done {
+			if err := decoderCtx.ReceiveFrame(frame); err != nil {
+				if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+					return nil
+				}
+				return errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+			}
+			if startPts == astiav.NoPtsValue {
+				startPts = frame.Pts()
+				endPts = startPts + astiav.RescaleQ(opts.Duration.Microseconds(), astiav.TimeBaseQ, videoStream.TimeBase())
+			}
+			var err error
+			if frame.Pts() >= endPts {
+				done = true
+			} else if frame.Pts() >= startPts {
+				err = frames.add(frame, videoStream.TimeBase())
+			}
+			frame.Unref()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gotKeyframe := false
+	for !done {
+		if err = inputFormatCtx.ReadFrame(packet); err != nil {
+			if ctx.Err() != nil {
+				frames.Free()
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, astiav.ErrEof) {
+				break
+			}
+			frames.Free()
+			return nil, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if packet.StreamIndex() != videoStream.Index() {
+			packet.Unref()
+			continue
+		}
+		// 从第一个关键帧开始解码，之前的帧缺少参考帧
+		if !gotKeyframe && !packet.Flags().Has(astiav.PacketFlagKey) {
+			packet.Unref()
+			continue
+		}
+		gotKeyframe = true
+		err = decoderCtx.SendPacket(packet)
+		packet.Unref()
+		if err != nil {
+			frames.Free()
+			return nil, errors.New(fmt.Sprintf("视频数据发送给视频解码器失败: %s", err))
+		}
+		if err = receiveFrames(); err != nil {
+			frames.Free()
+			return nil, err
+		}
+	}
+	// 读到结尾时取出解码器中剩余的帧
+	if !done {
+		if err = decoderCtx.SendPacket(nil); err == nil {
+			err = receiveFrames()
+		}
+		if err != nil {
+			frames.Free()
+			return nil, err
+		}
+	}
+	if err = frames.finish(); err != nil {
+		frames.Free()
+		return nil, err
+	}
+	if len(frames.frames) == 0 {
+		frames.Free()
+		return nil, errors.New("未解码出视频帧")
+	}
+	return frames, nil
+}
+
+// add 降低帧率并缩放后保存
+func (p *previewFrames) add(frame *astiav.Frame, timeBase astiav.Rational) error {
+	if p.filter == nil {
+		description := fmt.Sprintf("fps=%d,scale='min(%d,iw)':-2:flags=lanczos", p.opts.Fps, p.opts.Width)
+		filter, err := newVideoFilter(description, frame, timeBase)
+		if err != nil {
+			return err
+		}
+		p.filter = filter
+	}
+	return p.filter.Filter(frame, p.keep)
+}
+
+// finish 取出滤镜中剩余的帧
+func (p *previewFrames) finish() error {
+	if p.filter == nil {
+		return nil
+	}
+	if err := p.filter.Filter(nil, p.keep); err != nil {
+		return err
+	}
+	p.timeBase = p.filter.sink.TimeBase()
+	return nil
+}
+
+func (p *previewFrames) keep(frame *astiav.Frame) error {
+	p.frames = append(p.frames, frame.Clone())
+	return nil
+}
+
+// Encode 编码为动图，超过大小限制时每次将宽度缩小为3/4重新编码
+func (p *previewFrames) Encode() ([]byte, error) {
+	width := p.frames[0].Width()
+	for {
+		data, err := p.encode(width)
+		if err != nil {
+			return nil, err
+		}
+		if p.opts.MaxBytes <= 0 || len(data) <= p.opts.MaxBytes {
+			return data, nil
+		}
+		if width = width * 3 / 4; width < minPreviewWidth {
+			return nil, errors.New(fmt.Sprintf("预览动图超过大小限制：%d字节", p.opts.MaxBytes))
+		}
+	}
+}
+
+// encode 按指定宽度编码为动图
+// gif先用palettegen生成调色板再用paletteuse映射，webp转换为yuv420p后编码
+func (p *previewFrames) encode(width int) ([]byte, error) {
+	var description string
+	var encoder *astiav.Codec
+	if p.opts.Format == PreviewWebp {
+		description = fmt.Sprintf("scale=%d:-2:flags=lanczos,format=yuv420p", width)
+		if encoder = astiav.FindEncoderByName("libwebp_anim"); encoder == nil {
+			encoder = astiav.FindEncoderByName("libwebp")
+		}
+	} else {
+		description = fmt.Sprintf("scale=%d:-2:flags=lanczos,split[a][b];[a]palettegen=stats_mode=diff[p];[b][p]paletteuse=dither=bayer:bayer_scale=5", width)
+		encoder = astiav.FindEncoder(astiav.CodecIDGif)
+	}
+	if encoder == nil {
+		return nil, errors.New(fmt.Sprintf("未找到%s编码器", p.opts.Format))
+	}
+	filter, err := newVideoFilter(description, p.frames[0], p.timeBase)
+	if err != nil {
+		return nil, err
+	}
+	defer filter.Free()
+
+	outputFormatCtx, err := astiav.AllocOutputFormatContext(nil, p.opts.Format, "")
+	if err != nil || outputFormatCtx == nil {
+		return nil, errors.New(fmt.Sprintf("分配%s输出格式上下文失败: %s", p.opts.Format, err))
+	}
+	defer outputFormatCtx.Free()
+	outputBuf := buffer.NewEmptyBuffer()
+	ioContext, err := astiav.AllocIOContext(
+		4096,
+		true,
+		nil,
+		func(offset int64, whence int) (n int64, err error) {
+			return outputBuf.Seek(offset, whence)
+		},
+		func(b []byte) (n int, err error) {
+			return outputBuf.Write(b)
+		},
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("分配IO上下文失败: %s", err))
+	}
+	defer ioContext.Free()
+	outputFormatCtx.SetPb(ioContext)
+
+	// 滤镜输出第一帧后才能确定编码器的尺寸和像素格式，gif要等调色板生成后才有输出
+	var encoderCtx *astiav.CodecContext
+	var outputStream *astiav.Stream
+	defer func() {
+		if encoderCtx != nil {
+			encoderCtx.Free()
+		}
+	}()
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	// 取出编码后的数据包写入输出
+	writePackets := func() error {
+		for {
+			if err := encoderCtx.ReceivePacket(packet); err != nil {
+				if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+					return nil
+				}
+				return errors.New(fmt.Sprintf("从编码器获取数据包失败: %s", err))
+			}
+			packet.RescaleTs(encoderCtx.TimeBase(), outputStream.TimeBase())
+			packet.SetStreamIndex(outputStream.Index())
+			err := outputFormatCtx.WriteInterleavedFrame(packet)
+			packet.Unref()
+			if err != nil {
+				return errors.New(fmt.Sprintf("写入数据包失败: %s", err))
+			}
+		}
+	}
+	encodeFrame := func(frame *astiav.Frame) error {
+		if encoderCtx == nil {
+			encoderCtx = astiav.AllocCodecContext(encoder)
+			encoderCtx.SetWidth(frame.Width())
+			encoderCtx.SetHeight(frame.Height())
+			encoderCtx.SetPixelFormat(frame.PixelFormat())
+			encoderCtx.SetSampleAspectRatio(frame.SampleAspectRatio())
+			encoderCtx.SetTimeBase(filter.sink.TimeBase())
+			encoderCtx.SetFramerate(astiav.NewRational(p.opts.Fps, 1))
+			if err := encoderCtx.Open(encoder, nil); err != nil {
+				return errors.New(fmt.Sprintf("无法打开%s编码器: %s", p.opts.Format, err))
+			}
+			outputStream = outputFormatCtx.NewStream(nil)
+			if err := encoderCtx.ToCodecParameters(outputStream.CodecParameters()); err != nil {
+				return errors.New(fmt.Sprintf("复制编码参数失败: %s", err))
+			}
+			outputStream.SetTimeBase(encoderCtx.TimeBase())
+			// 无限循环播放
+			options := &astiav.Dictionary{}
+			defer options.Free()
+			_ = options.Set("loop", "0", astiav.DictionaryFlags(0))
+			if err := outputFormatCtx.WriteHeader(options); err != nil {
+				return errors.New(fmt.Sprintf("写入%s文件头失败: %s", p.opts.Format, err))
+			}
+		}
+		if err := encoderCtx.SendFrame(frame); err != nil {
+			return errors.New(fmt.Sprintf("视频帧发送给编码器失败: %s", err))
+		}
+		return writePackets()
+	}
+
+	for _, frame := range p.frames {
+		if err = filter.Filter(frame, encodeFrame); err != nil {
+			return nil, err
+		}
+	}
+	if err = filter.Filter(nil, encodeFrame); err != nil {
+		return nil, err
+	}
+	if encoderCtx == nil {
+		return nil, errors.New("滤镜未输出视频帧")
+	}
+	// 刷新编码器
+	if err = encoderCtx.SendFrame(nil); err != nil {
+		return nil, errors.New(fmt.Sprintf("刷新编码器失败: %s", err))
+	}
+	if err = writePackets(); err != nil {
+		return nil, err
+	}
+	if err = outputFormatCtx.WriteTrailer(); err != nil {
+		return nil, errors.New(fmt.Sprintf("写入%s文件尾失败: %s", p.opts.Format, err))
+	}
+	return outputBuf.Bytes(), nil
+}
+
+// Free 释放预览帧和滤镜
+func (p *previewFrames) Free() {
+	for _, frame := range p.frames {
+		frame.Free()
+	}
+	p.frames = nil
+	if p.filter != nil {
+		p.filter.Free()
+		p.filter = nil
+	}
+}
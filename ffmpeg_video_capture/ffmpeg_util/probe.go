@@ -0,0 +1,371 @@
+package ffmpegutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"math"
+	"time"
+)
+
+// ProbeOptions 探测参数
+type ProbeOptions struct {
+	Duration time.Duration // 读取多长时间的数据用于统计GOP、帧率和码率，为0时为5秒
+	Timeout  time.Duration // 超时时间，为0时为Duration加10秒
+}
+
+// ProbeReport 输入的探测结果
+type ProbeReport struct {
+	Url        string          `json:"url"`
+	Format     string          `json:"format"`
+	FormatName string          `json:"formatName"`
+	Duration   float64         `json:"duration"` // 输入时长，单位秒，直播流为0
+	BitRate    int64           `json:"bitRate"`  // 声明的总码率
+	Measured   float64         `json:"measured"` // 实际统计的时长，单位秒
+	Streams    []*StreamReport `json:"streams"`
+}
+
+// StreamReport 单个流的探测结果
+type StreamReport struct {
+	Index     int    `json:"index"`
+	MediaType string `json:"mediaType"`
+	Codec     string `json:"codec"`
+	Profile   string `json:"profile,omitempty"`
+	Level     string `json:"level,omitempty"`
+	TimeBase  string `json:"timeBase"`
+
+	// 视频
+	Width             int        `json:"width,omitempty"`
+	Height            int        `json:"height,omitempty"`
+	PixelFormat       string     `json:"pixelFormat,omitempty"`
+	AvgFrameRate      float64    `json:"avgFrameRate,omitempty"`      // 容器声明的平均帧率
+	RealFrameRate     float64    `json:"realFrameRate,omitempty"`     // 容器推测的基础帧率
+	MeasuredFrameRate float64    `json:"measuredFrameRate,omitempty"` // 按时间戳统计的帧率
+	Gop               *GopReport `json:"gop,omitempty"`
+
+	// 音频
+	SampleRate    int    `json:"sampleRate,omitempty"`
+	Channels      int    `json:"channels,omitempty"`
+	ChannelLayout string `json:"channelLayout,omitempty"`
+	SampleFormat  string `json:"sampleFormat,omitempty"`
+
+	BitRate         int64            `json:"bitRate"`         // 声明的码率
+	MeasuredBitRate int64            `json:"measuredBitRate"` // 按数据量统计的码率
+	Timestamps      *TimestampReport `json:"timestamps"`
+}
+
+// GopReport GOP统计，长度为两个关键帧之间的帧数
+type GopReport struct {
+	Keyframes int     `json:"keyframes"`
+	Min       int     `json:"min"`
+	Max       int     `json:"max"`
+	Avg       float64 `json:"avg"`
+	Interval  float64 `json:"interval"` // 关键帧平均间隔，单位秒
+}
+
+// TimestampReport 时间戳检查结果
+type TimestampReport struct {
+	Packets         int      `json:"packets"`
+	StartTime       float64  `json:"startTime"`       // 第一个包的时间戳，单位秒
+	MissingPts      int      `json:"missingPts"`      // 没有pts的包
+	NonMonotonicDts int      `json:"nonMonotonicDts"` // dts没有递增的包
+	PtsBeforeDts    int      `json:"ptsBeforeDts"`    // pts小于dts的包
+	Gaps            int      `json:"gaps"`            // dts跳变超过1秒的次数
+	Ok              bool     `json:"ok"`
+	Issues          []string `json:"issues,omitempty"`
+}
+
+// streamStats 读取过程中的统计数据
+type streamStats struct {
+	stream     *astiav.Stream
+	timeBase   astiav.Rational
+	packets    int
+	bytes      int64
+	firstDts   int64
+	lastDts    int64
+	lastKey    int // 上一个关键帧的包序号，-1表示还没有关键帧
+	firstKey   int64
+	lastKeyTs  int64
+	gops       []int
+	timestamps *TimestampReport
+}
+
+// Probe 探测输入的格式和每个流的参数，读取一段数据统计GOP、帧率、码率并检查时间戳
+func Probe(url string, opts *ProbeOptions) (*ProbeReport, error) {
+	return ProbeContext(context.Background(), url, opts)
+}
+
+// ProbeContext 同Probe，ctx取消时中断探测
+func ProbeContext(ctx context.Context, url string, opts *ProbeOptions) (*ProbeReport, error) {
+	return ProbeInput(ctx, UrlInput(url), opts)
+}
+
+// ProbeInput 探测地址或读取器输入，报告中的Url为输入的描述
+func ProbeInput(ctx context.Context, input *Input, opts *ProbeOptions) (*ProbeReport, error) {
+	if opts == nil {
+		opts = &ProbeOptions{}
+	}
+	duration := opts.Duration
+	if duration <= 0 {
+		duration = 5 * time.Second
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = duration + 10*time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	inputFormatCtx, closeInput, err := input.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+
+	report := &ProbeReport{
+		Url:        input.String(),
+		Format:     inputFormatCtx.InputFormat().Name(),
+		FormatName: inputFormatCtx.InputFormat().LongName(),
+		BitRate:    inputFormatCtx.BitRate(),
+	}
+	if inputFormatCtx.Duration() > 0 {
+		report.Duration = float64(inputFormatCtx.Duration()) / float64(astiav.TimeBase)
+	}
+
+	stats := make(map[int]*streamStats)
+	for _, stream := range inputFormatCtx.Streams() {
+		stats[stream.Index()] = newStreamStats(stream, stream.TimeBase())
+	}
+
+	// 读取duration时长的数据，文件读到结尾为止
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	for measured := 0.0; measured < duration.Seconds(); {
+		if err = inputFormatCtx.ReadFrame(packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) {
+				break
+			}
+			if ctx.Err() != nil {
+				// 超时后使用已读取的数据
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					break
+				}
+				return nil, ctx.Err()
+			}
+			return nil, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if s, ok := stats[packet.StreamIndex()]; ok {
+			s.add(packet)
+			if span := s.span(); span > measured {
+				measured = span
+			}
+		}
+		packet.Unref()
+	}
+
+	for _, stream := range inputFormatCtx.Streams() {
+		streamReport := stats[stream.Index()].report()
+		if streamReport.Timestamps.Packets > 0 {
+			report.Measured = math.Max(report.Measured, stats[stream.Index()].span())
+		}
+		report.Streams = append(report.Streams, streamReport)
+	}
+	return report, nil
+}
+
+// newStreamStats 新建流的统计数据，stream可以为nil，只使用timeBase统计
+func newStreamStats(stream *astiav.Stream, timeBase astiav.Rational) *streamStats {
+	return &streamStats{stream: stream, timeBase: timeBase, lastKey: -1, timestamps: &TimestampReport{}}
+}
+
+// add 统计一个包
+func (s *streamStats) add(packet *astiav.Packet) {
+	s.addPacket(packet.Pts(), packet.Dts(), packet.Flags().Has(astiav.PacketFlagKey), packet.Size())
+}
+
+// addPacket 按时间戳、是否为关键帧和大小统计一个包
+func (s *streamStats) addPacket(pts, dts int64, key bool, size int) {
+	ts := s.timestamps
+	if dts == astiav.NoPtsValue {
+		dts = pts
+	}
+	if pts == astiav.NoPtsValue {
+		ts.MissingPts++
+	} else if dts != astiav.NoPtsValue && pts < dts {
+		ts.PtsBeforeDts++
+	}
+	if dts != astiav.NoPtsValue {
+		if s.packets == 0 || s.firstDts == astiav.NoPtsValue {
+			s.firstDts = dts
+		} else {
+			if dts <= s.lastDts {
+				ts.NonMonotonicDts++
+			} else if float64(dts-s.lastDts)*s.timeBase.Float64() > 1 {
+				ts.Gaps++
+			}
+		}
+		s.lastDts = dts
+	} else if s.packets == 0 {
+		s.firstDts = astiav.NoPtsValue
+	}
+
+	if key {
+		if s.lastKey >= 0 {
+			s.gops = append(s.gops, s.packets-s.lastKey)
+		} else {
+			s.firstKey = dts
+		}
+		s.lastKey = s.packets
+		s.lastKeyTs = dts
+	}
+	s.packets++
+	s.bytes += int64(size)
+}
+
+// span 已统计数据的时长，单位秒
+func (s *streamStats) span() float64 {
+	if s.packets < 2 || s.firstDts == astiav.NoPtsValue {
+		return 0
+	}
+	return float64(s.lastDts-s.firstDts) * s.timeBase.Float64()
+}
+
+// report 生成流的探测结果
+func (s *streamStats) report() *StreamReport {
+	params := s.stream.CodecParameters()
+	report := &StreamReport{
+		Index:     s.stream.Index(),
+		MediaType: params.MediaType().String(),
+		Codec:     params.CodecID().Name(),
+		Profile:   profileName(params.CodecID(), params.Profile()),
+		Level:     levelName(params.CodecID(), params.Level()),
+		TimeBase:  s.stream.TimeBase().String(),
+		BitRate:   params.BitRate(),
+	}
+	span := s.span()
+	if span > 0 {
+		report.MeasuredBitRate = int64(float64(s.bytes*8) / span)
+	}
+
+	switch params.MediaType() {
+	case astiav.MediaTypeVideo:
+		report.Width = params.Width()
+		report.Height = params.Height()
+		report.PixelFormat = params.PixelFormat().Name()
+		report.AvgFrameRate = s.stream.AvgFrameRate().Float64()
+		report.RealFrameRate = s.stream.RFrameRate().Float64()
+		if span > 0 {
+			report.MeasuredFrameRate = math.Round(float64(s.packets-1)/span*100) / 100
+		}
+		report.Gop = s.gopReport()
+	case astiav.MediaTypeAudio:
+		report.SampleRate = params.SampleRate()
+		report.Channels = params.ChannelLayout().Channels()
+		report.ChannelLayout = params.ChannelLayout().String()
+		report.SampleFormat = params.SampleFormat().Name()
+	}
+
+	report.Timestamps = s.timestampReport()
+	return report
+}
+
+// timestampReport 时间戳检查结果
+func (s *streamStats) timestampReport() *TimestampReport {
+	ts := s.timestamps
+	ts.Packets = s.packets
+	if s.packets > 0 && s.firstDts != astiav.NoPtsValue {
+		ts.StartTime = float64(s.firstDts) * s.timeBase.Float64()
+	}
+	if s.packets == 0 {
+		ts.Issues = append(ts.Issues, "统计时间内没有数据")
+	}
+	if ts.MissingPts > 0 {
+		ts.Issues = append(ts.Issues, fmt.Sprintf("%d个包没有pts", ts.MissingPts))
+	}
+	if ts.NonMonotonicDts > 0 {
+		ts.Issues = append(ts.Issues, fmt.Sprintf("%d个包dts没有递增", ts.NonMonotonicDts))
+	}
+	if ts.PtsBeforeDts > 0 {
+		ts.Issues = append(ts.Issues, fmt.Sprintf("%d个包pts小于dts", ts.PtsBeforeDts))
+	}
+	if ts.Gaps > 0 {
+		ts.Issues = append(ts.Issues, fmt.Sprintf("dts跳变超过1秒%d次", ts.Gaps))
+	}
+	ts.Ok = len(ts.Issues) == 0
+	return ts
+}
+
+// gopReport GOP统计，没有完整的GOP时只返回关键帧个数
+func (s *streamStats) gopReport() *GopReport {
+	gop := &GopReport{Keyframes: len(s.gops)}
+	if s.lastKey >= 0 {
+		gop.Keyframes++
+	}
+	if len(s.gops) == 0 {
+		return gop
+	}
+	total := 0
+	gop.Min = math.MaxInt
+	for _, length := range s.gops {
+		total += length
+		gop.Min = min(gop.Min, length)
+		gop.Max = max(gop.Max, length)
+	}
+	gop.Avg = math.Round(float64(total)/float64(len(s.gops))*100) / 100
+	gop.Interval = math.Round(float64(s.lastKeyTs-s.firstKey)*s.timeBase.Float64()/float64(len(s.gops))*1000) / 1000
+	return gop
+}
+
+// 常见编码的profile名称
+var profileNames = map[astiav.CodecID]map[astiav.Profile]string{
+	astiav.CodecIDH264: {
+		astiav.ProfileH264Baseline:            "Baseline",
+		astiav.ProfileH264ConstrainedBaseline: "Constrained Baseline",
+		astiav.ProfileH264Main:                "Main",
+		astiav.ProfileH264Extended:            "Extended",
+		astiav.ProfileH264High:                "High",
+		astiav.ProfileH264High10:              "High 10",
+		astiav.ProfileH264High422:             "High 4:2:2",
+		astiav.ProfileH264High444Predictive:   "High 4:4:4 Predictive",
+	},
+	astiav.CodecIDHevc: {
+		astiav.ProfileHevcMain:   "Main",
+		astiav.ProfileHevcMain10: "Main 10",
+	},
+	astiav.CodecIDAac: {
+		astiav.ProfileAacMain: "Main",
+		astiav.ProfileAacLow:  "LC",
+		astiav.ProfileAacSsr:  "SSR",
+		astiav.ProfileAacLtp:  "LTP",
+		astiav.ProfileAacHe:   "HE-AAC",
+		astiav.ProfileAacHeV2: "HE-AACv2",
+		astiav.ProfileAacLd:   "LD",
+		astiav.ProfileAacEld:  "ELD",
+	},
+}
+
+// profileName profile名称，未知的profile返回编号
+func profileName(codecID astiav.CodecID, profile astiav.Profile) string {
+	if name, ok := profileNames[codecID][profile]; ok {
+		return name
+	}
+	if profile < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", profile)
+}
+
+// levelName level名称，h264的level为10倍，hevc的level为30倍
+func levelName(codecID astiav.CodecID, level astiav.Level) string {
+	if level <= 0 || level == astiav.LevelUnknown {
+		return ""
+	}
+	switch codecID {
+	case astiav.CodecIDH264:
+		return fmt.Sprintf("%.1f", float64(level)/10)
+	case astiav.CodecIDHevc:
+		return fmt.Sprintf("%.1f", float64(level)/30)
+	}
+	return fmt.Sprintf("%d", level)
+}
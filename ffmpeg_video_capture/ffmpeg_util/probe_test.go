@@ -0,0 +1,84 @@
+package ffmpegutil
+
+import (
+	"github.com/asticode/go-astiav"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestStreamStatsGop(t *testing.T) {
+	// 30fps，每30帧一个关键帧
+	s := newStreamStats(nil, astiav.NewRational(1, 90000))
+	for i := 0; i < 90; i++ {
+		pts := int64(i * 3000)
+		s.addPacket(pts, pts, i%30 == 0, 1000)
+	}
+	if span := s.span(); math.Abs(span-89.0/30) > 1e-9 {
+		t.Errorf("span() = %f", span)
+	}
+	want := &GopReport{Keyframes: 3, Min: 30, Max: 30, Avg: 30, Interval: 1}
+	if gop := s.gopReport(); !reflect.DeepEqual(gop, want) {
+		t.Errorf("gopReport() = %+v, want %+v", gop, want)
+	}
+	if ts := s.timestampReport(); !ts.Ok || ts.Packets != 90 || ts.StartTime != 0 {
+		t.Errorf("timestampReport() = %+v", ts)
+	}
+}
+
+func TestStreamStatsTimestamps(t *testing.T) {
+	s := newStreamStats(nil, astiav.NewRational(1, 1000))
+	packets := []struct {
+		pts, dts int64
+	}{
+		{1000, 1000},
+		{astiav.NoPtsValue, 1040}, // 没有pts
+		{1080, 1080},
+		{1080, 1080}, // dts没有递增
+		{1100, 1120}, // pts小于dts
+		{3000, 3000}, // 跳变2秒
+	}
+	for _, packet := range packets {
+		s.addPacket(packet.pts, packet.dts, false, 100)
+	}
+	ts := s.timestampReport()
+	if ts.Ok || ts.MissingPts != 1 || ts.NonMonotonicDts != 1 || ts.PtsBeforeDts != 1 || ts.Gaps != 1 || len(ts.Issues) != 4 {
+		t.Errorf("timestampReport() = %+v", ts)
+	}
+	if ts.StartTime != 1 {
+		t.Errorf("StartTime = %f", ts.StartTime)
+	}
+	// 没有关键帧时GOP为空
+	if gop := s.gopReport(); gop.Keyframes != 0 || gop.Max != 0 {
+		t.Errorf("gopReport() = %+v", gop)
+	}
+
+	empty := newStreamStats(nil, astiav.NewRational(1, 1000))
+	if ts = empty.timestampReport(); ts.Ok || len(ts.Issues) != 1 {
+		t.Errorf("没有数据时timestampReport() = %+v", ts)
+	}
+}
+
+func TestProfileLevelName(t *testing.T) {
+	tests := []struct {
+		codecID   astiav.CodecID
+		profile   astiav.Profile
+		level     astiav.Level
+		name      string
+		levelName string
+	}{
+		{astiav.CodecIDH264, astiav.ProfileH264High, 31, "High", "3.1"},
+		{astiav.CodecIDHevc, astiav.ProfileHevcMain, 93, "Main", "3.1"},
+		{astiav.CodecIDAac, astiav.ProfileAacLow, astiav.LevelUnknown, "LC", ""},
+		{astiav.CodecIDMjpeg, 3, 0, "3", ""},
+		{astiav.CodecIDMjpeg, -99, 5, "", "5"},
+	}
+	for _, test := range tests {
+		if got := profileName(test.codecID, test.profile); got != test.name {
+			t.Errorf("profileName(%d, %d) = %s, want %s", test.codecID, test.profile, got, test.name)
+		}
+		if got := levelName(test.codecID, test.level); got != test.levelName {
+			t.Errorf("levelName(%d, %d) = %s, want %s", test.codecID, test.level, got, test.levelName)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package ffmpegutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"log"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// DefaultRestreamRetry 转推断开后默认的重连间隔
+const DefaultRestreamRetry = 5 * time.Second
+
+// RestreamOptions 转推参数
+type RestreamOptions struct {
+	Transcode  bool          // 视频解码后重新编码为H.264，为false时直接复制
+	Bitrate    int64         // 转码的视频码率，为0时使用编码器默认码率
+	RetryDelay time.Duration // 输入或推流地址断开后的重连间隔，为0时为5秒
+}
+
+// 各封装格式可以直接复制的编码格式，flv只支持H.264和aac/mp3
+var restreamCodecs = map[string]map[astiav.CodecID]bool{
+	"flv": {
+		astiav.CodecIDH264: true,
+		astiav.CodecIDAac:  true,
+		astiav.CodecIDMp3:  true,
+	},
+	"rtsp": {
+		astiav.CodecIDH264:     true,
+		astiav.CodecIDHevc:     true,
+		astiav.CodecIDMjpeg:    true,
+		astiav.CodecIDAac:      true,
+		astiav.CodecIDPcmAlaw:  true,
+		astiav.CodecIDPcmMulaw: true,
+		astiav.CodecIDOpus:     true,
+	},
+}
+
+// RestreamFormat 按推流地址的协议选择封装格式，rtmp使用flv，rtsp使用rtsp
+func RestreamFormat(url string) (string, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("推流地址格式错误: %s", err))
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "rtmp", "rtmps":
+		return "flv", nil
+	case "rtsp", "rtsps":
+		return "rtsp", nil
+	}
+	return "", errors.New(fmt.Sprintf("不支持的推流协议：%s，只支持rtmp和rtsp", u.Scheme))
+}
+
+// Restream 拉流后推送到rtmp或rtsp地址(如nginx-rtmp、mediamtx)，直接复制或将视频转码为H.264
+// 推流地址断开(如流媒体服务重启)时继续读取输入并丢弃，间隔RetryDelay重连，重连后从关键帧开始推流；
+// 输入断开时重新拉流。ctx取消时返回nil，推流地址不支持或编码格式需要转码时返回错误
+// 只支持地址输入：输入断开后需要重新打开，读取器不能重新读取，且推流需要按实时速度发送
+func Restream(ctx context.Context, inputUrl, outputUrl string, opts *RestreamOptions) error {
+	options := RestreamOptions{}
+	if opts != nil {
+		options = *opts
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = DefaultRestreamRetry
+	}
+	formatName, err := RestreamFormat(outputUrl)
+	if err != nil {
+		return err
+	}
+
+	for {
+		retry, err := restreamInput(ctx, inputUrl, outputUrl, formatName, &options)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !retry {
+			return err
+		}
+		log.Printf("转推输入中断，%s后重新拉流: %s", options.RetryDelay, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(options.RetryDelay):
+		}
+	}
+}
+
+// restreamInput 打开一次输入并推流，推流地址断开时自动重连，输入出错时返回
+// retry为false表示重新拉流也无法恢复的错误
+func restreamInput(ctx context.Context, inputUrl, outputUrl, formatName string, opts *RestreamOptions) (retry bool, err error) {
+	inputFormatCtx, closeInput, err := OpenInput(ctx, inputUrl)
+	if err != nil {
+		return true, err
+	}
+	defer closeInput()
+	videoInputStream := FindStream(inputFormatCtx, astiav.MediaTypeVideo)
+	if videoInputStream == nil {
+		return true, errors.New("未找到视频流")
+	}
+	videoCodecID := videoInputStream.CodecParameters().CodecID()
+	if !opts.Transcode && !restreamCodecs[formatName][videoCodecID] {
+		return false, errors.New(fmt.Sprintf("%s不支持直接复制视频格式%s，需要转码", formatName, videoCodecID.Name()))
+	}
+	// 不支持的音频格式直接丢弃
+	audioInputStream := FindStream(inputFormatCtx, astiav.MediaTypeAudio)
+	if audioInputStream != nil && !restreamCodecs[formatName][audioInputStream.CodecParameters().CodecID()] {
+		log.Printf("%s不支持音频格式%s，推流中不包含音频", formatName, audioInputStream.CodecParameters().CodecID().Name())
+		audioInputStream = nil
+	}
+
+	var output *restreamOutput
+	defer func() {
+		if output != nil {
+			output.Close()
+		}
+	}()
+	// 推流地址断开后，到retryAt之前不重连
+	var retryAt time.Time
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	for {
+		if err = inputFormatCtx.ReadFrame(packet); err != nil {
+			if ctx.Err() != nil {
+				return true, nil
+			}
+			if errors.Is(err, astiav.ErrEof) {
+				return true, errors.New("直播输入已结束")
+			}
+			return true, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		isVideo := packet.StreamIndex() == videoInputStream.Index()
+		if !isVideo && (audioInputStream == nil || packet.StreamIndex() != audioInputStream.Index()) {
+			packet.Unref()
+			continue
+		}
+		if output == nil {
+			// 断开期间继续读取输入并丢弃，避免输入缓冲堆积，重连后从视频关键帧开始
+			if !isVideo || !packet.Flags().Has(astiav.PacketFlagKey) || time.Now().Before(retryAt) {
+				packet.Unref()
+				continue
+			}
+			if output, err = openRestreamOutput(ctx, outputUrl, formatName, videoInputStream, audioInputStream, packet, opts); err != nil {
+				packet.Unref()
+				if ctx.Err() != nil {
+					return true, nil
+				}
+				log.Printf("连接推流地址失败，%s后重试: %s", opts.RetryDelay, err)
+				retryAt = time.Now().Add(opts.RetryDelay)
+				continue
+			}
+			log.Printf("开始推流，格式：%s", formatName)
+		}
+		if isVideo {
+			err = output.WriteVideo(packet)
+		} else {
+			err = output.WriteAudio(packet)
+		}
+		packet.Unref()
+		if err != nil {
+			output.Close()
+			output = nil
+			if ctx.Err() != nil {
+				return true, nil
+			}
+			log.Printf("推流中断，%s后重连: %s", opts.RetryDelay, err)
+			retryAt = time.Now().Add(opts.RetryDelay)
+		}
+	}
+}
+
+// restreamOutput 一次推流连接，输出的时间戳从0开始
+type restreamOutput struct {
+	formatCtx     *astiav.FormatContext
+	ioContext     *astiav.IOContext // rtsp封装自己管理连接，为nil
+	interrupter   *astiav.IOInterrupter
+	stopInterrupt func() bool
+	headerWritten bool
+	videoInput    *astiav.Stream
+	videoOutput   *astiav.Stream
+	audioInput    *astiav.Stream
+	audioOutput   *astiav.Stream
+	transcoder    *restreamTranscoder // 不转码时为nil
+	offset        int64               // 第一个视频关键帧的时间，单位微秒
+}
+
+// openRestreamOutput 连接推流地址并写入文件头，first为第一个视频关键帧
+func openRestreamOutput(ctx context.Context, url, formatName string, videoInputStream, audioInputStream *astiav.Stream, first *astiav.Packet, opts *RestreamOptions) (output *restreamOutput, err error) {
+	outputFormatCtx, err := astiav.AllocOutputFormatContext(nil, formatName, url)
+	if err != nil || outputFormatCtx == nil {
+		return nil, errors.New(fmt.Sprintf("分配%s输出格式上下文失败: %s", formatName, err))
+	}
+	interrupter := astiav.NewIOInterrupter()
+	output = &restreamOutput{
+		formatCtx:     outputFormatCtx,
+		interrupter:   interrupter,
+		stopInterrupt: context.AfterFunc(ctx, interrupter.Interrupt),
+		videoInput:    videoInputStream,
+		audioInput:    audioInputStream,
+	}
+	defer func() {
+		if err != nil {
+			output.Close()
+			output = nil
+		}
+	}()
+	outputFormatCtx.SetIOInterrupter(interrupter)
+
+	if opts.Transcode {
+		globalHeader := outputFormatCtx.OutputFormat().Flags().Has(astiav.IOFormatFlagGlobalheader)
+		if output.transcoder, err = newRestreamTranscoder(videoInputStream, opts.Bitrate, globalHeader); err != nil {
+			return output, err
+		}
+		output.videoOutput = outputFormatCtx.NewStream(nil)
+		if err = output.transcoder.encoderCtx.ToCodecParameters(output.videoOutput.CodecParameters()); err != nil {
+			return output, errors.New(fmt.Sprintf("复制编码参数失败: %s", err))
+		}
+		output.videoOutput.SetTimeBase(output.transcoder.encoderCtx.TimeBase())
+	} else if output.videoOutput, err = CreateStreamAndCopyParams(outputFormatCtx, videoInputStream); err != nil {
+		return output, errors.New(fmt.Sprintf("创建视频输出流失败: %s", err))
+	}
+	if audioInputStream != nil {
+		if output.audioOutput, err = CreateStreamAndCopyParams(outputFormatCtx, audioInputStream); err != nil {
+			return output, errors.New(fmt.Sprintf("创建音频输出流失败: %s", err))
+		}
+	}
+
+	options := &astiav.Dictionary{}
+	defer options.Free()
+	if !outputFormatCtx.OutputFormat().Flags().Has(astiav.IOFormatFlagNofile) {
+		// rtmp需要自己打开连接，服务端无响应时超时(微秒)断开
+		ioOptions := &astiav.Dictionary{}
+		defer ioOptions.Free()
+		_ = ioOptions.Set("rw_timeout", "10000000", astiav.DictionaryFlags(0))
+		if output.ioContext, err = astiav.OpenIOContext(url, astiav.NewIOContextFlags(astiav.IOContextFlagWrite), interrupter, ioOptions); err != nil {
+			return output, errors.New(fmt.Sprintf("连接推流地址失败: %s", err))
+		}
+		outputFormatCtx.SetPb(output.ioContext)
+	}
+	switch formatName {
+	case "flv":
+		// 直播不回写时长和文件大小
+		_ = options.Set("flvflags", "no_duration_filesize", astiav.DictionaryFlags(0))
+	case "rtsp":
+		_ = options.Set("rtsp_transport", "tcp", astiav.DictionaryFlags(0))
+	}
+	if err = outputFormatCtx.WriteHeader(options); err != nil {
+		return output, errors.New(fmt.Sprintf("写入%s文件头失败: %s", formatName, err))
+	}
+	output.headerWritten = true
+
+	ts := first.Dts()
+	if ts == astiav.NoPtsValue {
+		ts = first.Pts()
+	}
+	output.offset = astiav.RescaleQ(ts, videoInputStream.TimeBase(), astiav.TimeBaseQ)
+	return output, nil
+}
+
+// WriteVideo 写入视频数据包，转码时先解码再编码
+func (output *restreamOutput) WriteVideo(packet *astiav.Packet) error {
+	if output.transcoder == nil {
+		return output.write(packet, output.videoInput.TimeBase(), output.videoOutput)
+	}
+	return output.transcoder.Transcode(packet, func(encoded *astiav.Packet) error {
+		return output.write(encoded, output.transcoder.encoderCtx.TimeBase(), output.videoOutput)
+	})
+}
+
+// WriteAudio 写入音频数据包，第一个视频关键帧之前的音频丢弃
+func (output *restreamOutput) WriteAudio(packet *astiav.Packet) error {
+	return output.write(packet, output.audioInput.TimeBase(), output.audioOutput)
+}
+
+// write 时间戳减去第一个视频关键帧的时间后写入
+func (output *restreamOutput) write(packet *astiav.Packet, timeBase astiav.Rational, outputStream *astiav.Stream) error {
+	offset := astiav.RescaleQ(output.offset, astiav.TimeBaseQ, timeBase)
+	if packet.Dts() != astiav.NoPtsValue {
+		if packet.Dts() < offset {
+			return nil
+		}
+		packet.SetDts(packet.Dts() - offset)
+	}
+	if packet.Pts() != astiav.NoPtsValue {
+		packet.SetPts(packet.Pts() - offset)
+	}
+	packet.RescaleTs(timeBase, outputStream.TimeBase())
+	packet.SetStreamIndex(outputStream.Index())
+	packet.SetPos(-1)
+	if err := output.formatCtx.WriteInterleavedFrame(packet); err != nil {
+		return errors.New(fmt.Sprintf("推流写入数据包失败: %s", err))
+	}
+	return nil
+}
+
+// Close 断开推流连接并释放资源
+func (output *restreamOutput) Close() {
+	if output.headerWritten {
+		_ = output.formatCtx.WriteTrailer()
+	}
+	if output.ioContext != nil {
+		_ = output.ioContext.Close()
+	}
+	output.formatCtx.Free()
+	if output.transcoder != nil {
+		output.transcoder.Free()
+	}
+	output.stopInterrupt()
+	output.interrupter.Free()
+}
+
+// restreamTranscoder 将视频解码后重新编码为H.264
+type restreamTranscoder struct {
+	decoderCtx *astiav.CodecContext
+	encoderCtx *astiav.CodecContext
+	swsCtx     *astiav.SoftwareScaleContext // 像素格式不同时转换，不需要时为nil
+	frame      *astiav.Frame
+	scaled     *astiav.Frame
+	packet     *astiav.Packet
+}
+
+// newRestreamTranscoder 根据视频流创建解码器和低延迟的H.264编码器，优先使用libx264
+func newRestreamTranscoder(stream *astiav.Stream, bitrate int64, globalHeader bool) (*restreamTranscoder, error) {
+	decoderCtx, _, err := FindAndOpenDecoderCtx(stream)
+	if err != nil {
+		return nil, err
+	}
+	encoder := astiav.FindEncoderByName("libx264")
+	if encoder == nil {
+		encoder = astiav.FindEncoder(astiav.CodecIDH264)
+	}
+	if encoder == nil {
+		decoderCtx.Free()
+		return nil, errors.New("未找到H.264编码器")
+	}
+
+	encoderCtx := astiav.AllocCodecContext(encoder)
+	encoderCtx.SetWidth(decoderCtx.Width())
+	encoderCtx.SetHeight(decoderCtx.Height())
+	// yuvj420p与yuv420p只有色彩范围不同，可以直接编码，其他像素格式先转换
+	pixelFormat := decoderCtx.PixelFormat()
+	if pixelFormat != astiav.PixelFormatYuv420P && pixelFormat != astiav.PixelFormatYuvj420P {
+		pixelFormat = astiav.PixelFormatYuv420P
+	}
+	encoderCtx.SetPixelFormat(pixelFormat)
+	encoderCtx.SetSampleAspectRatio(decoderCtx.SampleAspectRatio())
+	encoderCtx.SetTimeBase(stream.TimeBase())
+	framerate := stream.AvgFrameRate()
+	encoderCtx.SetFramerate(framerate)
+	// 2秒一个关键帧，播放端连接后能尽快出画面
+	gopSize := 50
+	if framerate.Num() > 0 && framerate.Den() > 0 {
+		gopSize = max(framerate.Num()*2/framerate.Den(), 1)
+	}
+	encoderCtx.SetGopSize(gopSize)
+	encoderCtx.SetMaxBFrames(0)
+	if bitrate > 0 {
+		encoderCtx.SetBitRate(bitrate)
+	}
+	if globalHeader {
+		encoderCtx.SetFlags(encoderCtx.Flags().Add(astiav.CodecContextFlagGlobalHeader))
+	}
+	options := &astiav.Dictionary{}
+	defer options.Free()
+	_ = options.Set("preset", "veryfast", astiav.DictionaryFlags(0))
+	_ = options.Set("tune", "zerolatency", astiav.DictionaryFlags(0))
+	if err = encoderCtx.Open(encoder, options); err != nil {
+		decoderCtx.Free()
+		encoderCtx.Free()
+		return nil, errors.New(fmt.Sprintf("无法打开H.264编码器: %s", err))
+	}
+
+	return &restreamTranscoder{
+		decoderCtx: decoderCtx,
+		encoderCtx: encoderCtx,
+		frame:      astiav.AllocFrame(),
+		scaled:     astiav.AllocFrame(),
+		packet:     astiav.AllocPacket(),
+	}, nil
+}
+
+// Transcode 解码数据包，重新编码后交给write写入
+func (t *restreamTranscoder) Transcode(packet *astiav.Packet, write func(packet *astiav.Packet) error) error {
+	if err := t.decoderCtx.SendPacket(packet); err != nil {
+		return errors.New(fmt.Sprintf("数据发送给视频解码器失败: %s", err))
+	}
+	for {
+		if err := t.decoderCtx.ReceiveFrame(t.frame); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+		}
+		err := t.encode(write)
+		t.frame.Unref()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// encode 编码解码后的帧，像素格式或尺寸与编码器不同时先转换
+func (t *restreamTranscoder) encode(write func(packet *astiav.Packet) error) error {
+	frame := t.frame
+	if frame.PixelFormat() != t.encoderCtx.PixelFormat() || frame.Width() != t.encoderCtx.Width() || frame.Height() != t.encoderCtx.Height() {
+		if t.swsCtx == nil {
+			swsCtx, err := astiav.CreateSoftwareScaleContext(frame.Width(), frame.Height(), frame.PixelFormat(),
+				t.encoderCtx.Width(), t.encoderCtx.Height(), t.encoderCtx.PixelFormat(), astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear))
+			if err != nil {
+				return errors.New(fmt.Sprintf("创建图像缩放上下文失败: %s", err))
+			}
+			t.swsCtx = swsCtx
+		}
+		t.scaled.Unref()
+		t.scaled.SetWidth(t.encoderCtx.Width())
+		t.scaled.SetHeight(t.encoderCtx.Height())
+		t.scaled.SetPixelFormat(t.encoderCtx.PixelFormat())
+		if err := t.swsCtx.ScaleFrame(frame, t.scaled); err != nil {
+			return errors.New(fmt.Sprintf("图像像素格式转换失败: %s", err))
+		}
+		t.scaled.SetPts(frame.Pts())
+		frame = t.scaled
+	}
+	frame.SetPictureType(astiav.PictureTypeNone)
+	if err := t.encoderCtx.SendFrame(frame); err != nil {
+		return errors.New(fmt.Sprintf("视频帧发送给编码器失败: %s", err))
+	}
+	for {
+		if err := t.encoderCtx.ReceivePacket(t.packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("从视频编码器获取数据包失败: %s", err))
+		}
+		err := write(t.packet)
+		t.packet.Unref()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Free 释放编解码器
+func (t *restreamTranscoder) Free() {
+	if t.swsCtx != nil {
+		t.swsCtx.Free()
+	}
+	t.packet.Free()
+	t.scaled.Free()
+	t.frame.Free()
+	t.encoderCtx.Free()
+	t.decoderCtx.Free()
+}
@@ -0,0 +1,203 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"log"
+	"strings"
+)
+
+// RTP包的最大长度，加上IP和UDP头不超过以太网MTU
+const rtpPacketSize = 1400
+
+// 可以封装为RTP的编码格式
+var rtpCodecs = map[astiav.CodecID]bool{
+	astiav.CodecIDH264:     true,
+	astiav.CodecIDHevc:     true,
+	astiav.CodecIDMjpeg:    true,
+	astiav.CodecIDAac:      true,
+	astiav.CodecIDPcmAlaw:  true,
+	astiav.CodecIDPcmMulaw: true,
+	astiav.CodecIDOpus:     true,
+}
+
+// RtpInit RTP转发的初始化信息
+type RtpInit struct {
+	Tracks int    // 媒体流个数，第一个为视频
+	Sdp    string // 会话描述，每个媒体流的control为trackID={序号}
+}
+
+// RtpPacket 一个RTP或RTCP包
+type RtpPacket struct {
+	Track    int  // 媒体流序号
+	Rtcp     bool // 是否为RTCP包(封装器定期发送的SR)
+	Keyframe bool // 是否属于视频关键帧，客户端从关键帧开始接收
+	Data     []byte
+}
+
+// rtpTrack 一个媒体流的RTP封装，rtp封装器每个上下文只支持一个流
+type rtpTrack struct {
+	inputStream  *astiav.Stream
+	outputStream *astiav.Stream
+	formatCtx    *astiav.FormatContext
+	ioContext    *astiav.IOContext
+}
+
+// RtpLive 打开直播输入，直接复制(不转码)封装为RTP包
+// 先调用一次onInit传入会话描述，之后每个RTP或RTCP包调用一次onPacket
+// ctx取消时返回nil，输入出错或回调返回错误时返回错误
+// 只支持地址输入：RTP包按读取速度发送，读取器没有实时速度，RTSP客户端会收到突发的数据
+func RtpLive(ctx context.Context, url string, onInit func(init *RtpInit) error, onPacket func(packet *RtpPacket) error) error {
+	inputFormatCtx, closeInput, err := OpenInput(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+	videoInputStream := FindStream(inputFormatCtx, astiav.MediaTypeVideo)
+	if videoInputStream == nil {
+		return errors.New("未找到视频流")
+	}
+	if codecID := videoInputStream.CodecParameters().CodecID(); !rtpCodecs[codecID] {
+		return errors.New(fmt.Sprintf("视频格式%s不支持RTP转发", codecID.Name()))
+	}
+	inputStreams := []*astiav.Stream{videoInputStream}
+	if audioInputStream := FindStream(inputFormatCtx, astiav.MediaTypeAudio); audioInputStream != nil {
+		if codecID := audioInputStream.CodecParameters().CodecID(); rtpCodecs[codecID] {
+			inputStreams = append(inputStreams, audioInputStream)
+		} else {
+			log.Printf("音频格式%s不支持RTP转发，转发中不包含音频", codecID.Name())
+		}
+	}
+
+	// 封装器写出RTP包时回调，当前写入的数据包信息
+	var current RtpPacket
+	var callbackErr error
+	var tracks []*rtpTrack
+	defer func() {
+		for _, track := range tracks {
+			track.formatCtx.Free()
+			track.ioContext.Free()
+		}
+	}()
+	var medias []string
+	for i, inputStream := range inputStreams {
+		track := &rtpTrack{inputStream: inputStream}
+		if track.formatCtx, err = astiav.AllocOutputFormatContext(nil, "rtp", ""); err != nil || track.formatCtx == nil {
+			return errors.New(fmt.Sprintf("分配rtp输出格式上下文失败: %s", err))
+		}
+		// 封装器每输出一个RTP包刷新一次，每次回调为一个完整的包
+		track.ioContext, err = astiav.AllocIOContext(
+			rtpPacketSize*2,
+			true,
+			nil,
+			nil,
+			func(b []byte) (n int, err error) {
+				if callbackErr != nil || len(b) < 2 {
+					return len(b), nil
+				}
+				packet := current
+				// RTCP的包类型为200-204，与RTP的payload type不重叠
+				packet.Rtcp = b[1] >= 200 && b[1] <= 204
+				packet.Data = bytes.Clone(b)
+				callbackErr = onPacket(&packet)
+				return len(b), nil
+			},
+		)
+		if err != nil {
+			track.formatCtx.Free()
+			return errors.New(fmt.Sprintf("分配IO上下文失败: %s", err))
+		}
+		tracks = append(tracks, track)
+		track.formatCtx.SetPb(track.ioContext)
+		if track.outputStream, err = CreateStreamAndCopyParams(track.formatCtx, inputStream); err != nil {
+			return errors.New(fmt.Sprintf("创建rtp输出流失败: %s", err))
+		}
+		options := &astiav.Dictionary{}
+		_ = options.Set("packetsize", fmt.Sprint(rtpPacketSize), astiav.DictionaryFlags(0))
+		err = track.formatCtx.WriteHeader(options)
+		options.Free()
+		if err != nil {
+			return errors.New(fmt.Sprintf("写入rtp文件头失败: %s", err))
+		}
+		sdp, err := track.formatCtx.SDPCreate()
+		if err != nil {
+			return errors.New(fmt.Sprintf("生成会话描述失败: %s", err))
+		}
+		medias = append(medias, rtpMedia(sdp, i))
+	}
+	if err = onInit(&RtpInit{Tracks: len(tracks), Sdp: rtpSessionHeader + strings.Join(medias, "")}); err != nil {
+		return err
+	}
+
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	started := false
+	for {
+		if err = inputFormatCtx.ReadFrame(packet); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, astiav.ErrEof) {
+				return errors.New("直播输入已结束")
+			}
+			return errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		index := -1
+		for i, track := range tracks {
+			if packet.StreamIndex() == track.inputStream.Index() {
+				index = i
+				break
+			}
+		}
+		isKey := index == 0 && packet.Flags().Has(astiav.PacketFlagKey)
+		// 从第一个视频关键帧开始
+		if index < 0 || packet.Pts() == astiav.NoPtsValue || (!started && !isKey) {
+			packet.Unref()
+			continue
+		}
+		started = true
+
+		track := tracks[index]
+		current = RtpPacket{Track: index, Keyframe: isKey}
+		packet.SetStreamIndex(track.outputStream.Index())
+		packet.RescaleTs(track.inputStream.TimeBase(), track.outputStream.TimeBase())
+		packet.SetPos(-1)
+		err = track.formatCtx.WriteFrame(packet)
+		packet.Unref()
+		if callbackErr != nil {
+			return callbackErr
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("写入rtp数据帧失败: %s", err))
+		}
+	}
+}
+
+// 会话描述的会话级字段，媒体级字段来自rtp封装器
+const rtpSessionHeader = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=ffmpeg_video_capture\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"t=0 0\r\n" +
+	"a=control:*\r\n" +
+	"a=range:npt=0-\r\n"
+
+// rtpMedia 取出rtp封装器生成的会话描述中的媒体级字段，control替换为trackID={序号}
+func rtpMedia(sdp string, track int) string {
+	var media strings.Builder
+	inMedia := false
+	for _, line := range strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(line, "m=") {
+			inMedia = true
+		}
+		if !inMedia || line == "" || strings.HasPrefix(line, "a=control:") || strings.HasPrefix(line, "c=") {
+			continue
+		}
+		media.WriteString(line + "\r\n")
+	}
+	media.WriteString(fmt.Sprintf("a=control:trackID=%d\r\n", track))
+	return media.String()
+}
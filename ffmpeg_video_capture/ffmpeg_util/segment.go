@@ -0,0 +1,235 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"log"
+	"time"
+)
+
+// 直播切片的封装格式
+const (
+	SegmentTs   = "mpegts" // MPEG-TS切片，每个切片可以单独播放
+	SegmentFmp4 = "fmp4"   // fMP4切片，播放前需要先加载初始化切片
+)
+
+// SegmentOptions 直播切片参数
+type SegmentOptions struct {
+	Format   string        // mpegts或fmp4，为空时为fmp4
+	Duration time.Duration // 目标切片时长，达到后在下一个关键帧处切分，为0时每个关键帧切分
+	// Fragment 切片内的分片时长，只对fmp4有效，为0时不在切片内分片
+	// 大于0时切片内每隔该时长输出一个不从关键帧开始的分片，用于降低延迟
+	Fragment time.Duration
+}
+
+// LiveSegment 直播切片或切片内的分片
+type LiveSegment struct {
+	Sequence int64         // 序号，从0开始
+	Start    time.Duration // 相对第一个切片开始的时间
+	Duration time.Duration // 时长
+	Keyframe bool          // 是否从关键帧开始，为false时为切片内的分片
+	Data     []byte
+}
+
+// SegmentInit 直播切片的初始化信息
+type SegmentInit struct {
+	Data  []byte     // fmp4的初始化切片(ftyp+moov)，mpegts时为nil
+	Media *MediaInfo // 切片的编码信息
+}
+
+// SegmentLive 打开直播输入，直接复制(不转码)封装为切片，每个切片从视频关键帧开始
+// 先调用一次onInit传入初始化信息，之后每个切片调用一次onSegment
+// ctx取消时返回nil，输入出错或回调返回错误时返回错误
+func SegmentLive(ctx context.Context, url string, opts *SegmentOptions, onInit func(init *SegmentInit) error, onSegment func(segment *LiveSegment) error) error {
+	return SegmentInput(ctx, UrlInput(url), opts, onInit, onSegment)
+}
+
+// SegmentInput 从地址或读取器切片，与SegmentLive相同
+// 读取器的数据不按实时速度读取，读完后输出最后一个切片并返回nil；地址输入结束视为直播中断，返回错误
+func SegmentInput(ctx context.Context, input *Input, opts *SegmentOptions, onInit func(init *SegmentInit) error, onSegment func(segment *LiveSegment) error) error {
+	if opts == nil {
+		opts = &SegmentOptions{}
+	}
+	format := opts.Format
+	if format == "" {
+		format = SegmentFmp4
+	}
+	if format != SegmentFmp4 && format != SegmentTs {
+		return errors.New(fmt.Sprintf("不支持的切片格式：%s", format))
+	}
+
+	inputFormatCtx, closeInput, err := input.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+	videoInputStream := FindStream(inputFormatCtx, astiav.MediaTypeVideo)
+	if videoInputStream == nil {
+		return errors.New("未找到视频流")
+	}
+	// 只复制aac音频，其他音频格式(如G.711)在mp4和ts中兼容性差，直接丢弃
+	audioInputStream := FindStream(inputFormatCtx, astiav.MediaTypeAudio)
+	if audioInputStream != nil && audioInputStream.CodecParameters().CodecID() != astiav.CodecIDAac {
+		log.Printf("音频格式%s不支持直接复制，切片中不包含音频", audioInputStream.CodecParameters().CodecID().Name())
+		audioInputStream = nil
+	}
+
+	formatName := "mp4"
+	if format == SegmentTs {
+		formatName = "mpegts"
+	}
+	outputFormatCtx, err := astiav.AllocOutputFormatContext(nil, formatName, "")
+	if err != nil || outputFormatCtx == nil {
+		return errors.New(fmt.Sprintf("分配%s输出格式上下文失败: %s", formatName, err))
+	}
+	defer outputFormatCtx.Free()
+	// 封装后的数据先写入pending，切分时取出
+	var pending bytes.Buffer
+	ioContext, err := astiav.AllocIOContext(
+		4096,
+		true,
+		nil,
+		nil,
+		func(b []byte) (n int, err error) {
+			return pending.Write(b)
+		},
+	)
+	if err != nil {
+		return errors.New(fmt.Sprintf("分配IO上下文失败: %s", err))
+	}
+	defer ioContext.Free()
+	outputFormatCtx.SetPb(ioContext)
+
+	videoOutputStream, err := CreateStreamAndCopyParams(outputFormatCtx, videoInputStream)
+	if err != nil {
+		return errors.New(fmt.Sprintf("创建视频输出流失败: %s", err))
+	}
+	var audioOutputStream *astiav.Stream
+	if audioInputStream != nil {
+		if audioOutputStream, err = CreateStreamAndCopyParams(outputFormatCtx, audioInputStream); err != nil {
+			return errors.New(fmt.Sprintf("创建音频输出流失败: %s", err))
+		}
+	}
+
+	options := &astiav.Dictionary{}
+	defer options.Free()
+	if format == SegmentFmp4 {
+		// 手动控制分片，moov中不包含数据帧，每个分片的时间戳相对moof
+		_ = options.Set("movflags", "+frag_custom+empty_moov+default_base_moof", astiav.DictionaryFlags(0))
+	}
+	if err = outputFormatCtx.WriteHeader(options); err != nil {
+		return errors.New(fmt.Sprintf("写入%s文件头失败: %s", formatName, err))
+	}
+	ioContext.Flush()
+	segmentInit := &SegmentInit{Media: newMediaInfo(videoInputStream, audioInputStream)}
+	if format == SegmentFmp4 {
+		segmentInit.Data = bytes.Clone(pending.Bytes())
+		pending.Reset()
+	}
+	if err = onInit(segmentInit); err != nil {
+		return err
+	}
+
+	videoTimeBase := videoInputStream.TimeBase()
+	toTime := func(pts int64) time.Duration {
+		return time.Duration(astiav.RescaleQ(pts, videoTimeBase, astiav.TimeBaseQ)) * time.Microsecond
+	}
+	var sequence int64
+	firstPts, segmentPts, fragmentPts := astiav.NoPtsValue, astiav.NoPtsValue, astiav.NoPtsValue
+	// 已写入的视频帧的结束时间戳，读取器读完时作为最后一个切片的结束时间
+	endPts := astiav.NoPtsValue
+	fragmentKeyframe := true
+	// 输出当前切片或分片，endPts为下一个切片或分片开始的时间戳
+	flush := func(endPts int64) error {
+		// 写入缓存的数据帧，fmp4输出moof和mdat，ts输出缓存的音频
+		if err := outputFormatCtx.WriteFrame(nil); err != nil {
+			return errors.New(fmt.Sprintf("输出切片失败: %s", err))
+		}
+		ioContext.Flush()
+		segment := &LiveSegment{
+			Sequence: sequence,
+			Start:    toTime(fragmentPts - firstPts),
+			Duration: toTime(endPts - fragmentPts),
+			Keyframe: fragmentKeyframe,
+			Data:     bytes.Clone(pending.Bytes()),
+		}
+		pending.Reset()
+		sequence++
+		return onSegment(segment)
+	}
+
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	for {
+		if err = inputFormatCtx.ReadFrame(packet); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, astiav.ErrEof) {
+				if input.Reader == nil {
+					return errors.New("直播输入已结束")
+				}
+				if firstPts == astiav.NoPtsValue {
+					return errors.New("未找到视频关键帧")
+				}
+				return flush(max(endPts, fragmentPts))
+			}
+			return errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+
+		var outputStream *astiav.Stream
+		var inputStream *astiav.Stream
+		if packet.StreamIndex() == videoInputStream.Index() {
+			inputStream, outputStream = videoInputStream, videoOutputStream
+			pts := packet.Pts()
+			isKey := packet.Flags().Has(astiav.PacketFlagKey)
+			if pts == astiav.NoPtsValue || (firstPts == astiav.NoPtsValue && !isKey) {
+				// 从第一个关键帧开始
+				packet.Unref()
+				continue
+			}
+			switch {
+			case firstPts == astiav.NoPtsValue:
+				firstPts, segmentPts, fragmentPts = pts, pts, pts
+			case isKey && pts-segmentPts >= astiav.RescaleQ(opts.Duration.Microseconds(), astiav.TimeBaseQ, videoTimeBase):
+				// 达到切片时长，在关键帧处切分
+				if err = flush(pts); err != nil {
+					return err
+				}
+				segmentPts, fragmentPts, fragmentKeyframe = pts, pts, true
+				if format == SegmentTs {
+					// 每个ts切片开头重新写入PAT和PMT
+					_ = outputFormatCtx.PrivateData().Options().Set("mpegts_flags", "+resend_headers", astiav.NewOptionSearchFlags())
+				}
+			case format == SegmentFmp4 && opts.Fragment > 0 && pts-fragmentPts >= astiav.RescaleQ(opts.Fragment.Microseconds(), astiav.TimeBaseQ, videoTimeBase):
+				// 切片内的分片
+				if err = flush(pts); err != nil {
+					return err
+				}
+				fragmentPts, fragmentKeyframe = pts, false
+			}
+			endPts = max(endPts, pts+packet.Duration())
+		} else if audioInputStream != nil && packet.StreamIndex() == audioInputStream.Index() {
+			if firstPts == astiav.NoPtsValue {
+				packet.Unref()
+				continue
+			}
+			inputStream, outputStream = audioInputStream, audioOutputStream
+		} else {
+			packet.Unref()
+			continue
+		}
+
+		packet.SetStreamIndex(outputStream.Index())
+		packet.RescaleTs(inputStream.TimeBase(), outputStream.TimeBase())
+		packet.SetPos(-1)
+		// 直接写入，切分时封装器中不会残留上一个切片的数据帧
+		if err = outputFormatCtx.WriteFrame(packet); err != nil {
+			return errors.New(fmt.Sprintf("写入数据帧失败: %s", err))
+		}
+		packet.Unref()
+	}
+}
@@ -0,0 +1,342 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"image"
+	"image/jpeg"
+	"sync"
+	"time"
+)
+
+// SnapshotOptions 抓图参数
+type SnapshotOptions struct {
+	Width      int           // 输出宽度，为0时使用原始宽度，只设置宽或高时按比例缩放
+	Height     int           // 输出高度，为0时使用原始高度
+	Quality    int           // jpg质量，为0时使用默认质量
+	Timeout    time.Duration // 超时时间，为0时为10秒
+	ReuseInput bool          // 同一地址正在录制时，复用录制中缓存的关键帧，不再打开新的连接
+}
+
+// Snapshot 抓取一张jpg图片，打开输入后解码到第一个完整的关键帧为止，不封装视频和音频
+func Snapshot(ctx context.Context, url string, opts *SnapshotOptions) ([]byte, error) {
+	return SnapshotInput(ctx, UrlInput(url), opts)
+}
+
+// SnapshotInput 从地址或读取器抓取一张jpg图片，读取器输入不复用录制中的关键帧
+func SnapshotInput(ctx context.Context, input *Input, opts *SnapshotOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &SnapshotOptions{}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var frame *astiav.Frame
+	var err error
+	if opts.ReuseInput && input.Reader == nil {
+		frame, err = decodeLiveKeyframe(input.Url)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if frame == nil {
+		if frame, err = decodeFirstKeyframe(ctx, input); err != nil {
+			return nil, err
+		}
+	}
+	defer frame.Free()
+	return FrameToJPEG(frame, opts.Width, opts.Height, opts.Quality)
+}
+
+// decodeFirstKeyframe 打开输入，解码第一个关键帧
+func decodeFirstKeyframe(ctx context.Context, input *Input) (*astiav.Frame, error) {
+	inputFormatCtx, closeInput, err := input.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+
+	videoInputStream := FindStream(inputFormatCtx, astiav.MediaTypeVideo)
+	if videoInputStream == nil {
+		return nil, errors.New("未找到视频流")
+	}
+	videoDecoderCtx, _, err := FindAndOpenDecoderCtx(videoInputStream)
+	if err != nil {
+		return nil, err
+	}
+	defer videoDecoderCtx.Free()
+
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	frame := astiav.AllocFrame()
+	gotKeyframe := false
+	for {
+		if err = inputFormatCtx.ReadFrame(packet); err != nil {
+			frame.Free()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, astiav.ErrEof) {
+				return nil, errors.New("读取到输入结尾，未找到关键帧")
+			}
+			return nil, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if packet.StreamIndex() != videoInputStream.Index() {
+			packet.Unref()
+			continue
+		}
+		// 从第一个关键帧开始解码，之前的帧缺少参考帧
+		if !gotKeyframe && !packet.Flags().Has(astiav.PacketFlagKey) {
+			packet.Unref()
+			continue
+		}
+		gotKeyframe = true
+		err = videoDecoderCtx.SendPacket(packet)
+		packet.Unref()
+		if err != nil {
+			frame.Free()
+			return nil, errors.New(fmt.Sprintf("视频数据发送给视频解码器失败: %s", err))
+		}
+		if err = videoDecoderCtx.ReceiveFrame(frame); err != nil {
+			if errors.Is(err, astiav.ErrEagain) {
+				continue
+			}
+			frame.Free()
+			return nil, errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+		}
+		return frame, nil
+	}
+}
+
+// FrameToImage 将解码帧转换为RGBA图片，width和height为0时使用原始尺寸，只设置其中一个时按比例缩放
+func FrameToImage(frame *astiav.Frame, width, height int) (image.Image, error) {
+	encoder := newJpegEncoder(width, height, 0)
+	defer encoder.Free()
+	return encoder.image(frame)
+}
+
+// FrameToJPEG 将解码帧编码为jpg，quality为0时使用默认质量
+func FrameToJPEG(frame *astiav.Frame, width, height, quality int) ([]byte, error) {
+	encoder := newJpegEncoder(width, height, quality)
+	defer encoder.Free()
+	return encoder.Encode(frame)
+}
+
+// jpegEncoder 连续将同一路视频的解码帧编码为jpg，缩放上下文、RGBA帧和图片在整个视频流中复用
+// 解码帧的尺寸或像素格式变化时重新创建缩放上下文
+type jpegEncoder struct {
+	width     int
+	height    int
+	options   *jpeg.Options
+	swsCtx    *astiav.SoftwareScaleContext
+	srcWidth  int
+	srcHeight int
+	srcFormat astiav.PixelFormat
+	rgbaFrame *astiav.Frame
+	img       image.Image
+	buffer    bytes.Buffer
+}
+
+// newJpegEncoder 新建jpg编码器，参数与FrameToJPEG相同，使用完后调用Free
+func newJpegEncoder(width, height, quality int) *jpegEncoder {
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+	return &jpegEncoder{width: width, height: height, options: &jpeg.Options{Quality: quality}, rgbaFrame: astiav.AllocFrame()}
+}
+
+// image 缩放并转换为RGBA图片，返回的图片在下一次调用时被覆盖
+func (e *jpegEncoder) image(frame *astiav.Frame) (image.Image, error) {
+	if e.swsCtx == nil || frame.Width() != e.srcWidth || frame.Height() != e.srcHeight || frame.PixelFormat() != e.srcFormat {
+		if e.swsCtx != nil {
+			e.swsCtx.Free()
+			e.swsCtx = nil
+		}
+		width, height := scaleSize(frame.Width(), frame.Height(), e.width, e.height)
+		swsCtx, err := astiav.CreateSoftwareScaleContext(frame.Width(), frame.Height(), frame.PixelFormat(),
+			width, height, astiav.PixelFormatRgba, astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("创建图像缩放上下文失败: %s", err))
+		}
+		e.swsCtx = swsCtx
+		e.srcWidth, e.srcHeight, e.srcFormat = frame.Width(), frame.Height(), frame.PixelFormat()
+		e.rgbaFrame.Unref()
+		e.rgbaFrame.SetWidth(width)
+		e.rgbaFrame.SetHeight(height)
+		e.rgbaFrame.SetPixelFormat(astiav.PixelFormatRgba)
+		e.img = nil
+	}
+	if err := e.swsCtx.ScaleFrame(frame, e.rgbaFrame); err != nil {
+		return nil, errors.New(fmt.Sprintf("图像像素格式转换失败: %s", err))
+	}
+
+	if e.img == nil {
+		img, err := e.rgbaFrame.Data().GuessImageFormat()
+		if err != nil {
+			return nil, err
+		}
+		e.img = img
+	}
+	if err := e.rgbaFrame.Data().ToImage(e.img); err != nil {
+		return nil, errors.New(fmt.Sprintf("图像数据拷贝失败: %s", err))
+	}
+	return e.img, nil
+}
+
+// Encode 将解码帧编码为jpg
+func (e *jpegEncoder) Encode(frame *astiav.Frame) ([]byte, error) {
+	img, err := e.image(frame)
+	if err != nil {
+		return nil, err
+	}
+	e.buffer.Reset()
+	if err = jpeg.Encode(&e.buffer, img, e.options); err != nil {
+		return nil, errors.New(fmt.Sprintf("图像编码失败: %s", err))
+	}
+	return bytes.Clone(e.buffer.Bytes()), nil
+}
+
+// Free 释放编码器
+func (e *jpegEncoder) Free() {
+	if e.swsCtx != nil {
+		e.swsCtx.Free()
+	}
+	e.rgbaFrame.Free()
+}
+
+// scaleSize 计算输出尺寸，只设置宽或高时按比例缩放，结果为偶数
+func scaleSize(srcWidth, srcHeight, width, height int) (int, int) {
+	if width <= 0 && height <= 0 {
+		return srcWidth, srcHeight
+	}
+	if width <= 0 {
+		width = srcWidth * height / srcHeight
+	} else if height <= 0 {
+		height = srcHeight * width / srcWidth
+	}
+	return max(width&^1, 2), max(height&^1, 2)
+}
+
+// liveInput 正在录制的输入中最近的视频关键帧，抓图时复用，避免摄像头再建立一个RTSP会话
+type liveInput struct {
+	mutex  sync.Mutex
+	params *astiav.CodecParameters
+	packet *astiav.Packet
+}
+
+// liveInputs 拉流地址 -> 正在录制的输入
+var liveInputs = struct {
+	sync.Mutex
+	inputs map[string]*liveInput
+}{inputs: make(map[string]*liveInput)}
+
+// registerLiveInput 登记正在录制的输入，录制结束后调用unregisterLiveInput
+func registerLiveInput(url string, stream *astiav.Stream) *liveInput {
+	input := &liveInput{params: astiav.AllocCodecParameters()}
+	if err := stream.CodecParameters().Copy(input.params); err != nil {
+		input.params.Free()
+		return nil
+	}
+	liveInputs.Lock()
+	liveInputs.inputs[url] = input
+	liveInputs.Unlock()
+	return input
+}
+
+// unregisterLiveInput 取消登记并释放缓存的关键帧
+func unregisterLiveInput(url string, input *liveInput) {
+	if input == nil {
+		return
+	}
+	liveInputs.Lock()
+	if liveInputs.inputs[url] == input {
+		delete(liveInputs.inputs, url)
+	}
+	liveInputs.Unlock()
+
+	input.mutex.Lock()
+	defer input.mutex.Unlock()
+	input.params.Free()
+	if input.packet != nil {
+		input.packet.Free()
+	}
+	input.params, input.packet = nil, nil
+}
+
+// updateKeyframe 缓存关键帧，非关键帧忽略，packet不会被修改
+func (input *liveInput) updateKeyframe(packet *astiav.Packet) {
+	if input == nil || !packet.Flags().Has(astiav.PacketFlagKey) {
+		return
+	}
+	// 引用计数拷贝，不复制数据
+	keyframe := packet.Clone()
+	input.mutex.Lock()
+	defer input.mutex.Unlock()
+	if input.params == nil {
+		keyframe.Free()
+		return
+	}
+	if input.packet != nil {
+		input.packet.Free()
+	}
+	input.packet = keyframe
+}
+
+// decodeLiveKeyframe 解码正在录制的输入中缓存的关键帧，没有正在录制的输入或还没有关键帧时返回nil
+func decodeLiveKeyframe(url string) (*astiav.Frame, error) {
+	liveInputs.Lock()
+	input, ok := liveInputs.inputs[url]
+	liveInputs.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	input.mutex.Lock()
+	if input.params == nil || input.packet == nil {
+		input.mutex.Unlock()
+		return nil, nil
+	}
+	params := astiav.AllocCodecParameters()
+	defer params.Free()
+	if err := input.params.Copy(params); err != nil {
+		input.mutex.Unlock()
+		return nil, err
+	}
+	packet := input.packet.Clone()
+	input.mutex.Unlock()
+	defer packet.Free()
+
+	codec := astiav.FindDecoder(params.CodecID())
+	if codec == nil {
+		return nil, errors.New(fmt.Sprintf("未找到解码器：%s", params.CodecID()))
+	}
+	decoderCtx := astiav.AllocCodecContext(codec)
+	defer decoderCtx.Free()
+	if err := decoderCtx.FromCodecParameters(params); err != nil {
+		return nil, errors.New(fmt.Sprintf("无法复制解码器参数: %s", err))
+	}
+	if err := decoderCtx.Open(codec, nil); err != nil {
+		return nil, errors.New(fmt.Sprintf("无法打开解码器: %s", err))
+	}
+
+	// 发送关键帧后刷新解码器，取出解码帧
+	if err := decoderCtx.SendPacket(packet); err != nil {
+		return nil, errors.New(fmt.Sprintf("视频数据发送给视频解码器失败: %s", err))
+	}
+	if err := decoderCtx.SendPacket(nil); err != nil {
+		return nil, errors.New(fmt.Sprintf("刷新视频解码器失败: %s", err))
+	}
+	frame := astiav.AllocFrame()
+	if err := decoderCtx.ReceiveFrame(frame); err != nil {
+		frame.Free()
+		return nil, errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+	}
+	return frame, nil
+}
@@ -0,0 +1,236 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SpriteOptions 雪碧图参数
+type SpriteOptions struct {
+	Width         int           // 缩略图宽度，为0时为160，高度按比例缩放
+	Columns       int           // 每行缩略图个数，为0时为10
+	Interval      time.Duration // 缩略图最小间隔，为0时每个关键帧一张
+	MaxThumbnails int           // 缩略图最大个数，为0时为100，超过时增大间隔
+	Quality       int           // jpg质量，为0时使用默认质量
+	ImageUrl      string        // WebVTT中引用的雪碧图地址，为空时为sprite，与片段产物的接口路径对应
+}
+
+// SpriteResult 雪碧图和对应的WebVTT
+type SpriteResult struct {
+	Image []byte // jpg雪碧图
+	Vtt   []byte // WebVTT，每条字幕为一个时间段对应的缩略图坐标
+}
+
+// thumbnail 一张缩略图及其显示时间
+type thumbnail struct {
+	image image.Image
+	time  time.Duration // 相对视频开头的时间
+}
+
+// SpriteSheet 解码mp4视频的关键帧，缩放后拼接为雪碧图，并生成时间段到缩略图坐标的WebVTT
+// index不为nil时按关键帧索引定位，否则先扫描整个视频查找关键帧
+func SpriteSheet(reader io.ReadSeeker, index *KeyframeIndex, opts *SpriteOptions) (*SpriteResult, error) {
+	if opts == nil {
+		opts = &SpriteOptions{}
+	}
+	width, columns, maxThumbnails := opts.Width, opts.Columns, opts.MaxThumbnails
+	if width <= 0 {
+		width = 160
+	}
+	if columns <= 0 {
+		columns = 10
+	}
+	if maxThumbnails <= 0 {
+		maxThumbnails = 100
+	}
+	imageUrl := opts.ImageUrl
+	if imageUrl == "" {
+		imageUrl = "sprite"
+	}
+
+	input, err := openReaderInput(reader, "mp4")
+	if err != nil {
+		return nil, err
+	}
+	defer input.Free()
+	videoStream := input.videoStream
+	if videoStream == nil {
+		return nil, errors.New("未找到视频流")
+	}
+
+	keyFrames, err := indexKeyFrames(input, index)
+	if err != nil {
+		return nil, err
+	}
+	if keyFrames == nil {
+		if keyFrames, err = scanKeyFrames(input); err != nil {
+			return nil, err
+		}
+	}
+	if len(keyFrames) == 0 {
+		return nil, errors.New("未找到关键帧")
+	}
+	sort.Slice(keyFrames, func(i, j int) bool { return keyFrames[i] < keyFrames[j] })
+
+	videoStartTime := videoStream.StartTime()
+	if videoStartTime == astiav.NoPtsValue {
+		videoStartTime = keyFrames[0]
+	}
+	toTime := func(pts int64) time.Duration {
+		return time.Duration(astiav.RescaleQ(pts-videoStartTime, videoStream.TimeBase(), astiav.TimeBaseQ)) * time.Microsecond
+	}
+	selected := selectKeyFrames(keyFrames, toTime, opts.Interval, maxThumbnails)
+
+	thumbnails, err := decodeThumbnails(input, selected, width, toTime)
+	if err != nil {
+		return nil, err
+	}
+	if len(thumbnails) == 0 {
+		return nil, errors.New("未解码出缩略图")
+	}
+
+	// 拼接雪碧图
+	columns = min(columns, len(thumbnails))
+	rows := (len(thumbnails) + columns - 1) / columns
+	tileWidth, tileHeight := thumbnails[0].image.Bounds().Dx(), thumbnails[0].image.Bounds().Dy()
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*tileWidth, rows*tileHeight))
+	for i, t := range thumbnails {
+		x, y := i%columns*tileWidth, i/columns*tileHeight
+		draw.Draw(sheet, image.Rect(x, y, x+tileWidth, y+tileHeight), t.image, t.image.Bounds().Min, draw.Src)
+	}
+	quality := opts.Quality
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+	var imageBuffer bytes.Buffer
+	if err = jpeg.Encode(&imageBuffer, sheet, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, errors.New(fmt.Sprintf("雪碧图编码失败: %s", err))
+	}
+
+	// 每张缩略图从其时间显示到下一张的时间，第一张从头开始，最后一张到视频结尾
+	duration := time.Duration(input.fmtCtx.Duration()) * time.Microsecond
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i, t := range thumbnails {
+		start, end := t.time, duration
+		if i == 0 {
+			start = 0
+		}
+		if i+1 < len(thumbnails) {
+			end = thumbnails[i+1].time
+		}
+		if end <= start {
+			end = start + time.Second
+		}
+		x, y := i%columns*tileWidth, i/columns*tileHeight
+		vtt.WriteString(fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTime(start), vttTime(end), imageUrl, x, y, tileWidth, tileHeight))
+	}
+	return &SpriteResult{Image: imageBuffer.Bytes(), Vtt: []byte(vtt.String())}, nil
+}
+
+// selectKeyFrames 按最小间隔和最大个数选取关键帧，keyFrames已排序
+func selectKeyFrames(keyFrames []int64, toTime func(int64) time.Duration, interval time.Duration, maxCount int) []int64 {
+	last := toTime(keyFrames[len(keyFrames)-1])
+	if limit := last / time.Duration(maxCount); len(keyFrames) > maxCount && limit > interval {
+		interval = limit
+	}
+	var selected []int64
+	next := time.Duration(math.MinInt64)
+	for _, key := range keyFrames {
+		if t := toTime(key); t >= next {
+			selected = append(selected, key)
+			next = t + interval
+		}
+		if len(selected) == maxCount {
+			break
+		}
+	}
+	return selected
+}
+
+// decodeThumbnails 定位并解码选取的关键帧，缩放为指定宽度的缩略图，按时间排序
+func decodeThumbnails(input *readerInput, keyFrames []int64, width int, toTime func(int64) time.Duration) ([]*thumbnail, error) {
+	videoStream := input.videoStream
+	decoderCtx, _, err := FindAndOpenDecoderCtx(videoStream)
+	if err != nil {
+		return nil, err
+	}
+	defer decoderCtx.Free()
+
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	frame := astiav.AllocFrame()
+	defer frame.Free()
+
+	var thumbnails []*thumbnail
+	// 取出解码器中已解码的帧
+	receiveFrames := func() error {
+		for {
+			if err := decoderCtx.ReceiveFrame(frame); err != nil {
+				if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+					return nil
+				}
+				return errors.New(fmt.Sprintf("从视频解码器获取视频帧失败: %s", err))
+			}
+			img, err := FrameToImage(frame, width, 0)
+			if err != nil {
+				frame.Unref()
+				return err
+			}
+			thumbnails = append(thumbnails, &thumbnail{image: img, time: toTime(frame.Pts())})
+			frame.Unref()
+		}
+	}
+
+	for _, key := range keyFrames {
+		if err = input.fmtCtx.SeekFrame(videoStream.Index(), key, astiav.NewSeekFlags(astiav.SeekFlagBackward)); err != nil {
+			return nil, errors.New(fmt.Sprintf("定位到关键帧失败: %s", err))
+		}
+		// 定位后的第一个视频帧即为关键帧，只解码这一帧
+		for {
+			if err = input.fmtCtx.ReadFrame(packet); err != nil {
+				if errors.Is(err, astiav.ErrEof) {
+					break
+				}
+				return nil, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+			}
+			if packet.StreamIndex() == videoStream.Index() {
+				err = decoderCtx.SendPacket(packet)
+				packet.Unref()
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("视频数据发送给视频解码器失败: %s", err))
+				}
+				break
+			}
+			packet.Unref()
+		}
+		if err = receiveFrames(); err != nil {
+			return nil, err
+		}
+	}
+	// 取出解码器中剩余的帧
+	if err = decoderCtx.SendPacket(nil); err != nil {
+		return nil, errors.New(fmt.Sprintf("刷新视频解码器失败: %s", err))
+	}
+	if err = receiveFrames(); err != nil {
+		return nil, err
+	}
+	sort.Slice(thumbnails, func(i, j int) bool { return thumbnails[i].time < thumbnails[j].time })
+	return thumbnails, nil
+}
+
+// vttTime WebVTT时间格式 hh:mm:ss.mmm
+func vttTime(t time.Duration) string {
+	milli := t.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", milli/3600000, milli/60000%60, milli/1000%60, milli%1000)
+}
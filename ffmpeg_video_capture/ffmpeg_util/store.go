@@ -0,0 +1,93 @@
+package ffmpegutil
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrSegmentNotFound 切片或播放列表不存在
+var ErrSegmentNotFound = errors.New("切片不存在")
+
+// SegmentStore 直播切片和播放列表的存储
+type SegmentStore interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error) // 不存在时返回ErrSegmentNotFound
+	Delete(name string) error
+}
+
+// MemoryStore 保存在内存中的切片存储
+type MemoryStore struct {
+	mutex sync.RWMutex
+	files map[string][]byte
+}
+
+// NewMemoryStore 新建内存切片存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{files: make(map[string][]byte)}
+}
+
+func (store *MemoryStore) Put(name string, data []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.files[name] = data
+	return nil
+}
+
+func (store *MemoryStore) Get(name string) ([]byte, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	data, ok := store.files[name]
+	if !ok {
+		return nil, ErrSegmentNotFound
+	}
+	return data, nil
+}
+
+func (store *MemoryStore) Delete(name string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.files, name)
+	return nil
+}
+
+// DirStore 保存在本地目录中的切片存储，可以直接由静态文件服务器提供
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore 新建目录切片存储，目录不存在时创建
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.New(fmt.Sprintf("创建切片目录失败: %s", err))
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// Put 先写入临时文件再重命名，播放器不会读到写了一半的文件
+func (store *DirStore) Put(name string, data []byte) error {
+	path := filepath.Join(store.dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (store *DirStore) Get(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(store.dir, filepath.Base(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrSegmentNotFound
+	}
+	return data, err
+}
+
+func (store *DirStore) Delete(name string) error {
+	err := os.Remove(filepath.Join(store.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,359 @@
+package ffmpegutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/asticode/go-astiav"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// VodInitName 点播片段的fMP4初始化切片文件名
+const VodInitName = "init.mp4"
+
+// VodOptions 点播播放列表参数
+type VodOptions struct {
+	SegmentDuration time.Duration // 目标切片时长，在关键帧处切分，为0时为6秒
+}
+
+// VodClip 点播播放列表中的一个mp4片段
+type VodClip struct {
+	// Uri 片段切片地址的前缀，初始化切片为Uri+VodInitName，切片为Uri+VodSegmentName(...)
+	Uri       string
+	Duration  time.Duration  // 片段时长
+	Keyframes *KeyframeIndex // 关键帧索引，为nil时整个片段作为一个切片
+	Start     time.Duration  // 片段内的起始时间，只保留与[Start, End)重叠的切片
+	End       time.Duration  // 片段内的结束时间，为0时到结尾
+	Media     *MediaInfo     // 编码信息，只用于DASH清单
+	Bandwidth int64          // 码率，单位bit/s，只用于DASH清单
+}
+
+// vodSegment 片段内的切片，包含关键帧索引中[first, last)的GOP
+type vodSegment struct {
+	first int
+	last  int
+	start time.Duration
+	end   time.Duration
+}
+
+// VodSegmentName 包含关键帧索引中[first, last)的GOP的切片文件名
+// 文件名中直接记录关键帧范围，请求切片时不依赖生成播放列表时的切片时长
+func VodSegmentName(first, last int) string {
+	return fmt.Sprintf("%d-%d.m4s", first, last)
+}
+
+// ParseVodSegmentName 解析切片文件名中的关键帧范围
+func ParseVodSegmentName(name string) (first, last int, err error) {
+	if _, err = fmt.Sscanf(name, "%d-%d.m4s", &first, &last); err != nil || VodSegmentName(first, last) != name {
+		return 0, 0, errors.New(fmt.Sprintf("切片文件名错误：%s", name))
+	}
+	return first, last, nil
+}
+
+// VodPlaylist 生成多个片段的HLS点播播放列表
+// 每个片段有自己的初始化切片，片段之间插入EXT-X-DISCONTINUITY，切片时间戳从片段开头计算
+func VodPlaylist(clips []*VodClip, opts *VodOptions) *HlsPlaylist {
+	target := vodTarget(opts)
+	playlist := &HlsPlaylist{Ended: true, Type: "VOD"}
+	for _, clip := range clips {
+		first := true
+		for _, segment := range vodSegments(clip, target) {
+			entry := HlsEntry{Uri: clip.Uri + VodSegmentName(segment.first, segment.last), Duration: segment.end - segment.start}
+			if first {
+				entry.Map = clip.Uri + VodInitName
+				entry.Discontinuity = len(playlist.Entries) > 0
+				first = false
+			}
+			playlist.Entries = append(playlist.Entries, entry)
+		}
+	}
+	return playlist
+}
+
+// vodTarget 目标切片时长
+func vodTarget(opts *VodOptions) time.Duration {
+	if opts != nil && opts.SegmentDuration > 0 {
+		return opts.SegmentDuration
+	}
+	return 6 * time.Second
+}
+
+// vodSegments 按关键帧将片段切分为不短于目标时长的切片，返回与[Start, End)重叠的切片
+func vodSegments(clip *VodClip, target time.Duration) []vodSegment {
+	index := clip.Keyframes
+	if index == nil || len(index.Keyframes) == 0 {
+		return []vodSegment{{first: 0, last: 1, start: 0, end: clip.Duration}}
+	}
+	var segments []vodSegment
+	for first := 0; first < len(index.Keyframes); {
+		start := index.Time(index.Keyframes[first].Pts)
+		last := first + 1
+		for last < len(index.Keyframes) && index.Time(index.Keyframes[last].Pts)-start < target {
+			last++
+		}
+		end := clip.Duration
+		if last < len(index.Keyframes) {
+			end = index.Time(index.Keyframes[last].Pts)
+		}
+		if end <= start {
+			// 片段时长不准确时按目标时长估计最后一个切片
+			end = start + target
+		}
+		if end > clip.Start && (clip.End <= 0 || start < clip.End) {
+			segments = append(segments, vodSegment{first: first, last: last, start: start, end: end})
+		}
+		first = last
+	}
+	return segments
+}
+
+// ProbeVodClip 扫描本地mp4视频，返回关键帧索引和时长，用于没有抓取时索引的视频
+func ProbeVodClip(reader io.ReadSeeker) (*KeyframeIndex, time.Duration, error) {
+	input, err := openReaderInput(reader, "mp4")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer input.Free()
+	videoStream := input.videoStream
+	if videoStream == nil {
+		return nil, 0, errors.New("未找到视频流")
+	}
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+
+	index := &KeyframeIndex{TimeBase: videoStream.TimeBase()}
+	firstPts, endPts := astiav.NoPtsValue, astiav.NoPtsValue
+	for {
+		if err = input.fmtCtx.ReadFrame(packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) {
+				break
+			}
+			return nil, 0, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if packet.StreamIndex() == videoStream.Index() && packet.Pts() != astiav.NoPtsValue {
+			if firstPts == astiav.NoPtsValue {
+				firstPts = packet.Pts()
+			}
+			if packet.Flags().Has(astiav.PacketFlagKey) {
+				index.Keyframes = append(index.Keyframes, Keyframe{Pts: packet.Pts() - firstPts, Offset: packet.Pos()})
+			}
+			endPts = max(endPts, packet.Pts()+packet.Duration())
+		}
+		packet.Unref()
+	}
+	if len(index.Keyframes) == 0 {
+		return nil, 0, errors.New("未找到关键帧")
+	}
+	index.End = endPts - firstPts
+	return index, index.Time(index.End), nil
+}
+
+// vodMuxer 将一个mp4片段重新封装为fMP4的封装器
+type vodMuxer struct {
+	fmtCtx      *astiav.FormatContext
+	ioCtx       *astiav.IOContext
+	pending     bytes.Buffer // 封装后的数据
+	videoStream *astiav.Stream
+	audioStream *astiav.Stream // 只复制aac音频，为nil时不输出音频
+}
+
+// newVodMuxer 新建fMP4封装器并写入文件头，写入后pending为初始化切片
+// fragmentIndex为第一个分片的序号，同一片段的初始化切片和所有切片使用相同的封装参数
+func newVodMuxer(input *readerInput, fragmentIndex int) (*vodMuxer, error) {
+	outputFormatCtx, err := astiav.AllocOutputFormatContext(nil, "mp4", "")
+	if err != nil || outputFormatCtx == nil {
+		return nil, errors.New(fmt.Sprintf("分配mp4输出格式上下文失败: %s", err))
+	}
+	muxer := &vodMuxer{fmtCtx: outputFormatCtx}
+	if muxer.ioCtx, err = astiav.AllocIOContext(
+		4096,
+		true,
+		nil,
+		nil,
+		func(b []byte) (n int, err error) {
+			return muxer.pending.Write(b)
+		},
+	); err != nil {
+		outputFormatCtx.Free()
+		return nil, errors.New(fmt.Sprintf("分配IO上下文失败: %s", err))
+	}
+	outputFormatCtx.SetPb(muxer.ioCtx)
+
+	if muxer.videoStream, err = CreateStreamAndCopyParams(outputFormatCtx, input.videoStream); err != nil {
+		muxer.Free()
+		return nil, errors.New(fmt.Sprintf("创建视频输出流失败: %s", err))
+	}
+	if input.audioStream != nil && input.audioStream.CodecParameters().CodecID() == astiav.CodecIDAac {
+		if muxer.audioStream, err = CreateStreamAndCopyParams(outputFormatCtx, input.audioStream); err != nil {
+			muxer.Free()
+			return nil, errors.New(fmt.Sprintf("创建音频输出流失败: %s", err))
+		}
+	}
+
+	options := &astiav.Dictionary{}
+	defer options.Free()
+	// frag_discont使每个分片的tfdt取第一个数据帧的时间戳，单独封装的切片拼接后时间连续
+	// 不平移时间戳，不写编辑列表，时间戳保持为片段内的时间
+	_ = options.Set("movflags", "+frag_custom+empty_moov+default_base_moof+frag_discont", astiav.DictionaryFlags(0))
+	_ = options.Set("use_editlist", "0", astiav.DictionaryFlags(0))
+	_ = options.Set("avoid_negative_ts", "disabled", astiav.DictionaryFlags(0))
+	_ = options.Set("fragment_index", strconv.Itoa(fragmentIndex), astiav.DictionaryFlags(0))
+	if err = outputFormatCtx.WriteHeader(options); err != nil {
+		muxer.Free()
+		return nil, errors.New(fmt.Sprintf("写入fMP4文件头失败: %s", err))
+	}
+	muxer.ioCtx.Flush()
+	return muxer, nil
+}
+
+// Free 释放封装器
+func (muxer *vodMuxer) Free() {
+	muxer.fmtCtx.Free()
+	muxer.ioCtx.Free()
+}
+
+// VodInit 生成mp4片段的fMP4初始化切片(ftyp+moov)
+func VodInit(reader io.ReadSeeker) ([]byte, error) {
+	input, err := openReaderInput(reader, "mp4")
+	if err != nil {
+		return nil, err
+	}
+	defer input.Free()
+	if input.videoStream == nil {
+		return nil, errors.New("未找到视频流")
+	}
+	muxer, err := newVodMuxer(input, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer muxer.Free()
+	return bytes.Clone(muxer.pending.Bytes()), nil
+}
+
+// VodSegment 将mp4片段中关键帧索引[first, last)的GOP直接复制(不转码)封装为fMP4切片(moof+mdat)
+// last不小于关键帧个数时到片段结尾，index为nil时只支持first为0、last为1，即整个片段
+// 切片的时间戳相对片段的第一个视频帧，与VodPlaylist中的切片时间一致
+func VodSegment(reader io.ReadSeeker, index *KeyframeIndex, first, last int) ([]byte, error) {
+	input, err := openReaderInput(reader, "mp4")
+	if err != nil {
+		return nil, err
+	}
+	defer input.Free()
+	videoStream, audioStream := input.videoStream, input.audioStream
+	if videoStream == nil {
+		return nil, errors.New("未找到视频流")
+	}
+
+	// 关键帧的时间戳和第一个视频帧的时间戳
+	keyFrames := []int64{math.MinInt64}
+	basePts := videoStream.StartTime()
+	if basePts == astiav.NoPtsValue {
+		basePts = 0
+	}
+	if index != nil {
+		if keyFrames, err = indexKeyFrames(input, index); err != nil {
+			return nil, err
+		}
+		if keyFrames == nil {
+			return nil, errors.New("关键帧索引与视频不一致")
+		}
+		basePts = keyFrames[0] - index.Keyframes[0].Pts
+	}
+	if first < 0 || first >= len(keyFrames) || last <= first {
+		return nil, errors.New(fmt.Sprintf("切片范围错误：%d-%d", first, last))
+	}
+	from, to := keyFrames[first], int64(math.MaxInt64)
+	if last < len(keyFrames) {
+		to = keyFrames[last]
+	}
+	if from != math.MinInt64 {
+		if err = input.fmtCtx.SeekFrame(videoStream.Index(), from, astiav.NewSeekFlags(astiav.SeekFlagBackward)); err != nil {
+			return nil, errors.New(fmt.Sprintf("定位到切片起点失败: %s", err))
+		}
+	}
+
+	muxer, err := newVodMuxer(input, first+1)
+	if err != nil {
+		return nil, err
+	}
+	defer muxer.Free()
+	muxer.pending.Reset()
+
+	// 时间戳减去第一个视频帧的时间戳后写入
+	writePacket := func(packet *astiav.Packet, inputStream, outputStream *astiav.Stream) error {
+		base := astiav.RescaleQ(basePts, videoStream.TimeBase(), inputStream.TimeBase())
+		packet.SetPts(astiav.RescaleQ(packet.Pts()-base, inputStream.TimeBase(), outputStream.TimeBase()))
+		packet.SetDts(astiav.RescaleQ(packet.Dts()-base, inputStream.TimeBase(), outputStream.TimeBase()))
+		packet.SetDuration(astiav.RescaleQ(packet.Duration(), inputStream.TimeBase(), outputStream.TimeBase()))
+		packet.SetStreamIndex(outputStream.Index())
+		packet.SetPos(-1)
+		if err := muxer.fmtCtx.WriteFrame(packet); err != nil {
+			return errors.New(fmt.Sprintf("写入数据帧失败: %s", err))
+		}
+		return nil
+	}
+
+	currentKey := int64(math.MinInt64)
+	videoDone, audioDone := false, muxer.audioStream == nil
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+	for !videoDone || !audioDone {
+		if err = input.fmtCtx.ReadFrame(packet); err != nil {
+			if errors.Is(err, astiav.ErrEof) {
+				break
+			}
+			return nil, errors.New(fmt.Sprintf("读取数据帧失败: %s", err))
+		}
+		if packet.StreamIndex() == videoStream.Index() {
+			if packet.Flags().Has(astiav.PacketFlagKey) {
+				currentKey = packet.Pts()
+			}
+			if currentKey >= to {
+				videoDone = true
+			} else if currentKey >= from {
+				if err = writePacket(packet, videoStream, muxer.videoStream); err != nil {
+					return nil, err
+				}
+			}
+		} else if muxer.audioStream != nil && packet.StreamIndex() == audioStream.Index() && packet.Pts() != astiav.NoPtsValue {
+			// 音频按换算到视频时间基的时间戳划分到切片
+			pts := astiav.RescaleQ(packet.Pts(), audioStream.TimeBase(), videoStream.TimeBase())
+			if pts >= to {
+				audioDone = true
+			} else if pts >= from && pts >= basePts {
+				if err = writePacket(packet, audioStream, muxer.audioStream); err != nil {
+					return nil, err
+				}
+			}
+		}
+		packet.Unref()
+	}
+
+	// 输出moof和mdat
+	if err = muxer.fmtCtx.WriteFrame(nil); err != nil {
+		return nil, errors.New(fmt.Sprintf("输出切片失败: %s", err))
+	}
+	muxer.ioCtx.Flush()
+	return bytes.Clone(muxer.pending.Bytes()), nil
+}
+
+// VodMedia 读取mp4片段的编码信息，用于DASH清单
+func VodMedia(reader io.ReadSeeker) (*MediaInfo, error) {
+	input, err := openReaderInput(reader, "mp4")
+	if err != nil {
+		return nil, err
+	}
+	defer input.Free()
+	if input.videoStream == nil {
+		return nil, errors.New("未找到视频流")
+	}
+	// 与切片一致，只包含aac音频
+	audioStream := input.audioStream
+	if audioStream != nil && audioStream.CodecParameters().CodecID() != astiav.CodecIDAac {
+		audioStream = nil
+	}
+	return newMediaInfo(input.videoStream, audioStream), nil
+}
@@ -0,0 +1,85 @@
+package ffmpegutil
+
+import (
+	"github.com/asticode/go-astiav"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVodSegments(t *testing.T) {
+	// 时间基为毫秒，关键帧间隔2秒，最后一个GOP为1秒
+	index := &KeyframeIndex{TimeBase: astiav.NewRational(1, 1000)}
+	for _, pts := range []int64{0, 2000, 4000, 6000, 8000} {
+		index.Keyframes = append(index.Keyframes, Keyframe{Pts: pts})
+	}
+	second := time.Second
+	tests := []struct {
+		name   string
+		clip   *VodClip
+		target time.Duration
+		want   []vodSegment
+	}{
+		{"没有索引", &VodClip{Duration: 9 * second}, 4 * second, []vodSegment{
+			{first: 0, last: 1, start: 0, end: 9 * second},
+		}},
+		{"按目标时长合并GOP", &VodClip{Duration: 9 * second, Keyframes: index}, 4 * second, []vodSegment{
+			{first: 0, last: 2, start: 0, end: 4 * second},
+			{first: 2, last: 4, start: 4 * second, end: 8 * second},
+			{first: 4, last: 5, start: 8 * second, end: 9 * second},
+		}},
+		{"目标时长小于GOP", &VodClip{Duration: 9 * second, Keyframes: index}, second, []vodSegment{
+			{first: 0, last: 1, start: 0, end: 2 * second},
+			{first: 1, last: 2, start: 2 * second, end: 4 * second},
+			{first: 2, last: 3, start: 4 * second, end: 6 * second},
+			{first: 3, last: 4, start: 6 * second, end: 8 * second},
+			{first: 4, last: 5, start: 8 * second, end: 9 * second},
+		}},
+		{"只保留重叠的切片", &VodClip{Duration: 9 * second, Keyframes: index, Start: 3 * second, End: 5 * second}, 2 * second, []vodSegment{
+			{first: 1, last: 2, start: 2 * second, end: 4 * second},
+			{first: 2, last: 3, start: 4 * second, end: 6 * second},
+		}},
+		// 时长短于最后一个关键帧时按目标时长估计最后一个切片
+		{"时长不准确", &VodClip{Duration: 7 * second, Keyframes: index}, 4 * second, []vodSegment{
+			{first: 0, last: 2, start: 0, end: 4 * second},
+			{first: 2, last: 4, start: 4 * second, end: 8 * second},
+			{first: 4, last: 5, start: 8 * second, end: 12 * second},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := vodSegments(test.clip, test.target); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("vodSegments() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVodPlaylist(t *testing.T) {
+	index := &KeyframeIndex{TimeBase: astiav.NewRational(1, 1000), Keyframes: []Keyframe{{Pts: 0}, {Pts: 3000}}}
+	clips := []*VodClip{
+		{Uri: "a/", Duration: 5 * time.Second, Keyframes: index},
+		{Uri: "b/", Duration: 2 * time.Second},
+	}
+	playlist := VodPlaylist(clips, &VodOptions{SegmentDuration: 3 * time.Second})
+	want := []HlsEntry{
+		{Uri: "a/0-1.m4s", Duration: 3 * time.Second, Map: "a/init.mp4"},
+		{Uri: "a/1-2.m4s", Duration: 2 * time.Second},
+		{Uri: "b/0-1.m4s", Duration: 2 * time.Second, Map: "b/init.mp4", Discontinuity: true},
+	}
+	if !reflect.DeepEqual(playlist.Entries, want) || !playlist.Ended || playlist.Type != "VOD" {
+		t.Errorf("VodPlaylist() = %+v", playlist)
+	}
+}
+
+func TestParseVodSegmentName(t *testing.T) {
+	first, last, err := ParseVodSegmentName(VodSegmentName(3, 7))
+	if err != nil || first != 3 || last != 7 {
+		t.Errorf("ParseVodSegmentName() = %d, %d, %v", first, last, err)
+	}
+	for _, name := range []string{"3.m4s", "3-7.ts", "03-7.m4s", "../3-7.m4s"} {
+		if _, _, err = ParseVodSegmentName(name); err == nil {
+			t.Errorf("ParseVodSegmentName(%s) 应返回错误", name)
+		}
+	}
+}
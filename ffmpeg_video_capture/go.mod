@@ -5,6 +5,7 @@ go 1.22.8
 require (
 	github.com/asticode/go-astiav v0.29.0
 	github.com/gomodule/redigo v1.9.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/asticode/go-astikit v0.42.0 // indirect
@@ -18,6 +18,7 @@ import (
 	"image"
 	"image/color"
 	"image/jpeg"
+	"log"
 	"os"
 	"unsafe"
 )
@@ -25,7 +26,6 @@ import (
 //var RTSP_URL = ""
 
 var RTSP_URL = "test.mp4"
-var redisHost = "127.0.0.1:6379"
 var redisClient *redis.RedisClient
 var videoOutput = "output.mp4"
 var audioOutput = "output.wav"
@@ -34,17 +34,9 @@ var fps = 25
 var duration = 2
 
 func init() {
-	client, err := redis.NewClient(&redis.RedisConf{
-		Host:        redisHost,
-		MaxIdle:     30,
-		MaxActive:   60,
-		IdleTimeout: 30,
-		Password:    "Abc@1234",
-		Db:          0,
-	})
+	client, err := redis.DefaultClient()
 	if err != nil {
-		fmt.Println("初始化redis连接池失败")
-		return
+		log.Fatalf("初始化redis连接池失败: %s", err)
 	}
 	redisClient = client
 	// 初始化FFmpeg的网络组件
@@ -0,0 +1,378 @@
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultChunkSize 默认分块大小，超过分块大小的产物分块存储
+const DefaultChunkSize = 1 << 20
+
+// ChunkManifest 分块存储的清单
+type ChunkManifest struct {
+	Size      int64 `json:"size"`      // 数据总字节数
+	ChunkSize int64 `json:"chunkSize"` // 分块大小
+	Chunks    int   `json:"chunks"`    // 分块个数
+	// Generation 分块的批次，每次写入使用新的批次，覆盖写入时新旧分块的key不同，读取中的旧数据不会被覆盖
+	// 为空时为旧版本写入的分块
+	Generation string `json:"generation,omitempty"`
+	// Key 写入分块时使用的key，与清单所在的key不同时(如抓取完成后才确定片段ID)按该key查找分块，为空时与清单相同
+	Key string `json:"key,omitempty"`
+}
+
+// ChunkManifestKey 分块清单的key
+func ChunkManifestKey(key string) string {
+	return key + ":manifest"
+}
+
+// ChunkKey 第index个分块的key
+func ChunkKey(key string, index int) string {
+	return key + ":chunk:" + strconv.Itoa(index)
+}
+
+// ChunkKey 清单中第index个分块的key，包含分块的批次
+func (manifest *ChunkManifest) ChunkKey(key string, index int) string {
+	if manifest.Key != "" {
+		key = manifest.Key
+	}
+	if manifest.Generation == "" {
+		return ChunkKey(key, index)
+	}
+	return key + ":chunk:" + manifest.Generation + ":" + strconv.Itoa(index)
+}
+
+// ChunkKeys 清单对应的所有分块的key
+func (manifest *ChunkManifest) ChunkKeys(key string) []interface{} {
+	return manifest.ChunkKeysFrom(key, 0)
+}
+
+// ChunkKeysFrom 清单中从第from个开始的分块的key
+func (manifest *ChunkManifest) ChunkKeysFrom(key string, from int) []interface{} {
+	keys := make([]interface{}, 0, max(manifest.Chunks-from, 0))
+	for i := max(from, 0); i < manifest.Chunks; i++ {
+		keys = append(keys, manifest.ChunkKey(key, i))
+	}
+	return keys
+}
+
+// chunkStore 分块数据的读写，由RedisClient实现
+type chunkStore interface {
+	Set(key string, value interface{}) error
+	GetBytes(key string) ([]byte, error)
+	getStringRange(key string, offset int64, length int64) ([]byte, error)
+	delKeys(keys ...interface{}) error
+}
+
+// ChunkWriter 分块写入数据，每写满一个分块就写入redis
+// 关闭后清单不会自动写入，调用Commit写入清单，或者由调用方在事务中写入
+type ChunkWriter struct {
+	store     chunkStore
+	key       string
+	chunkSize int
+	buf       []byte
+	manifest  *ChunkManifest
+}
+
+// NewChunkWriter 新建分块写入，chunkSize小于等于0时使用客户端的分块大小
+func (redisClient *RedisClient) NewChunkWriter(key string, chunkSize int) *ChunkWriter {
+	if chunkSize <= 0 {
+		chunkSize = redisClient.ChunkSize()
+	}
+	return newChunkWriter(redisClient, key, chunkSize)
+}
+
+func newChunkWriter(store chunkStore, key string, chunkSize int) *ChunkWriter {
+	return &ChunkWriter{
+		store:     store,
+		key:       key,
+		chunkSize: chunkSize,
+		buf:       make([]byte, 0, chunkSize),
+		manifest:  &ChunkManifest{ChunkSize: int64(chunkSize), Generation: newGeneration(), Key: key},
+	}
+}
+
+// newGeneration 随机生成分块的批次
+func newGeneration() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (w *ChunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := w.chunkSize - len(w.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		w.buf = append(w.buf, p[:size]...)
+		p = p[size:]
+		n += size
+		if len(w.buf) == w.chunkSize {
+			if err = w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush 写入当前分块
+func (w *ChunkWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if err := w.store.Set(w.manifest.ChunkKey(w.key, w.manifest.Chunks), w.buf); err != nil {
+		return errors.New(fmt.Sprintf("写入分块失败: %s", err))
+	}
+	w.manifest.Chunks++
+	w.manifest.Size += int64(len(w.buf))
+	w.buf = make([]byte, 0, w.chunkSize)
+	return nil
+}
+
+// Close 写入剩余数据
+func (w *ChunkWriter) Close() error {
+	return w.flush()
+}
+
+// Manifest 已写入数据的清单
+func (w *ChunkWriter) Manifest() *ChunkManifest {
+	return w.manifest
+}
+
+// Reader 已写入数据的读取器，Close后调用，用于清单写入前回读数据(如由视频生成雪碧图)
+func (w *ChunkWriter) Reader() *ChunkReader {
+	return &ChunkReader{store: w.store, key: w.key, manifest: w.manifest, size: w.manifest.Size, chunkIndex: -1}
+}
+
+// Commit 写入剩余数据和清单，清单写入后数据才可读
+func (w *ChunkWriter) Commit() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	manifestBytes, err := json.Marshal(w.manifest)
+	if err != nil {
+		return err
+	}
+	return w.store.Set(ChunkManifestKey(w.key), manifestBytes)
+}
+
+// Abort 删除已写入的分块，清单写入失败或不再需要写入时调用，避免分块残留
+// 只删除本次写入批次的分块，覆盖写入时不影响旧数据
+func (w *ChunkWriter) Abort() error {
+	w.buf = w.buf[:0]
+	if w.manifest.Chunks == 0 {
+		return nil
+	}
+	if err := w.store.delKeys(w.manifest.ChunkKeys(w.key)...); err != nil {
+		return errors.New(fmt.Sprintf("删除分块失败: %s", err))
+	}
+	w.manifest = &ChunkManifest{ChunkSize: int64(w.chunkSize), Generation: newGeneration(), Key: w.key}
+	return nil
+}
+
+// GetChunkManifest 获取分块清单，未分块存储时返回nil
+func (redisClient *RedisClient) GetChunkManifest(key string) (*ChunkManifest, error) {
+	manifestBytes, err := redisClient.GetBytes(ChunkManifestKey(key))
+	if err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	manifest := &ChunkManifest{}
+	if err = json.Unmarshal(manifestBytes, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// DelChunked 删除分块存储或普通存储的数据
+func (redisClient *RedisClient) DelChunked(key string) error {
+	manifest, err := redisClient.GetChunkManifest(key)
+	if err != nil {
+		return err
+	}
+	keys := []interface{}{key, ChunkManifestKey(key)}
+	if manifest != nil {
+		keys = append(keys, manifest.ChunkKeys(key)...)
+	}
+	return redisClient.delKeys(keys...)
+}
+
+// delKeys 删除多个key
+func (redisClient *RedisClient) delKeys(keys ...interface{}) error {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", keys...)
+	return err
+}
+
+// ChunkReader 读取分块存储的数据，支持顺序读取和范围读取，每次只加载一个分块
+// 数据未分块存储时，使用GETRANGE读取普通字符串
+// ReadAt可以并发调用，Read和Seek共用读取位置，不能并发调用
+type ChunkReader struct {
+	store    chunkStore
+	key      string
+	manifest *ChunkManifest
+	size     int64
+	offset   int64
+	// 最近读取的分块，ReadAt并发调用时由mutex保护
+	mutex      sync.Mutex
+	chunkIndex int
+	chunk      []byte
+}
+
+// OpenChunkReader 打开数据，数据不存在时返回redis.ErrNil
+func (redisClient *RedisClient) OpenChunkReader(key string) (*ChunkReader, error) {
+	manifest, err := redisClient.GetChunkManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	reader := &ChunkReader{store: redisClient, key: key, manifest: manifest, chunkIndex: -1}
+	if manifest != nil {
+		reader.size = manifest.Size
+		return reader, nil
+	}
+
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	exists, err := redis.Bool(conn.Do("EXISTS", key))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, redis.ErrNil
+	}
+	if reader.size, err = redis.Int64(conn.Do("STRLEN", key)); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Size 数据总字节数
+func (r *ChunkReader) Size() int64 {
+	return r.size
+}
+
+func (r *ChunkReader) Read(p []byte) (n int, err error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	n, err = r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt 从off处读取数据，不影响当前读取位置
+func (r *ChunkReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	for n < len(p) && off < r.size {
+		var data []byte
+		if r.manifest == nil {
+			// 普通存储按范围读取
+			data, err = r.store.getStringRange(r.key, off, int64(len(p)-n))
+			if err != nil {
+				return n, err
+			}
+			if len(data) == 0 {
+				break
+			}
+		} else {
+			index := int(off / r.manifest.ChunkSize)
+			chunk, err := r.loadChunk(index)
+			if err != nil {
+				return n, err
+			}
+			chunkOffset := off - int64(index)*r.manifest.ChunkSize
+			if chunkOffset >= int64(len(chunk)) {
+				break
+			}
+			data = chunk[chunkOffset:]
+		}
+		copied := copy(p[n:], data)
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// loadChunk 读取第index个分块，与最近读取的分块相同时直接返回
+// 返回的分块数据不会被修改，释放锁后可以继续使用
+func (r *ChunkReader) loadChunk(index int) ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if index != r.chunkIndex {
+		chunk, err := r.store.GetBytes(r.manifest.ChunkKey(r.key, index))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("读取分块失败: %s", err))
+		}
+		r.chunk, r.chunkIndex = chunk, index
+	}
+	return r.chunk, nil
+}
+
+func (r *ChunkReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = r.offset + offset
+	case io.SeekEnd:
+		newOffset = r.size + offset
+	default:
+		return 0, errors.New("invalid whence value")
+	}
+	if newOffset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.offset = newOffset
+	return r.offset, nil
+}
+
+// GetRange 读取数据中从offset开始的length个字节，支持分块存储和普通存储
+func (redisClient *RedisClient) GetRange(key string, offset int64, length int64) ([]byte, error) {
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	manifest, err := redisClient.GetChunkManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return redisClient.getStringRange(key, offset, length)
+	}
+	reader := &ChunkReader{store: redisClient, key: key, manifest: manifest, size: manifest.Size, chunkIndex: -1}
+	data := make([]byte, length)
+	n, err := reader.ReadAt(data, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// getStringRange 读取普通字符串中从offset开始的length个字节
+func (redisClient *RedisClient) getStringRange(key string, offset int64, length int64) ([]byte, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	return redis.Bytes(conn.Do("GETRANGE", key, offset, offset+length-1))
+}
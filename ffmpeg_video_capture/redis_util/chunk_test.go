@@ -0,0 +1,258 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// memoryChunkStore 内存中的分块存储
+type memoryChunkStore struct {
+	mutex sync.Mutex
+	data  map[string][]byte
+}
+
+func newMemoryChunkStore() *memoryChunkStore {
+	return &memoryChunkStore{data: make(map[string][]byte)}
+}
+
+func (store *memoryChunkStore) Set(key string, value interface{}) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.data[key] = append([]byte(nil), value.([]byte)...)
+	return nil
+}
+
+func (store *memoryChunkStore) GetBytes(key string) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	data, ok := store.data[key]
+	if !ok {
+		return nil, redis.ErrNil
+	}
+	return data, nil
+}
+
+func (store *memoryChunkStore) getStringRange(key string, offset int64, length int64) ([]byte, error) {
+	data, err := store.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= int64(len(data)) {
+		return []byte{}, nil
+	}
+	return data[offset:min(offset+length, int64(len(data)))], nil
+}
+
+func (store *memoryChunkStore) delKeys(keys ...interface{}) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, key := range keys {
+		delete(store.data, key.(string))
+	}
+	return nil
+}
+
+// testData 长度为size的测试数据
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestChunkWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []int // 每次写入的字节数
+		chunks int
+	}{
+		{"空数据", 0, nil, 0},
+		{"不足一个分块", 5, []int{5}, 1},
+		{"正好一个分块", 10, []int{10}, 1},
+		{"多次写入跨分块", 25, []int{3, 9, 13}, 3},
+		{"一次写入多个分块", 40, []int{40}, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemoryChunkStore()
+			data := testData(test.size)
+			writer := newChunkWriter(store, "clip", 10)
+			rest := data
+			for _, size := range test.writes {
+				n, err := writer.Write(rest[:size])
+				if err != nil || n != size {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+				rest = rest[size:]
+			}
+			if err := writer.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			manifest := writer.Manifest()
+			if manifest.Size != int64(test.size) || manifest.Chunks != test.chunks || manifest.ChunkSize != 10 {
+				t.Fatalf("Manifest() = %+v", manifest)
+			}
+			if _, ok := store.data[ChunkManifestKey("clip")]; !ok {
+				t.Fatal("清单未写入")
+			}
+
+			reader := &ChunkReader{store: store, key: "clip", manifest: manifest, size: manifest.Size, chunkIndex: -1}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("读取的数据与写入的数据不同")
+			}
+		})
+	}
+}
+
+func TestChunkWriterAbort(t *testing.T) {
+	store := newMemoryChunkStore()
+	writer := newChunkWriter(store, "clip", 10)
+	if _, err := writer.Write(testData(25)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.data) != 2 {
+		t.Fatalf("写入了%d个分块，应为2个", len(store.data))
+	}
+	if err := writer.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.data) != 0 {
+		t.Errorf("Abort后仍有%d个key", len(store.data))
+	}
+}
+
+func TestChunkKeysFrom(t *testing.T) {
+	manifest := &ChunkManifest{Chunks: 3}
+	tests := []struct {
+		from int
+		want []interface{}
+	}{
+		{0, []interface{}{"clip:chunk:0", "clip:chunk:1", "clip:chunk:2"}},
+		{2, []interface{}{"clip:chunk:2"}},
+		{3, []interface{}{}},
+		{5, []interface{}{}},
+	}
+	for _, test := range tests {
+		if got := manifest.ChunkKeysFrom("clip", test.from); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ChunkKeysFrom(%d) = %v, want %v", test.from, got, test.want)
+		}
+	}
+}
+
+func TestChunkReaderReadAt(t *testing.T) {
+	data := testData(35)
+	store := newMemoryChunkStore()
+	writer := newChunkWriter(store, "chunked", 10)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Set("plain", data)
+	readers := map[string]*ChunkReader{
+		"分块存储": {store: store, key: "chunked", manifest: writer.Manifest(), size: int64(len(data)), chunkIndex: -1},
+		"普通存储": {store: store, key: "plain", size: int64(len(data)), chunkIndex: -1},
+	}
+
+	tests := []struct {
+		off    int64
+		length int
+		n      int
+		eof    bool
+	}{
+		{0, 10, 10, false},
+		{5, 10, 10, false},
+		{8, 25, 25, false},
+		{30, 5, 5, false},
+		{30, 10, 5, true},
+		{35, 1, 0, true},
+		{40, 1, 0, true},
+	}
+	for name, reader := range readers {
+		for _, test := range tests {
+			p := make([]byte, test.length)
+			n, err := reader.ReadAt(p, test.off)
+			if n != test.n || errors.Is(err, io.EOF) != test.eof || (err != nil && !errors.Is(err, io.EOF)) {
+				t.Errorf("%s ReadAt(%d, %d) = %d, %v", name, test.length, test.off, n, err)
+				continue
+			}
+			if n > 0 && !bytes.Equal(p[:n], data[test.off:test.off+int64(n)]) {
+				t.Errorf("%s ReadAt(%d, %d) 数据错误", name, test.length, test.off)
+			}
+		}
+		if _, err := reader.ReadAt(make([]byte, 1), -1); err == nil {
+			t.Errorf("%s ReadAt负数偏移应返回错误", name)
+		}
+	}
+}
+
+func TestChunkReaderConcurrentReadAt(t *testing.T) {
+	data := testData(1000)
+	store := newMemoryChunkStore()
+	writer := newChunkWriter(store, "clip", 64)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	reader := &ChunkReader{store: store, key: "clip", manifest: writer.Manifest(), size: int64(len(data)), chunkIndex: -1}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := make([]byte, 50)
+			for off := int64(i * 13); off+50 <= int64(len(data)); off += 37 {
+				if n, err := reader.ReadAt(p, off); err != nil || n != 50 || !bytes.Equal(p, data[off:off+50]) {
+					t.Errorf("ReadAt(50, %d) = %d, %v", off, n, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestChunkReaderSeek(t *testing.T) {
+	data := testData(30)
+	store := newMemoryChunkStore()
+	_ = store.Set("plain", data)
+	reader := &ChunkReader{store: store, key: "plain", size: int64(len(data)), chunkIndex: -1}
+
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{10, io.SeekStart, 10},
+		{5, io.SeekCurrent, 15},
+		{-5, io.SeekEnd, 25},
+	}
+	for _, test := range tests {
+		got, err := reader.Seek(test.offset, test.whence)
+		if err != nil || got != test.want {
+			t.Errorf("Seek(%d, %d) = %d, %v, want %d", test.offset, test.whence, got, err, test.want)
+		}
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(rest, data[25:]) {
+		t.Errorf("Seek后读取的数据错误: %v", err)
+	}
+	if _, err = reader.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek到负数位置应返回错误")
+	}
+}
@@ -0,0 +1,503 @@
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// 片段产物类型
+const (
+	ArtifactVideo = "video" // mp4视频
+	ArtifactAudio = "audio" // wav音频
+	ArtifactImage = "image" // jpg图片
+
+	ArtifactSprite     = "sprite"     // jpg雪碧图，由视频生成的缩略图拼接
+	ArtifactThumbnails = "thumbnails" // WebVTT，时间段对应的雪碧图坐标
+
+	ArtifactGif  = "gif"  // gif预览动图
+	ArtifactWebp = "webp" // webp预览动图
+)
+
+// 片段相关的key前缀
+const (
+	clipCamerasKey       = "clip:cameras"  // 有片段的摄像头集合
+	clipIndexKeyPrefix   = "clip:index:"   // 每个摄像头的片段索引(zset)，分数为开始时间的毫秒时间戳
+	clipMetaKeyPrefix    = "clip:meta:"    // 片段元数据
+	clipDataKeyPrefix    = "clip:data:"    // 片段产物数据
+	clipStagingKeyPrefix = "clip:staging:" // 抓取中的产物分块，片段ID在抓取完成后才确定
+)
+
+// ClipMeta 片段元数据
+type ClipMeta struct {
+	ID        string           `json:"id"`
+	Camera    string           `json:"camera"`
+	Start     int64            `json:"start"`     // 开始时间，毫秒时间戳
+	End       int64            `json:"end"`       // 结束时间，毫秒时间戳
+	Artifacts map[string]int64 `json:"artifacts"` // 产物类型 -> 字节数
+	// Keyframes 视频的关键帧索引，导出、剪切和生成缩略图时直接定位，不再扫描整个视频
+	Keyframes *KeyframeIndex `json:"keyframes,omitempty"`
+}
+
+// KeyframeIndex 视频的关键帧索引
+type KeyframeIndex struct {
+	TimeBase  [2]int     `json:"time_base"`        // 视频流的时间基，分子和分母
+	Keyframes []Keyframe `json:"keyframes"`        // 按时间戳升序排列
+	End       int64      `json:"end,omitempty"`    // 最后一个视频帧的结束时间戳，即视频时长，为0时未记录
+	Layout    string     `json:"layout,omitempty"` // mp4的封装方式，决定关键帧偏移的含义
+}
+
+// Keyframe 关键帧位置
+type Keyframe struct {
+	Pts    int64 `json:"pts"`    // 显示时间戳，相对第一个视频帧，单位为时间基
+	Offset int64 `json:"offset"` // 在mp4数据中的字节偏移，分片mp4为关键帧所在分片的位置
+}
+
+// Time 时间戳对应的片段内时间
+func (index *KeyframeIndex) Time(pts int64) time.Duration {
+	if index.TimeBase[1] == 0 {
+		return 0
+	}
+	return time.Duration(pts) * time.Second * time.Duration(index.TimeBase[0]) / time.Duration(index.TimeBase[1])
+}
+
+// StartTime 片段开始时间
+func (meta *ClipMeta) StartTime() time.Time {
+	return time.UnixMilli(meta.Start)
+}
+
+// EndTime 片段结束时间
+func (meta *ClipMeta) EndTime() time.Time {
+	return time.UnixMilli(meta.End)
+}
+
+// NewClipID 根据摄像头和开始时间生成片段ID
+func NewClipID(camera string, start time.Time) string {
+	return fmt.Sprintf("%s:%d", camera, start.UnixMilli())
+}
+
+// ClipIndexKey 摄像头片段索引的key
+func ClipIndexKey(camera string) string {
+	return clipIndexKeyPrefix + camera
+}
+
+// ClipMetaKey 片段元数据的key
+func ClipMetaKey(id string) string {
+	return clipMetaKeyPrefix + id
+}
+
+// ClipDataKey 片段产物数据的key
+func ClipDataKey(id string, kind string) string {
+	return clipDataKeyPrefix + id + ":" + kind
+}
+
+// ClipStagingKey 摄像头抓取中的产物分块写入的key，保存片段时分块清单写入ClipDataKey，清单中记录该key
+func ClipStagingKey(camera string, kind string) string {
+	return clipStagingKeyPrefix + camera + ":" + kind
+}
+
+// SaveClip 保存片段元数据和产物的分块清单，加入摄像头的片段索引并发布片段事件，在同一个事务中写入
+// 产物由调用方边生成边通过ChunkWriter分块写入，关闭后传入清单，保存失败时删除清单中的分块
+// 同一片段重复保存时，事务成功后再删除被覆盖的旧分块
+func (redisClient *RedisClient) SaveClip(meta *ClipMeta, manifests map[string]*ChunkManifest) (err error) {
+	defer func() {
+		// 保存失败时删除已写入的分块
+		if err != nil {
+			for kind, manifest := range manifests {
+				if manifest.Chunks == 0 {
+					continue
+				}
+				if delErr := redisClient.delKeys(manifest.ChunkKeys(ClipDataKey(meta.ID, kind))...); delErr != nil {
+					log.Printf("片段%s保存失败，删除分块失败: %s", meta.ID, delErr)
+				}
+			}
+		}
+	}()
+	if meta.ID == "" || meta.Camera == "" {
+		return errors.New("片段ID和摄像头不能为空")
+	}
+	meta.Artifacts = make(map[string]int64, len(manifests))
+	kinds := make([]string, 0, len(manifests))
+	for kind, manifest := range manifests {
+		meta.Artifacts[kind] = manifest.Size
+		kinds = append(kinds, kind)
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// 产物类型 -> 分块清单
+	manifestBytes := make(map[string][]byte, len(manifests))
+	for kind, manifest := range manifests {
+		if manifestBytes[kind], err = json.Marshal(manifest); err != nil {
+			return err
+		}
+	}
+	// 同一片段重复保存时被覆盖的旧分块
+	staleKeys, err := redisClient.staleChunkKeys(meta.ID, kinds)
+	if err != nil {
+		return err
+	}
+
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	if err = conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for kind := range manifests {
+		if err = sendClipArtifact(conn, ClipDataKey(meta.ID, kind), manifestBytes[kind], nil); err != nil {
+			return err
+		}
+	}
+	if err = conn.Send("SET", ClipMetaKey(meta.ID), metaBytes); err != nil {
+		return err
+	}
+	if err = conn.Send("ZADD", ClipIndexKey(meta.Camera), meta.Start, meta.ID); err != nil {
+		return err
+	}
+	if err = conn.Send("SADD", clipCamerasKey, meta.Camera); err != nil {
+		return err
+	}
+	eventArgs := redis.Args{ClipEventStream, "*"}.Add(clipEventFields(meta, metaBytes)...)
+	if err = conn.Send("XADD", eventArgs...); err != nil {
+		return err
+	}
+	if _, err = conn.Do("EXEC"); err != nil {
+		return err
+	}
+	redisClient.delStaleChunks(meta.ID, staleKeys)
+	// 裁剪失败不影响片段保存，下次保存时再裁剪
+	if trimErr := redisClient.TrimStream(ClipEventStream, ClipEventStreamMaxLen); trimErr != nil {
+		log.Printf("裁剪片段事件流失败: %s", trimErr)
+	}
+	return nil
+}
+
+// AddClipArtifacts 为已保存的片段追加产物，同时更新元数据，同类型的产物会被覆盖
+// 新产物的分块写入新的批次，清单在事务中替换，事务成功后才删除旧分块，覆盖过程中旧数据始终完整可读
+// 保存失败时只删除本次写入的分块，返回更新后的元数据
+func (redisClient *RedisClient) AddClipArtifacts(id string, artifacts map[string][]byte) (result *ClipMeta, err error) {
+	// 超过分块大小的产物先写入分块，分块清单在事务中写入
+	manifests := make(map[string][]byte)
+	var chunkWriters []*ChunkWriter
+	defer func() {
+		if err != nil {
+			for _, chunkWriter := range chunkWriters {
+				if abortErr := chunkWriter.Abort(); abortErr != nil {
+					log.Printf("片段%s追加产物失败，%s", id, abortErr)
+				}
+			}
+		}
+	}()
+	for kind, data := range artifacts {
+		if len(data) <= redisClient.ChunkSize() {
+			continue
+		}
+		chunkWriter := redisClient.NewChunkWriter(ClipDataKey(id, kind), 0)
+		chunkWriters = append(chunkWriters, chunkWriter)
+		if _, err = chunkWriter.Write(data); err != nil {
+			return nil, err
+		}
+		if err = chunkWriter.Close(); err != nil {
+			return nil, err
+		}
+		if manifests[kind], err = json.Marshal(chunkWriter.Manifest()); err != nil {
+			return nil, err
+		}
+	}
+
+	// 元数据和被覆盖产物的清单都被监视，读取的旧清单与事务替换的清单一致
+	watchKeys := redis.Args{ClipMetaKey(id)}
+	kinds := make([]string, 0, len(artifacts))
+	for kind := range artifacts {
+		watchKeys = watchKeys.Add(ChunkManifestKey(ClipDataKey(id, kind)))
+		kinds = append(kinds, kind)
+	}
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	// 元数据被并发修改时重试
+	for retry := 0; retry < 3; retry++ {
+		if _, err := conn.Do("WATCH", watchKeys...); err != nil {
+			return nil, err
+		}
+		metaBytes, err := redis.Bytes(conn.Do("GET", ClipMetaKey(id)))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		meta := &ClipMeta{}
+		if err = json.Unmarshal(metaBytes, meta); err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		if meta.Artifacts == nil {
+			meta.Artifacts = make(map[string]int64)
+		}
+		for kind, data := range artifacts {
+			meta.Artifacts[kind] = int64(len(data))
+		}
+		if metaBytes, err = json.Marshal(meta); err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		staleKeys, err := redisClient.staleChunkKeys(id, kinds)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		if err = conn.Send("MULTI"); err != nil {
+			return nil, err
+		}
+		for kind, data := range artifacts {
+			if err = sendClipArtifact(conn, ClipDataKey(id, kind), manifests[kind], data); err != nil {
+				return nil, err
+			}
+		}
+		if err = conn.Send("SET", ClipMetaKey(id), metaBytes); err != nil {
+			return nil, err
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			redisClient.delStaleChunks(id, staleKeys)
+			return meta, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("片段元数据被并发修改，追加产物失败，片段ID：%s", id))
+}
+
+// staleChunkKeys 将被覆盖的产物的旧分块key
+func (redisClient *RedisClient) staleChunkKeys(id string, kinds []string) ([]interface{}, error) {
+	var staleKeys []interface{}
+	for _, kind := range kinds {
+		dataKey := ClipDataKey(id, kind)
+		manifest, err := redisClient.GetChunkManifest(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			staleKeys = append(staleKeys, manifest.ChunkKeys(dataKey)...)
+		}
+	}
+	return staleKeys, nil
+}
+
+// delStaleChunks 事务成功后删除被覆盖的旧分块，删除失败只留下无法访问的分块，不影响保存结果
+func (redisClient *RedisClient) delStaleChunks(id string, staleKeys []interface{}) {
+	if len(staleKeys) == 0 {
+		return
+	}
+	if err := redisClient.delKeys(staleKeys...); err != nil {
+		log.Printf("片段%s删除旧分块失败: %s", id, err)
+	}
+}
+
+// sendClipArtifact 在事务中写入产物，有分块清单时写入清单，否则写入数据，同时删除覆盖前另一种方式保存的数据
+func sendClipArtifact(conn redis.Conn, dataKey string, manifestBytes []byte, data []byte) error {
+	if manifestBytes != nil {
+		if err := conn.Send("DEL", dataKey); err != nil {
+			return err
+		}
+		return conn.Send("SET", ChunkManifestKey(dataKey), manifestBytes)
+	}
+	if err := conn.Send("DEL", ChunkManifestKey(dataKey)); err != nil {
+		return err
+	}
+	return conn.Send("SET", dataKey, data)
+}
+
+// EvictClipArtifacts 删除片段指定类型的产物，同时更新元数据，产物全部删除后片段从索引中移除
+// 返回删除前的元数据，片段不存在时返回nil
+func (redisClient *RedisClient) EvictClipArtifacts(id string, kinds []string) (*ClipMeta, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	// 元数据被并发修改时重试
+	for retry := 0; retry < 3; retry++ {
+		if _, err := conn.Do("WATCH", ClipMetaKey(id)); err != nil {
+			return nil, err
+		}
+		metaBytes, err := redis.Bytes(conn.Do("GET", ClipMetaKey(id)))
+		if err != nil {
+			conn.Do("UNWATCH")
+			if errors.Is(err, redis.ErrNil) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		meta := &ClipMeta{}
+		if err = json.Unmarshal(metaBytes, meta); err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		remain := &ClipMeta{ID: meta.ID, Camera: meta.Camera, Start: meta.Start, End: meta.End, Artifacts: make(map[string]int64), Keyframes: meta.Keyframes}
+		for kind, size := range meta.Artifacts {
+			remain.Artifacts[kind] = size
+		}
+		// 待删除的产物数据的key，包括分块清单和分块
+		var dataKeys []interface{}
+		for _, kind := range kinds {
+			delete(remain.Artifacts, kind)
+			dataKey := ClipDataKey(id, kind)
+			dataKeys = append(dataKeys, dataKey, ChunkManifestKey(dataKey))
+			manifest, err := redisClient.GetChunkManifest(dataKey)
+			if err != nil {
+				conn.Do("UNWATCH")
+				return nil, err
+			}
+			if manifest != nil {
+				dataKeys = append(dataKeys, manifest.ChunkKeys(dataKey)...)
+			}
+		}
+		if metaBytes, err = json.Marshal(remain); err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		if err = conn.Send("MULTI"); err != nil {
+			return nil, err
+		}
+		if len(dataKeys) > 0 {
+			if err = conn.Send("DEL", dataKeys...); err != nil {
+				return nil, err
+			}
+		}
+		if len(remain.Artifacts) == 0 {
+			// 产物已全部删除，移除元数据和索引
+			if err = conn.Send("DEL", ClipMetaKey(id)); err != nil {
+				return nil, err
+			}
+			if err = conn.Send("ZREM", ClipIndexKey(meta.Camera), id); err != nil {
+				return nil, err
+			}
+		} else if err = conn.Send("SET", ClipMetaKey(id), metaBytes); err != nil {
+			return nil, err
+		}
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return meta, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("片段元数据被并发修改，删除产物失败，片段ID：%s", id))
+}
+
+// removeEmptyCamera 摄像头的片段索引为空时从摄像头集合中移除
+// 监视片段索引，期间有新片段加入时不移除，保存片段时会再次加入集合
+func (redisClient *RedisClient) removeEmptyCamera(camera string) error {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("WATCH", ClipIndexKey(camera)); err != nil {
+		return err
+	}
+	count, err := redis.Int64(conn.Do("ZCARD", ClipIndexKey(camera)))
+	if err != nil || count > 0 {
+		conn.Do("UNWATCH")
+		return err
+	}
+	if err = conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err = conn.Send("SREM", clipCamerasKey, camera); err != nil {
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// ListCameras 获取有片段的摄像头
+func (redisClient *RedisClient) ListCameras() ([]string, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", clipCamerasKey))
+}
+
+// ListClips 获取摄像头的全部片段，按开始时间排序
+func (redisClient *RedisClient) ListClips(camera string) ([]*ClipMeta, error) {
+	ids, err := redisClient.ZRangeByScore(ClipIndexKey(camera), math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	clips := make([]*ClipMeta, 0, len(ids))
+	for _, id := range ids {
+		meta, err := redisClient.GetClip(id)
+		if err != nil {
+			if errors.Is(err, redis.ErrNil) {
+				continue
+			}
+			return nil, err
+		}
+		clips = append(clips, meta)
+	}
+	return clips, nil
+}
+
+// GetClip 获取片段元数据
+func (redisClient *RedisClient) GetClip(id string) (*ClipMeta, error) {
+	metaBytes, err := redisClient.GetBytes(ClipMetaKey(id))
+	if err != nil {
+		return nil, err
+	}
+	meta := &ClipMeta{}
+	if err = json.Unmarshal(metaBytes, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// GetClipArtifact 获取片段指定类型的产物数据
+func (redisClient *RedisClient) GetClipArtifact(id string, kind string) ([]byte, error) {
+	reader, err := redisClient.OpenClipArtifact(id, kind)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// OpenClipArtifact 打开片段指定类型的产物数据，用于流式读取和范围读取
+func (redisClient *RedisClient) OpenClipArtifact(id string, kind string) (*ChunkReader, error) {
+	return redisClient.OpenChunkReader(ClipDataKey(id, kind))
+}
+
+// FindClips 查找摄像头在[from, to]时间段内的片段，按开始时间排序
+// 开始时间早于from但结束时间晚于from的片段也会返回
+func (redisClient *RedisClient) FindClips(camera string, from time.Time, to time.Time) ([]*ClipMeta, error) {
+	indexKey := ClipIndexKey(camera)
+	// from之前最近的一个片段可能与时间段重叠
+	ids, err := redisClient.ZRevRangeByScore(indexKey, from.UnixMilli()-1, math.MinInt64, 1)
+	if err != nil {
+		return nil, err
+	}
+	inRangeIds, err := redisClient.ZRangeByScore(indexKey, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, inRangeIds...)
+
+	clips := make([]*ClipMeta, 0, len(ids))
+	for _, id := range ids {
+		meta, err := redisClient.GetClip(id)
+		if err != nil {
+			if errors.Is(err, redis.ErrNil) {
+				// 元数据已被删除，跳过
+				continue
+			}
+			return nil, err
+		}
+		if meta.End < from.UnixMilli() {
+			continue
+		}
+		clips = append(clips, meta)
+	}
+	return clips, nil
+}
@@ -0,0 +1,257 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// memoryRedis 内存中的redis，只支持片段读写用到的命令
+type memoryRedis struct {
+	*memoryChunkStore
+	execErr error // EXEC返回的错误
+	execNil bool  // EXEC返回nil，模拟监视的key被修改
+	zsets   map[string]map[string]int64
+	sets    map[string]map[string]bool
+}
+
+// memoryConn memoryRedis的连接，事务中的命令在EXEC时执行
+type memoryConn struct {
+	redis *memoryRedis
+	multi bool
+	queue [][]interface{}
+}
+
+func newMemoryRedisClient(memory *memoryRedis, chunkSize int) *RedisClient {
+	return &RedisClient{
+		redisPool: &redis.Pool{Dial: func() (redis.Conn, error) { return &memoryConn{redis: memory}, nil }},
+		chunkSize: chunkSize,
+	}
+}
+
+func (conn *memoryConn) Close() error { return nil }
+
+func (conn *memoryConn) Err() error { return nil }
+
+func (conn *memoryConn) Flush() error { return nil }
+
+func (conn *memoryConn) Receive() (interface{}, error) { return nil, nil }
+
+func (conn *memoryConn) Send(cmd string, args ...interface{}) error {
+	_, err := conn.Do(cmd, args...)
+	return err
+}
+
+func (conn *memoryConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "":
+		return nil, nil
+	case "MULTI":
+		conn.multi, conn.queue = true, nil
+		return "OK", nil
+	case "DISCARD":
+		conn.multi, conn.queue = false, nil
+		return "OK", nil
+	case "EXEC":
+		queue := conn.queue
+		conn.multi, conn.queue = false, nil
+		if conn.redis.execErr != nil {
+			return nil, conn.redis.execErr
+		}
+		if conn.redis.execNil {
+			return nil, nil
+		}
+		replies := make([]interface{}, 0, len(queue))
+		for _, command := range queue {
+			reply, err := conn.redis.do(command[0].(string), command[1:]...)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+		return replies, nil
+	}
+	if conn.multi {
+		conn.queue = append(conn.queue, append([]interface{}{cmd}, args...))
+		return "QUEUED", nil
+	}
+	return conn.redis.do(cmd, args...)
+}
+
+func (memory *memoryRedis) do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "GET":
+		data, err := memory.GetBytes(args[0].(string))
+		if err != nil {
+			return nil, nil
+		}
+		return data, nil
+	case "SET":
+		value, ok := args[1].([]byte)
+		if !ok {
+			value = []byte(args[1].(string))
+		}
+		return "OK", memory.Set(args[0].(string), value)
+	case "DEL":
+		return int64(len(args)), memory.delKeys(args...)
+	case "WATCH", "UNWATCH":
+		return "OK", nil
+	case "ZADD", "ZREM", "ZCARD", "ZRANGEBYSCORE", "SADD", "SREM", "SMEMBERS":
+		return memory.doSet(cmd, args...), nil
+	case "XADD", "XLEN":
+		return int64(0), nil
+	}
+	return nil, errors.New("不支持的命令: " + cmd)
+}
+
+// doSet 执行zset和set的命令，ZRANGEBYSCORE返回全部元素
+func (memory *memoryRedis) doSet(cmd string, args ...interface{}) interface{} {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	if memory.zsets == nil {
+		memory.zsets, memory.sets = make(map[string]map[string]int64), make(map[string]map[string]bool)
+	}
+	key := args[0].(string)
+	switch cmd {
+	case "ZADD":
+		if memory.zsets[key] == nil {
+			memory.zsets[key] = make(map[string]int64)
+		}
+		memory.zsets[key][args[2].(string)] = args[1].(int64)
+	case "ZREM":
+		delete(memory.zsets[key], args[1].(string))
+	case "ZCARD":
+		return int64(len(memory.zsets[key]))
+	case "ZRANGEBYSCORE":
+		members := make([]string, 0, len(memory.zsets[key]))
+		for member := range memory.zsets[key] {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool { return memory.zsets[key][members[i]] < memory.zsets[key][members[j]] })
+		return stringsReply(members)
+	case "SADD":
+		if memory.sets[key] == nil {
+			memory.sets[key] = make(map[string]bool)
+		}
+		memory.sets[key][args[1].(string)] = true
+	case "SREM":
+		delete(memory.sets[key], args[1].(string))
+	case "SMEMBERS":
+		members := make([]string, 0, len(memory.sets[key]))
+		for member := range memory.sets[key] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return stringsReply(members)
+	}
+	return int64(1)
+}
+
+// stringsReply 转换为redis返回的多个字符串
+func stringsReply(values []string) []interface{} {
+	reply := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		reply = append(reply, []byte(value))
+	}
+	return reply
+}
+
+// keys 当前所有的key，按字典序排列
+func (memory *memoryRedis) keys() []string {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	keys := make([]string, 0, len(memory.data))
+	for key := range memory.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveTestClip 分块写入视频后保存片段
+func saveTestClip(t *testing.T, client *RedisClient, meta *ClipMeta, video []byte) {
+	t.Helper()
+	w := client.NewChunkWriter(ClipDataKey(meta.ID, ArtifactVideo), 0)
+	if _, err := w.Write(video); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SaveClip(meta, map[string]*ChunkManifest{ArtifactVideo: w.Manifest()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddClipArtifactsExecFailed(t *testing.T) {
+	tests := []struct {
+		name    string
+		execErr error
+		execNil bool
+	}{
+		{"EXEC失败", errors.New("连接断开"), false},
+		{"监视的key被修改，重试次数用完", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memory := &memoryRedis{memoryChunkStore: newMemoryChunkStore()}
+			client := newMemoryRedisClient(memory, 10)
+			oldData := testData(35)
+			saveTestClip(t, client, &ClipMeta{ID: "cam:1", Camera: "cam"}, oldData)
+			keys := memory.keys()
+
+			memory.execErr, memory.execNil = test.execErr, test.execNil
+			if _, err := client.AddClipArtifacts("cam:1", map[string][]byte{ArtifactVideo: bytes.Repeat([]byte{1}, 25)}); err == nil {
+				t.Fatal("EXEC失败时AddClipArtifacts应返回错误")
+			}
+			if got := memory.keys(); !reflect.DeepEqual(got, keys) {
+				t.Errorf("覆盖失败后的key = %v, want %v", got, keys)
+			}
+			data, err := client.GetClipArtifact("cam:1", ArtifactVideo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, oldData) {
+				t.Errorf("覆盖失败后旧产物被修改")
+			}
+		})
+	}
+}
+
+func TestAddClipArtifactsOverwrite(t *testing.T) {
+	memory := &memoryRedis{memoryChunkStore: newMemoryChunkStore()}
+	client := newMemoryRedisClient(memory, 10)
+	saveTestClip(t, client, &ClipMeta{ID: "cam:1", Camera: "cam"}, testData(35))
+	oldManifest, err := client.GetChunkManifest(ClipDataKey("cam:1", ArtifactVideo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newData := bytes.Repeat([]byte{1}, 25)
+	meta, err := client.AddClipArtifacts("cam:1", map[string][]byte{ArtifactVideo: newData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Artifacts[ArtifactVideo] != int64(len(newData)) {
+		t.Errorf("产物大小 = %d, want %d", meta.Artifacts[ArtifactVideo], len(newData))
+	}
+	data, err := client.GetClipArtifact("cam:1", ArtifactVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, newData) {
+		t.Errorf("读取的产物不是覆盖后的数据")
+	}
+	for _, key := range oldManifest.ChunkKeys(ClipDataKey("cam:1", ArtifactVideo)) {
+		if _, ok := memory.data[key.(string)]; ok {
+			t.Errorf("旧分块%s未删除", key)
+		}
+	}
+	// 元数据、清单和3个新分块
+	if keys := memory.keys(); len(keys) != 5 {
+		t.Errorf("覆盖后的key = %v", keys)
+	}
+}
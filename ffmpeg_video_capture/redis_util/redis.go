@@ -3,8 +3,8 @@ package redis
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gomodule/redigo/redis"
-	"log"
 	"math"
 	"os"
 	"strconv"
@@ -14,6 +14,7 @@ import (
 // RedisClient RedisClient实列
 type RedisClient struct {
 	redisPool *redis.Pool
+	chunkSize int
 }
 
 // RedisConf redis链接池配置信息
@@ -24,6 +25,7 @@ type RedisConf struct {
 	IdleTimeout int    `json:"idleTimeout"`
 	Password    string `json:"password"`
 	Db          int    `json:"db"`
+	ChunkSize   int    `json:"chunkSize"` // 分块大小，超过分块大小的片段产物分块存储，为0时使用默认值
 }
 
 // NewClient 新建redis客户端
@@ -33,27 +35,35 @@ func NewClient(redisConf *RedisConf) (*RedisClient, error) {
 	return redisClient, err
 }
 
-// DefaultClient 默认redis客户端
+// DefaultConfigEnv 指定默认redis配置文件路径的环境变量
+const DefaultConfigEnv = "FFCAP_REDIS_CONFIG"
+
+// DefaultClient 默认redis客户端，读取环境变量FFCAP_REDIS_CONFIG指定的配置文件，未设置时读取redis_util/config.json
 func DefaultClient() (*RedisClient, error) {
-	bytes := make([]byte, 0)
-	bytes, err := os.ReadFile("redis_util/config.json")
+	path := os.Getenv(DefaultConfigEnv)
+	if path == "" {
+		path = "redis_util/config.json"
+	}
+	return NewClientFromFile(path)
+}
+
+// NewClientFromFile 读取json配置文件，新建redis客户端
+func NewClientFromFile(path string) (*RedisClient, error) {
+	bytes, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal("配置文件读取失败", err)
-		return nil, err
+		return nil, errors.New(fmt.Sprintf("配置文件读取失败: %s", err))
 	}
 	redisConf := &RedisConf{}
 	err = json.Unmarshal(bytes, redisConf)
 	if err != nil {
-		log.Fatal("反序列化失败", err)
-		return nil, err
+		return nil, errors.New(fmt.Sprintf("反序列化失败: %s", err))
 	}
-	redisClient, _ := NewClient(redisConf)
-	return redisClient, nil
-
+	return NewClient(redisConf)
 }
 
 // InitRedis 初始化redis
 func (redisClient *RedisClient) InitRedis(redisconf *RedisConf) error {
+	redisClient.chunkSize = redisconf.ChunkSize
 	redisClient.redisPool = &redis.Pool{
 		MaxIdle:     redisconf.MaxIdle,
 		MaxActive:   redisconf.MaxActive,
@@ -91,6 +101,14 @@ func (redisClient *RedisClient) InitRedis(redisconf *RedisConf) error {
 	return nil
 }
 
+// ChunkSize 分块大小
+func (redisClient *RedisClient) ChunkSize() int {
+	if redisClient.chunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return redisClient.chunkSize
+}
+
 // redis 设置
 func (redisClient *RedisClient) Set(key string, value interface{}) error {
 	conn := redisClient.redisPool.Get()
@@ -166,6 +184,16 @@ func (redisClient *RedisClient) Push(topic string, value interface{}) error {
 
 }
 
+// LTrim 只保留列表中start到stop之间的元素
+func (redisClient *RedisClient) LTrim(topic string, start int64, stop int64) error {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("LTRIM", topic, start, stop); err != nil {
+		return err
+	}
+	return nil
+}
+
 // 返回列表的长度
 func (redisClient *RedisClient) GetPopCount(topic string) (int64, error) {
 	conn := redisClient.redisPool.Get()
@@ -238,6 +266,20 @@ func (redisClient *RedisClient) ZAdd(key string, score int64, value interface{})
 	}
 }
 
+// ZRangeByScore 获取zset集合中分数在 min和max之间的元素，按分数从小到大排列
+func (redisClient *RedisClient) ZRangeByScore(key string, min int64, max int64) ([]string, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", key, min, max))
+}
+
+// ZRevRangeByScore 获取zset集合中分数在 max和min之间的前count个元素，按分数从大到小排列
+func (redisClient *RedisClient) ZRevRangeByScore(key string, max int64, min int64, count int) ([]string, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("ZREVRANGEBYSCORE", key, max, min, "LIMIT", 0, count))
+}
+
 // ZRemRangeByScore 移除zset集合中分数在 min和max之间的元素
 func (redisClient *RedisClient) ZRemRangeByScore(key string, min int64, max int64) error {
 	conn := redisClient.redisPool.Get()
@@ -330,5 +372,4 @@ func (redisClient *RedisClient) Hexists(topic string, field string) (interface{}
 	} else {
 		return result, nil
 	}
-	return int64(0), nil
 }
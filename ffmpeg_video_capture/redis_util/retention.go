@@ -0,0 +1,287 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 淘汰原因
+const (
+	EvictReasonAge   = "age"   // 超过最长保留时间
+	EvictReasonCount = "count" // 超过最多保留个数
+	EvictReasonBytes = "bytes" // 超过最多占用字节数
+)
+
+// RetentionPolicy 保留策略，字段为0表示不限制
+type RetentionPolicy struct {
+	MaxAge   int64 `json:"maxAge"`   // 最长保留时间，单位秒
+	MaxCount int64 `json:"maxCount"` // 最多保留的片段个数
+	MaxBytes int64 `json:"maxBytes"` // 最多占用的字节数
+}
+
+// RetentionConfig 保留策略配置
+type RetentionConfig struct {
+	Default map[string]*RetentionPolicy            `json:"default"` // 产物类型 -> 保留策略
+	Cameras map[string]map[string]*RetentionPolicy `json:"cameras"` // 摄像头 -> 产物类型 -> 保留策略，优先于默认策略
+	Lists   map[string]int64                       `json:"lists"`   // 列表key -> 最多保留的元素个数，用于旧的列表存储
+}
+
+// Policy 获取摄像头指定产物类型的保留策略，没有配置时返回nil
+func (config *RetentionConfig) Policy(camera string, kind string) *RetentionPolicy {
+	if policies, ok := config.Cameras[camera]; ok {
+		if policy, ok := policies[kind]; ok {
+			return policy
+		}
+	}
+	return config.Default[kind]
+}
+
+// Eviction 一次淘汰记录
+type Eviction struct {
+	ClipID string `json:"clipId"`
+	Camera string `json:"camera"`
+	Kind   string `json:"kind"`
+	Bytes  int64  `json:"bytes"`
+	Reason string `json:"reason"`
+}
+
+// RetentionReport 保留策略执行结果
+type RetentionReport struct {
+	Time         time.Time        `json:"time"`
+	Evictions    []*Eviction      `json:"evictions"`
+	TrimmedLists map[string]int64 `json:"trimmedLists"` // 列表key -> 删除的元素个数
+}
+
+// Bytes 淘汰的总字节数
+func (report *RetentionReport) Bytes() int64 {
+	var total int64
+	for _, eviction := range report.Evictions {
+		total += eviction.Bytes
+	}
+	return total
+}
+
+// EnforceRetention 按保留策略淘汰片段产物，按开始时间从旧到新淘汰
+func (redisClient *RedisClient) EnforceRetention(config *RetentionConfig, now time.Time) (*RetentionReport, error) {
+	report := &RetentionReport{Time: now, TrimmedLists: make(map[string]int64)}
+
+	cameras, err := redisClient.ListCameras()
+	if err != nil {
+		return report, err
+	}
+	for _, camera := range cameras {
+		clips, err := redisClient.ListClips(camera)
+		if err != nil {
+			return report, err
+		}
+		// 片段ID -> 待淘汰的产物
+		evictKinds := make(map[string][]*Eviction)
+		for _, kind := range artifactKinds(clips) {
+			policy := config.Policy(camera, kind)
+			if policy == nil {
+				continue
+			}
+			for _, eviction := range selectEvictions(clips, camera, kind, policy, now) {
+				evictKinds[eviction.ClipID] = append(evictKinds[eviction.ClipID], eviction)
+			}
+		}
+		for _, clip := range clips {
+			evictions, ok := evictKinds[clip.ID]
+			if !ok {
+				continue
+			}
+			kinds := make([]string, 0, len(evictions))
+			for _, eviction := range evictions {
+				kinds = append(kinds, eviction.Kind)
+			}
+			meta, err := redisClient.EvictClipArtifacts(clip.ID, kinds)
+			if err != nil {
+				return report, err
+			}
+			if meta != nil {
+				report.Evictions = append(report.Evictions, evictions...)
+			}
+		}
+		// 片段已全部淘汰时从摄像头集合中移除
+		if err = redisClient.removeEmptyCamera(camera); err != nil {
+			return report, err
+		}
+	}
+
+	for listKey, maxLen := range config.Lists {
+		if maxLen <= 0 {
+			continue
+		}
+		length, err := redisClient.GetPopCount(listKey)
+		if err != nil {
+			return report, err
+		}
+		if length <= maxLen {
+			continue
+		}
+		if err = redisClient.LTrim(listKey, -maxLen, -1); err != nil {
+			return report, err
+		}
+		report.TrimmedLists[listKey] = length - maxLen
+	}
+	return report, nil
+}
+
+// artifactKinds 片段中出现的所有产物类型
+func artifactKinds(clips []*ClipMeta) []string {
+	kindSet := make(map[string]bool)
+	for _, clip := range clips {
+		for kind := range clip.Artifacts {
+			kindSet[kind] = true
+		}
+	}
+	kinds := make([]string, 0, len(kindSet))
+	for kind := range kindSet {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// selectEvictions 按保留策略选出需要淘汰的产物，clips按开始时间从旧到新排列
+func selectEvictions(clips []*ClipMeta, camera string, kind string, policy *RetentionPolicy, now time.Time) []*Eviction {
+	var candidates []*ClipMeta
+	var totalBytes int64
+	for _, clip := range clips {
+		if size, ok := clip.Artifacts[kind]; ok {
+			candidates = append(candidates, clip)
+			totalBytes += size
+		}
+	}
+
+	var evictions []*Eviction
+	evict := func(clip *ClipMeta, reason string) {
+		size := clip.Artifacts[kind]
+		totalBytes -= size
+		evictions = append(evictions, &Eviction{ClipID: clip.ID, Camera: camera, Kind: kind, Bytes: size, Reason: reason})
+	}
+
+	i := 0
+	if policy.MaxAge > 0 {
+		deadline := now.Add(-time.Duration(policy.MaxAge) * time.Second).UnixMilli()
+		for ; i < len(candidates) && candidates[i].End < deadline; i++ {
+			evict(candidates[i], EvictReasonAge)
+		}
+	}
+	if policy.MaxCount > 0 {
+		for ; int64(len(candidates)-i) > policy.MaxCount; i++ {
+			evict(candidates[i], EvictReasonCount)
+		}
+	}
+	if policy.MaxBytes > 0 {
+		for ; i < len(candidates) && totalBytes > policy.MaxBytes; i++ {
+			evict(candidates[i], EvictReasonBytes)
+		}
+	}
+	return evictions
+}
+
+// Janitor 后台定期执行保留策略
+type Janitor struct {
+	redisClient *RedisClient
+	interval    time.Duration
+	mutex       sync.Mutex
+	config      *RetentionConfig
+	onReport    func(report *RetentionReport)
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// NewJanitor 新建后台清理任务，onReport在每次执行后调用，可以为nil
+// interval小于等于0或config为nil时返回错误
+func NewJanitor(redisClient *RedisClient, config *RetentionConfig, interval time.Duration, onReport func(report *RetentionReport)) (*Janitor, error) {
+	janitor := &Janitor{
+		redisClient: redisClient,
+		interval:    interval,
+		config:      config,
+		onReport:    onReport,
+	}
+	if err := janitor.validate(); err != nil {
+		return nil, err
+	}
+	return janitor, nil
+}
+
+// validate 检查执行间隔和保留策略
+func (janitor *Janitor) validate() error {
+	if janitor.interval <= 0 {
+		return errors.New(fmt.Sprintf("保留策略的执行间隔必须大于0：%s", janitor.interval))
+	}
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+	if janitor.config == nil {
+		return errors.New("保留策略不能为空")
+	}
+	return nil
+}
+
+// SetConfig 更新保留策略，下次执行时生效，config为nil时返回错误并继续使用当前策略
+func (janitor *Janitor) SetConfig(config *RetentionConfig) error {
+	if config == nil {
+		return errors.New("保留策略不能为空")
+	}
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+	janitor.config = config
+	return nil
+}
+
+// RunOnce 立即执行一次保留策略
+func (janitor *Janitor) RunOnce() (*RetentionReport, error) {
+	janitor.mutex.Lock()
+	config := janitor.config
+	janitor.mutex.Unlock()
+
+	report, err := janitor.redisClient.EnforceRetention(config, time.Now())
+	if len(report.Evictions) > 0 || len(report.TrimmedLists) > 0 {
+		log.Printf("保留策略执行完成，淘汰%d个产物，共%d字节，裁剪%d个列表", len(report.Evictions), report.Bytes(), len(report.TrimmedLists))
+	}
+	if janitor.onReport != nil {
+		janitor.onReport(report)
+	}
+	return report, err
+}
+
+// Start 启动后台清理任务，执行间隔小于等于0或保留策略为nil时返回错误
+func (janitor *Janitor) Start() error {
+	if err := janitor.validate(); err != nil {
+		return err
+	}
+	janitor.stop = make(chan struct{})
+	janitor.done = make(chan struct{})
+	go func() {
+		defer close(janitor.done)
+		ticker := time.NewTicker(janitor.interval)
+		defer ticker.Stop()
+		for {
+			if _, err := janitor.RunOnce(); err != nil {
+				log.Println("保留策略执行失败:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-janitor.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop 停止后台清理任务，等待正在执行的清理完成
+func (janitor *Janitor) Stop() {
+	if janitor.stop == nil {
+		return
+	}
+	close(janitor.stop)
+	<-janitor.done
+	janitor.stop = nil
+}
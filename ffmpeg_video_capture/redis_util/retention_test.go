@@ -0,0 +1,158 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionConfigPolicy(t *testing.T) {
+	defaultPolicy := &RetentionPolicy{MaxCount: 10}
+	cameraPolicy := &RetentionPolicy{MaxCount: 3}
+	config := &RetentionConfig{
+		Default: map[string]*RetentionPolicy{"video": defaultPolicy},
+		Cameras: map[string]map[string]*RetentionPolicy{"cam1": {"video": cameraPolicy}},
+	}
+	tests := []struct {
+		camera string
+		kind   string
+		want   *RetentionPolicy
+	}{
+		{"cam1", "video", cameraPolicy},
+		{"cam2", "video", defaultPolicy},
+		{"cam1", "image", nil},
+	}
+	for _, test := range tests {
+		if got := config.Policy(test.camera, test.kind); got != test.want {
+			t.Errorf("Policy(%s, %s) = %v, want %v", test.camera, test.kind, got, test.want)
+		}
+	}
+}
+
+func TestSelectEvictions(t *testing.T) {
+	now := time.UnixMilli(1000000)
+	// 每个片段10秒，结束时间从旧到新
+	clip := func(id string, end int64, size int64) *ClipMeta {
+		return &ClipMeta{ID: id, Start: end - 10000, End: end, Artifacts: map[string]int64{"video": size}}
+	}
+	clips := []*ClipMeta{
+		clip("a", 100000, 100),
+		clip("b", 500000, 200),
+		{ID: "c", Start: 600000, End: 610000, Artifacts: map[string]int64{"image": 10}},
+		clip("d", 900000, 300),
+		clip("e", 990000, 400),
+	}
+	tests := []struct {
+		name   string
+		policy *RetentionPolicy
+		want   []*Eviction
+	}{
+		{"不限制", &RetentionPolicy{}, nil},
+		{"按时间", &RetentionPolicy{MaxAge: 200}, []*Eviction{
+			{ClipID: "a", Camera: "cam", Kind: "video", Bytes: 100, Reason: EvictReasonAge},
+			{ClipID: "b", Camera: "cam", Kind: "video", Bytes: 200, Reason: EvictReasonAge},
+		}},
+		{"按个数", &RetentionPolicy{MaxCount: 3}, []*Eviction{
+			{ClipID: "a", Camera: "cam", Kind: "video", Bytes: 100, Reason: EvictReasonCount},
+		}},
+		{"按字节数", &RetentionPolicy{MaxBytes: 700}, []*Eviction{
+			{ClipID: "a", Camera: "cam", Kind: "video", Bytes: 100, Reason: EvictReasonBytes},
+			{ClipID: "b", Camera: "cam", Kind: "video", Bytes: 200, Reason: EvictReasonBytes},
+		}},
+		{"组合", &RetentionPolicy{MaxAge: 800, MaxCount: 2, MaxBytes: 400}, []*Eviction{
+			{ClipID: "a", Camera: "cam", Kind: "video", Bytes: 100, Reason: EvictReasonAge},
+			{ClipID: "b", Camera: "cam", Kind: "video", Bytes: 200, Reason: EvictReasonCount},
+			{ClipID: "d", Camera: "cam", Kind: "video", Bytes: 300, Reason: EvictReasonBytes},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := selectEvictions(clips, "cam", "video", test.policy, now)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("selectEvictions() = %v, want %v", evictionValues(got), evictionValues(test.want))
+			}
+		})
+	}
+}
+
+// evictionValues 淘汰记录的值，便于输出比较结果
+func evictionValues(evictions []*Eviction) []Eviction {
+	values := make([]Eviction, 0, len(evictions))
+	for _, eviction := range evictions {
+		values = append(values, *eviction)
+	}
+	return values
+}
+
+func TestArtifactKinds(t *testing.T) {
+	clips := []*ClipMeta{
+		{Artifacts: map[string]int64{"video": 1, "image": 1}},
+		{Artifacts: map[string]int64{"audio": 1}},
+	}
+	want := []string{"audio", "image", "video"}
+	if got := artifactKinds(clips); !reflect.DeepEqual(got, want) {
+		t.Errorf("artifactKinds() = %v, want %v", got, want)
+	}
+}
+
+func TestNewJanitorInvalid(t *testing.T) {
+	config := &RetentionConfig{}
+	tests := []struct {
+		name     string
+		config   *RetentionConfig
+		interval time.Duration
+	}{
+		{"执行间隔为0", config, 0},
+		{"执行间隔小于0", config, -time.Second},
+		{"保留策略为nil", nil, time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewJanitor(nil, test.config, test.interval, nil); err == nil {
+				t.Error("NewJanitor应返回错误")
+			}
+			janitor := &Janitor{config: test.config, interval: test.interval}
+			if err := janitor.Start(); err == nil {
+				janitor.Stop()
+				t.Error("Start应返回错误")
+			}
+		})
+	}
+
+	janitor, err := NewJanitor(nil, config, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = janitor.SetConfig(nil); err == nil {
+		t.Error("SetConfig(nil)应返回错误")
+	}
+	if janitor.config != config {
+		t.Error("SetConfig(nil)后应继续使用当前策略")
+	}
+}
+
+func TestEnforceRetentionRemovesEmptyCamera(t *testing.T) {
+	memory := &memoryRedis{memoryChunkStore: newMemoryChunkStore()}
+	client := newMemoryRedisClient(memory, 10)
+	now := time.UnixMilli(10000000)
+	old := now.Add(-2 * time.Hour).UnixMilli()
+	saveTestClip(t, client, &ClipMeta{ID: "a:1", Camera: "a", Start: old, End: old + 1000}, testData(15))
+	saveTestClip(t, client, &ClipMeta{ID: "b:1", Camera: "b", Start: old, End: old + 1000}, testData(15))
+	saveTestClip(t, client, &ClipMeta{ID: "b:2", Camera: "b", Start: now.UnixMilli() - 1000, End: now.UnixMilli()}, testData(15))
+
+	config := &RetentionConfig{Default: map[string]*RetentionPolicy{ArtifactVideo: {MaxAge: 3600}}}
+	report, err := client.EnforceRetention(config, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Evictions) != 2 {
+		t.Errorf("淘汰记录 = %v", evictionValues(report.Evictions))
+	}
+	cameras, err := client.ListCameras()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(cameras, want) {
+		t.Errorf("淘汰后的摄像头 = %v, want %v", cameras, want)
+	}
+}
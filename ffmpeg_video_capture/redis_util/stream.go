@@ -0,0 +1,532 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClipEventStream 片段事件流的key，每个片段保存成功后写入一条事件
+const ClipEventStream = "clip:events"
+
+// ClipEventStreamMaxLen 片段事件流的最大长度(近似值)，消费者组未确认和未读取的事件不受限制
+const ClipEventStreamMaxLen = 100000
+
+// DefaultMaxDeliveries 消息默认最多投递次数，超过后转入死信流
+const DefaultMaxDeliveries = 5
+
+// DeadLetterStreamMaxLen 死信流的最大长度(近似值)
+const DeadLetterStreamMaxLen = 10000
+
+// DeadLetterStream 流对应的死信流的key
+func DeadLetterStream(stream string) string {
+	return stream + ":dead"
+}
+
+// StreamMessage 流中的一条消息
+type StreamMessage struct {
+	ID     string
+	Fields map[string]string
+}
+
+// ClipEvent 片段事件
+type ClipEvent struct {
+	MessageID string    // 消息ID，确认消息时使用
+	Meta      *ClipMeta // 片段元数据
+}
+
+// clipEventFields 片段事件的字段
+func clipEventFields(meta *ClipMeta, metaBytes []byte) []interface{} {
+	return []interface{}{
+		"id", meta.ID,
+		"camera", meta.Camera,
+		"start", meta.Start,
+		"end", meta.End,
+		"meta", metaBytes,
+	}
+}
+
+// XAdd 往流中添加消息，maxLen大于0时按TrimStream裁剪流的长度，返回消息ID
+func (redisClient *RedisClient) XAdd(stream string, maxLen int64, fields map[string]interface{}) (string, error) {
+	args := redis.Args{stream, "*"}
+	for field, value := range fields {
+		args = args.Add(field, value)
+	}
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	id, err := redis.String(conn.Do("XADD", args...))
+	if err != nil {
+		return "", err
+	}
+	if maxLen > 0 {
+		if err = redisClient.TrimStream(stream, maxLen); err != nil {
+			log.Printf("裁剪流%s失败: %s", stream, err)
+		}
+	}
+	return id, nil
+}
+
+// streamTrimBatch 超出最大长度的消息数达到最大长度的1/streamTrimBatch后才裁剪，避免每次写入都读取待裁剪的消息
+const streamTrimBatch = 100
+
+// TrimStream 裁剪流，只保留最新的maxLen条消息(近似值)
+// 按MINID裁剪，消费者组中未确认和尚未读取的消息不会被裁剪，此时流的长度可能超过maxLen
+func (redisClient *RedisClient) TrimStream(stream string, maxLen int64) error {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	length, err := redis.Int64(conn.Do("XLEN", stream))
+	if err != nil {
+		return err
+	}
+	excess := length - maxLen
+	if excess <= 0 || excess < maxLen/streamTrimBatch {
+		return nil
+	}
+	// 超出部分之后的第一条消息，之前的消息都可以裁剪
+	reply, err := conn.Do("XRANGE", stream, "-", "+", "COUNT", excess+1)
+	if err != nil {
+		return err
+	}
+	messages, err := parseStreamMessages(reply)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	minID := messages[len(messages)-1].ID
+
+	// 不能超过各消费者组最早的未确认消息和最后读取的消息
+	groupsReply, err := conn.Do("XINFO", "GROUPS", stream)
+	if err != nil {
+		return err
+	}
+	groups, err := parseStreamGroups(groupsReply)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		safeID := group.LastDeliveredID
+		if group.Pending > 0 {
+			summary, err := redis.Values(conn.Do("XPENDING", stream, group.Name))
+			if err != nil {
+				return err
+			}
+			if len(summary) < 2 {
+				return errors.New("解析XPENDING结果失败")
+			}
+			if safeID, err = redis.String(summary[1], nil); err != nil {
+				return err
+			}
+		}
+		if compareStreamID(safeID, minID) < 0 {
+			minID = safeID
+		}
+	}
+	_, err = conn.Do("XTRIM", stream, "MINID", "~", minID)
+	return err
+}
+
+// StreamGroup 消费者组信息
+type StreamGroup struct {
+	Name            string
+	Pending         int64  // 未确认的消息数
+	LastDeliveredID string // 最后读取的消息ID
+}
+
+// parseStreamGroups 解析XINFO GROUPS的结果，每个消费者组为[field, value, ...]格式
+func parseStreamGroups(reply interface{}) ([]*StreamGroup, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*StreamGroup, 0, len(entries))
+	for _, entry := range entries {
+		values, err := redis.Values(entry, nil)
+		if err != nil || len(values)%2 != 0 {
+			return nil, errors.New(fmt.Sprintf("解析消费者组信息失败: %v", err))
+		}
+		group := &StreamGroup{}
+		for i := 0; i < len(values); i += 2 {
+			field, err := redis.String(values[i], nil)
+			if err != nil {
+				return nil, err
+			}
+			switch field {
+			case "name":
+				group.Name, err = redis.String(values[i+1], nil)
+			case "pending":
+				group.Pending, err = redis.Int64(values[i+1], nil)
+			case "last-delivered-id":
+				group.LastDeliveredID, err = redis.String(values[i+1], nil)
+			}
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("解析消费者组字段%s失败: %s", field, err))
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// compareStreamID 比较两个流消息ID的先后，a在b之前返回-1，相同返回0，之后返回1
+// ID格式为"毫秒时间戳-序号"，无法解析的部分按0处理
+func compareStreamID(a, b string) int {
+	aTime, aSeq := splitStreamID(a)
+	bTime, bSeq := splitStreamID(b)
+	switch {
+	case aTime < bTime || (aTime == bTime && aSeq < bSeq):
+		return -1
+	case aTime == bTime && aSeq == bSeq:
+		return 0
+	}
+	return 1
+}
+
+// splitStreamID 将流消息ID拆分为毫秒时间戳和序号
+func splitStreamID(id string) (uint64, uint64) {
+	timePart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(timePart, 10, 64)
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
+
+// XGroupCreate 创建消费者组，流不存在时自动创建，消费者组已存在时不报错
+// start为"$"表示只消费新消息，"0"表示从头消费
+func (redisClient *RedisClient) XGroupCreate(stream string, group string, start string) error {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("XGROUP", "CREATE", stream, group, start, "MKSTREAM"); err != nil {
+		if strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// XReadGroup 以消费者组的方式读取新消息，block大于0时阻塞等待，超时返回空列表
+func (redisClient *RedisClient) XReadGroup(stream string, group string, consumer string, count int, block time.Duration) ([]*StreamMessage, error) {
+	args := redis.Args{"GROUP", group, consumer, "COUNT", count}
+	if block > 0 {
+		args = args.Add("BLOCK", block.Milliseconds())
+	}
+	args = args.Add("STREAMS", stream, ">")
+
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("XREADGROUP", args...))
+	if err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var messages []*StreamMessage
+	for _, streamReply := range reply {
+		streamValues, err := redis.Values(streamReply, nil)
+		if err != nil || len(streamValues) != 2 {
+			return nil, errors.New(fmt.Sprintf("解析流数据失败: %v", err))
+		}
+		streamMessages, err := parseStreamMessages(streamValues[1])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, streamMessages...)
+	}
+	return messages, nil
+}
+
+// XAck 确认消息已处理
+func (redisClient *RedisClient) XAck(stream string, group string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("XACK", redis.Args{stream, group}.AddFlat(ids)...)
+	return err
+}
+
+// XAutoClaim 将消费者组中空闲超过minIdle的未确认消息转移给consumer，返回下次扫描的起始ID和转移的消息
+func (redisClient *RedisClient) XAutoClaim(stream string, group string, consumer string, minIdle time.Duration, start string, count int) (string, []*StreamMessage, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("XAUTOCLAIM", stream, group, consumer, minIdle.Milliseconds(), start, "COUNT", count))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) < 2 {
+		return "", nil, errors.New("解析XAUTOCLAIM结果失败")
+	}
+	next, err := redis.String(reply[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	messages, err := parseStreamMessages(reply[1])
+	if err != nil {
+		return "", nil, err
+	}
+	return next, messages, nil
+}
+
+// XClaimJustID 将消息转移给consumer并重置空闲时间，不增加投递次数
+// 消费者处理耗时较长时定期调用，避免消息被其他消费者当作空闲消息认领
+func (redisClient *RedisClient) XClaimJustID(stream string, group string, consumer string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	args := redis.Args{stream, group, consumer, 0}.AddFlat(ids).Add("JUSTID")
+	_, err := conn.Do("XCLAIM", args...)
+	return err
+}
+
+// promoteDelayedScript 将有序集合中到期的成员写入流并删除，在脚本中执行保证不会重复写入或丢失
+var promoteDelayedScript = redis.NewScript(2, `
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(members) do
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('XADD', KEYS[2], '*', ARGV[3], member)
+end
+return #members
+`)
+
+// PromoteDelayed 延迟队列，将有序集合zsetKey中分数不大于now的成员作为field字段写入流，最多count个，返回写入的个数
+// 成员通过ZAdd以到期时间为分数加入有序集合
+func (redisClient *RedisClient) PromoteDelayed(zsetKey string, stream string, field string, now int64, count int) (int, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	return redis.Int(promoteDelayedScript.Do(conn, zsetKey, stream, now, count, field))
+}
+
+// PendingMessage 消费者组中未确认的消息
+type PendingMessage struct {
+	ID         string
+	Consumer   string        // 当前持有消息的消费者
+	Idle       time.Duration // 空闲时间
+	Deliveries int64         // 已投递次数
+}
+
+// XPending 列出消费者组中空闲超过minIdle的未确认消息，最多count条
+func (redisClient *RedisClient) XPending(stream string, group string, minIdle time.Duration, count int) ([]*PendingMessage, error) {
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("XPENDING", stream, group, "IDLE", minIdle.Milliseconds(), "-", "+", count))
+	if err != nil {
+		return nil, err
+	}
+	return parsePendingMessages(reply)
+}
+
+// parsePendingMessages 解析[[id, consumer, idle, deliveries], ...]格式的未确认消息列表
+func parsePendingMessages(reply []interface{}) ([]*PendingMessage, error) {
+	messages := make([]*PendingMessage, 0, len(reply))
+	for _, entry := range reply {
+		values, err := redis.Values(entry, nil)
+		if err != nil || len(values) != 4 {
+			return nil, errors.New(fmt.Sprintf("解析未确认消息失败: %v", err))
+		}
+		message := &PendingMessage{}
+		if message.ID, err = redis.String(values[0], nil); err != nil {
+			return nil, err
+		}
+		if message.Consumer, err = redis.String(values[1], nil); err != nil {
+			return nil, err
+		}
+		idle, err := redis.Int64(values[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		message.Idle = time.Duration(idle) * time.Millisecond
+		if message.Deliveries, err = redis.Int64(values[3], nil); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// DeadLetterPending 将空闲超过minIdle且投递次数达到maxDeliveries的未确认消息转入死信流并确认，返回转入的消息数
+// 死信流中保留原消息的字段，另外记录原消息ID、消费者组和投递次数
+func (redisClient *RedisClient) DeadLetterPending(stream string, group string, minIdle time.Duration, maxDeliveries int64, count int) (int, error) {
+	pending, err := redisClient.XPending(stream, group, minIdle, count)
+	if err != nil {
+		return 0, err
+	}
+	conn := redisClient.redisPool.Get()
+	defer conn.Close()
+	deadLetters := 0
+	for _, message := range pending {
+		if message.Deliveries < maxDeliveries {
+			continue
+		}
+		reply, err := conn.Do("XRANGE", stream, message.ID, message.ID)
+		if err != nil {
+			return deadLetters, err
+		}
+		messages, err := parseStreamMessages(reply)
+		if err != nil {
+			return deadLetters, err
+		}
+		args := redis.Args{DeadLetterStream(stream), "MAXLEN", "~", DeadLetterStreamMaxLen, "*"}
+		// 原消息已被裁剪时只记录ID
+		if len(messages) > 0 {
+			for field, value := range messages[0].Fields {
+				args = args.Add(field, value)
+			}
+		}
+		args = args.Add("source_id", message.ID, "group", group, "deliveries", message.Deliveries)
+		if err = conn.Send("MULTI"); err != nil {
+			return deadLetters, err
+		}
+		if err = conn.Send("XADD", args...); err != nil {
+			return deadLetters, err
+		}
+		if err = conn.Send("XACK", stream, group, message.ID); err != nil {
+			return deadLetters, err
+		}
+		if _, err = conn.Do("EXEC"); err != nil {
+			return deadLetters, err
+		}
+		log.Printf("消息投递%d次仍未确认，转入死信流，流：%s，消费者组：%s，消息ID：%s", message.Deliveries, stream, group, message.ID)
+		deadLetters++
+	}
+	return deadLetters, nil
+}
+
+// parseStreamMessages 解析[[id, [field, value, ...]], ...]格式的消息列表
+func parseStreamMessages(reply interface{}) ([]*StreamMessage, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*StreamMessage, 0, len(entries))
+	for _, entry := range entries {
+		entryValues, err := redis.Values(entry, nil)
+		if err != nil || len(entryValues) != 2 {
+			return nil, errors.New(fmt.Sprintf("解析流消息失败: %v", err))
+		}
+		id, err := redis.String(entryValues[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		message := &StreamMessage{ID: id, Fields: make(map[string]string)}
+		// 已被删除的消息字段为nil
+		if entryValues[1] != nil {
+			fields, err := redis.StringMap(entryValues[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			message.Fields = fields
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// ParseClipEvent 将流消息解析为片段事件
+func ParseClipEvent(message *StreamMessage) (*ClipEvent, error) {
+	metaJson, ok := message.Fields["meta"]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("消息缺少片段元数据，消息ID：%s", message.ID))
+	}
+	meta := &ClipMeta{}
+	if err := json.Unmarshal([]byte(metaJson), meta); err != nil {
+		return nil, err
+	}
+	return &ClipEvent{MessageID: message.ID, Meta: meta}, nil
+}
+
+// ClipConsumer 片段事件消费者
+// 同一消费者组内的多个消费者共同消费，每个片段只会被组内的一个消费者处理；不同的消费者组各自收到全部片段
+// 处理成功后确认消息，处理失败的消息保留在待处理列表中，空闲超过ClaimIdle后被重新认领处理
+// 投递MaxDeliveries次仍未确认的消息转入死信流DeadLetterStream(Stream)，不再重新认领
+type ClipConsumer struct {
+	redisClient   *RedisClient
+	Stream        string        // 事件流，默认为ClipEventStream
+	Group         string        // 消费者组，如asr、analytics、archive
+	Consumer      string        // 消费者名称，组内唯一
+	Count         int           // 每次读取的消息数
+	Block         time.Duration // 读取阻塞等待时间
+	ClaimIdle     time.Duration // 未确认消息空闲多久后重新认领，为0时不认领
+	MaxDeliveries int64         // 最多投递次数，为0时不限制
+}
+
+// NewClipConsumer 新建片段事件消费者
+func NewClipConsumer(redisClient *RedisClient, group string, consumer string) *ClipConsumer {
+	return &ClipConsumer{
+		redisClient:   redisClient,
+		Stream:        ClipEventStream,
+		Group:         group,
+		Consumer:      consumer,
+		Count:         10,
+		Block:         5 * time.Second,
+		ClaimIdle:     5 * time.Minute,
+		MaxDeliveries: DefaultMaxDeliveries,
+	}
+}
+
+// Run 持续消费片段事件，直到ctx被取消
+func (consumer *ClipConsumer) Run(ctx context.Context, handler func(event *ClipEvent) error) error {
+	if err := consumer.redisClient.XGroupCreate(consumer.Stream, consumer.Group, "0"); err != nil {
+		return errors.New(fmt.Sprintf("创建消费者组失败: %s", err))
+	}
+	claimStart := "0-0"
+	lastClaim := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		messages, err := consumer.redisClient.XReadGroup(consumer.Stream, consumer.Group, consumer.Consumer, consumer.Count, consumer.Block)
+		if err != nil {
+			return errors.New(fmt.Sprintf("读取片段事件失败: %s", err))
+		}
+
+		// 定期认领其他消费者未确认的消息，以及自己处理失败的消息
+		if consumer.ClaimIdle > 0 && time.Since(lastClaim) >= consumer.ClaimIdle {
+			// 反复处理失败的消息先转入死信流，不再认领
+			if consumer.MaxDeliveries > 0 {
+				if _, err = consumer.redisClient.DeadLetterPending(consumer.Stream, consumer.Group, consumer.ClaimIdle, consumer.MaxDeliveries, consumer.Count); err != nil {
+					return errors.New(fmt.Sprintf("片段事件转入死信流失败: %s", err))
+				}
+			}
+			var claimed []*StreamMessage
+			claimStart, claimed, err = consumer.redisClient.XAutoClaim(consumer.Stream, consumer.Group, consumer.Consumer, consumer.ClaimIdle, claimStart, consumer.Count)
+			if err != nil {
+				return errors.New(fmt.Sprintf("认领未确认的片段事件失败: %s", err))
+			}
+			messages = append(messages, claimed...)
+			lastClaim = time.Now()
+		}
+
+		for _, message := range messages {
+			event, err := ParseClipEvent(message)
+			if err != nil {
+				// 无法解析的消息直接确认，避免反复处理
+				log.Printf("解析片段事件失败，消息ID：%s，%s", message.ID, err)
+				if err = consumer.redisClient.XAck(consumer.Stream, consumer.Group, message.ID); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = handler(event); err != nil {
+				log.Printf("处理片段事件失败，片段ID：%s，%s", event.Meta.ID, err)
+				continue
+			}
+			if err = consumer.redisClient.XAck(consumer.Stream, consumer.Group, message.ID); err != nil {
+				return errors.New(fmt.Sprintf("确认片段事件失败: %s", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompareStreamID(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1-0", "1-0", 0},
+		{"1-0", "2-0", -1},
+		{"2-0", "1-5", 1},
+		{"1526919030474-55", "1526919030474-9", 1},
+		{"9-0", "10-0", -1},
+		{"0-0", "1-0", -1},
+	}
+	for _, test := range tests {
+		if got := compareStreamID(test.a, test.b); got != test.want {
+			t.Errorf("compareStreamID(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestParseStreamGroups(t *testing.T) {
+	// redis返回的字符串为[]byte，整数为int64
+	reply := []interface{}{
+		[]interface{}{
+			[]byte("name"), []byte("asr"),
+			[]byte("consumers"), int64(2),
+			[]byte("pending"), int64(3),
+			[]byte("last-delivered-id"), []byte("1700000000000-1"),
+		},
+		[]interface{}{
+			[]byte("name"), []byte("archive"),
+			[]byte("pending"), int64(0),
+			[]byte("last-delivered-id"), []byte("0-0"),
+		},
+	}
+	groups, err := parseStreamGroups(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*StreamGroup{
+		{Name: "asr", Pending: 3, LastDeliveredID: "1700000000000-1"},
+		{Name: "archive", Pending: 0, LastDeliveredID: "0-0"},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("parseStreamGroups() = %+v, want %+v", groups, want)
+	}
+
+	if _, err = parseStreamGroups([]interface{}{[]interface{}{[]byte("name")}}); err == nil {
+		t.Error("字段个数为奇数时应返回错误")
+	}
+}
+
+func TestParsePendingMessages(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{[]byte("1-0"), []byte("worker-1"), int64(1500), int64(4)},
+	}
+	messages, err := parsePendingMessages(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*PendingMessage{{ID: "1-0", Consumer: "worker-1", Idle: 1500 * time.Millisecond, Deliveries: 4}}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("parsePendingMessages() = %+v, want %+v", messages, want)
+	}
+}
+
+func TestParseStreamMessages(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{[]byte("1-0"), []interface{}{[]byte("id"), []byte("cam:1"), []byte("meta"), []byte(`{"id":"cam:1","camera":"cam"}`)}},
+		// 已被删除的消息字段为nil
+		[]interface{}{[]byte("2-0"), nil},
+	}
+	messages, err := parseStreamMessages(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != "1-0" || messages[0].Fields["id"] != "cam:1" || len(messages[1].Fields) != 0 {
+		t.Fatalf("parseStreamMessages() = %+v", messages)
+	}
+
+	event, err := ParseClipEvent(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.MessageID != "1-0" || event.Meta.ID != "cam:1" || event.Meta.Camera != "cam" {
+		t.Errorf("ParseClipEvent() = %+v", event)
+	}
+	if _, err = ParseClipEvent(messages[1]); err == nil {
+		t.Error("缺少元数据的消息应返回错误")
+	}
+}
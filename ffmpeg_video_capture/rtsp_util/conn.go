@@ -0,0 +1,410 @@
+package rtsputil
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 支持的RTSP方法
+const publicMethods = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER, SET_PARAMETER"
+
+// 会话超时时间，单位秒，客户端按此间隔发送保活请求
+const sessionTimeout = 60
+
+// transport 一个媒体流的传输方式
+type transport struct {
+	tcp        bool
+	channel    int          // TCP交织的RTP通道，RTCP为channel+1
+	clientRtp  int          // UDP传输时客户端的RTP端口
+	clientRtcp int          // UDP传输时客户端的RTCP端口
+	rtpAddr    *net.UDPAddr // UDP传输时客户端的RTP地址
+	rtcpAddr   *net.UDPAddr // UDP传输时客户端的RTCP地址
+}
+
+// request RTSP请求
+type request struct {
+	method string
+	url    *neturl.URL
+	header textproto.MIMEHeader
+}
+
+// response RTSP响应
+type response struct {
+	status  int
+	reason  string
+	headers [][2]string
+	body    string
+}
+
+// conn 一个客户端的RTSP控制连接，会话与连接绑定，连接断开时停止播放
+type conn struct {
+	server     *Server
+	netConn    net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex // 响应和TCP交织数据的写入互斥
+	session    string
+	source     *source
+	tracks     map[int]*transport
+	viewer     *viewer
+	stopped    chan struct{} // 停止播放时关闭
+}
+
+func newConn(server *Server, netConn net.Conn) *conn {
+	return &conn{
+		server:  server,
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		tracks:  make(map[int]*transport),
+	}
+}
+
+// serve 处理请求直到连接关闭或TEARDOWN
+func (c *conn) serve() {
+	defer c.netConn.Close()
+	defer c.stop()
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("RTSP读取请求失败，客户端：%s，%s", c.netConn.RemoteAddr(), err)
+			}
+			return
+		}
+		var resp *response
+		switch req.method {
+		case "OPTIONS":
+			resp = &response{status: 200, headers: [][2]string{{"Public", publicMethods}}}
+		case "DESCRIBE":
+			resp = c.describe(req)
+		case "SETUP":
+			resp = c.setup(req)
+		case "PLAY":
+			resp = c.play()
+		case "TEARDOWN":
+			c.stop()
+			c.writeResponse(req, &response{status: 200})
+			return
+		case "GET_PARAMETER", "SET_PARAMETER":
+			// 保活请求
+			resp = &response{status: 200}
+		default:
+			resp = &response{status: 405, headers: [][2]string{{"Allow", publicMethods}}}
+		}
+		if err = c.writeResponse(req, resp); err != nil {
+			return
+		}
+	}
+}
+
+// readRequest 读取一个请求，跳过客户端通过TCP交织发送的RTCP包
+func (c *conn) readRequest() (*request, error) {
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		header := make([]byte, 4)
+		if _, err = io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		if _, err = c.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, errors.New(fmt.Sprintf("RTSP请求格式错误：%s", line))
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		if _, err = c.reader.Discard(length); err != nil {
+			return nil, err
+		}
+	}
+	u, err := neturl.Parse(parts[1])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("RTSP请求地址格式错误：%s", parts[1]))
+	}
+	return &request{method: parts[0], url: u, header: header}, nil
+}
+
+// writeResponse 写入响应，CSeq与请求相同
+func (c *conn) writeResponse(req *request, resp *response) error {
+	if resp.reason == "" {
+		resp.reason = statusText[resp.status]
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", resp.status, resp.reason)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	b.WriteString("Server: ffmpeg_video_capture\r\n")
+	if c.session != "" && resp.status == 200 {
+		fmt.Fprintf(&b, "Session: %s;timeout=%d\r\n", c.session, sessionTimeout)
+	}
+	for _, header := range resp.headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", header[0], header[1])
+	}
+	if resp.body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(resp.body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(resp.body)
+	return c.write([]byte(b.String()))
+}
+
+// write 写入连接，客户端长时间不读取时断开
+func (c *conn) write(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.netConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.netConn.Write(data)
+	return err
+}
+
+// 响应状态码对应的原因
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	503: "Service Unavailable",
+}
+
+// camera 请求地址中的摄像头名称和媒体流序号，没有trackID时序号为-1
+func camera(u *neturl.URL) (string, int) {
+	name := strings.Trim(u.Path, "/")
+	track := -1
+	if i := strings.LastIndex(name, "/"); i >= 0 && strings.HasPrefix(name[i+1:], "trackID=") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(name[i+1:], "trackID=")); err == nil {
+			track = n
+			name = name[:i]
+		}
+	}
+	return name, track
+}
+
+// describe 返回摄像头的会话描述，第一次请求时开始拉流
+func (c *conn) describe(req *request) *response {
+	name, _ := camera(req.url)
+	s, err := c.acquire(name)
+	if err != nil {
+		return &response{status: 404, body: err.Error()}
+	}
+	base := *req.url
+	base.Path = "/" + name + "/"
+	return &response{
+		status: 200,
+		headers: [][2]string{
+			{"Content-Type", "application/sdp"},
+			{"Content-Base", base.String()},
+		},
+		body: s.init.Sdp,
+	}
+}
+
+// acquire 获取摄像头的拉流，同一连接只能播放一个摄像头
+func (c *conn) acquire(name string) (*source, error) {
+	if c.source != nil && c.source.camera == name {
+		select {
+		case <-c.source.done:
+		default:
+			return c.source, nil
+		}
+	}
+	if c.viewer != nil {
+		return nil, errors.New("连接正在播放其他摄像头")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), describeTimeout)
+	defer cancel()
+	s, err := c.server.acquire(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	c.source = s
+	c.tracks = make(map[int]*transport)
+	return s, nil
+}
+
+// setup 设置一个媒体流的传输方式
+func (c *conn) setup(req *request) *response {
+	if c.viewer != nil {
+		return &response{status: 455}
+	}
+	name, track := camera(req.url)
+	if track < 0 {
+		// 只有一个媒体流时客户端可能直接使用会话地址
+		track = 0
+	}
+	s, err := c.acquire(name)
+	if err != nil {
+		return &response{status: 404, body: err.Error()}
+	}
+	if track >= s.init.Tracks {
+		return &response{status: 404, body: fmt.Sprintf("媒体流不存在：%d", track)}
+	}
+	t, err := c.parseTransport(req.header.Get("Transport"), track)
+	if err != nil {
+		return &response{status: 461, body: err.Error()}
+	}
+	c.tracks[track] = t
+	if c.session == "" {
+		id := make([]byte, 8)
+		_, _ = rand.Read(id)
+		c.session = hex.EncodeToString(id)
+	}
+
+	value := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", t.channel, t.channel+1)
+	if !t.tcp {
+		value = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", t.clientRtp, t.clientRtcp, c.server.udpPort, c.server.udpPort+1)
+	}
+	return &response{status: 200, headers: [][2]string{{"Transport", value}}}
+}
+
+// parseTransport 解析Transport头，客户端列出多种方式时使用第一种支持的
+func (c *conn) parseTransport(value string, track int) (*transport, error) {
+	for _, spec := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(spec), ";")
+		protocol := strings.ToUpper(fields[0])
+		if protocol != "RTP/AVP" && protocol != "RTP/AVP/UDP" && protocol != "RTP/AVP/TCP" {
+			continue
+		}
+		t := &transport{tcp: protocol == "RTP/AVP/TCP", channel: track * 2}
+		multicast := false
+		for _, field := range fields[1:] {
+			key, param, _ := strings.Cut(field, "=")
+			switch strings.ToLower(key) {
+			case "interleaved":
+				first, _, _ := strings.Cut(param, "-")
+				if n, err := strconv.Atoi(first); err == nil && n >= 0 && n < 255 {
+					t.channel = n
+				}
+			case "client_port":
+				first, second, ok := strings.Cut(param, "-")
+				t.clientRtp, _ = strconv.Atoi(first)
+				t.clientRtcp = t.clientRtp + 1
+				if ok {
+					t.clientRtcp, _ = strconv.Atoi(second)
+				}
+			case "multicast":
+				multicast = true
+			}
+		}
+		if multicast {
+			continue
+		}
+		if !t.tcp {
+			if c.server.udpRtp == nil || t.clientRtp <= 0 {
+				continue
+			}
+			addr, ok := c.netConn.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+			ip := addr.IP
+			t.rtpAddr = &net.UDPAddr{IP: ip, Port: t.clientRtp}
+			t.rtcpAddr = &net.UDPAddr{IP: ip, Port: t.clientRtcp}
+		}
+		return t, nil
+	}
+	return nil, errors.New(fmt.Sprintf("不支持的传输方式：%s", value))
+}
+
+// play 开始播放已设置的媒体流
+func (c *conn) play() *response {
+	if c.source == nil || len(c.tracks) == 0 {
+		return &response{status: 455}
+	}
+	if c.viewer != nil {
+		// 播放中重复PLAY，不支持暂停和拖动
+		return &response{status: 200, headers: [][2]string{{"Range", "npt=0.000-"}}}
+	}
+	tracks := make(map[int]*transport, len(c.tracks))
+	for track, t := range c.tracks {
+		tracks[track] = t
+	}
+	c.viewer = c.server.join(c.source)
+	c.stopped = make(chan struct{})
+	go c.send(c.source, c.viewer, tracks, c.stopped)
+	return &response{status: 200, headers: [][2]string{{"Range", "npt=0.000-"}}}
+}
+
+// send 将RTP包发送给客户端，拉流结束、客户端接收过慢或写入失败时断开连接
+func (c *conn) send(s *source, v *viewer, tracks map[int]*transport, stopped chan struct{}) {
+	for {
+		select {
+		case packet := <-v.packets:
+			t, ok := tracks[packet.Track]
+			if !ok {
+				continue
+			}
+			var err error
+			switch {
+			case t.tcp:
+				channel := t.channel
+				if packet.Rtcp {
+					channel++
+				}
+				frame := make([]byte, 4, 4+len(packet.Data))
+				frame[0], frame[1] = '$', byte(channel)
+				binary.BigEndian.PutUint16(frame[2:], uint16(len(packet.Data)))
+				err = c.write(append(frame, packet.Data...))
+			case packet.Rtcp:
+				_, err = c.server.udpRtcp.WriteToUDP(packet.Data, t.rtcpAddr)
+			default:
+				_, err = c.server.udpRtp.WriteToUDP(packet.Data, t.rtpAddr)
+			}
+			if err != nil {
+				c.netConn.Close()
+				return
+			}
+		case <-v.dropped:
+			log.Printf("RTSP客户端接收过慢，已断开，摄像头：%s，客户端：%s", s.camera, c.netConn.RemoteAddr())
+			c.netConn.Close()
+			return
+		case <-s.done:
+			c.netConn.Close()
+			return
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// stop 停止播放
+func (c *conn) stop() {
+	if c.viewer == nil {
+		return
+	}
+	c.server.leave(c.source, c.viewer)
+	close(c.stopped)
+	c.viewer = nil
+}
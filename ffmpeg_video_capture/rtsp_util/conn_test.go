@@ -0,0 +1,128 @@
+package rtsputil
+
+import (
+	"bufio"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"net"
+	neturl "net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRequest(t *testing.T) {
+	data := "$\x01\x00\x03abc" + // 客户端通过TCP交织发送的RTCP包
+		"SET_PARAMETER rtsp://host/cam RTSP/1.0\r\nCSeq: 2\r\nContent-Length: 5\r\n\r\nhello" +
+		"DESCRIBE rtsp://host/cam RTSP/1.0\r\nCSeq: 3\r\nAccept: application/sdp\r\n\r\n" +
+		"PLAY rtsp://host/cam\r\n\r\n"
+	c := &conn{reader: bufio.NewReader(strings.NewReader(data))}
+
+	for _, want := range []struct{ method, cseq string }{{"SET_PARAMETER", "2"}, {"DESCRIBE", "3"}} {
+		req, err := c.readRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.method != want.method || req.header.Get("CSeq") != want.cseq || req.url.Path != "/cam" {
+			t.Errorf("readRequest() = %s %s CSeq %s", req.method, req.url, req.header.Get("CSeq"))
+		}
+	}
+	if _, err := c.readRequest(); err == nil || !strings.Contains(err.Error(), "格式错误") {
+		t.Errorf("缺少版本的请求行应返回格式错误: %v", err)
+	}
+}
+
+// remoteConn 只用于提供客户端地址的连接
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestParseTransport(t *testing.T) {
+	clientIp := net.IPv4(192, 168, 1, 20)
+	udpServer := NewServer(nil, nil)
+	udpServer.udpRtp = &net.UDPConn{}
+	tests := []struct {
+		name   string
+		server *Server
+		value  string
+		track  int
+		want   *transport
+	}{
+		{"TCP交织", udpServer, "RTP/AVP/TCP;unicast;interleaved=4-5", 1, &transport{tcp: true, channel: 4}},
+		{"TCP默认通道", udpServer, "RTP/AVP/TCP;unicast", 1, &transport{tcp: true, channel: 2}},
+		{"UDP", udpServer, "RTP/AVP;unicast;client_port=5000-5001", 0, &transport{
+			clientRtp: 5000, clientRtcp: 5001,
+			rtpAddr:  &net.UDPAddr{IP: clientIp, Port: 5000},
+			rtcpAddr: &net.UDPAddr{IP: clientIp, Port: 5001},
+		}},
+		// 只支持TCP时跳过UDP，使用下一种方式
+		{"不支持UDP", NewServer(nil, &Options{UdpPort: -1}), "RTP/AVP;unicast;client_port=5000-5001,RTP/AVP/TCP;unicast;interleaved=0-1", 0, &transport{tcp: true, channel: 0}},
+		{"跳过组播", udpServer, "RTP/AVP;multicast,RTP/AVP/TCP;interleaved=2-3", 0, &transport{tcp: true, channel: 2}},
+		{"不支持的传输方式", udpServer, "RAW/RAW/UDP;unicast", 0, nil},
+		{"UDP缺少端口", udpServer, "RTP/AVP;unicast", 0, nil},
+	}
+	for _, test := range tests {
+		c := &conn{server: test.server, netConn: remoteConn{addr: &net.TCPAddr{IP: clientIp, Port: 40000}}}
+		got, err := c.parseTransport(test.value, test.track)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: parseTransport() = %+v，应返回错误", test.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseTransport() = %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestCamera(t *testing.T) {
+	tests := []struct {
+		url   string
+		name  string
+		track int
+	}{
+		{"rtsp://host:8554/camera1", "camera1", -1},
+		{"rtsp://host:8554/camera1/", "camera1", -1},
+		{"rtsp://host:8554/camera1/trackID=1", "camera1", 1},
+		{"rtsp://host:8554/group/camera1", "group/camera1", -1},
+		{"rtsp://host:8554/camera1/trackID=x", "camera1/trackID=x", -1},
+	}
+	for _, test := range tests {
+		u, err := neturl.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, track := camera(u); name != test.name || track != test.track {
+			t.Errorf("camera(%s) = %s, %d, want %s, %d", test.url, name, track, test.name, test.track)
+		}
+	}
+}
+
+func TestSourceOnPacket(t *testing.T) {
+	s := &source{viewers: make(map[*viewer]struct{})}
+	fast := &viewer{packets: make(chan *ffmpegutil.RtpPacket, 4), dropped: make(chan struct{})}
+	slow := &viewer{packets: make(chan *ffmpegutil.RtpPacket, 1), dropped: make(chan struct{})}
+	s.viewers[fast] = struct{}{}
+	s.viewers[slow] = struct{}{}
+
+	// 关键帧之前的包不发送，缓冲满的客户端被断开
+	for _, keyframe := range []bool{false, true, false} {
+		_ = s.onPacket(&ffmpegutil.RtpPacket{Keyframe: keyframe})
+	}
+	if len(fast.packets) != 2 || !fast.started {
+		t.Errorf("客户端收到%d个包", len(fast.packets))
+	}
+	select {
+	case <-slow.dropped:
+	default:
+		t.Error("缓冲满的客户端应被断开")
+	}
+	if _, ok := s.viewers[slow]; ok || len(s.viewers) != 1 {
+		t.Errorf("断开后仍有%d个客户端", len(s.viewers))
+	}
+}
@@ -0,0 +1,161 @@
+package rtsputil
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 转发服务的默认参数
+const (
+	DefaultIdle    = 30 * time.Second // 最后一个客户端断开后保持拉流的时间
+	DefaultUdpPort = 8000             // UDP传输的RTP端口，RTCP为端口+1
+)
+
+// Options 转发服务参数
+type Options struct {
+	Idle    time.Duration // 最后一个客户端断开后保持拉流的时间，为0时为30秒
+	UdpPort int           // UDP传输的服务端RTP端口，RTCP为UdpPort+1，为0时为8000，小于0时只支持TCP
+}
+
+// Server 内置RTSP转发服务，每个摄像头只拉一次流，转发给任意个RTSP客户端
+// 播放地址为rtsp://{addr}/{camera}，支持TCP交织(RTP/AVP/TCP)和UDP(RTP/AVP)传输，不做鉴权，只应在内网使用
+// 直接复制视频和音频，不转码；录制、分析等本地程序使用转发地址拉流即可共用摄像头连接
+type Server struct {
+	mutex    sync.Mutex
+	cameras  map[string]string // 摄像头 -> 拉流地址
+	sources  map[string]*source
+	conns    map[*conn]struct{}
+	idle     time.Duration
+	udpPort  int
+	udpRtp   *net.UDPConn // UDP传输的RTP端口，只支持TCP时为nil
+	udpRtcp  *net.UDPConn
+	listener net.Listener
+	closed   bool
+}
+
+// NewServer 新建RTSP转发服务，cameras为摄像头到拉流地址的映射
+func NewServer(cameras map[string]string, opts *Options) *Server {
+	options := Options{}
+	if opts != nil {
+		options = *opts
+	}
+	if options.Idle <= 0 {
+		options.Idle = DefaultIdle
+	}
+	if options.UdpPort == 0 {
+		options.UdpPort = DefaultUdpPort
+	}
+	return &Server{
+		cameras: cameras,
+		sources: make(map[string]*source),
+		conns:   make(map[*conn]struct{}),
+		idle:    options.Idle,
+		udpPort: options.UdpPort,
+	}
+}
+
+// SetCameras 更新摄像头地址，地址修改或删除的摄像头停止拉流，客户端重新连接后使用新地址
+func (server *Server) SetCameras(cameras map[string]string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for camera, s := range server.sources {
+		if rtspUrl, ok := cameras[camera]; !ok || rtspUrl != server.cameras[camera] {
+			delete(server.sources, camera)
+			s.cancel()
+		}
+	}
+	server.cameras = cameras
+}
+
+// ListenAndServe 监听TCP地址(如:8554)和UDP端口，处理RTSP请求，Close后返回nil
+func (server *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.New(fmt.Sprintf("RTSP监听失败: %s", err))
+	}
+	if server.udpPort > 0 {
+		if server.udpRtp, err = net.ListenUDP("udp", &net.UDPAddr{Port: server.udpPort}); err != nil {
+			listener.Close()
+			return errors.New(fmt.Sprintf("RTSP监听UDP端口%d失败: %s", server.udpPort, err))
+		}
+		if server.udpRtcp, err = net.ListenUDP("udp", &net.UDPAddr{Port: server.udpPort + 1}); err != nil {
+			listener.Close()
+			server.udpRtp.Close()
+			return errors.New(fmt.Sprintf("RTSP监听UDP端口%d失败: %s", server.udpPort+1, err))
+		}
+		// 客户端发送的RTCP接收报告不需要处理，读取后丢弃
+		go discardUdp(server.udpRtp)
+		go discardUdp(server.udpRtcp)
+	}
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	server.listener = listener
+	server.mutex.Unlock()
+
+	log.Printf("RTSP转发服务已启动，监听地址：%s", addr)
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			server.mutex.Lock()
+			closed := server.closed
+			server.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("RTSP接受连接失败: %s", err))
+		}
+		c := newConn(server, netConn)
+		server.mutex.Lock()
+		server.conns[c] = struct{}{}
+		server.mutex.Unlock()
+		go func() {
+			c.serve()
+			server.mutex.Lock()
+			delete(server.conns, c)
+			server.mutex.Unlock()
+		}()
+	}
+}
+
+// Close 停止监听，断开全部客户端，停止拉流并等待结束
+func (server *Server) Close() {
+	server.mutex.Lock()
+	server.closed = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+	for c := range server.conns {
+		c.netConn.Close()
+	}
+	var done []chan struct{}
+	for _, s := range server.sources {
+		s.cancel()
+		done = append(done, s.done)
+	}
+	server.mutex.Unlock()
+	for _, ch := range done {
+		<-ch
+	}
+	if server.udpRtp != nil {
+		server.udpRtp.Close()
+		server.udpRtcp.Close()
+	}
+}
+
+// discardUdp 读取UDP端口收到的数据并丢弃，端口关闭时返回
+func discardUdp(udpConn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		if _, _, err := udpConn.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
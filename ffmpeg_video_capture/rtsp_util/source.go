@@ -0,0 +1,158 @@
+package rtsputil
+
+import (
+	"context"
+	"errors"
+	ffmpegutil "ffmpeg_video_capture/ffmpeg_util"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// 客户端待发送RTP包的缓冲个数，客户端接收过慢、缓冲满时断开
+const viewerBuffer = 512
+
+// 等待摄像头返回会话描述的最长时间
+const describeTimeout = 15 * time.Second
+
+// viewer 一个正在播放的客户端
+type viewer struct {
+	packets chan *ffmpegutil.RtpPacket
+	dropped chan struct{} // 缓冲满被断开时关闭
+	started bool          // 是否已开始发送，从视频关键帧开始发送
+}
+
+// source 一个摄像头的拉流，所有客户端共用，最后一个客户端断开一段时间后停止
+type source struct {
+	camera string
+	cancel context.CancelFunc
+	done   chan struct{}
+	ready  chan struct{} // 收到会话描述后关闭
+	init   *ffmpegutil.RtpInit
+	// mutex 保护viewers和viewer.started，每个RTP包只锁当前摄像头，不影响其他摄像头和新连接
+	// 需要同时持有时先锁server.mutex
+	mutex   sync.Mutex
+	viewers map[*viewer]struct{}
+	idle    *time.Timer // 没有客户端时停止拉流的计时器
+}
+
+// onPacket 将RTP包发送给客户端，新加入的客户端从视频关键帧开始接收
+func (s *source) onPacket(packet *ffmpegutil.RtpPacket) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for viewer := range s.viewers {
+		if !viewer.started && !packet.Keyframe {
+			continue
+		}
+		viewer.started = true
+		select {
+		case viewer.packets <- packet:
+		default:
+			delete(s.viewers, viewer)
+			close(viewer.dropped)
+		}
+	}
+	return nil
+}
+
+// acquire 获取摄像头的拉流，没有时开始拉流，等待收到会话描述
+func (server *Server) acquire(ctx context.Context, camera string) (*source, error) {
+	server.mutex.Lock()
+	s, ok := server.sources[camera]
+	if !ok {
+		rtspUrl, ok := server.cameras[camera]
+		if !ok {
+			server.mutex.Unlock()
+			return nil, errors.New(fmt.Sprintf("未配置摄像头：%s", camera))
+		}
+		s = server.startSource(camera, rtspUrl)
+	}
+	server.mutex.Unlock()
+
+	timer := time.NewTimer(describeTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.ready:
+		return s, nil
+	case <-s.done:
+		return nil, errors.New(fmt.Sprintf("摄像头拉流失败：%s", camera))
+	case <-timer.C:
+		return nil, errors.New(fmt.Sprintf("等待摄像头会话描述超时：%s", camera))
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// startSource 开始拉流，没有客户端播放时idle后停止，调用时需持有server.mutex
+func (server *Server) startSource(camera, rtspUrl string) *source {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &source{
+		camera:  camera,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		ready:   make(chan struct{}),
+		viewers: make(map[*viewer]struct{}),
+	}
+	s.idle = time.AfterFunc(server.idle, func() { server.stopIdle(s) })
+	server.sources[camera] = s
+	go func() {
+		defer close(s.done)
+		defer cancel()
+		log.Printf("RTSP转发开始拉流，摄像头：%s", camera)
+		err := ffmpegutil.RtpLive(ctx, rtspUrl, func(init *ffmpegutil.RtpInit) error {
+			s.init = init
+			close(s.ready)
+			return nil
+		}, func(packet *ffmpegutil.RtpPacket) error {
+			return s.onPacket(packet)
+		})
+		if err != nil {
+			log.Printf("RTSP转发拉流出错，摄像头：%s，%s", camera, err)
+		}
+		log.Printf("RTSP转发停止拉流，摄像头：%s", camera)
+		server.mutex.Lock()
+		s.idle.Stop()
+		if server.sources[camera] == s {
+			delete(server.sources, camera)
+		}
+		server.mutex.Unlock()
+	}()
+	return s
+}
+
+// stopIdle 没有客户端播放时停止拉流
+func (server *Server) stopIdle(s *source) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.viewers) > 0 {
+		return
+	}
+	if server.sources[s.camera] == s {
+		delete(server.sources, s.camera)
+	}
+	s.cancel()
+}
+
+// join 客户端开始播放
+func (server *Server) join(s *source) *viewer {
+	v := &viewer{packets: make(chan *ffmpegutil.RtpPacket, viewerBuffer), dropped: make(chan struct{})}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.viewers[v] = struct{}{}
+	s.idle.Stop()
+	return v
+}
+
+// leave 客户端停止播放，最后一个客户端离开idle后停止拉流
+// 录制等按片段重复连接的客户端可以一直共用同一个摄像头连接
+func (server *Server) leave(s *source, v *viewer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.viewers, v)
+	if len(s.viewers) == 0 {
+		s.idle.Reset(server.idle)
+	}
+}
@@ -13,8 +13,7 @@ var redisClient *redis.RedisClient
 func init() {
 	client, err := redis.DefaultClient()
 	if err != nil {
-		fmt.Println("初始化redis连接池失败")
-		return
+		log.Fatalf("初始化redis连接池失败: %s", err)
 	}
 	redisClient = client
 }